@@ -3,8 +3,16 @@ package main
 import (
 	"contented/pkg/actions"
 	"contented/pkg/config"
+	"contented/pkg/managers"
 	"contented/pkg/models"
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -24,7 +32,37 @@ func main() {
 	actions.GinApp(r)
 
 	actions.SetupContented(r, "", 0, 0)
-	if err := r.Run(); err != nil {
-		log.Fatalf("Crashed out %s", err)
+
+	// Same address gin.Run would use
+	srv := &http.Server{
+		Addr:    ":" + config.GetEnvString("PORT", "8080"),
+		Handler: r,
 	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Crashed out %s", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop() // A second signal kills the process right away
+
+	// A transcode lasts as long as the video, stop those streams so they cannot hold up the shutdown.
+	// Then stop taking requests and give running tasks their own grace period.
+	actions.StopTranscodes()
+	httpGrace := time.Duration(cfg.ShutdownHttpGracePeriod) * time.Second
+	log.Printf("Shutting down, waiting up to %s for requests to finish", httpGrace)
+	httpCtx, cancelHttp := context.WithTimeout(context.Background(), httpGrace)
+	defer cancelHttp()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Printf("HTTP server did not shut down cleanly %s", err)
+	}
+
+	grace := time.Duration(cfg.ShutdownGracePeriod) * time.Second
+	log.Printf("Waiting up to %s for running tasks to finish", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	actions.ShutdownWorkers(shutdownCtx, managers.GetManagerNoContext())
 }
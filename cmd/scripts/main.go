@@ -4,6 +4,8 @@ import (
 	"contented/pkg/config"
 	"contented/pkg/managers"
 	"contented/pkg/models"
+	"contented/pkg/utils"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/url"
@@ -15,6 +17,9 @@ import (
 func main() {
 	// Use the env setup (make it possible to pass env location?)
 	actionFlag := flag.String("action", "help", "Directory where we search for content")
+	profileFlag := flag.String("profile", "", "Encoding profile for encode-plan (empty is the default profile)")
+	formatFlag := flag.String("format", "table", "Output of encode-plan, table or json")
+	containerFlag := flag.String("container", "", "Only plan the encoding of this container ID")
 	flag.Parse()
 
 	//dirDefault := utils.GetEnvString("DIR", "")
@@ -31,6 +36,11 @@ func main() {
 		preview(CreateScriptManager())
 	case "encode":
 		encode(CreateScriptManager())
+	case "encode-plan":
+		if err := encodePlan(CreateScriptManager(), *profileFlag, *formatFlag, *containerFlag); err != nil {
+			fmt.Printf("Failed to create the encoding plan %s\n", err)
+			os.Exit(1)
+		}
 	case "tags":
 		tags(CreateScriptManager())
 	case "duplicates":
@@ -80,6 +90,24 @@ func encode(man managers.ContentManager) error {
 	return managers.EncodeVideos(man)
 }
 
+// What encode would do without encoding anything
+func encodePlan(man managers.ContentManager, profileName string, format string, containerID string) error {
+	profile, err := utils.GetEncodingProfile(man.GetCfg(), profileName)
+	if err != nil {
+		return err
+	}
+	plan, err := managers.PlanEncodeVideos(man, profile, containerID)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	return plan.WriteTable(os.Stdout)
+}
+
 func tags(man managers.ContentManager) error {
 	cfg := man.GetCfg()
 	fmt.Printf("Attempting to create tags from file %s", cfg.TagFile)
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"contented/pkg/actions"
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/**
+ * A standalone task worker that claims tasks from the task_requests table.  Run as many of these
+ * as you like (other machines need the same DIR mounted) with the web server set to
+ * START_QUEUE_WORKERS=false so it only creates the tasks.
+ */
+func main() {
+	operationsFlag := flag.String("operations", "", "Comma separated task operations to run (default all)")
+	flag.Parse()
+
+	cfg := config.GetCfgDefaults()
+	config.InitConfigEnvy(&cfg)
+	cfg.StartQueueWorkers = true
+	cfg.ClaimTasksFromDB = true
+	config.SetCfg(cfg)
+	if !cfg.UseDatabase {
+		log.Fatalf("The task worker requires USE_DATABASE=true")
+	}
+
+	operations, err := parseOperations(*operationsFlag)
+	if err != nil {
+		log.Fatalf("Invalid operations %s", err)
+	}
+
+	actions.InitTaskQueues()
+	actions.TASK_QUEUE.Start()
+	actions.ENCODING_QUEUE.Start()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Partial outputs from a crashed worker, recent ones are skipped as another worker might own them
+	go actions.RemoveOrphanedOutputs(&cfg)
+
+	man := managers.GetManagerNoContext()
+	if err := actions.RunTaskWorker(ctx, man, operations); err != nil {
+		log.Fatalf("Task worker failed %s", err)
+	}
+	stop() // A second signal kills the process right away
+
+	grace := time.Duration(cfg.ShutdownGracePeriod) * time.Second
+	log.Printf("Task worker shutting down, waiting up to %s for running tasks", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	actions.ShutdownWorkers(shutdownCtx, man)
+}
+
+func parseOperations(operationsStr string) ([]models.TaskOperationType, error) {
+	all := actions.AllTaskOperations()
+	if operationsStr == "" {
+		return all, nil
+	}
+	operations := []models.TaskOperationType{}
+	for _, name := range strings.Split(operationsStr, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, op := range all {
+			if op.String() == name {
+				operations = append(operations, op)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown operation %s", name)
+		}
+	}
+	return operations, nil
+}
@@ -265,3 +265,44 @@ func TestPreviewApiLoadsNormalContent(t *testing.T) {
 		}
 	}
 }
+
+func TestTranscodeHandlerMemory(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(false)
+	ValidateTranscodeHandler(t, cfg, router)
+}
+
+func TestTranscodeHandlerDB(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(true)
+	ValidateTranscodeHandler(t, cfg, router)
+}
+
+// Only the checks before ffmpeg starts, the stream itself needs ffmpeg
+func ValidateTranscodeHandler(t *testing.T, cfg *config.DirConfigEntry, router *gin.Engine) {
+	cnt, content := CreateVideoContainer(t, router)
+	image := CreateContentNamed("not_a_video.png", &cnt.ID, t, router, "image/png")
+
+	checkContent := models.Content{}
+	code, err := GetJson(fmt.Sprintf("/api/contents/%d", content.ID), "", &checkContent, router)
+	assert.Equal(t, http.StatusOK, code, fmt.Sprintf("Error loading %s", err))
+	assert.True(t, checkContent.BrowserPlayable, "An mp4 should play in the browser")
+
+	checks := []struct {
+		url  string
+		code int
+	}{
+		{fmt.Sprintf("/api/transcode/%d?start=-5", content.ID), http.StatusBadRequest},
+		{fmt.Sprintf("/api/transcode/%d?start=abc", content.ID), http.StatusBadRequest},
+		{fmt.Sprintf("/api/transcode/%d", image.ID), http.StatusBadRequest},
+		{"/api/transcode/999999", http.StatusNotFound},
+	}
+	for _, check := range checks {
+		code, _, _ := MakeHttpRequest(check.url, router, "GET")
+		assert.Equal(t, check.code, code, fmt.Sprintf("Wrong status for %s", check.url))
+	}
+
+	cfg.TranscodeConcurrency = 0
+	config.SetCfg(*cfg)
+	code, w, _ := MakeHttpRequest(fmt.Sprintf("/api/transcode/%d?start=10", content.ID), router, "GET")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "No transcode slots left")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -54,6 +54,8 @@ func SetupRoutes(r *gin.Engine) {
 	// Downloads and basic rendering of content
 	r.GET("/api/preview/:id", PreviewHandler)
 	r.GET("/api/view/:id", FullHandler)
+	r.GET("/api/stream/:id/:file", StreamHandler)
+	r.GET("/api/transcode/:id", TranscodeHandler)
 	r.GET("/api/download/:id", DownloadHandler)
 	r.GET("/api/splash", SplashHandler)
 
@@ -70,6 +72,7 @@ func SetupRoutes(r *gin.Engine) {
 	r.GET("/api/contents", ContentsResourceList)
 	r.GET("/api/contents/:content_id", ContentsResourceShow)
 	r.GET("/api/contents/:content_id/screens", ScreensResourceList)
+	r.GET("/api/contents/:content_id/subtitles/:lang", SubtitleHandler)
 	//r.GET("/api/contents/:content_id/tags", TagsResourceList) Needs updates in the ListAllTagsContext
 	r.POST("/api/contents", ContentsResourceCreate)
 	r.PUT("/api/contents/:content_id", ContentsResourceUpdate)
@@ -93,16 +96,46 @@ func SetupRoutes(r *gin.Engine) {
 	// Tasks
 	r.GET("/api/task_requests", TaskRequestsResourceList)
 	r.GET("/api/task_requests/:task_request_id", TaskRequestsResourceShow)
+	r.GET("/api/task_requests/:task_request_id/log", TaskRequestsLogHandler)
 	r.POST("/api/task_requests", TaskRequestsResourceCreate)
 	r.PUT("/api/task_requests/:task_request_id", TaskRequestsResourceUpdate)
+	r.POST("/api/task_requests/:task_request_id/retry", TaskRequestsRetryHandler)
 	r.DELETE("/api/task_requests/:screen_id", TaskRequestsResourceDestroy)
 
+	// Chained tasks for a single content
+	r.GET("/api/pipelines/:pipeline_id", PipelinesResourceShow)
+	r.POST("/api/pipelines/:pipeline_id/cancel", PipelineCancelHandler)
+
+	// Recurring jobs from the SCHEDULES config
+	r.GET("/api/encoding_profiles", EncodingProfilesResourceList)
+	r.GET("/api/encoding_plan", EncodingPlanHandler)
+	r.GET("/api/schedules", SchedulesResourceList)
+	r.GET("/api/schedules/:name", SchedulesResourceShow)
+	r.POST("/api/schedules/:name/pause", SchedulePauseHandler)
+	r.POST("/api/schedules/:name/resume", ScheduleResumeHandler)
+	r.POST("/api/schedules/:name/trigger", ScheduleTriggerHandler)
+
+	// Local task queue limits
+	r.GET("/api/admin/task_queues", TaskQueuesHandler)
+	r.PUT("/api/admin/task_queues/:queue", TaskQueueUpdateHandler)
+
+	// Remote workers leasing tasks
+	workers := r.Group("/api/workers", WorkerAuth)
+	workers.POST("/claim", WorkerClaimHandler)
+	workers.POST("/tasks/:task_request_id/heartbeat", WorkerHeartbeatHandler)
+	workers.POST("/tasks/:task_request_id/complete", WorkerCompleteHandler)
+	workers.POST("/tasks/:task_request_id/fail", WorkerFailHandler)
+	workers.POST("/tasks/:task_request_id/release", WorkerReleaseHandler)
+
 	// Available tasks that can be added ot the system
 	r.POST("/api/editing_queue/:content_id/screens/:count/:startTimeSeconds", ContentTaskScreensHandler)
 	r.POST("/api/editing_queue/:content_id/encoding", VideoEncodingHandler)
 	r.POST("/api/editing_queue/:content_id/webp", WebpFromScreensHandler)
+	r.POST("/api/editing_queue/:content_id/hls", HlsPackageHandler)
+	r.POST("/api/editing_queue/:content_id/subtitles", ExtractSubtitlesHandler)
 	r.POST("/api/editing_queue/:content_id/tagging", TaggingHandler)
 	r.POST("/api/editing_queue/:content_id/duplicates", DupesHandler)
+	r.POST("/api/editing_queue/:content_id/pipeline", ContentPipelineHandler)
 
 	// TODO: Check that we can still kick off a duplicates task for the container.
 	r.POST("/api/editing_container_queue/:container_id/screens/:count/:startTimeSeconds", ContainerScreensHandler)
@@ -110,5 +143,6 @@ func SetupRoutes(r *gin.Engine) {
 	r.POST("/api/editing_container_queue/:container_id/tagging", ContainerTaggingHandler)
 	r.POST("/api/editing_container_queue/:container_id/duplicates", DupesHandler)
 	r.POST("/api/editing_container_queue/:container_id/remove_duplicates", ContainerRemoveDuplicatesHandler)
+	r.POST("/api/editing_container_queue/:container_id/pipeline", ContainerPipelineHandler)
 	//TODO: app.POST("/editing_container_queue/{containerID}/webp", ContainerWebpHandler)
 }
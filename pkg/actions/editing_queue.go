@@ -8,31 +8,75 @@ import (
 	"contented/pkg/config"
 	"contented/pkg/managers"
 	"contented/pkg/models"
+	"contented/pkg/utils"
 	"contented/pkg/worker"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type TasksQueuedResponse struct {
-	Message string              `json:"message" default:""`
-	Results models.TaskRequests `json:"results" default:"[]"`
+	Message  string              `json:"message" default:""`
+	Results  models.TaskRequests `json:"results" default:"[]"`
+	Existing int                 `json:"existing" default:"0"` // Results that were already queued
 }
 
-type HandleTaskTypeFunc func(managers.ContentManager, int64) error
+// Clients can send an Idempotency-Key header (or ?idempotency_key=) so retrying a request does
+// not queue the work again.
+const IdempotencyKeyHeader = "Idempotency-Key"
 
-func HandleTask(args worker.Task, taskFunc HandleTaskTypeFunc) error {
+// Checking for an existing task and creating it has to happen together, this only covers the one
+// process.  Across processes the in flight unique indexes reject the second create.
+var taskSubmitMutex sync.Mutex
+
+type HandleTaskTypeFunc func(context.Context, managers.ContentManager, int64) error
+
+// The context is canceled when the task is canceled while running (kills ffmpeg)
+func HandleTask(ctx context.Context, args worker.Task, taskFunc HandleTaskTypeFunc) error {
 	taskId, err := GetTaskId(args) // Determines if it is a valid id (bad request)
 	if err != nil {
 		return err
 	}
 	man := managers.GetManagerNoContext()
-	return taskFunc(man, taskId)
+	taskLog, logErr := utils.OpenTaskLog(man.GetCfg(), taskId)
+	if logErr != nil {
+		log.Printf("Task %d will run without a log %s", taskId, logErr)
+	} else {
+		defer taskLog.Close()
+		ctx = utils.WithTaskLog(ctx, taskLog)
+	}
+	utils.TaskLogf(ctx, "Starting task %d %s", taskId, args.Operation)
+
+	taskErr := taskFunc(ctx, man, taskId)
+	if taskErr != nil {
+		utils.TaskLogf(ctx, "Task %d failed %s", taskId, taskErr)
+		RetryFailedTask(man, taskId)
+	} else {
+		utils.TaskLogf(ctx, "Task %d finished", taskId)
+	}
+	return taskErr
+}
+
+// A failed task with attempts left is back in new with a RetryAt, queue it up after the backoff
+func RetryFailedTask(man managers.ContentManager, taskID int64) bool {
+	if man.GetCfg().ClaimTasksFromDB {
+		return false // Any worker process will claim it once the RetryAt has passed
+	}
+	task, err := man.GetTask(taskID)
+	if err != nil || task.Status != models.TaskStatus.NEW || task.RetryAt == nil {
+		return false
+	}
+	ScheduleTaskRequest(*task)
+	return true
 }
 
 /**
@@ -43,41 +87,51 @@ func HandleTask(args worker.Task, taskFunc HandleTaskTypeFunc) error {
  * Execute the task within the transaction middleware scope.
  * TODO: Can this work in a full unit test?
  */
-func VideoEncodingWrapper(args worker.Task) error {
+func VideoEncodingWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("VideoEncodingWrapper () Starting Task args %s", args)
-	return HandleTask(args, managers.EncodingVideoTask)
+	return HandleTask(ctx, args, managers.EncodingVideoTask)
 }
 
 /*
  * For all the transaction middleware to play nice you have to ensure that everything
  * is wrapped by a transaction
  */
-func ScreenCaptureWrapper(args worker.Task) error {
+func ScreenCaptureWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("ScreenCaptureWrapper() Starting Task args %s", args)
-	return HandleTask(args, managers.ScreenCaptureTask)
+	return HandleTask(ctx, args, managers.ScreenCaptureTask)
 }
 
-func WebpFromScreensWrapper(args worker.Task) error {
+func WebpFromScreensWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("Web From Screens () Starting Task args %s", args)
-	return HandleTask(args, managers.WebpFromScreensTask)
+	return HandleTask(ctx, args, managers.WebpFromScreensTask)
 }
 
 /*
  * Attempt to tag a piece of content (tempting to just make this a switch)
  */
-func TaggingContentWrapper(args worker.Task) error {
+func TaggingContentWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("Tagging content element () Starting Task args %s", args)
-	return HandleTask(args, managers.TaggingContentTask)
+	return HandleTask(ctx, args, managers.TaggingContentTask)
 }
 
-func DuplicatesWrapper(args worker.Task) error {
+func DuplicatesWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("Finding Duplicates %s", args)
-	return HandleTask(args, managers.DetectDuplicatesTask)
+	return HandleTask(ctx, args, managers.DetectDuplicatesTask)
 }
 
-func RemoveDuplicatesWrapper(args worker.Task) error {
+func RemoveDuplicatesWrapper(ctx context.Context, args worker.Task) error {
 	log.Printf("Removing Duplicates %s", args)
-	return HandleTask(args, managers.RemoveDuplicateContentTask)
+	return HandleTask(ctx, args, managers.RemoveDuplicateContentTask)
+}
+
+func HlsPackageWrapper(ctx context.Context, args worker.Task) error {
+	log.Printf("HLS packaging %s", args)
+	return HandleTask(ctx, args, managers.HlsPackageTask)
+}
+
+func ExtractSubtitlesWrapper(ctx context.Context, args worker.Task) error {
+	log.Printf("Extracting subtitles %s", args)
+	return HandleTask(ctx, args, managers.ExtractSubtitlesTask)
 }
 
 func GetTaskId(args worker.Task) (int64, error) {
@@ -109,6 +163,48 @@ func WebpFromScreensHandler(c *gin.Context) {
 	QueueTaskRequest(c, man, tr)
 }
 
+// Package the video for streaming, served from /api/stream/:id/master.m3u8 once the task is done
+func HlsPackageHandler(c *gin.Context) {
+	contentID, bad_id := strconv.ParseInt(c.Param("content_id"), 10, 64)
+	if bad_id != nil {
+		c.AbortWithError(http.StatusBadRequest, bad_id)
+		return
+	}
+	man := managers.GetManager(c)
+	content, err := man.GetContent(contentID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	tr, tErr := CreateHlsTask(content)
+	if tErr != nil {
+		c.AbortWithError(http.StatusBadRequest, tErr)
+		return
+	}
+	QueueTaskRequest(c, man, tr)
+}
+
+// Extract the subtitle streams of the video to WebVTT for /api/contents/:id/subtitles/:lang
+func ExtractSubtitlesHandler(c *gin.Context) {
+	contentID, bad_id := strconv.ParseInt(c.Param("content_id"), 10, 64)
+	if bad_id != nil {
+		c.AbortWithError(http.StatusBadRequest, bad_id)
+		return
+	}
+	man := managers.GetManager(c)
+	content, err := man.GetContent(contentID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	tr, tErr := CreateSubtitlesTask(content)
+	if tErr != nil {
+		c.AbortWithError(http.StatusBadRequest, tErr)
+		return
+	}
+	QueueTaskRequest(c, man, tr)
+}
+
 // Should deny quickly if the media content type is incorrect for the action
 func VideoEncodingHandler(c *gin.Context) {
 	contentID, bad_id := strconv.ParseInt(c.Param("content_id"), 10, 64)
@@ -123,7 +219,12 @@ func VideoEncodingHandler(c *gin.Context) {
 		return
 	}
 
-	task, badTask := CreateVideoEncodingTask(content, c.Param("codec"))
+	options, badOptions := GetEncodingOptions(c)
+	if badOptions != nil {
+		c.AbortWithError(http.StatusBadRequest, badOptions)
+		return
+	}
+	task, badTask := CreateVideoEncodingTask(content, options)
 	if badTask != nil {
 		c.AbortWithError(http.StatusBadRequest, badTask)
 		return
@@ -138,6 +239,12 @@ func ContainerVideoEncodingHandler(c *gin.Context) {
 		return
 	}
 
+	options, badOptions := GetEncodingOptions(c)
+	if badOptions != nil {
+		c.AbortWithError(http.StatusBadRequest, badOptions)
+		return
+	}
+
 	// A lot of these will follow a pretty simple pattern of load all the container content
 	// and then attempt to act on them.  Unify it?
 	man := managers.GetManager(c)
@@ -163,7 +270,7 @@ func ContainerVideoEncodingHandler(c *gin.Context) {
 	// TODO: Need to make it so that we get all the tasks created.
 	tasks := models.TaskRequests{}
 	for _, content := range *contents {
-		task, taskErr := CreateVideoEncodingTask(&content, c.Param("codec"))
+		task, taskErr := CreateVideoEncodingTask(&content, options)
 		if taskErr != nil {
 			c.AbortWithError(http.StatusInternalServerError, taskErr)
 			return
@@ -423,22 +530,63 @@ func CreateScreensTask(content *models.Content, numberOfScreens int, startTimeSe
 	return &tr, nil
 }
 
-func CreateVideoEncodingTask(content *models.Content, codecChoice string) (*models.TaskRequest, error) {
+// What an encoding request asked for, ?profile= and optionally a smaller ?width= / ?height=
+type EncodingOptions struct {
+	Codec   string
+	Profile string
+	Width   int
+	Height  int
+}
+
+// The profile must exist so a typo is a 400 rather than a task that fails later
+func GetEncodingOptions(c *gin.Context) (EncodingOptions, error) {
+	options := EncodingOptions{Codec: c.Param("codec"), Profile: c.Query("profile")}
+	if _, err := utils.GetEncodingProfile(config.GetCfg(), options.Profile); err != nil {
+		return options, err
+	}
+	for _, size := range []struct {
+		name string
+		dst  *int
+	}{{"width", &options.Width}, {"height", &options.Height}} {
+		sizeStr := c.Query(size.name)
+		if sizeStr == "" {
+			continue
+		}
+		val, err := strconv.Atoi(sizeStr)
+		if err != nil || val <= 0 {
+			return options, fmt.Errorf("invalid %s %s", size.name, sizeStr)
+		}
+		*size.dst = val
+	}
+	return options, nil
+}
+
+func CreateVideoEncodingTask(content *models.Content, options EncodingOptions) (*models.TaskRequest, error) {
 	// Probably should at least sanity check the codecs
 	if !content.IsVideo() {
 		return nil, fmt.Errorf("content %s was not a video %s", content.Src, content.ContentType)
 	}
-	cfg := config.GetCfg()
-	codec := managers.StringDefault(codecChoice, cfg.CodecForConversion)
+	profile, err := utils.GetEncodingProfile(config.GetCfg(), options.Profile)
+	if err != nil {
+		return nil, err
+	}
+	codec := managers.StringDefault(options.Codec, profile.Codec)
+	profileName := profile.Name
+	if profileName == config.DefaultEncodingProfileName {
+		profileName = "" // The same work as a task queued before there were profiles
+	}
 
 	// Check codec seems valid?
-	log.Printf("Requesting a re-encode %s with codec %s for contentID %d", content.Src, codec, content.ID)
+	log.Printf("Requesting a re-encode %s with codec %s profile %s for contentID %d", content.Src, codec, profile.Name, content.ID)
 	tr := models.TaskRequest{
 		ContentID:        &content.ID,
 		Operation:        models.TaskOperation.ENCODING,
 		NumberOfScreens:  0,
 		StartTimeSeconds: 0,
 		Codec:            codec,
+		Profile:          profileName,
+		Width:            options.Width,
+		Height:           options.Height,
 	}
 	return &tr, nil
 }
@@ -457,54 +605,216 @@ func CreateWebpTask(content *models.Content) (*models.TaskRequest, error) {
 	return &tr, nil
 }
 
+func CreateHlsTask(content *models.Content) (*models.TaskRequest, error) {
+	if !content.IsVideo() {
+		return nil, fmt.Errorf("cannot package hls content was not video %s", content.ContentType)
+	}
+	tr := models.TaskRequest{
+		ContentID: &content.ID,
+		Operation: models.TaskOperation.HLS,
+	}
+	return &tr, nil
+}
+
+func CreateSubtitlesTask(content *models.Content) (*models.TaskRequest, error) {
+	if !content.IsVideo() {
+		return nil, fmt.Errorf("cannot extract subtitles content was not video %s", content.ContentType)
+	}
+	tr := models.TaskRequest{
+		ContentID: &content.ID,
+		Operation: models.TaskOperation.SUBTITLES,
+	}
+	return &tr, nil
+}
+
+// The same work already queued returns the existing task (200) rather than creating one (201)
 func QueueTaskRequest(c *gin.Context, man managers.ContentManager, tr *models.TaskRequest) {
-	taskCreated, queueErr := AddTaskRequest(man, tr)
+	priority, badPriority := GetTaskPriority(c, models.TaskPriority.NORMAL)
+	if badPriority != nil {
+		c.AbortWithError(http.StatusBadRequest, badPriority)
+		return
+	}
+	key, badKey := GetIdempotencyKey(c)
+	if badKey != nil {
+		c.AbortWithError(http.StatusBadRequest, badKey)
+		return
+	}
+	tr.Priority = priority
+	tr.IdempotencyKey = key
+	if existing, _ := managers.FindExistingTask(man, tr); existing != nil {
+		c.JSON(http.StatusOK, existing)
+		return
+	}
+	if status, full := CheckTaskBacklog(man, 1); full != nil {
+		AbortQueueFull(c, status, full)
+		return
+	}
+	task, created, queueErr := AddTaskRequest(man, tr)
 	if queueErr != nil {
 		c.AbortWithError(http.StatusInternalServerError, queueErr)
 		return
 	}
-	c.JSON(http.StatusCreated, taskCreated)
+	if !created {
+		c.JSON(http.StatusOK, task)
+		return
+	}
+	c.JSON(http.StatusCreated, task)
 }
 
-// Hande a partial failure
+// Hande a partial failure, batches of tasks default to a low priority
 func QueueTaskRequests(c *gin.Context, man managers.ContentManager, tasks models.TaskRequests) {
+	priority, badPriority := GetTaskPriority(c, models.TaskPriority.LOW)
+	if badPriority != nil {
+		c.AbortWithError(http.StatusBadRequest, badPriority)
+		return
+	}
+	key, badKey := GetIdempotencyKey(c)
+	if badKey != nil {
+		c.AbortWithError(http.StatusBadRequest, badKey)
+		return
+	}
+
+	// Only the work that is not already queued counts against the backlog
 	tasksOk := models.TaskRequests{}
+	toCreate := models.TaskRequests{}
 	for _, task := range tasks {
-		taskCreated, queueErr := AddTaskRequest(man, &task)
+		task.Priority = priority
+		task.IdempotencyKey = key
+		if existing, _ := managers.FindExistingTask(man, &task); existing != nil {
+			tasksOk = append(tasksOk, *existing)
+			continue
+		}
+		toCreate = append(toCreate, task)
+	}
+	if status, full := CheckTaskBacklog(man, len(toCreate)); len(toCreate) > 0 && full != nil {
+		AbortQueueFull(c, status, full)
+		return
+	}
+	existing := len(tasksOk)
+	for _, task := range toCreate {
+		taskOk, created, queueErr := AddTaskRequest(man, &task)
 		if queueErr != nil {
 			c.AbortWithError(http.StatusInternalServerError, queueErr)
 			return
 		}
-		tasksOk = append(tasksOk, *taskCreated)
+		if !created {
+			existing++
+		}
+		tasksOk = append(tasksOk, *taskOk)
 	}
 
 	queueResponse := TasksQueuedResponse{
-		Message: fmt.Sprintf("Queued %d tasks for", len(tasksOk)),
-		Results: tasksOk,
+		Message:  fmt.Sprintf("Queued %d tasks, %d were already queued", len(tasksOk)-existing, existing),
+		Results:  tasksOk,
+		Existing: existing,
+	}
+	status := http.StatusCreated
+	if existing == len(tasksOk) && existing > 0 {
+		status = http.StatusOK
 	}
-	c.JSON(http.StatusCreated, queueResponse)
+	c.JSON(status, queueResponse)
 }
 
-func AddTaskRequest(man managers.ContentManager, tr *models.TaskRequest) (*models.TaskRequest, error) {
+// The Idempotency-Key header or ?idempotency_key= param, empty if there is neither
+func GetIdempotencyKey(c *gin.Context) (string, error) {
+	key := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+	if key == "" {
+		key = strings.TrimSpace(c.Query("idempotency_key"))
+	}
+	return key, managers.ValidateIdempotencyKey(key)
+}
+
+// The ?priority= param is a number (higher runs first) or one of low, normal, high
+func GetTaskPriority(c *gin.Context, defaultPriority int) (int, error) {
+	priorityStr := c.Query("priority")
+	switch priorityStr {
+	case "":
+		return defaultPriority, nil
+	case "low":
+		return models.TaskPriority.LOW, nil
+	case "normal":
+		return models.TaskPriority.NORMAL, nil
+	case "high":
+		return models.TaskPriority.HIGH, nil
+	}
+	priority, err := strconv.Atoi(priorityStr)
+	if err != nil {
+		return defaultPriority, fmt.Errorf("invalid priority %s", priorityStr)
+	}
+	return priority, nil
+}
+
+// Create the task unless the same work is already queued, returns the existing task and false if it is
+func AddTaskRequest(man managers.ContentManager, tr *models.TaskRequest) (*models.TaskRequest, bool, error) {
+	taskSubmitMutex.Lock()
+	defer taskSubmitMutex.Unlock()
+
+	existing, findErr := managers.FindExistingTask(man, tr)
+	if findErr != nil {
+		return nil, false, findErr
+	}
+	if existing != nil {
+		log.Printf("Task %d is already queued for %s, not creating another", existing.ID, tr.Operation)
+		return existing, false, nil
+	}
+	managers.ApplyRetryPolicy(man.GetCfg(), tr)
 	createdTask, tErr := man.CreateTask(tr)
+	if errors.Is(tErr, managers.ErrTaskInFlight) {
+		// Another process created the same work after the check above
+		raced, raceErr := managers.FindExistingTask(man, tr)
+		if raceErr == nil && raced != nil {
+			log.Printf("Task %d was queued for %s by another process, not creating another", raced.ID, tr.Operation)
+			return raced, false, nil
+		}
+	}
 	if tErr != nil {
-		return nil, tErr
+		return nil, false, tErr
 	}
+	EnqueueTaskRequest(tr)
+	return createdTask, true, nil
+}
 
-	// This needs to delay a little before it starts
-	// It should probably not kick off the job task inside the manager
-	task := worker.Task{
-		ID:        tr.ID,
-		Operation: tr.Operation,
+// Let the dispatcher know about a created task, it is claimed into the local queue for the
+// operation once there is room.
+func EnqueueTaskRequest(tr *models.TaskRequest) {
+	// Nothing would ever read the local queue, a worker process (cmd/worker) claims it from the DB
+	if !config.GetCfg().StartQueueWorkers {
+		log.Printf("Local queue workers are not running, task %d left for a worker process", tr.ID)
+		return
 	}
-	log.Printf("Created task %s", task)
+	log.Printf("Task %d operation %s is ready to be dispatched", tr.ID, tr.Operation)
+	SignalTaskAvailable()
+}
 
-	if tr.Operation == models.TaskOperation.ENCODING {
-		log.Printf("Queuing encoding task for %d", tr.ID)
-		ENCODING_QUEUE.EnqueueTask(task)
-	} else {
-		log.Printf("Queuing task for %d operation %s", tr.ID, tr.Operation)
-		TASK_QUEUE.EnqueueTask(task)
+// Encoding (and HLS packaging) is expensive so it has its own queue, everything else shares the task queue
+func QueueForOperation(operation models.TaskOperationType) *worker.TaskQueue {
+	if operation == models.TaskOperation.ENCODING || operation == models.TaskOperation.HLS {
+		return ENCODING_QUEUE
+	}
+	return TASK_QUEUE
+}
+
+// Queue the task, or if it has a RetryAt in the future queue it once the backoff has passed
+func ScheduleTaskRequest(tr models.TaskRequest) {
+	if tr.RetryAt == nil || !tr.RetryAt.After(time.Now()) {
+		EnqueueTaskRequest(&tr)
+		return
+	}
+	delay := time.Until(*tr.RetryAt)
+	log.Printf("Task %d will be retried in %s", tr.ID, delay)
+	time.AfterFunc(delay, func() {
+		EnqueueTaskRequest(&tr)
+	})
+}
+
+// Stop a task that is already executing on one of the local queues (kills any ffmpeg process)
+func CancelRunningTask(taskID int64) bool {
+	canceled := false
+	if ENCODING_QUEUE != nil && ENCODING_QUEUE.CancelTask(taskID) {
+		canceled = true
+	}
+	if TASK_QUEUE != nil && TASK_QUEUE.CancelTask(taskID) {
+		canceled = true
 	}
-	return createdTask, nil
+	return canceled
 }
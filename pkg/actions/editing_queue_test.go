@@ -5,11 +5,14 @@ import (
 	"contented/pkg/managers"
 	"contented/pkg/models"
 	"contented/pkg/test_common"
+	"contented/pkg/utils"
 	"contented/pkg/worker"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -95,7 +98,7 @@ func ValidateEditingQueue(t *testing.T, router *gin.Engine) {
 	assert.Equal(t, tr.Operation, models.TaskOperation.SCREENS)
 
 	args := worker.Task{ID: tr.ID}
-	errWrapper := ScreenCaptureWrapper(args)
+	errWrapper := ScreenCaptureWrapper(context.Background(), args)
 	assert.NoError(t, errWrapper, fmt.Sprintf("Failed to get screens %s", err))
 
 	screenUrl := fmt.Sprintf("/api/contents/%d/screens", content.ID)
@@ -141,7 +144,7 @@ func ValidateVideoEncodingQueue(t *testing.T, router *gin.Engine) {
 	assert.Equal(t, tr.Operation, models.TaskOperation.ENCODING)
 
 	args := worker.Task{ID: tr.ID, Operation: models.TaskOperation.ENCODING}
-	vErr := VideoEncodingWrapper(args)
+	vErr := VideoEncodingWrapper(context.Background(), args)
 	assert.NoError(t, vErr, fmt.Sprintf("Failed to encode video %s", vErr))
 
 	checkTask := models.TaskRequest{}
@@ -201,7 +204,7 @@ func ValidateWebpCode(t *testing.T, router *gin.Engine, content *models.Content)
 	assert.Equal(t, content.Preview, "", "It should not have a preview already")
 	ctx := test_common.GetContext()
 	man := managers.GetManager(ctx)
-	_, _, screenErr := managers.CreateScreensForContent(man, content.ID, 10, 1)
+	_, _, screenErr := managers.CreateScreensForContent(context.Background(), man, content.ID, 10, 1, nil)
 	assert.NoError(t, screenErr)
 
 	url := fmt.Sprintf("/api/editing_queue/%d/webp", content.ID)
@@ -214,7 +217,7 @@ func ValidateWebpCode(t *testing.T, router *gin.Engine, content *models.Content)
 	assert.Equal(t, tr.Operation, models.TaskOperation.WEBP)
 
 	args := worker.Task{ID: tr.ID}
-	wErr := WebpFromScreensWrapper(args)
+	wErr := WebpFromScreensWrapper(context.Background(), args)
 	assert.NoError(t, wErr, fmt.Sprintf("Failed to create webp for task %s", wErr))
 
 	checkContent := models.Content{}
@@ -254,7 +257,7 @@ func ValidateTaggingCode(t *testing.T, router *gin.Engine, content *models.Conte
 	assert.NoError(t, err, "Failed to create Task to do tagging")
 	assert.NotZero(t, task.ID)
 
-	tagErr := managers.TaggingContentTask(man, task.ID)
+	tagErr := managers.TaggingContentTask(context.Background(), man, task.ID)
 	assert.NoError(t, tagErr, "It should not have a problem doing the tagging")
 
 	contentTagged, errLoad := man.GetContent(content.ID)
@@ -266,9 +269,26 @@ func ValidateTaggingCode(t *testing.T, router *gin.Engine, content *models.Conte
 	assert.NoError(t, taskErr, "We should still have a task")
 	assert.Equal(t, models.TaskStatus.DONE, taskCheck.Status)
 
-	url := fmt.Sprintf("/api/editing_queue/%d/tagging", content.ID)
+	tagged := models.TaggingTaskResult{}
+	assert.NoError(t, taskCheck.Result.Decode(&tagged), "The tags applied should be in the result")
+	assert.Equal(t, []string{"donut", "mp4"}, tagged.Tags)
+
+	// The results can be filtered on with any JSON the result contains
+	found := TaskRequestResponse{}
+	filter := url.QueryEscape(`{"tags": ["donut"]}`)
+	_, listErr := GetJson("/api/task_requests?result="+filter, nil, &found, router)
+	assert.NoError(t, listErr, "It should filter on the result")
+	assert.Equal(t, int64(1), found.Total, "Only the tagging task has the tag in the result")
+	filter = url.QueryEscape(`{"tags": ["THIS_WILL_NOT_MATCH"]}`)
+	_, listErr = GetJson("/api/task_requests?result="+filter, nil, &found, router)
+	assert.NoError(t, listErr)
+	assert.Equal(t, int64(0), found.Total)
+	status, _ := GetJson("/api/task_requests?result=notjson", nil, &found, router)
+	assert.Equal(t, http.StatusBadRequest, status, "The filter has to be JSON")
+
+	taggingUrl := fmt.Sprintf("/api/editing_queue/%d/tagging", content.ID)
 	checkTask := models.TaskRequest{}
-	checkCode, checkErr := PostJson(url, &content, &checkTask, router)
+	checkCode, checkErr := PostJson(taggingUrl, &content, &checkTask, router)
 	assert.Equal(t, http.StatusCreated, checkCode, fmt.Sprintf("Failed to queue tagging task %s", checkErr))
 
 }
@@ -312,7 +332,7 @@ func ValidateDuplicatesTask(t *testing.T, router *gin.Engine, container *models.
 	task, err := man.CreateTask(&tr)
 	assert.NoError(t, err, "It should be able to create the duplicates task")
 
-	dupeErr := managers.DetectDuplicatesTask(man, task.ID)
+	dupeErr := managers.DetectDuplicatesTask(context.Background(), man, task.ID)
 	assert.NoError(t, dupeErr, "It should be able to run the duplicates task")
 
 	taskCheck, errCheck := man.GetTask(task.ID)
@@ -320,8 +340,9 @@ func ValidateDuplicatesTask(t *testing.T, router *gin.Engine, container *models.
 	assert.Equal(t, taskCheck.Status, models.TaskStatus.DONE)
 	assert.NotEqual(t, taskCheck.Message, "")
 
-	dupes := managers.DuplicateContents{}
-	json.Unmarshal([]byte(taskCheck.Message), &dupes)
+	result := models.DuplicatesTaskResult{}
+	assert.NoError(t, taskCheck.Result.Decode(&result), "The duplicates should be in the result")
+	dupes := result.Duplicates
 	assert.Equal(t, 1, len(dupes), fmt.Sprintf("There should be a duplicate %s", dupes))
 	assert.Equal(t, dupes[0].DuplicateSrc, "SampleVideo_1280x720_1mb.mp4")
 }
@@ -395,6 +416,163 @@ func ValidateContainerEncoding(t *testing.T, router *gin.Engine, man managers.Co
 	for _, task := range *tasks {
 		assert.Equal(t, task.Operation, models.TaskOperation.ENCODING)
 	}
+
+	// Re-running the container encode should not race a second encode on the same files
+	again := TasksQueuedResponse{}
+	code, err = PostJson(url, cnt, &again, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code, "Nothing new was queued")
+	assert.Equal(t, 2, again.Existing)
+	assert.Equal(t, 2, len(again.Results), "It returns the tasks already queued")
+	_, total, _ = man.ListTasks(managers.TaskQuery{})
+	assert.Equal(t, int64(2), total, "No more tasks were created")
+}
+
+func TestTaskIdempotencyMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateTaskIdempotency(t, router)
+}
+
+func TestTaskIdempotencyDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateTaskIdempotency(t, router)
+}
+
+func ValidateTaskIdempotency(t *testing.T, router *gin.Engine) {
+	man := managers.GetManager(test_common.GetContext())
+	content := CreateContentNamed("idempotent.mp4", nil, t, router, "video")
+	url := fmt.Sprintf("/api/editing_queue/%d/encoding", content.ID)
+
+	first := models.TaskRequest{}
+	code, err := PostJson(url, nil, &first, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+
+	second := models.TaskRequest{}
+	code, err = PostJson(url, nil, &second, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code, "A double click gets the task already queued")
+	assert.Equal(t, first.ID, second.ID)
+
+	// Once the first is finished a retry with the same key still gets the original task back
+	keyUrl := url + "?idempotency_key=encode-idempotent"
+	_, err = managers.CancelTask(man, &first, "Canceled for the test")
+	assert.NoError(t, err)
+	keyed := models.TaskRequest{}
+	code, err = PostJson(keyUrl, nil, &keyed, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code, "Nothing is in flight so a new task is created")
+	assert.Equal(t, "encode-idempotent", keyed.IdempotencyKey)
+
+	_, err = managers.CancelTask(man, &keyed, "Canceled for the test")
+	assert.NoError(t, err)
+	retried := models.TaskRequest{}
+	code, err = PostJson(keyUrl, nil, &retried, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, keyed.ID, retried.ID, "The key returns the original task")
+	assert.Equal(t, models.TaskStatus.CANCELED, retried.Status)
+
+	code, _ = PostJson(url+"?idempotency_key="+strings.Repeat("k", 300), nil, &retried, router)
+	assert.Equal(t, http.StatusBadRequest, code, "The key is too long")
+}
+
+func TestEncodingProfilesMemory(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(false)
+	ValidateEncodingProfiles(t, cfg, router)
+}
+
+func TestEncodingProfilesDB(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(true)
+	ValidateEncodingProfiles(t, cfg, router)
+}
+
+func ValidateEncodingProfiles(t *testing.T, cfg *config.DirConfigEntry, router *gin.Engine) {
+	cfg.EncodingProfiles = []config.EncodingProfile{
+		{Name: "phone", Codec: "libx264", CodecName: "h264", Crf: 26, MaxHeight: 720, FilenameModifier: "_720p"},
+	}
+	defer func() { cfg.EncodingProfiles = []config.EncodingProfile{} }()
+
+	listed := EncodingProfilesResponse{}
+	code, err := GetJson("/api/encoding_profiles", nil, &listed, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, listed.Total, "The default profile and the configured one")
+	assert.Equal(t, config.DefaultEncodingProfileName, listed.Results[0].Name)
+
+	content := CreateContentNamed("profiled.mp4", nil, t, router, "video")
+	url := fmt.Sprintf("/api/editing_queue/%d/encoding", content.ID)
+
+	archival := models.TaskRequest{}
+	code, err = PostJson(url, nil, &archival, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "", archival.Profile, "No profile is the default")
+	assert.Equal(t, cfg.CodecForConversion, archival.Codec)
+
+	phone := models.TaskRequest{}
+	code, err = PostJson(url+"?profile=phone", nil, &phone, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code, "A different profile is different work")
+	assert.NotEqual(t, archival.ID, phone.ID)
+	assert.Equal(t, "phone", phone.Profile)
+	assert.Equal(t, "libx264", phone.Codec)
+
+	smaller := models.TaskRequest{}
+	code, err = PostJson(url+"?profile=phone&height=480", nil, &smaller, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, 480, smaller.Height)
+
+	code, _ = PostJson(url+"?profile=missing", nil, &smaller, router)
+	assert.Equal(t, http.StatusBadRequest, code, "Unknown profiles are rejected")
+	code, _ = PostJson(url+"?profile=phone&width=wide", nil, &smaller, router)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestEncodingPlanMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateEncodingPlan(t, router)
+}
+
+func TestEncodingPlanDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateEncodingPlan(t, router)
+}
+
+func ValidateEncodingPlan(t *testing.T, router *gin.Engine) {
+	cnt := CreateNamedContainer("encode_plan", t, router)
+	fqPath := filepath.Join(config.GetCfg().Dir, cnt.Name)
+	defer os.RemoveAll(fqPath)
+	video := CreateContentNamed("planned.mp4", &cnt.ID, t, router, "video/mp4")
+	CreateContentNamed("planned.png", &cnt.ID, t, router, "image/png")
+
+	plan := utils.EncodePlan{}
+	code, err := GetJson(fmt.Sprintf("/api/encoding_plan?container_id=%d", cnt.ID), nil, &plan, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, config.DefaultEncodingProfileName, plan.Profile)
+	assert.Equal(t, 1, len(plan.Entries), "Only the video is planned")
+	if len(plan.Entries) == 1 {
+		assert.Equal(t, video.ID, plan.Entries[0].ContentID)
+		assert.Equal(t, utils.EncodePlanError, plan.Entries[0].Decision, "The file is missing")
+		assert.Contains(t, plan.Entries[0].Reason, "planned.mp4")
+	}
+	assert.Equal(t, 1, plan.Total.Files)
+	assert.Equal(t, 0, plan.Total.Encode)
+
+	code, _ = GetJson(fmt.Sprintf("/api/encoding_plan?profile=missing&container_id=%d", cnt.ID), nil, &plan, router)
+	assert.Equal(t, http.StatusBadRequest, code, "Unknown profiles are rejected")
+	code, _ = GetJson("/api/encoding_plan?container_id=abc", nil, &plan, router)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = GetJson("/api/encoding_plan", nil, &plan, router)
+	assert.Equal(t, http.StatusBadRequest, code, "Probing the whole library is left to make encode-plan")
+
+	cfg := config.GetCfg()
+	cfg.ReadOnly = true
+	defer func() { cfg.ReadOnly = false }()
+	code, _ = GetJson(fmt.Sprintf("/api/encoding_plan?container_id=%d", cnt.ID), nil, &plan, router)
+	assert.Equal(t, http.StatusNotImplemented, code, "The plan is only for managers that can edit")
 }
 
 func TestContainerScreensMemory(t *testing.T) {
@@ -496,3 +674,103 @@ func ValidateContainerDuplicateRemovalTask(t *testing.T, router *gin.Engine, man
 		assert.Equal(t, task.Operation, models.TaskOperation.REMOVE_DUPLICATE_FILES)
 	}
 }
+
+func TestStreamHandlerMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateStreamHandler(t, router)
+}
+
+func TestStreamHandlerDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateStreamHandler(t, router)
+}
+
+func ValidateStreamHandler(t *testing.T, router *gin.Engine) {
+	created, content := CreateVideoContainer(t, router)
+	man := managers.GetManager(test_common.GetContext())
+	cnt, cErr := man.GetContainer(created.ID) // The API response does not include the path
+	assert.NoError(t, cErr)
+
+	tr := models.TaskRequest{}
+	code, err := PostJson(fmt.Sprintf("/api/editing_queue/%d/hls", content.ID), content, &tr, router)
+	assert.Equal(t, http.StatusCreated, code, fmt.Sprintf("Failed to queue hls task %s", err))
+	assert.Equal(t, models.TaskOperation.HLS, tr.Operation)
+
+	// Fake a finished package rather than running ffmpeg over the ladder
+	streamDir := utils.GetContentStreamDst(cnt, content.ID)
+	assert.NoError(t, os.MkdirAll(streamDir, 0755))
+	defer os.RemoveAll(utils.GetStreamDst(cnt))
+	master := "#EXTM3U\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(streamDir, utils.HlsMasterPlaylist), []byte(master), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(streamDir, "notes.txt"), []byte("secret"), 0644))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/stream/%d/%s", content.ID, utils.HlsMasterPlaylist), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "The master playlist should be served")
+	assert.Equal(t, "application/vnd.apple.mpegurl", w.Header().Get("Content-Type"))
+	assert.Equal(t, master, w.Body.String())
+
+	for _, name := range []string{"720p_00001.m4s", "notes.txt"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/stream/%d/%s", content.ID, name), nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, fmt.Sprintf("%s should not be served", name))
+	}
+}
+
+func TestSubtitleHandlerMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateSubtitleHandler(t, router)
+}
+
+func TestSubtitleHandlerDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateSubtitleHandler(t, router)
+}
+
+func ValidateSubtitleHandler(t *testing.T, router *gin.Engine) {
+	created, content := CreateVideoContainer(t, router)
+	man := managers.GetManager(test_common.GetContext())
+	cnt, cErr := man.GetContainer(created.ID)
+	assert.NoError(t, cErr)
+
+	tr := models.TaskRequest{}
+	code, err := PostJson(fmt.Sprintf("/api/editing_queue/%d/subtitles", content.ID), content, &tr, router)
+	assert.Equal(t, http.StatusCreated, code, fmt.Sprintf("Failed to queue subtitle task %s", err))
+	assert.Equal(t, models.TaskOperation.SUBTITLES, tr.Operation)
+
+	// A sidecar srt next to the video and an extracted vtt, the tracks are set through the API
+	srtName := "donut_subtitle_test.en.srt"
+	srtFile := filepath.Join(cnt.GetFqPath(), srtName)
+	assert.NoError(t, os.WriteFile(srtFile, []byte("1\n00:00:01,000 --> 00:00:02,000\nDonut\n"), 0644))
+	defer os.Remove(srtFile)
+	vttDir := utils.GetContentSubtitleDst(cnt, content.ID)
+	assert.NoError(t, os.MkdirAll(vttDir, 0755))
+	defer os.RemoveAll(utils.GetSubtitleDst(cnt))
+	assert.NoError(t, os.WriteFile(filepath.Join(vttDir, "fre.vtt"), []byte("WEBVTT\n"), 0644))
+
+	content.Subtitles = models.SubtitleTracks{
+		{Lang: "en", Src: srtName, Format: "srt"},
+		{Lang: "fre", Src: "fre.vtt", Format: "vtt", Extracted: true},
+		{Lang: "bad", Src: "../dir1/" + srtName, Format: "srt"},
+	}
+	updated := models.Content{}
+	code, err = PutJson(fmt.Sprintf("/api/contents/%d", content.ID), content, &updated, router)
+	assert.Equal(t, http.StatusOK, code, fmt.Sprintf("Failed to update the subtitles %s", err))
+	assert.Equal(t, 3, len(updated.Subtitles))
+
+	code, w, _ := MakeHttpRequest(fmt.Sprintf("/api/contents/%d/subtitles/en", content.ID), router, "GET")
+	assert.Equal(t, http.StatusOK, code, "The srt should be served")
+	assert.Equal(t, utils.SubtitleContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nDonut\n", w.Body.String(), "Converted to WebVTT")
+
+	code, w, _ = MakeHttpRequest(fmt.Sprintf("/api/contents/%d/subtitles/fre", content.ID), router, "GET")
+	assert.Equal(t, http.StatusOK, code, "The extracted vtt should be served")
+	assert.Equal(t, "WEBVTT\n", w.Body.String())
+
+	for _, lang := range []string{"de", "bad"} {
+		code, _, _ := MakeHttpRequest(fmt.Sprintf("/api/contents/%d/subtitles/%s", content.ID, lang), router, "GET")
+		assert.Equal(t, http.StatusNotFound, code, fmt.Sprintf("%s subtitles should not be served", lang))
+	}
+}
@@ -0,0 +1,48 @@
+package actions
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/utils"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EncodingProfilesResponse struct {
+	Total   int                      `json:"total"`
+	Results []config.EncodingProfile `json:"results"`
+}
+
+// GET /api/encoding_profiles the profiles an encoding request can pick with ?profile=
+func EncodingProfilesResourceList(c *gin.Context) {
+	profiles := utils.ListEncodingProfiles(managers.GetManager(c).GetCfg())
+	c.JSON(http.StatusOK, EncodingProfilesResponse{Total: len(profiles), Results: profiles})
+}
+
+// GET /api/encoding_plan?profile=&container_id= what an encode would do without encoding.  Every
+// video is probed so a request only plans one container, make encode-plan plans the whole library.
+func EncodingPlanHandler(c *gin.Context) {
+	if _, _, err := managers.ManagerCanCUD(c); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	containerID := c.Query("container_id")
+	if containerID == "" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("container_id is required, use make encode-plan for the whole library"))
+		return
+	}
+	man := managers.GetManager(c)
+	profile, err := utils.GetEncodingProfile(man.GetCfg(), c.Query("profile"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	plan, err := managers.PlanEncodeVideos(man, profile, containerID)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
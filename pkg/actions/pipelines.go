@@ -0,0 +1,250 @@
+package actions
+
+/**
+ * Pipelines queue up a set of operations for a piece of content in one request, each step runs
+ * once the step before it is done (see managers/task_pipelines.go).
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Optional body for creating a pipeline, the operations default to managers.DefaultPipeline
+type PipelineRequest struct {
+	Operations       []models.TaskOperationType `json:"operations"`
+	Codec            string                     `json:"codec"`
+	Profile          string                     `json:"profile"` // Encoding profile, empty is the default
+	NumberOfScreens  int                        `json:"number_of_screens"`
+	StartTimeSeconds int                        `json:"start_time_seconds"`
+}
+
+type PipelineResponse struct {
+	ID     int64                 `json:"id"`
+	Status models.TaskStatusType `json:"status"`
+	Steps  models.TaskRequests   `json:"steps"`
+}
+
+type PipelinesQueuedResponse struct {
+	Message string             `json:"message" default:""`
+	Results []PipelineResponse `json:"results" default:"[]"`
+}
+
+func NewPipelineResponse(steps models.TaskRequests) PipelineResponse {
+	res := PipelineResponse{Status: managers.PipelineStatus(steps), Steps: steps}
+	if len(steps) > 0 && steps[0].PipelineID != nil {
+		res.ID = *steps[0].PipelineID
+	}
+	return res
+}
+
+// POST /api/editing_queue/:content_id/pipeline
+func ContentPipelineHandler(c *gin.Context) {
+	contentID, badId := strconv.ParseInt(c.Param("content_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	req, ok := BindPipelineRequest(c)
+	if !ok {
+		return
+	}
+	priority, badPriority := GetTaskPriority(c, models.TaskPriority.NORMAL)
+	if badPriority != nil {
+		c.AbortWithError(http.StatusBadRequest, badPriority)
+		return
+	}
+	man := managers.GetManager(c)
+	content, err := man.GetContent(contentID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	steps, stepErr := CreatePipelineSteps(content, req, priority)
+	if stepErr != nil {
+		c.AbortWithError(http.StatusBadRequest, stepErr)
+		return
+	}
+	if status, full := CheckTaskBacklog(man, len(steps)); full != nil {
+		AbortQueueFull(c, status, full)
+		return
+	}
+	created, createErr := AddPipeline(man, steps)
+	if createErr != nil {
+		c.AbortWithError(http.StatusInternalServerError, createErr)
+		return
+	}
+	c.JSON(http.StatusCreated, NewPipelineResponse(created))
+}
+
+// POST /api/editing_container_queue/:container_id/pipeline creates a pipeline for every video
+func ContainerPipelineHandler(c *gin.Context) {
+	containerID, badId := strconv.ParseInt(c.Param("container_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	req, ok := BindPipelineRequest(c)
+	if !ok {
+		return
+	}
+	priority, badPriority := GetTaskPriority(c, models.TaskPriority.LOW)
+	if badPriority != nil {
+		c.AbortWithError(http.StatusBadRequest, badPriority)
+		return
+	}
+	man := managers.GetManager(c)
+	contentQuery := managers.ContentQuery{
+		ContainerID: strconv.FormatInt(containerID, 10),
+		ContentType: "video",
+		PerPage:     man.GetCfg().Limit,
+	}
+	contents, total, err := man.SearchContent(contentQuery)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	res := PipelinesQueuedResponse{Results: []PipelineResponse{}}
+	if total == 0 {
+		res.Message = "No video content found to run a pipeline on"
+		c.JSON(http.StatusOK, res)
+		return
+	}
+
+	pipelines := []models.TaskRequests{}
+	stepCount := 0
+	for _, content := range *contents {
+		steps, stepErr := CreatePipelineSteps(&content, req, priority)
+		if stepErr != nil {
+			c.AbortWithError(http.StatusBadRequest, stepErr)
+			return
+		}
+		pipelines = append(pipelines, steps)
+		stepCount += len(steps)
+	}
+	if status, full := CheckTaskBacklog(man, stepCount); full != nil {
+		AbortQueueFull(c, status, full)
+		return
+	}
+	for _, steps := range pipelines {
+		created, createErr := AddPipeline(man, steps)
+		if createErr != nil {
+			c.AbortWithError(http.StatusInternalServerError, createErr)
+			return
+		}
+		res.Results = append(res.Results, NewPipelineResponse(created))
+	}
+	res.Message = fmt.Sprintf("Queued %d pipelines", len(res.Results))
+	c.JSON(http.StatusCreated, res)
+}
+
+// GET /api/pipelines/:pipeline_id
+func PipelinesResourceShow(c *gin.Context) {
+	pipelineID, badId := strconv.ParseInt(c.Param("pipeline_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	steps, err := managers.GetPipeline(managers.GetManager(c), pipelineID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, NewPipelineResponse(steps))
+}
+
+// POST /api/pipelines/:pipeline_id/cancel cancels the active step and everything after it
+func PipelineCancelHandler(c *gin.Context) {
+	_, _, err := managers.ManagerCanCUD(c)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	pipelineID, badId := strconv.ParseInt(c.Param("pipeline_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	man := managers.GetManager(c)
+	before, err := managers.GetPipeline(man, pipelineID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	steps, cancelErr := managers.CancelPipeline(man, pipelineID, "Pipeline canceled by request")
+	if cancelErr != nil {
+		c.AbortWithError(http.StatusBadRequest, cancelErr)
+		return
+	}
+	for _, step := range before {
+		if step.Status == models.TaskStatus.IN_PROGRESS {
+			CancelRunningTask(step.ID)
+		}
+	}
+	c.JSON(http.StatusOK, NewPipelineResponse(steps))
+}
+
+// The body is optional, an empty body runs the default pipeline
+func BindPipelineRequest(c *gin.Context) (PipelineRequest, bool) {
+	req := PipelineRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return req, false
+	}
+	if len(req.Operations) == 0 {
+		req.Operations = managers.DefaultPipeline
+	}
+	return req, true
+}
+
+// Build (but do not create) the steps for the content in order
+func CreatePipelineSteps(content *models.Content, req PipelineRequest, priority int) (models.TaskRequests, error) {
+	cfg := config.GetCfg()
+	steps := models.TaskRequests{}
+	for _, op := range req.Operations {
+		var step *models.TaskRequest
+		var err error
+		switch op {
+		case models.TaskOperation.ENCODING:
+			step, err = CreateVideoEncodingTask(content, EncodingOptions{Codec: req.Codec, Profile: req.Profile})
+		case models.TaskOperation.SCREENS:
+			count, start := req.NumberOfScreens, req.StartTimeSeconds
+			if count <= 0 {
+				count = cfg.PreviewCount
+			}
+			if start <= 0 {
+				start = cfg.PreviewFirstScreenOffset
+			}
+			step, err = CreateScreensTask(content, count, start)
+		case models.TaskOperation.WEBP:
+			step, err = CreateWebpTask(content)
+		case models.TaskOperation.TAGGING, models.TaskOperation.DUPES:
+			step = &models.TaskRequest{ContentID: &content.ID, Operation: op}
+		default:
+			err = fmt.Errorf("operation %s cannot be part of a pipeline", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		step.Priority = priority
+		steps = append(steps, *step)
+	}
+	return steps, nil
+}
+
+// Create the pipeline and let the dispatcher know the first step is ready
+func AddPipeline(man managers.ContentManager, steps models.TaskRequests) (models.TaskRequests, error) {
+	created, err := managers.CreatePipeline(man, steps)
+	if err != nil {
+		return nil, err
+	}
+	EnqueueTaskRequest(&created[0])
+	return created, nil
+}
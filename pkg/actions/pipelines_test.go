@@ -0,0 +1,67 @@
+package actions
+
+import (
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineApiMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidatePipelineApi(t, router)
+}
+
+func TestPipelineApiDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidatePipelineApi(t, router)
+}
+
+func ValidatePipelineApi(t *testing.T, router *gin.Engine) {
+	content := CreateContentNamed("pipeline.mp4", nil, t, router, "video")
+
+	created := PipelineResponse{}
+	url := fmt.Sprintf("/api/editing_queue/%d/pipeline", content.ID)
+	status, err := PostJson(url, nil, &created, router)
+	assert.NoError(t, err, "An empty body should use the default pipeline")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, len(managers.DefaultPipeline), len(created.Steps))
+	assert.Equal(t, created.Steps[0].ID, created.ID)
+	assert.Equal(t, models.TaskStatus.NEW, created.Status)
+	assert.Equal(t, models.TaskStatus.WAITING, created.Steps[1].Status)
+
+	shown := PipelineResponse{}
+	_, err = GetJson(fmt.Sprintf("/api/pipelines/%d", created.ID), nil, &shown, router)
+	assert.NoError(t, err, "It should show the pipeline")
+	assert.Equal(t, len(created.Steps), len(shown.Steps))
+
+	canceled := PipelineResponse{}
+	_, err = PostJson(fmt.Sprintf("/api/pipelines/%d/cancel", created.ID), nil, &canceled, router)
+	assert.NoError(t, err, "It should cancel the pipeline")
+	assert.Equal(t, models.TaskStatus.CANCELED, canceled.Status)
+	for _, step := range canceled.Steps {
+		assert.Equal(t, models.TaskStatus.CANCELED, step.Status, "Every step is canceled")
+	}
+
+	custom := PipelineRequest{
+		Operations:      []models.TaskOperationType{models.TaskOperation.SCREENS, models.TaskOperation.WEBP},
+		NumberOfScreens: 3,
+	}
+	short := PipelineResponse{}
+	_, err = PostJson(url+"?priority=high", custom, &short, router)
+	assert.NoError(t, err, "It should create a pipeline with the requested steps")
+	assert.Equal(t, 2, len(short.Steps))
+	assert.Equal(t, 3, short.Steps[0].NumberOfScreens)
+	assert.Equal(t, models.TaskPriority.HIGH, short.Steps[1].Priority)
+
+	invalid := PipelineRequest{Operations: []models.TaskOperationType{models.TaskOperation.REMOVE_DUPLICATE_FILES}}
+	status, _ = PostJson(url, invalid, &short, router)
+	assert.Equal(t, http.StatusBadRequest, status, "Removing duplicates cannot be chained")
+
+	status, _ = GetJson("/api/pipelines/-1", nil, &shown, router)
+	assert.Equal(t, http.StatusNotFound, status)
+}
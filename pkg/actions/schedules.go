@@ -0,0 +1,388 @@
+package actions
+
+/**
+ * The scheduler queues the recurring jobs from the SCHEDULES config (nightly encoding, a weekly
+ * duplicate sweep etc) when their cron comes due.  It only runs in the web server, worker
+ * processes pick up the tasks like any other.  With several web servers each cron slot is claimed
+ * in the DB so only one of them queues it.  A pause from the API and the result of the last run
+ * are stored with the claim, so they survive a restart and every server sees them.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often the scheduler checks for schedules that are due
+const ScheduleCheckInterval = 30 * time.Second
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// The backlog could not fit the tasks for a run, nothing was created
+type ScheduleBacklogError struct {
+	Status int
+	Full   *QueueFullResponse
+}
+
+func (e *ScheduleBacklogError) Error() string {
+	return e.Full.Error
+}
+
+// The config for a schedule and what it has been doing (the run state is loaded from the manager)
+type ScheduleState struct {
+	config.TaskSchedule
+	NextRun    *time.Time `json:"next_run"`
+	LastRun    *time.Time `json:"last_run"`
+	LastQueued int        `json:"last_queued"`
+	LastError  string     `json:"last_error"`
+}
+
+type scheduleEntry struct {
+	state  ScheduleState
+	cron   *utils.CronExpression
+	window *utils.TimeWindow
+}
+
+type Scheduler struct {
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+}
+
+// Set by SetupWorkers when there are schedules configured
+var SCHEDULER *Scheduler
+
+func NewScheduler(schedules []config.TaskSchedule, now time.Time) (*Scheduler, error) {
+	s := &Scheduler{entries: map[string]*scheduleEntry{}}
+	for _, sched := range schedules {
+		cron, window, err := managers.ValidateSchedule(sched)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := s.entries[sched.Name]; exists {
+			return nil, fmt.Errorf("schedule %s is configured more than once", sched.Name)
+		}
+		entry := &scheduleEntry{state: ScheduleState{TaskSchedule: sched}, cron: cron, window: window}
+		entry.setNextRun(now)
+		s.entries[sched.Name] = entry
+	}
+	return s, nil
+}
+
+func (e *scheduleEntry) setNextRun(now time.Time) {
+	next := e.cron.Next(now)
+	if next.IsZero() {
+		e.state.NextRun = nil
+		return
+	}
+	e.state.NextRun = &next
+}
+
+// Check for due schedules until the context is done
+func (s *Scheduler) Run(ctx context.Context, man managers.ContentManager) {
+	log.Printf("Scheduler started with %d schedules", len(s.List(man)))
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Scheduler stopping %s", ctx.Err())
+			return
+		case now := <-ticker.C:
+			s.RunDue(man, now)
+		}
+	}
+}
+
+// Trigger every schedule that is due (and not paused), returns the names that were run.  Each
+// server runs a scheduler so the cron slot is claimed first, only the server that claims it
+// queues the tasks.  The pause is checked in the manager as another server may have set it.
+func (s *Scheduler) RunDue(man managers.ContentManager, now time.Time) []string {
+	slots := map[string]time.Time{}
+	s.mu.Lock()
+	for name, entry := range s.entries {
+		if entry.state.NextRun == nil || now.Before(*entry.state.NextRun) {
+			continue
+		}
+		// A paused schedule still moves along so resuming it does not kick off a stale run
+		slots[name] = *entry.state.NextRun
+		entry.setNextRun(now)
+	}
+	s.mu.Unlock()
+
+	due := []string{}
+	for name, slot := range slots {
+		state, err := s.Get(man, name)
+		if err != nil {
+			log.Printf("Could not check if %s is paused %s", name, err)
+			continue
+		}
+		if state.Paused {
+			continue
+		}
+		claimed, err := man.ClaimScheduleRun(name, slot)
+		if err != nil {
+			log.Printf("Could not claim the %s run of %s %s", slot.Format(time.RFC3339), name, err)
+			continue
+		}
+		if !claimed {
+			log.Printf("The %s run of %s was already claimed by another server", slot.Format(time.RFC3339), name)
+			continue
+		}
+		due = append(due, name)
+	}
+	sort.Strings(due)
+	for _, name := range due {
+		if _, err := s.Trigger(man, name, now); err != nil {
+			log.Printf("Scheduled run of %s failed %s", name, err)
+		}
+	}
+	return due
+}
+
+// Queue the tasks for the schedule now, paused or not.  Outside of the window the tasks are
+// created but will not start until it opens.
+func (s *Scheduler) Trigger(man managers.ContentManager, name string, now time.Time) (models.TaskRequests, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[name]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w %s", ErrScheduleNotFound, name)
+	}
+	sched := entry.state.TaskSchedule
+	window := entry.window
+	s.mu.Unlock()
+
+	created, err := queueScheduledTasks(man, sched, window, now)
+
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	if recordErr := man.RecordScheduleResult(name, now, len(created), errMsg); recordErr != nil {
+		log.Printf("Could not record the run of schedule %s %s", name, recordErr)
+	}
+	log.Printf("Schedule %s queued %d %s tasks", name, len(created), sched.Operation)
+	return created, err
+}
+
+func queueScheduledTasks(man managers.ContentManager, sched config.TaskSchedule, window *utils.TimeWindow, now time.Time) (models.TaskRequests, error) {
+	tasks, err := managers.ScheduledTasks(man, sched)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return models.TaskRequests{}, nil
+	}
+	if status, full := CheckTaskBacklog(man, len(tasks)); full != nil {
+		return nil, &ScheduleBacklogError{Status: status, Full: full}
+	}
+
+	var retryAt *time.Time
+	if !window.Contains(now) {
+		start := window.NextStart(now).UTC()
+		retryAt = &start
+	}
+	created := models.TaskRequests{}
+	for _, task := range tasks {
+		task.RetryAt = retryAt
+		taskCreated, isNew, createErr := AddTaskRequest(man, &task)
+		if createErr != nil {
+			return created, createErr
+		}
+		if isNew {
+			created = append(created, *taskCreated)
+		}
+	}
+	return created, nil
+}
+
+func (s *Scheduler) SetPaused(man managers.ContentManager, name string, paused bool) (*ScheduleState, error) {
+	if _, ok := s.entry(name); !ok {
+		return nil, fmt.Errorf("%w %s", ErrScheduleNotFound, name)
+	}
+	if err := man.SetSchedulePaused(name, paused); err != nil {
+		return nil, err
+	}
+	return s.Get(man, name)
+}
+
+func (s *Scheduler) Get(man managers.ContentManager, name string) (*ScheduleState, error) {
+	entry, ok := s.entry(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrScheduleNotFound, name)
+	}
+	return loadScheduleState(man, entry)
+}
+
+// Sorted by name
+func (s *Scheduler) List(man managers.ContentManager) []ScheduleState {
+	s.mu.Lock()
+	entries := []scheduleEntry{}
+	for _, entry := range s.entries {
+		entries = append(entries, *entry)
+	}
+	s.mu.Unlock()
+
+	states := []ScheduleState{}
+	for _, entry := range entries {
+		state, err := loadScheduleState(man, entry)
+		if err != nil {
+			log.Printf("Could not load the run state of schedule %s %s", entry.state.Name, err)
+			state = &entry.state
+		}
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// A copy of the entry so the run state can be loaded without holding the lock
+func (s *Scheduler) entry(name string) (scheduleEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[name]
+	if !ok {
+		return scheduleEntry{}, false
+	}
+	return *entry, true
+}
+
+// The config and next run with the pause and last run stored by the manager
+func loadScheduleState(man managers.ContentManager, entry scheduleEntry) (*ScheduleState, error) {
+	state := entry.state
+	run, err := man.GetScheduleRun(state.Name)
+	if err != nil {
+		return nil, err
+	}
+	if run.Paused != nil {
+		state.Paused = *run.Paused
+	}
+	state.LastRun = run.RanAt
+	state.LastQueued = run.LastQueued
+	state.LastError = run.LastError
+	return &state, nil
+}
+
+// Start the scheduler if any schedules are configured, a bad schedule config is fatal
+func StartScheduler(ctx context.Context, man managers.ContentManager) {
+	cfg := man.GetCfg()
+	if len(cfg.Schedules) == 0 {
+		return
+	}
+	scheduler, err := NewScheduler(cfg.Schedules, time.Now())
+	if err != nil {
+		log.Fatalf("Invalid SCHEDULES config %s", err)
+	}
+	SCHEDULER = scheduler
+	go scheduler.Run(ctx, man)
+}
+
+type SchedulesResponse struct {
+	Total   int             `json:"total"`
+	Results []ScheduleState `json:"results"`
+}
+
+type ScheduleTriggeredResponse struct {
+	Schedule ScheduleState       `json:"schedule"`
+	Message  string              `json:"message"`
+	Results  models.TaskRequests `json:"results"`
+}
+
+func getScheduler() *Scheduler {
+	if SCHEDULER == nil {
+		scheduler, _ := NewScheduler([]config.TaskSchedule{}, time.Now())
+		return scheduler
+	}
+	return SCHEDULER
+}
+
+func abortScheduleErr(c *gin.Context, err error) {
+	if errors.Is(err, ErrScheduleNotFound) {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.AbortWithError(http.StatusBadRequest, err)
+}
+
+// GET /api/schedules
+func SchedulesResourceList(c *gin.Context) {
+	states := getScheduler().List(managers.GetManager(c))
+	c.JSON(http.StatusOK, SchedulesResponse{Total: len(states), Results: states})
+}
+
+// GET /api/schedules/:name
+func SchedulesResourceShow(c *gin.Context) {
+	state, err := getScheduler().Get(managers.GetManager(c), c.Param("name"))
+	if err != nil {
+		abortScheduleErr(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+// POST /api/schedules/:name/pause
+func SchedulePauseHandler(c *gin.Context) {
+	setSchedulePaused(c, true)
+}
+
+// POST /api/schedules/:name/resume
+func ScheduleResumeHandler(c *gin.Context) {
+	setSchedulePaused(c, false)
+}
+
+func setSchedulePaused(c *gin.Context, paused bool) {
+	man, _, err := managers.ManagerCanCUD(c)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	state, pauseErr := getScheduler().SetPaused(man, c.Param("name"), paused)
+	if pauseErr != nil {
+		abortScheduleErr(c, pauseErr)
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+// POST /api/schedules/:name/trigger runs the schedule now (even if it is paused)
+func ScheduleTriggerHandler(c *gin.Context) {
+	man, _, err := managers.ManagerCanCUD(c)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	scheduler := getScheduler()
+	created, triggerErr := scheduler.Trigger(man, c.Param("name"), time.Now())
+	if triggerErr != nil {
+		var full *ScheduleBacklogError
+		if errors.As(triggerErr, &full) {
+			AbortQueueFull(c, full.Status, full.Full)
+			return
+		}
+		abortScheduleErr(c, triggerErr)
+		return
+	}
+	state, stateErr := scheduler.Get(man, c.Param("name"))
+	if stateErr != nil {
+		abortScheduleErr(c, stateErr)
+		return
+	}
+	c.JSON(http.StatusCreated, ScheduleTriggeredResponse{
+		Schedule: *state,
+		Message:  fmt.Sprintf("Queued %d tasks for schedule %s", len(created), state.Name),
+		Results:  created,
+	})
+}
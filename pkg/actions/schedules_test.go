@@ -0,0 +1,160 @@
+package actions
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleApiMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateScheduleApi(t, router)
+}
+
+func TestScheduleApiDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateScheduleApi(t, router)
+}
+
+func TestSchedulerRunDue(t *testing.T) {
+	test_common.InitMemoryFakeAppEmpty()
+	man := managers.GetManager(test_common.GetContext())
+	start := time.Date(2024, 3, 10, 0, 30, 0, 0, time.Local)
+	schedules := []config.TaskSchedule{
+		{Name: "nightly", Cron: "0 1 * * *", Operation: "video_encoding"},
+		{Name: "paused", Cron: "0 1 * * *", Operation: "detect_duplicates", Paused: true},
+	}
+	scheduler, err := NewScheduler(schedules, start)
+	assert.NoError(t, err)
+	nightly, _ := scheduler.Get(man, "nightly")
+	assert.Equal(t, start.Add(30*time.Minute), *nightly.NextRun)
+
+	_, err = NewScheduler(append(schedules, schedules[0]), start)
+	assert.Error(t, err, "Schedule names have to be unique")
+	_, err = NewScheduler([]config.TaskSchedule{{Name: "bad", Cron: "nope", Operation: "video_encoding"}}, start)
+	assert.Error(t, err, "The cron has to be valid")
+
+	_, err = scheduler.Trigger(nil, "missing", start)
+	assert.ErrorIs(t, err, ErrScheduleNotFound)
+
+	// Nothing is due yet, the manager is never touched
+	assert.Equal(t, 0, len(scheduler.RunDue(nil, start.Add(10*time.Minute))))
+
+	// The paused schedule is skipped but still moves on to its next run
+	_, err = scheduler.SetPaused(man, "nightly", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(scheduler.RunDue(man, start.Add(31*time.Minute))))
+	paused, _ := scheduler.Get(man, "paused")
+	assert.Equal(t, start.Add(24*time.Hour+30*time.Minute), *paused.NextRun)
+	assert.Nil(t, paused.LastRun)
+
+	// The pause is kept by the manager so a restarted scheduler still skips it
+	restarted, err := NewScheduler(schedules, start)
+	assert.NoError(t, err)
+	nightly, _ = restarted.Get(man, "nightly")
+	assert.True(t, nightly.Paused, "The pause survives a restart")
+	assert.Equal(t, 0, len(restarted.RunDue(man, start.Add(31*time.Minute))))
+	claimed, err := man.ClaimScheduleRun("nightly", start.Add(30*time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, claimed, "The paused slot was never claimed")
+
+	// Resuming overrides a pause from the config as well
+	resumed, err := restarted.SetPaused(man, "paused", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed.Paused)
+}
+
+func ValidateScheduleApi(t *testing.T, router *gin.Engine) {
+	cnt, contents := CreateVideoContents("test_encoding", "", t, router)
+	assert.Greater(t, len(*contents), 0)
+
+	now := time.Now()
+	closed := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	schedules := []config.TaskSchedule{
+		{Name: "nightly_screens", Cron: "0 1 * * *", Operation: "screen_capture", ContainerIDs: []int64{cnt.ID}, Window: closed},
+		{Name: "weekly_dupes", Cron: "0 3 * * 0", Operation: "detect_duplicates", ContainerIDs: []int64{cnt.ID}},
+	}
+	scheduler, err := NewScheduler(schedules, now)
+	assert.NoError(t, err)
+	SCHEDULER = scheduler
+	defer func() { SCHEDULER = nil }()
+
+	listed := SchedulesResponse{}
+	code, err := GetJson("/api/schedules", nil, &listed, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, listed.Total)
+	assert.Equal(t, "nightly_screens", listed.Results[0].Name)
+	assert.NotNil(t, listed.Results[0].NextRun)
+
+	paused := ScheduleState{}
+	code, err = PostJson("/api/schedules/weekly_dupes/pause", nil, &paused, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, paused.Paused)
+
+	shown := ScheduleState{}
+	_, err = GetJson("/api/schedules/weekly_dupes", nil, &shown, router)
+	assert.NoError(t, err)
+	assert.True(t, shown.Paused, "It should stay paused")
+
+	_, err = PostJson("/api/schedules/weekly_dupes/resume", nil, &shown, router)
+	assert.NoError(t, err)
+	assert.False(t, shown.Paused)
+
+	triggered := ScheduleTriggeredResponse{}
+	code, err = PostJson("/api/schedules/nightly_screens/trigger", nil, &triggered, router)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, len(*contents), len(triggered.Results), "Every video in the container gets screens")
+	assert.Equal(t, len(triggered.Results), triggered.Schedule.LastQueued)
+	assert.NotNil(t, triggered.Schedule.LastRun)
+	for _, task := range triggered.Results {
+		assert.Equal(t, "nightly_screens", task.Schedule)
+		assert.Equal(t, models.TaskOperation.SCREENS, task.Operation)
+		assert.NotNil(t, task.RetryAt, "Outside of the window the tasks wait for it to open")
+	}
+
+	again := ScheduleTriggeredResponse{}
+	_, err = PostJson("/api/schedules/nightly_screens/trigger", nil, &again, router)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(again.Results), "The screens are still waiting to run")
+
+	bySchedule := TaskRequestResponse{}
+	_, err = GetJson("/api/task_requests?schedule=nightly_screens", nil, &bySchedule, router)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(triggered.Results)), bySchedule.Total, "Tasks can be listed by schedule")
+
+	code, _ = PostJson(fmt.Sprintf("/api/schedules/%s/trigger", "missing"), nil, &triggered, router)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Two servers with the same schedules, only one of them queues the slot
+	man := managers.GetManager(test_common.GetContext())
+	sweep := []config.TaskSchedule{schedules[1]}
+	first, err := NewScheduler(sweep, now)
+	assert.NoError(t, err)
+	second, err := NewScheduler(sweep, now)
+	assert.NoError(t, err)
+	due := now.Add(8 * 24 * time.Hour)
+	assert.Equal(t, []string{"weekly_dupes"}, first.RunDue(man, due))
+	assert.Equal(t, 0, len(second.RunDue(man, due)), "The slot was already claimed")
+	state, _ := second.Get(man, "weekly_dupes")
+	assert.NotNil(t, state.LastRun, "Every server sees the run the first one queued")
+	assert.True(t, state.NextRun.After(due), "The second server still moves on to the next slot")
+
+	// A pause from one server stops the others claiming the slot
+	_, err = first.SetPaused(man, "weekly_dupes", true)
+	assert.NoError(t, err)
+	later := due.Add(7 * 24 * time.Hour)
+	assert.Equal(t, 0, len(second.RunDue(man, later)), "The pause is shared")
+	state, _ = second.Get(man, "weekly_dupes")
+	assert.True(t, state.Paused)
+}
@@ -0,0 +1,157 @@
+package actions
+
+/**
+ * Admin view of the local task queues.  Limits changed here only last until a restart, set the
+ * TASK_QUEUE_SIZE / TASK_CONCURRENCY etc config to keep them.
+ *
+ * Requests that would grow the backlog past TASK_BACKLOG_LIMIT are refused here as well.
+ */
+import (
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/worker"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Zero values are left unchanged, an operation limit of all zeros removes the limit
+type TaskQueueUpdate struct {
+	MaxConcurrent int                              `json:"max_concurrent"`
+	QueueSize     int                              `json:"queue_size"`
+	Operations    map[string]worker.OperationLimit `json:"operations"`
+}
+
+// Seconds a client is told to wait when the backlog is full
+const TaskBacklogRetryAfter = 60
+
+// Returned with a 429 (backlog full) or 503 (queues shutting down) instead of creating tasks
+type QueueFullResponse struct {
+	Error        string                       `json:"error"`
+	QueueDepth   int64                        `json:"queue_depth"`
+	BacklogLimit int                          `json:"backlog_limit"`
+	Requested    int                          `json:"requested"`
+	RetryAfter   int                          `json:"retry_after"`
+	Queues       map[string]worker.QueueStats `json:"queues"`
+}
+
+// Check there is room for the requested number of tasks, returns the status and body to abort
+// with when there is not.
+func CheckTaskBacklog(man managers.ContentManager, requested int) (int, *QueueFullResponse) {
+	cfg := man.GetCfg()
+	res := &QueueFullResponse{
+		BacklogLimit: cfg.TaskBacklogLimit,
+		Requested:    requested,
+		RetryAfter:   TaskBacklogRetryAfter,
+	}
+	if cfg.StartQueueWorkers {
+		for name, queue := range GetTaskQueues() {
+			if queue != nil && queue.IsStopped() {
+				res.Error = fmt.Sprintf("the %s queue is shutting down", name)
+				return http.StatusServiceUnavailable, res
+			}
+		}
+	}
+	if cfg.TaskBacklogLimit <= 0 {
+		return http.StatusOK, nil
+	}
+	depth, err := managers.TaskQueueDepth(man)
+	if err != nil {
+		log.Printf("Could not determine the task queue depth %s", err)
+		return http.StatusOK, nil
+	}
+	res.QueueDepth = depth
+	if depth+int64(requested) > int64(cfg.TaskBacklogLimit) {
+		res.Error = fmt.Sprintf("%d tasks are already waiting, the limit is %d", depth, cfg.TaskBacklogLimit)
+		return http.StatusTooManyRequests, res
+	}
+	return http.StatusOK, nil
+}
+
+func AbortQueueFull(c *gin.Context, status int, res *QueueFullResponse) {
+	res.Queues = GetTaskQueueStats()
+	log.Printf("Refusing %d tasks %s", res.Requested, res.Error)
+	c.Header("Retry-After", strconv.Itoa(res.RetryAfter))
+	c.AbortWithStatusJSON(status, res)
+}
+
+func GetTaskQueueStats() map[string]worker.QueueStats {
+	stats := map[string]worker.QueueStats{}
+	for name, queue := range GetTaskQueues() {
+		if queue != nil {
+			stats[name] = queue.Stats()
+		}
+	}
+	return stats
+}
+
+func GetTaskQueues() map[string]*worker.TaskQueue {
+	return map[string]*worker.TaskQueue{
+		"encoding": ENCODING_QUEUE,
+		"tasks":    TASK_QUEUE,
+	}
+}
+
+// GET /api/admin/task_queues
+func TaskQueuesHandler(c *gin.Context) {
+	if _, _, err := managers.ManagerCanCUD(c); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	c.JSON(http.StatusOK, GetTaskQueueStats())
+}
+
+// PUT /api/admin/task_queues/:queue
+func TaskQueueUpdateHandler(c *gin.Context) {
+	if _, _, err := managers.ManagerCanCUD(c); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	name := c.Param("queue")
+	queue, ok := GetTaskQueues()[name]
+	if !ok || queue == nil {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("no task queue named %s", name))
+		return
+	}
+	update := TaskQueueUpdate{}
+	if err := c.BindJSON(&update); err != nil {
+		return
+	}
+	if err := ValidateTaskQueueUpdate(queue, update); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if update.MaxConcurrent > 0 {
+		queue.SetMaxConcurrent(worker.MaxConcurrentTasks(update.MaxConcurrent))
+	}
+	if update.QueueSize > 0 {
+		queue.SetQueueSize(update.QueueSize)
+	}
+	for op, limit := range update.Operations {
+		queue.SetOperationLimit(op, limit)
+	}
+	c.JSON(http.StatusOK, queue.Stats())
+}
+
+func ValidateTaskQueueUpdate(queue *worker.TaskQueue, update TaskQueueUpdate) error {
+	if update.MaxConcurrent < 0 || update.QueueSize < 0 {
+		return errors.New("max_concurrent and queue_size cannot be negative")
+	}
+	for op, limit := range update.Operations {
+		if limit.MaxConcurrent < 0 || limit.QueueSize < 0 {
+			return fmt.Errorf("limits for %s cannot be negative", op)
+		}
+		if QueueForOperation(models.TaskOperationType(op)) != queue {
+			return fmt.Errorf("operation %s is not run by this queue", op)
+		}
+		if _, err := queue.GetTaskHandler(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
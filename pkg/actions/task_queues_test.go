@@ -0,0 +1,155 @@
+package actions
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"contented/pkg/worker"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskQueueAdmin(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+
+	stats := map[string]worker.QueueStats{}
+	_, err := GetJson("/api/admin/task_queues", nil, &stats, router)
+	assert.NoError(t, err, "It should list the queues")
+	assert.Equal(t, 1, stats["encoding"].MaxConcurrent)
+	_, hasTagging := stats["tasks"].Operations[models.TaskOperation.TAGGING.String()]
+	assert.True(t, hasTagging, "Operations with a handler are listed")
+
+	tagging := models.TaskOperation.TAGGING.String()
+	update := TaskQueueUpdate{
+		MaxConcurrent: 4,
+		Operations:    map[string]worker.OperationLimit{tagging: {MaxConcurrent: 2, QueueSize: 50}},
+	}
+	updated := worker.QueueStats{}
+	_, err = PutJson("/api/admin/task_queues/tasks", update, &updated, router)
+	assert.NoError(t, err, "It should update the limits")
+	assert.Equal(t, 4, updated.MaxConcurrent)
+	assert.Equal(t, 100, updated.QueueSize, "Zero values are left alone")
+	assert.Equal(t, 2, updated.Operations[tagging].MaxConcurrent)
+	assert.Equal(t, 50, updated.Operations[tagging].QueueSize)
+
+	wrongQueue := TaskQueueUpdate{Operations: map[string]worker.OperationLimit{tagging: {MaxConcurrent: 1}}}
+	status, _ := PutJson("/api/admin/task_queues/encoding", wrongQueue, &updated, router)
+	assert.Equal(t, http.StatusBadRequest, status, "Tagging does not run on the encoding queue")
+
+	status, _ = PutJson("/api/admin/task_queues/tasks", TaskQueueUpdate{MaxConcurrent: -1}, &updated, router)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = PutJson("/api/admin/task_queues/nope", update, &updated, router)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	cfg := config.GetCfg()
+	cfg.ReadOnly = true
+	defer func() { cfg.ReadOnly = false }()
+	status, _ = GetJson("/api/admin/task_queues", nil, &stats, router)
+	assert.Equal(t, http.StatusNotImplemented, status, "A read only server does not expose the admin routes")
+}
+
+func TestTaskPriorityParamMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	content := CreateContentNamed("priority.mp4", nil, t, router, "video")
+
+	task := models.TaskRequest{}
+	url := fmt.Sprintf("/api/editing_queue/%d/webp?priority=high", content.ID)
+	_, err := PostJson(url, nil, &task, router)
+	assert.NoError(t, err, "It should queue the task")
+	assert.Equal(t, models.TaskPriority.HIGH, task.Priority)
+
+	other := CreateContentNamed("priority_number.mp4", nil, t, router, "video")
+	url = fmt.Sprintf("/api/editing_queue/%d/webp?priority=7", other.ID)
+	_, err = PostJson(url, nil, &task, router)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, task.Priority, "A number can be used as well")
+
+	url = fmt.Sprintf("/api/editing_queue/%d/webp?priority=urgent", content.ID)
+	status, _ := PostJson(url, nil, &task, router)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestTaskBacklogMemory(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(false)
+	ValidateTaskBacklog(t, cfg, router)
+}
+
+func TestTaskBacklogDB(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(true)
+	ValidateTaskBacklog(t, cfg, router)
+}
+
+func ValidateTaskBacklog(t *testing.T, cfg *config.DirConfigEntry, router *gin.Engine) {
+	cfg.TaskBacklogLimit = 1
+	defer func() { cfg.TaskBacklogLimit = config.DefaultTaskBacklogLimit }()
+
+	content := CreateContentNamed("backlog.mp4", nil, t, router, "video")
+	url := fmt.Sprintf("/api/editing_queue/%d/webp", content.ID)
+	status, _, err := MakeHttpRequest(url, router, "POST")
+	assert.NoError(t, err, "There is room for one task")
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, _, _ = MakeHttpRequest(url, router, "POST")
+	assert.Equal(t, http.StatusOK, status, "The same work is already queued so it does not need room")
+
+	other := CreateContentNamed("backlog_other.mp4", nil, t, router, "video")
+	url = fmt.Sprintf("/api/editing_queue/%d/webp", other.ID)
+	status, w, _ := MakeHttpRequest(url, router, "POST")
+	assert.Equal(t, http.StatusTooManyRequests, status, "The backlog is full")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	full := QueueFullResponse{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&full))
+	assert.Equal(t, int64(1), full.QueueDepth, "It should say how many tasks are waiting")
+	assert.Equal(t, 1, full.BacklogLimit)
+
+	// Queues that are shutting down cannot take anything
+	cfg.TaskBacklogLimit = 0
+	cfg.StartQueueWorkers = true
+	defer func() { cfg.StartQueueWorkers = false }()
+	InitTaskQueues()
+	TASK_QUEUE.Stop()
+	status, _, _ = MakeHttpRequest(url, router, "POST")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	InitTaskQueues()
+}
+
+func TestShutdownWorkersMemory(t *testing.T) {
+	InitFakeRouterApp(false)
+	ValidateShutdownWorkers(t)
+}
+
+func TestShutdownWorkersDB(t *testing.T) {
+	InitFakeRouterApp(true)
+	ValidateShutdownWorkers(t)
+}
+
+func ValidateShutdownWorkers(t *testing.T) {
+	man := managers.GetManager(test_common.GetContext())
+	created, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING})
+	assert.NoError(t, err)
+
+	// Claimed into a queue that never starts it
+	claimed, err := man.NextTask(models.TaskOperation.TAGGING)
+	assert.NoError(t, err)
+	assert.Equal(t, created.ID, claimed.ID)
+	assert.NoError(t, TASK_QUEUE.EnqueueTask(TaskForRequest(claimed)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ShutdownWorkers(ctx, man)
+
+	check, err := man.GetTask(created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.NEW, check.Status, "The claimed task should go back to the queue")
+	assert.True(t, TASK_QUEUE.IsStopped(), "Nothing more should be taken on")
+	assert.ErrorIs(t, ENCODING_QUEUE.EnqueueTask(worker.Task{ID: 1, Operation: models.TaskOperation.ENCODING}), worker.ErrQueueStopped)
+}
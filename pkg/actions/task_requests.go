@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 
 	"contented/pkg/managers"
 	"contented/pkg/models"
+	"contented/pkg/utils"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -56,12 +58,46 @@ func TaskRequestsResourceShow(c *gin.Context) {
 	c.JSON(http.StatusOK, task)
 }
 
+// The ffmpeg / ffprobe output of the task as plain text (rotated copies first)
+func TaskRequestsLogHandler(c *gin.Context) {
+	id, badId := strconv.ParseInt(c.Param("task_request_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	man := managers.GetManager(c)
+	task, err := man.GetTask(id)
+	if err != nil || task == nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if task.LogFile == "" {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("task %d has no log", id))
+		return
+	}
+	path, pathErr := utils.TaskLogPath(man.GetCfg().TaskLogDir, task.LogFile)
+	if pathErr != nil {
+		c.AbortWithError(http.StatusNotFound, pathErr)
+		return
+	}
+	content, readErr := utils.ReadTaskLog(path)
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			c.AbortWithError(http.StatusNotFound, fmt.Errorf("the log for task %d was purged", id))
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, readErr)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", content)
+}
+
 // Currently this is a private setup not accessible from the UI
 func TaskRequestsResourceCreate(c *gin.Context) {
 	c.AbortWithError(http.StatusNotImplemented, errors.New("restricted to editing queue requests"))
 }
 
-// Another private method, might be opened to just canceling a task (if possible)
+// Currently only supports canceling a task, running tasks have their process killed.
 func TaskRequestsResourceUpdate(c *gin.Context) {
 	_, _, err := managers.ManagerCanCUD(c)
 	if err != nil {
@@ -107,24 +143,64 @@ func TaskRequestsResourceUpdate(c *gin.Context) {
 
 	// Awkward states to handle, but the basic one is just going to be can we cancel
 	task := *exists
-	if !(task.Status == models.TaskStatus.NEW || task.Status == models.TaskStatus.PENDING) {
+	if !managers.IsCancelable(task.Status) {
 		msg := fmt.Sprintf("Cannot change state from current (%s) to %s", task.Status, state)
 		log.Print(msg)
 		c.AbortWithError(http.StatusBadRequest, errors.New(msg))
 		return
 	}
 
+	// Canceling a pipeline step cancels the steps waiting on it as well
 	currentState := task.Status
-	task.Status = state
-	taskUpdated, upErr := man.UpdateTask(&task, currentState)
+	taskUpdated, upErr := managers.CancelTask(man, &task, "Canceled by request")
 	if upErr != nil || taskUpdated == nil {
 		log.Printf("Failed to update resource %s", upErr)
 		c.AbortWithError(http.StatusInternalServerError, upErr)
 		return
 	}
+
+	// The status is already canceled so the task will not overwrite it with an error
+	if currentState == models.TaskStatus.IN_PROGRESS {
+		killed := CancelRunningTask(taskUpdated.ID)
+		log.Printf("Canceled in progress task %d, running locally %t", taskUpdated.ID, killed)
+	}
 	c.JSON(http.StatusOK, taskUpdated)
 }
 
+// Put a task that errored back onto the queue with a fresh set of attempts
+// POST /api/task_requests/{task_request_id}/retry
+func TaskRequestsRetryHandler(c *gin.Context) {
+	_, _, err := managers.ManagerCanCUD(c)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	id, badId := strconv.ParseInt(c.Param("task_request_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	man := managers.GetManager(c)
+	task, err := man.GetTask(id)
+	if err != nil || task == nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if task.Status != models.TaskStatus.ERROR {
+		msg := fmt.Sprintf("Only tasks in %s can be retried, task is %s", models.TaskStatus.ERROR, task.Status)
+		c.AbortWithError(http.StatusBadRequest, errors.New(msg))
+		return
+	}
+	retryTask := *task
+	retried, retryErr := managers.RetryTask(man, &retryTask)
+	if retryErr != nil {
+		c.AbortWithError(http.StatusInternalServerError, retryErr)
+		return
+	}
+	EnqueueTaskRequest(retried)
+	c.JSON(http.StatusOK, retried)
+}
+
 // Also a private setup, it is saner to not have somebody messing with the task queue.
 func TaskRequestsResourceDestroy(c *gin.Context) {
 	c.AbortWithError(http.StatusNotImplemented, errors.New("not available"))
@@ -1,12 +1,18 @@
 package actions
 
 import (
+	"contented/pkg/config"
 	"contented/pkg/managers"
 	"contented/pkg/models"
 	"contented/pkg/test_common"
+	"contented/pkg/utils"
+	"contented/pkg/worker"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -116,3 +122,182 @@ func ValidateTaskRequestUpdate(t *testing.T, router *gin.Engine) {
 	assert.Equal(t, upOk, http.StatusOK, fmt.Sprintf("This should work as this is a cancel %s", unexpectedErr))
 	assert.Equal(t, models.TaskStatus.CANCELED, validateTask.Status, "Its should have updated")
 }
+
+func TestCancelInProgressTaskMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateCancelInProgressTask(t, router)
+}
+
+func TestCancelInProgressTaskDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	test_common.CreateContentByDirName("dir1")
+	ValidateCancelInProgressTask(t, router)
+}
+
+func ValidateCancelInProgressTask(t *testing.T, router *gin.Engine) {
+	ctx := test_common.GetContext()
+	man := managers.GetManager(ctx)
+
+	contents, _, err := man.ListContent(managers.ContentQuery{PerPage: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, len(*contents), 1)
+
+	task := CreateTask((*contents)[0].ID, t, man)
+	task.Status = models.TaskStatus.IN_PROGRESS
+	running, runErr := man.UpdateTask(task, models.TaskStatus.NEW)
+	assert.NoError(t, runErr, "It should be able to start the task")
+
+	upUrl := fmt.Sprintf("/api/task_requests/%d", running.ID)
+	cancelTask := models.TaskRequest{Status: models.TaskStatus.CANCELED}
+	validateTask := models.TaskRequest{}
+	upOk, upErr := PutJson(upUrl, cancelTask, &validateTask, router)
+	assert.Equal(t, http.StatusOK, upOk, fmt.Sprintf("It should cancel a running task %s", upErr))
+	assert.Equal(t, models.TaskStatus.CANCELED, validateTask.Status, "It should be canceled")
+
+	// A canceled task should not be picked up again by a worker
+	_, _, _, takeErr := managers.TakeTask(man, running.ID, "Canceled check")
+	assert.ErrorIs(t, takeErr, managers.ErrTaskCanceled, "Canceled tasks cannot be restarted")
+	check, _ := man.GetTask(running.ID)
+	assert.Equal(t, models.TaskStatus.CANCELED, check.Status, "Taking the task should not change the state")
+
+	// Finished tasks cannot be canceled
+	upDone, _ := PutJson(upUrl, cancelTask, &models.TaskRequest{}, router)
+	assert.Equal(t, http.StatusBadRequest, upDone, "It should not cancel a task that is no longer running")
+}
+
+func TestRetryTaskMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateRetryTaskApi(t, router)
+}
+
+func TestRetryTaskDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	test_common.CreateContentByDirName("dir1")
+	ValidateRetryTaskApi(t, router)
+}
+
+func ValidateRetryTaskApi(t *testing.T, router *gin.Engine) {
+	ctx := test_common.GetContext()
+	man := managers.GetManager(ctx)
+
+	contents, _, err := man.ListContent(managers.ContentQuery{PerPage: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, len(*contents), 1)
+
+	task := CreateTask((*contents)[0].ID, t, man)
+	retryUrl := fmt.Sprintf("/api/task_requests/%d/retry", task.ID)
+	notFailed, _ := PostJson(retryUrl, nil, &models.TaskRequest{}, router)
+	assert.Equal(t, http.StatusBadRequest, notFailed, "Only errored tasks can be retried")
+
+	_, failErr := managers.ErrorTask(man, task, "It broke")
+	assert.NoError(t, failErr)
+
+	retried := models.TaskRequest{}
+	code, retryErr := PostJson(retryUrl, nil, &retried, router)
+	assert.Equal(t, http.StatusOK, code, fmt.Sprintf("It should retry the task %s", retryErr))
+	assert.Equal(t, models.TaskStatus.NEW, retried.Status, "It should be new again")
+	assert.Equal(t, 0, retried.Attempts, "With no attempts used")
+	assert.Greater(t, retried.MaxAttempts, 0, "And the retry policy applied")
+}
+
+func TestClaimAvailableTasksMemory(t *testing.T) {
+	cfg, _, _ := InitFakeRouterApp(false)
+	ValidateClaimAvailableTasks(t, cfg)
+}
+
+func TestClaimAvailableTasksDB(t *testing.T) {
+	cfg, _, _ := InitFakeRouterApp(true)
+	ValidateClaimAvailableTasks(t, cfg)
+}
+
+func ValidateClaimAvailableTasks(t *testing.T, cfg *config.DirConfigEntry) {
+	ctx := test_common.GetContext()
+	man := managers.GetManager(ctx)
+
+	// The queues are not started so claimed tasks just sit in the local queue
+	cfg.StartQueueWorkers = true
+	defer func() { cfg.StartQueueWorkers = false }()
+	InitTaskQueues()
+
+	for i := 0; i < 3; i++ {
+		contentID := int64(i + 1)
+		_, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &contentID})
+		assert.NoError(t, err)
+	}
+	claimed := ClaimAvailableTasks(man, []models.TaskOperationType{models.TaskOperation.ENCODING})
+	assert.Equal(t, 1, claimed, "The encoding queue only has room for one task")
+	assert.Equal(t, 0, ENCODING_QUEUE.Available(), "It should fill the queue")
+
+	pending, total, err := man.ListTasks(managers.TaskQuery{Status: models.TaskStatus.PENDING.String()})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), total, fmt.Sprintf("Only the claimed task is pending %s", pending))
+
+	// An operation at its own queue size is left waiting even if the queue has room
+	TASK_QUEUE.SetOperationLimit(models.TaskOperation.TAGGING.String(), worker.OperationLimit{QueueSize: 1})
+	for i := 0; i < 2; i++ {
+		contentID := int64(i + 1)
+		_, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING, ContentID: &contentID})
+		assert.NoError(t, err)
+	}
+	urgent, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.SCREENS, Priority: models.TaskPriority.HIGH})
+	claimed = ClaimAvailableTasks(man, []models.TaskOperationType{models.TaskOperation.TAGGING, models.TaskOperation.SCREENS})
+	assert.Equal(t, 2, claimed, "One tagging task and the screens task")
+	stats := TASK_QUEUE.Stats()
+	assert.Equal(t, 1, stats.Operations[models.TaskOperation.TAGGING.String()].Pending)
+	urgentCheck, _ := man.GetTask(urgent.ID)
+	assert.Equal(t, models.TaskStatus.PENDING, urgentCheck.Status)
+}
+
+func TestTaskLogMemory(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(false)
+	ValidateTaskLogApi(t, cfg, router)
+}
+
+func TestTaskLogDB(t *testing.T) {
+	cfg, _, router := InitFakeRouterApp(true)
+	test_common.CreateContentByDirName("dir1")
+	ValidateTaskLogApi(t, cfg, router)
+}
+
+func ValidateTaskLogApi(t *testing.T, cfg *config.DirConfigEntry, router *gin.Engine) {
+	cfg.TaskLogDir = t.TempDir()
+	man := managers.GetManager(test_common.GetContext())
+
+	contents, _, err := man.ListContent(managers.ContentQuery{PerPage: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, len(*contents), 1)
+	task := CreateTask((*contents)[0].ID, t, man)
+
+	logUrl := fmt.Sprintf("/api/task_requests/%d/log", task.ID)
+	code, _, _ := MakeHttpRequest(logUrl, router, "GET")
+	assert.Equal(t, http.StatusNotFound, code, "The task has not run so it has no log")
+
+	// Stand in for ffmpeg writing to the task log then exiting badly
+	failing := func(ctx context.Context, man managers.ContentManager, id int64) error {
+		running, _, takeErr := managers.TakeContentTask(man, id, "logging")
+		if takeErr != nil {
+			return takeErr
+		}
+		utils.TaskLogf(ctx, "Invalid data found when processing input")
+		msg := "Failed to encode exit status 1"
+		managers.FailTask(man, running, msg)
+		return errors.New(msg)
+	}
+	taskErr := HandleTask(context.Background(), TaskForRequest(task), failing)
+	assert.Error(t, taskErr)
+
+	ran, err := man.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.TaskLogName(task.ID), ran.LogFile, "The task links to its log")
+
+	code, w, logErr := MakeHttpRequest(logUrl, router, "GET")
+	assert.Equal(t, http.StatusOK, code, fmt.Sprintf("It should serve the log %s", logErr))
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, w.Body.String(), "Invalid data found when processing input")
+	assert.Contains(t, w.Body.String(), "exit status 1", "The failure is recorded at the end")
+
+	assert.Equal(t, 0, PurgeTaskLogs(cfg, time.Now()), "The log is inside the retention")
+	assert.Equal(t, 1, PurgeTaskLogs(cfg, time.Now().Add(time.Duration(cfg.TaskLogRetentionDays+1)*24*time.Hour)))
+	code, _, _ = MakeHttpRequest(logUrl, router, "GET")
+	assert.Equal(t, http.StatusNotFound, code, "The log was purged")
+}
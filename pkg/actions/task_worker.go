@@ -0,0 +1,272 @@
+package actions
+
+/**
+ * Worker processes (cmd/worker) claim tasks out of the task_requests table and run them on the
+ * same local queues the web server uses.  Several processes / machines can run at once as the
+ * claim uses FOR UPDATE SKIP LOCKED, the web server should then run with START_QUEUE_WORKERS=false
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"contented/pkg/worker"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Wakes up the dispatcher, buffered so a signal sent while it is busy claiming is not lost
+var taskSignal = make(chan struct{}, 1)
+
+// Stops the dispatcher, reaper, log purge and scheduler started by SetupWorkers
+var stopDispatch context.CancelFunc = func() {}
+
+// Let the dispatcher know a task is waiting or a queue slot freed up, never blocks
+func SignalTaskAvailable() {
+	select {
+	case taskSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Claim and run tasks until the context is done.  The worker wakes up when a task is created
+// (LISTEN / NOTIFY) and also polls every TaskPollInterval for retries or missed notifications.
+func RunTaskWorker(ctx context.Context, man managers.ContentManager, operations []models.TaskOperationType) error {
+	cfg := man.GetCfg()
+	if !cfg.UseDatabase {
+		return errors.New("task workers claim from the database, USE_DATABASE must be true")
+	}
+
+	var notify <-chan *pq.Notification
+	listener, err := managers.ListenForTasks()
+	if err != nil {
+		log.Printf("Could not LISTEN for tasks, polling every %ds instead %s", cfg.TaskPollInterval, err)
+	} else {
+		defer listener.Close()
+		notify = listener.Notify
+	}
+
+	// A crashed worker process leaves its tasks in progress, any of the other workers can reap them
+	go RunTaskReaper(ctx, man)
+	go RunTaskLogPurge(ctx, cfg)
+
+	log.Printf("Task worker started for operations %s", operations)
+	DispatchTasks(ctx, man, operations, notify)
+	return nil
+}
+
+// The task store (DB or memory) is the real queue, the local queues only hold what is about to
+// run.  Claim tasks into the local queues whenever they have room until the context is done.
+func DispatchTasks(ctx context.Context, man managers.ContentManager, operations []models.TaskOperationType, notify <-chan *pq.Notification) {
+	pollInterval := time.Duration(man.GetCfg().TaskPollInterval) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	for {
+		claimed := ClaimAvailableTasks(man, operations)
+		if claimed > 0 {
+			log.Printf("Dispatched %d tasks to the local queues", claimed)
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Task dispatch stopping %s", ctx.Err())
+			return
+		case <-notify:
+		case <-taskSignal:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Claim as many tasks as the local queues have room for, highest priority first, returns how
+// many were claimed.
+func ClaimAvailableTasks(man managers.ContentManager, operations []models.TaskOperationType) int {
+	byQueue := map[*worker.TaskQueue][]models.TaskOperationType{}
+	for _, operation := range operations {
+		queue := QueueForOperation(operation)
+		byQueue[queue] = append(byQueue[queue], operation)
+	}
+
+	claimed := 0
+	for queue, queueOperations := range byQueue {
+		for queue.Available() > 0 {
+			// Operations at their own queue size are left in the store
+			withRoom := []models.TaskOperationType{}
+			for _, operation := range queueOperations {
+				if queue.AvailableFor(operation.String()) > 0 {
+					withRoom = append(withRoom, operation)
+				}
+			}
+			if len(withRoom) == 0 {
+				break
+			}
+			task, err := managers.ClaimNextTask(man, withRoom...)
+			if err != nil {
+				if !errors.Is(err, managers.ErrNoTaskAvailable) {
+					log.Printf("Failed to claim a task for %s %s", withRoom, err)
+				}
+				break
+			}
+			if qErr := queue.EnqueueTask(TaskForRequest(task)); qErr != nil {
+				log.Printf("Could not queue claimed task %d %s", task.ID, qErr)
+				managers.UnclaimTask(man, task)
+				break
+			}
+			claimed++
+		}
+	}
+	return claimed
+}
+
+// Stop claiming tasks and drain the local queues.  Running tasks get until the context is done to
+// finish, then they are canceled and put back to new.  Tasks that were claimed but never started
+// go back to new as well so the next start (or another worker) picks them up.
+func ShutdownWorkers(ctx context.Context, man managers.ContentManager) {
+	stopDispatch()
+
+	var wg sync.WaitGroup
+	for _, queue := range []*worker.TaskQueue{ENCODING_QUEUE, TASK_QUEUE} {
+		if queue == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(queue *worker.TaskQueue) {
+			defer wg.Done()
+			dropped, finished := queue.Shutdown(ctx)
+			if !finished {
+				log.Printf("Tasks were still running after the shutdown %v", queue.Stats())
+			}
+			for _, task := range dropped {
+				if _, err := managers.UnclaimTaskByID(man, task.ID); err != nil {
+					log.Printf("Failed to return task %d to the queue %s", task.ID, err)
+				}
+			}
+		}(queue)
+	}
+	wg.Wait()
+	log.Printf("Task queues shut down")
+}
+
+func TaskForRequest(tr *models.TaskRequest) worker.Task {
+	return worker.Task{
+		ID:        tr.ID,
+		Operation: tr.Operation,
+		Priority:  tr.Priority,
+	}
+}
+
+// Periodically fail (and so retry) in progress tasks that stopped heartbeating until the context is done
+func RunTaskReaper(ctx context.Context, man managers.ContentManager) {
+	interval := time.Duration(man.GetCfg().TaskHeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ReapStaleTasks(man)
+		}
+	}
+}
+
+// How often logs past TaskLogRetentionDays are looked for
+var TaskLogPurgeInterval = time.Hour
+
+// Periodically remove task logs older than the retention until the context is done
+func RunTaskLogPurge(ctx context.Context, cfg *config.DirConfigEntry) {
+	if cfg.TaskLogRetentionDays <= 0 {
+		return
+	}
+	ticker := time.NewTicker(TaskLogPurgeInterval)
+	defer ticker.Stop()
+	for {
+		PurgeTaskLogs(cfg, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Remove the temp outputs (encodes, screens, previews) a crash or kill left under the library dir
+func RemoveOrphanedOutputs(cfg *config.DirConfigEntry) int {
+	if cfg.Dir == "" {
+		return 0
+	}
+	removed, err := utils.RemoveTempOutputs(cfg.Dir, utils.TempOutputMinAge)
+	if err != nil {
+		log.Printf("Failed to remove orphaned temp outputs in %s %s", cfg.Dir, err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d orphaned temp outputs under %s", removed, cfg.Dir)
+	}
+	return removed
+}
+
+func PurgeTaskLogs(cfg *config.DirConfigEntry, now time.Time) int {
+	olderThan := now.Add(-time.Duration(cfg.TaskLogRetentionDays) * 24 * time.Hour)
+	removed, err := utils.PurgeTaskLogs(cfg.TaskLogDir, olderThan)
+	if err != nil {
+		log.Printf("Failed to purge task logs in %s %s", cfg.TaskLogDir, err)
+	}
+	if removed > 0 {
+		log.Printf("Purged %d task logs older than %d days", removed, cfg.TaskLogRetentionDays)
+	}
+	return removed
+}
+
+// Reap stale tasks, anything still running locally is killed and the retries are queued up
+func ReapStaleTasks(man managers.ContentManager) models.TaskRequests {
+	reaped, err := managers.ReapStaleTasks(man)
+	if err != nil {
+		log.Printf("Failed to reap stale tasks %s", err)
+	}
+	for _, task := range reaped {
+		CancelRunningTask(task.ID)
+		RetryFailedTask(man, task.ID)
+	}
+	return reaped
+}
+
+// A handler panicked, the queue recovered so record the stack trace on the task
+func TaskPanicked(task worker.Task, recovered any, stack []byte) {
+	if _, err := managers.PanicTask(managers.GetManagerNoContext(), task.ID, recovered, stack); err != nil {
+		log.Printf("Failed to record the panic on task %d %s", task.ID, err)
+	}
+}
+
+// Called by the queues on an interval while a task is running
+func TaskHeartbeat(task worker.Task) {
+	_, err := managers.HeartbeatTask(managers.GetManagerNoContext(), task.ID)
+	if errors.Is(err, managers.ErrTaskNotInProgress) {
+		// Reaped (or canceled) by another process, it can only be stopped from here
+		log.Printf("Task %d is no longer in progress, stopping it %s", task.ID, err)
+		CancelRunningTask(task.ID)
+	} else if err != nil {
+		log.Printf("Failed to heartbeat task %d %s", task.ID, err)
+	}
+}
+
+// All the operations that a worker knows how to run
+func AllTaskOperations() []models.TaskOperationType {
+	return []models.TaskOperationType{
+		models.TaskOperation.ENCODING,
+		models.TaskOperation.SCREENS,
+		models.TaskOperation.WEBP,
+		models.TaskOperation.TAGGING,
+		models.TaskOperation.DUPES,
+		models.TaskOperation.REMOVE_DUPLICATE_FILES,
+		models.TaskOperation.HLS,
+		models.TaskOperation.SUBTITLES,
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"contented/pkg/models"
 	"contented/pkg/utils"
 	"contented/pkg/worker"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -45,10 +50,8 @@ func (t SearchContainersResult) String() string {
 func SetupContented(r *gin.Engine, contentDir string, numToPreview int64, limit int) {
 	cfg := config.GetCfg()
 
-	// Initialize workers that will listen for encoding tasks (GoBuffalo has some Gin does not)
-	log.Printf("TODO: The job processors are busted without GoBuffalo")
-	SetupWorkers()
-
+	// Note the workers are already setup by GinApp, calling SetupWorkers again would start a second
+	// set of queues (and recover the unfinished tasks twice).
 	// If we are not using databases load up the memory view
 	if !cfg.UseDatabase {
 		SetupMemory(cfg.Dir)
@@ -71,24 +74,87 @@ var ENCODING_QUEUE *worker.TaskQueue
 // TODO: Determine if these should be registered by config (don't use normal workers basically)
 func SetupWorkers() {
 	cfg := config.GetCfg()
+	InitTaskQueues()
+
+	man := managers.GetManagerNoContext()
+
+	// A second setup (tests, reloading the app) would leak the dispatcher and scheduler goroutines
+	stopDispatch()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopDispatch = cancel
+
+	// Scheduled tasks are only created here, worker processes run them like any other task
+	StartScheduler(ctx, man)
+
+	if cfg.StartQueueWorkers {
+		log.Printf("Starting Queue workers locally")
+
+		// Partial outputs from before a crash, recent ones are skipped as a worker might own them.
+		// Without local workers the worker process (cmd/worker) owns the outputs and cleans them up.
+		go RemoveOrphanedOutputs(cfg)
+		TASK_QUEUE.Start()
+		ENCODING_QUEUE.Start()
+
+		// Memory managers lose all their tasks on a restart so there is nothing to recover.  Recover
+		// before dispatching so a freshly claimed task is not mistaken for an interrupted one.
+		go func() {
+			if cfg.UseDatabase {
+				RecoverQueuedTasks(man)
+			}
+			DispatchTasks(ctx, man, AllTaskOperations(), nil)
+		}()
+		go RunTaskReaper(ctx, man)
+		go RunTaskLogPurge(ctx, cfg)
+	}
+}
+
+// Create the queues and register the handlers for each operation (does not start them)
+func InitTaskQueues() {
+	cfg := config.GetCfg()
 
 	// Note this only works locally in memory and this should be extended to a set of tasks that
 	// can read from redis OR a local queue.
-	ENCODING_QUEUE = worker.NewTaskQueue(100, 1)
+	ENCODING_QUEUE = worker.NewTaskQueue(cfg.EncodingQueueSize, worker.MaxConcurrentTasks(cfg.EncodingConcurrency))
 	ENCODING_QUEUE.RegisterTaskHandler(models.TaskOperation.ENCODING.String(), VideoEncodingWrapper)
+	ENCODING_QUEUE.RegisterTaskHandler(models.TaskOperation.HLS.String(), HlsPackageWrapper)
 
-	TASK_QUEUE = worker.NewTaskQueue(100, 10)
+	TASK_QUEUE = worker.NewTaskQueue(cfg.TaskQueueSize, worker.MaxConcurrentTasks(cfg.TaskConcurrency))
 	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.SCREENS.String(), ScreenCaptureWrapper)
 	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.WEBP.String(), WebpFromScreensWrapper)
 	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.TAGGING.String(), TaggingContentWrapper)
 	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.DUPES.String(), DuplicatesWrapper)
 	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.REMOVE_DUPLICATE_FILES.String(), RemoveDuplicatesWrapper)
+	TASK_QUEUE.RegisterTaskHandler(models.TaskOperation.SUBTITLES.String(), ExtractSubtitlesWrapper)
 
-	if cfg.StartQueueWorkers {
-		log.Printf("Starting Queue workers locally")
-		TASK_QUEUE.Start()
-		ENCODING_QUEUE.Start()
+	heartbeatInterval := time.Duration(cfg.TaskHeartbeatInterval) * time.Second
+	for _, queue := range []*worker.TaskQueue{ENCODING_QUEUE, TASK_QUEUE} {
+		queue.SetPanicHandler(TaskPanicked)
+		queue.SetHeartbeat(heartbeatInterval, TaskHeartbeat)
+		queue.SetReleaseHandler(func(worker.Task) { SignalTaskAvailable() })
+	}
+	for _, op := range AllTaskOperations() {
+		limit := worker.OperationLimit{
+			MaxConcurrent: cfg.TaskOperationConcurrency[op.String()],
+			QueueSize:     cfg.TaskOperationQueueSizes[op.String()],
+		}
+		if limit.MaxConcurrent > 0 || limit.QueueSize > 0 {
+			QueueForOperation(op).SetOperationLimit(op.String(), limit)
+		}
+	}
+}
+
+// Anything left new, pending or in progress from a previous run is stranded in the DB unless
+// it is put back onto the queues.  Tasks a worker process is still running are not touched.
+func RecoverQueuedTasks(man managers.ContentManager) (models.TaskRequests, error) {
+	tasks, err := managers.RecoverTasks(man, man.GetCfg().RequeueInterruptedTasks)
+	if err != nil {
+		log.Printf("Failed to recover unfinished tasks %s", err)
+		return tasks, err
 	}
+	for _, task := range tasks {
+		ScheduleTaskRequest(task)
+	}
+	return tasks, nil
 }
 
 func FullHandler(c *gin.Context) {
@@ -114,6 +180,155 @@ func FullHandler(c *gin.Context) {
 	c.File(fq_path)
 }
 
+// Each transcode is an ffmpeg process so only TRANSCODE_CONCURRENCY run at once
+var transcodeSlots = struct {
+	sync.Mutex
+	active int
+}{}
+
+func acquireTranscodeSlot(limit int) bool {
+	transcodeSlots.Lock()
+	defer transcodeSlots.Unlock()
+	if transcodeSlots.active >= limit {
+		return false
+	}
+	transcodeSlots.active++
+	return true
+}
+
+func releaseTranscodeSlot() {
+	transcodeSlots.Lock()
+	defer transcodeSlots.Unlock()
+	transcodeSlots.active--
+}
+
+// Canceled on shutdown, every transcode stream is stopped along with it
+var transcodeCtx, stopTranscodes = context.WithCancel(context.Background())
+
+// Kill the running transcodes (and refuse new ones), a stream would otherwise hold up the shutdown
+// for as long as the video plays.
+func StopTranscodes() {
+	stopTranscodes()
+}
+
+// Pipes a video the browser cannot play through ffmpeg as fragmented mp4, ?start=<seconds> to seek.
+// ffmpeg is killed when the client goes away.
+func TranscodeHandler(c *gin.Context) {
+	mcID, badId := strconv.ParseInt(c.Param("id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	startSeconds := 0.0
+	if startStr := c.Query("start"); startStr != "" {
+		start, badStart := strconv.ParseFloat(startStr, 64)
+		if badStart != nil || start < 0 {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid start %s", startStr))
+			return
+		}
+		startSeconds = start
+	}
+	man := managers.GetManager(c)
+	mc, err := man.GetContent(mcID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if !mc.IsVideo() {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("content %d is not a video", mc.ID))
+		return
+	}
+	fq_path, fq_err := man.FindActualFile(mc)
+	if fq_err != nil {
+		log.Printf("File to transcode not found on disk %s with err %s", fq_path, fq_err)
+		c.AbortWithError(http.StatusUnprocessableEntity, fq_err)
+		return
+	}
+	cfg := man.GetCfg()
+	if transcodeCtx.Err() != nil {
+		c.AbortWithError(http.StatusServiceUnavailable, errors.New("the server is shutting down"))
+		return
+	}
+	if !acquireTranscodeSlot(cfg.TranscodeConcurrency) {
+		c.Header("Retry-After", "10")
+		c.AbortWithError(http.StatusServiceUnavailable, fmt.Errorf("already running %d transcodes", cfg.TranscodeConcurrency))
+		return
+	}
+	defer releaseTranscodeSlot()
+
+	log.Printf("Transcoding %s for %d from %.1fs", fq_path, mc.ID, startSeconds)
+	c.Header("Content-Type", utils.TranscodeContentType)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	stopOnShutdown := context.AfterFunc(transcodeCtx, cancel)
+	defer stopOnShutdown()
+	streamErr := utils.TranscodeStream(ctx, cfg, fq_path, mc.VideoCodec(), startSeconds, c.Writer)
+	if errors.Is(streamErr, context.Canceled) {
+		log.Printf("Transcode of %d stopped, the client disconnected or the server is shutting down", mc.ID)
+	} else if streamErr != nil {
+		log.Printf("Transcode of %d failed %s", mc.ID, streamErr)
+	}
+}
+
+// Serves the master playlist, rendition playlists and segments of the HLS package for the content
+func StreamHandler(c *gin.Context) {
+	mcID, badId := strconv.ParseInt(c.Param("id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	man := managers.GetManager(c)
+	mc, err := man.GetContent(mcID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	name := c.Param("file")
+	fq_path, fq_err := managers.FindStreamFile(man, mc, name)
+	if fq_err != nil {
+		log.Printf("Stream file %s not found for %d with err %s", name, mc.ID, fq_err)
+		c.AbortWithError(http.StatusNotFound, fq_err)
+		return
+	}
+	c.Header("Content-Type", utils.HlsContentType(name))
+	c.File(fq_path)
+}
+
+// Serves a subtitle track as WebVTT, sidecar srt files are converted as they are served
+func SubtitleHandler(c *gin.Context) {
+	mcID, badId := strconv.ParseInt(c.Param("content_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return
+	}
+	man := managers.GetManager(c)
+	mc, err := man.GetContent(mcID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	lang := c.Param("lang")
+	track, fq_path, fq_err := managers.FindSubtitleFile(man, mc, lang)
+	if fq_err != nil {
+		log.Printf("Subtitles %s not found for %d with err %s", lang, mc.ID, fq_err)
+		c.AbortWithError(http.StatusNotFound, fq_err)
+		return
+	}
+	if track.Format == "vtt" {
+		c.Header("Content-Type", utils.SubtitleContentType)
+		c.File(fq_path)
+		return
+	}
+	srt, readErr := os.ReadFile(fq_path)
+	if readErr != nil {
+		c.AbortWithError(http.StatusUnprocessableEntity, readErr)
+		return
+	}
+	c.Data(http.StatusOK, utils.SubtitleContentType, utils.SrtToVtt(srt))
+}
+
 func SearchHandler(c *gin.Context) {
 	man := managers.GetManager(c)
 	mcs, count, err := man.SearchContentContext()
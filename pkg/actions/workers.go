@@ -0,0 +1,241 @@
+package actions
+
+/**
+ * HTTP protocol for remote agents (a transcoding box etc) that do not have DB access.  An agent
+ * claims a lease on a task, downloads the source with /api/download/:id, heartbeats with its
+ * progress and then uploads the result or gives the task back.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WorkerClaimRequest struct {
+	WorkerID   string                     `json:"worker_id"`
+	Operations []models.TaskOperationType `json:"operations"`
+}
+
+type WorkerClaimResponse struct {
+	Task         models.TaskRequest `json:"task"`
+	Content      *models.Content    `json:"content"`
+	DownloadUrl  string             `json:"download_url"`
+	LeaseSeconds int                `json:"lease_seconds"`
+
+	// The ffmpeg settings for an encoding task
+	Profile *config.EncodingProfile `json:"profile,omitempty"`
+}
+
+// Sent on a heartbeat, fail or release.  Progress fields are only used by the heartbeat.
+type WorkerTaskUpdate struct {
+	WorkerID        string  `json:"worker_id"`
+	Progress        float64 `json:"progress"`
+	FramesProcessed int64   `json:"frames_processed"`
+	Speed           float64 `json:"speed"`
+	EtaSeconds      int64   `json:"eta_seconds"`
+	ErrMsg          string  `json:"err_msg"`
+}
+
+// Middleware for the /api/workers routes, edits have to be allowed and the token must match
+func WorkerAuth(c *gin.Context) {
+	_, _, err := managers.ManagerCanCUD(c)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+	token := managers.GetManager(c).GetCfg().WorkerToken
+	if token != "" && c.GetHeader("X-Worker-Token") != token {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("invalid worker token"))
+		return
+	}
+	c.Next()
+}
+
+// POST /api/workers/claim returns 204 when there is nothing to do
+func WorkerClaimHandler(c *gin.Context) {
+	claim := WorkerClaimRequest{}
+	if err := c.BindJSON(&claim); err != nil {
+		return
+	}
+	man := managers.GetManager(c)
+	task, err := managers.LeaseTask(man, claim.WorkerID, claim.Operations)
+	if errors.Is(err, managers.ErrNoTaskAvailable) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	res := WorkerClaimResponse{
+		Task:         *task,
+		LeaseSeconds: man.GetCfg().WorkerLeaseSeconds,
+	}
+	if task.ContentID != nil {
+		content, cErr := man.GetContent(*task.ContentID)
+		if cErr == nil {
+			res.Content = content
+			res.DownloadUrl = fmt.Sprintf("/api/download/%d", content.ID)
+		}
+	}
+	if task.Operation == models.TaskOperation.ENCODING {
+		// The worker cannot encode without the settings and another attempt would not fix them
+		profile, pErr := managers.TaskEncodingProfile(man.GetCfg(), task)
+		if pErr != nil {
+			managers.ClearLease(task)
+			managers.ErrorTask(man, task, fmt.Sprintf("Invalid encoding profile, not leased to worker %s %s", claim.WorkerID, pErr))
+			c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("task %d has an invalid encoding profile %s", task.ID, pErr))
+			return
+		}
+		res.Profile = profile
+	}
+	log.Printf("Worker %s leased task %d", claim.WorkerID, task.ID)
+	c.JSON(http.StatusOK, res)
+}
+
+// POST /api/workers/tasks/:task_request_id/heartbeat extends the lease and records progress
+func WorkerHeartbeatHandler(c *gin.Context) {
+	man, task, update, ok := GetWorkerTask(c)
+	if !ok {
+		return
+	}
+	progress := utils.TaskProgress{
+		Percent:    update.Progress,
+		Frames:     update.FramesProcessed,
+		Speed:      update.Speed,
+		EtaSeconds: update.EtaSeconds,
+	}
+	updated, err := managers.RenewLease(man, task, update.WorkerID, progress)
+	if err != nil {
+		AbortWorkerTask(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// POST /api/workers/tasks/:task_request_id/fail the task is retried (by a worker) under the retry policy
+func WorkerFailHandler(c *gin.Context) {
+	man, task, update, ok := GetWorkerTask(c)
+	if !ok {
+		return
+	}
+	failed, err := managers.FailRemoteTask(man, task, update.WorkerID, update.ErrMsg)
+	if err != nil {
+		AbortWorkerTask(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, failed)
+}
+
+// POST /api/workers/tasks/:task_request_id/release gives the task back without using an attempt
+func WorkerReleaseHandler(c *gin.Context) {
+	man, task, update, ok := GetWorkerTask(c)
+	if !ok {
+		return
+	}
+	released, err := managers.ReleaseTask(man, task, update.WorkerID)
+	if err != nil {
+		AbortWorkerTask(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, released)
+}
+
+// POST /api/workers/tasks/:task_request_id/complete multipart form with worker_id and the file
+func WorkerCompleteHandler(c *gin.Context) {
+	man := managers.GetManager(c)
+	task, ok := GetWorkerTaskByID(c, man)
+	if !ok {
+		return
+	}
+	workerID := c.PostForm("worker_id")
+	if err := managers.CheckLease(task, workerID); err != nil {
+		AbortWorkerTask(c, err)
+		return
+	}
+	if task.Operation != models.TaskOperation.ENCODING || task.ContentID == nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("cannot complete %s remotely", task.Operation))
+		return
+	}
+	upload, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("the result file is required %s", err))
+		return
+	}
+	content, err := man.GetContent(*task.ContentID)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	dstFile, err := managers.RemoteEncodingDestination(man, task, content)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Do not leave a partial or truncated upload where a scan would pick it up as content
+	saveErr := managers.SaveRemoteEncode(c.Request.Context(), man, task, workerID, dstFile, func(tmpFile string) error {
+		return c.SaveUploadedFile(upload, tmpFile)
+	})
+	if saveErr != nil {
+		AbortWorkerTask(c, saveErr)
+		return
+	}
+	done, err := managers.CompleteRemoteEncoding(c.Request.Context(), man, task, workerID, dstFile)
+	if err != nil {
+		AbortWorkerTask(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, done)
+}
+
+// Lookup the task and the worker update body for the task routes
+func GetWorkerTask(c *gin.Context) (managers.ContentManager, *models.TaskRequest, WorkerTaskUpdate, bool) {
+	update := WorkerTaskUpdate{}
+	man := managers.GetManager(c)
+	task, ok := GetWorkerTaskByID(c, man)
+	if !ok {
+		return man, nil, update, false
+	}
+	if err := c.BindJSON(&update); err != nil {
+		return man, nil, update, false
+	}
+	return man, task, update, true
+}
+
+func GetWorkerTaskByID(c *gin.Context, man managers.ContentManager) (*models.TaskRequest, bool) {
+	id, badId := strconv.ParseInt(c.Param("task_request_id"), 10, 64)
+	if badId != nil {
+		c.AbortWithError(http.StatusBadRequest, badId)
+		return nil, false
+	}
+	task, err := man.GetTask(id)
+	if err != nil || task == nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return nil, false
+	}
+	taskCopy := *task
+	return &taskCopy, true
+}
+
+// A canceled task is gone (stop working on it), a lost lease means someone else has it now
+func AbortWorkerTask(c *gin.Context, err error) {
+	if errors.Is(err, managers.ErrTaskCanceled) {
+		c.AbortWithError(http.StatusGone, err)
+	} else if errors.Is(err, managers.ErrLeaseLost) {
+		c.AbortWithError(http.StatusConflict, err)
+	} else if errors.Is(err, managers.ErrQualityRejected) || errors.Is(err, managers.ErrUploadInvalid) {
+		c.AbortWithError(http.StatusUnprocessableEntity, err)
+	} else {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
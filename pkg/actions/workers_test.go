@@ -0,0 +1,74 @@
+package actions
+
+import (
+	"contented/pkg/managers"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerApiMemory(t *testing.T) {
+	_, _, router := InitFakeRouterApp(false)
+	ValidateWorkerApi(t, router)
+}
+
+func TestWorkerApiDB(t *testing.T) {
+	_, _, router := InitFakeRouterApp(true)
+	ValidateWorkerApi(t, router)
+}
+
+func ValidateWorkerApi(t *testing.T, router *gin.Engine) {
+	ctx := test_common.GetContext()
+	man := managers.GetManager(ctx)
+
+	claim := WorkerClaimRequest{WorkerID: "agent-1"}
+	status, _, _ := MakeHttpRequest("/api/workers/claim", router, "POST")
+	assert.Equal(t, http.StatusBadRequest, status, "A claim needs a body")
+
+	res := WorkerClaimResponse{}
+	status, _ = PostJson("/api/workers/claim", claim, &res, router)
+	assert.Equal(t, http.StatusNoContent, status, "Nothing to claim yet")
+
+	content := CreateContentNamed("worker_encode.mp4", nil, t, router, "video")
+	created, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &content.ID})
+	assert.NoError(t, err)
+
+	status, err = PostJson("/api/workers/claim", claim, &res, router)
+	assert.NoError(t, err, "It should lease the task")
+	assert.Equal(t, created.ID, res.Task.ID)
+	assert.Equal(t, fmt.Sprintf("/api/download/%d", content.ID), res.DownloadUrl)
+
+	heartbeatUrl := fmt.Sprintf("/api/workers/tasks/%d/heartbeat", created.ID)
+	update := WorkerTaskUpdate{WorkerID: "agent-1", Progress: 50}
+	hb := models.TaskRequest{}
+	_, err = PostJson(heartbeatUrl, update, &hb, router)
+	assert.NoError(t, err, "The lease holder can heartbeat")
+	assert.Equal(t, 50.0, hb.Progress)
+
+	status, _ = PostJson(heartbeatUrl, WorkerTaskUpdate{WorkerID: "agent-2"}, &hb, router)
+	assert.Equal(t, http.StatusConflict, status, "Another worker does not hold the lease")
+
+	released := models.TaskRequest{}
+	releaseUrl := fmt.Sprintf("/api/workers/tasks/%d/release", created.ID)
+	_, err = PostJson(releaseUrl, update, &released, router)
+	assert.NoError(t, err, "It should release the task")
+	assert.Equal(t, models.TaskStatus.NEW, released.Status)
+
+	// A task whose profile cannot be used errors instead of being leased without the settings
+	_, err = managers.CancelTask(man, &released, "Done with the released task")
+	assert.NoError(t, err)
+	broken, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &content.ID, Profile: "missing_profile"})
+	assert.NoError(t, err)
+	status, _ = PostJson("/api/workers/claim", claim, &res, router)
+	assert.Equal(t, http.StatusInternalServerError, status, "The task is not leased")
+	errored, err := man.GetTask(broken.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.ERROR, errored.Status)
+	assert.Equal(t, "", errored.WorkerID)
+	assert.Contains(t, errored.ErrMsg, "Invalid encoding profile")
+}
@@ -6,8 +6,10 @@ package config
 * in environment variables when running the full instance vs unit tests.
  */
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
@@ -18,6 +20,13 @@ import (
 
 // TODO: hard code vs Envy vs test stuff.  A pain in the butt
 const PREVIEW_DIRECTORY = "container_previews"
+
+// HLS packages, one directory per content id next to the previews
+const STREAM_DIRECTORY = "container_streams"
+
+// Subtitle streams extracted to WebVTT, one directory per content id
+const SUBTITLE_DIRECTORY = "container_subtitles"
+
 const SniffLen = 512           // How many bytes to read in a file when trying to determine mime type
 const DefaultLimit int = 10000 // The max limit set by environment variable
 const DefaultPreviewCount int = 8
@@ -33,8 +42,79 @@ const DefaultCodecForConversionName = "hevc" // The name of the encoding (someti
 const DefaultEncodingDestination = ""
 const DefaultCodecForConversion = "libx265"
 const DefaultEncodingFilenameModifier = "_h265" // This is used when encoding a new video file name <name>_h265.mp4
+const DefaultEncodingProfileName = "default"    // Built from the CODEC_FOR_CONVERSION settings
+const DefaultTaskMaxAttempts = 3                // Including the first run
+const DefaultTaskRetryDelay = 30                // Seconds
+const DefaultTaskRetryMaxDelay = 3600           // Seconds
+const DefaultTaskPollInterval = 5               // Seconds
+const DefaultWorkerLeaseSeconds = 300
+const DefaultTaskHeartbeatInterval = 30 // Seconds
+const DefaultTaskHeartbeatTimeout = 300 // Seconds
+const DefaultTaskMaxRuntime = 4 * 3600  // Seconds, a hung handler still heartbeats
+const DefaultTaskQueueSize = 100
+const DefaultTaskConcurrency = 10
+const DefaultEncodingQueueSize = 100
+const DefaultEncodingConcurrency = 1
+const DefaultTaskBacklogLimit = 10000
+const DefaultShutdownGracePeriod = 60     // Seconds
+const DefaultShutdownHttpGracePeriod = 10 // Seconds
+const DefaultTaskLogMaxBytes = 5 * 1024 * 1024
+const DefaultTaskLogMaxFiles = 2
+const DefaultTaskLogRetentionDays = 14
+const DefaultFfmpegLogLevel = "info"
+const DefaultQualityMinVmaf = 90.0
+const DefaultQualityMinSsim = 0.95
+const DefaultQualityMinPsnr = 35.0 // dB
+const DefaultQualityRejectAction = "delete"
+const DefaultEncodingMinBitrate = 0 // kbps, 0 encodes no matter how low the source bitrate is
+// Percent smaller than the source an encode has to be to keep it
+const DefaultEncodingMinSavings = 5.0
+const DefaultEncodingAudioTracks = "all"
+const DefaultHlsRenditions = "1080,720,480" // Heights, renditions taller than the source are skipped
+const DefaultHlsSegmentSeconds = 6
+const DefaultHlsSegmentType = "fmp4"
+const DefaultHlsCodec = "libx264" // h264 plays in every browser hls.js supports
+const DefaultTranscodeConcurrency = 2
+const DefaultTranscodeCodec = "libx264"
+const DefaultTranscodePreset = "veryfast" // Has to keep up with playback
+
+// Worker processes on other machines need a shared TASK_LOG_DIR for the API to serve their logs
+func DefaultTaskLogDir() string {
+	return filepath.Join(os.TempDir(), "contented_task_logs")
+}
 
 var ValidPreviewTypes = []string{"png", "gif", "screens"}
+var ValidQualityMetrics = []string{"", "vmaf", "ssim", "psnr"}
+var ValidQualityRejectActions = []string{"delete", "flag"}
+var ValidEncodingAudioTracks = []string{"all", "first"}
+var ValidHlsSegmentTypes = []string{"fmp4", "mpegts"}
+
+// A recurring job that queues an existing task operation for the library (or some containers)
+type TaskSchedule struct {
+	Name         string  `json:"name"`
+	Cron         string  `json:"cron"`          // minute hour day month weekday ie: "0 1 * * *"
+	Operation    string  `json:"operation"`     // video_encoding, screen_capture, webp_from_screens, tag_content, detect_duplicates
+	ContainerIDs []int64 `json:"container_ids"` // Empty is every container
+	Window       string  `json:"window"`        // Optional "01:00-06:00", tasks only start inside the window
+	Paused       bool    `json:"paused"`
+}
+
+// Named ffmpeg settings an encoding task can use (ENCODING_PROFILES), ie a 720p pass for phones
+type EncodingProfile struct {
+	Name             string `json:"name"`
+	Codec            string `json:"codec"`             // The ffmpeg encoder libx265, libx264, hevc_nvenc, libsvtav1, libvpx-vp9
+	CodecName        string `json:"codec_name"`        // What a probe reports for the output hevc, h264, av1, vp9
+	Crf              int    `json:"crf"`               // Constant quality, 0 uses the bitrate (or the encoder default)
+	Bitrate          string `json:"bitrate"`           // Video bitrate ie "4M" when there is no crf
+	Preset           string `json:"preset"`            // Encoder preset ie slow, medium (cpu-used for libaom-av1 / libvpx-vp9)
+	PixelFormat      string `json:"pixel_format"`      // ie yuv420p, empty keeps the source format
+	MaxWidth         int    `json:"max_width"`         // Larger video is scaled down keeping the aspect ratio
+	MaxHeight        int    `json:"max_height"`        // 0 is no limit
+	AudioCodec       string `json:"audio_codec"`       // ie aac or copy, empty is the ffmpeg default for the container (opus for webm)
+	AudioBitrate     string `json:"audio_bitrate"`     // ie "128k"
+	Container        string `json:"container"`         // mp4, mkv, mov or webm, defaults to what suits the codec
+	FilenameModifier string `json:"filename_modifier"` // Output is <name><FilenameModifier>.<Container>
+}
 
 // Matchers that determine if you want to include specific filenames/content types
 type ContentMatcher func(string, string) bool
@@ -49,7 +129,7 @@ func ExcludeNoContainers(name string) bool {
 }
 
 func ExcludeContainerDefault(name string) bool {
-	defaultCntExclude := regexp.MustCompile("DS_Store|container_previews")
+	defaultCntExclude := regexp.MustCompile("DS_Store|container_previews|container_streams|container_subtitles")
 	return defaultCntExclude.MatchString(name)
 }
 
@@ -117,7 +197,94 @@ type DirConfigEntry struct {
 	RemoveDuplicateFiles     bool   // Removing old video files after re-encoding
 	RemoveLocation           string // If defined and something we can write to delete of content will move the files here
 
-	StartQueueWorkers bool // Should we process requested tasks on this server
+	// Extra profiles that can be picked per task, the default profile uses the codec settings above
+	EncodingProfiles []EncodingProfile
+
+	// Encodes that do not make the file smaller, a source already under the bitrate (kbps) is not
+	// encoded and an output not EncodingMinSavings percent smaller than the source is discarded.
+	EncodingMinBitrate int
+	EncodingMinSavings float64
+
+	// The streams an encode keeps, without a -map ffmpeg only keeps one video and one audio stream.
+	// EncodingKeepMetadata copies the global metadata, chapters and the source modification time.
+	EncodingAudioTracks  string // all or first
+	EncodingSubtitles    bool
+	EncodingKeepMetadata bool
+
+	// After an encode the output is compared to the source (vmaf falls back to ssim if ffmpeg has no
+	// libvmaf).  Below the minimum for the metric the output is deleted or flagged and the task errors.
+	QualityMetric        string  // Empty disables the check
+	QualityMinVmaf       float64 // 0-100
+	QualityMinSsim       float64 // 0-1
+	QualityMinPsnr       float64 // dB
+	QualityRejectAction  string  // delete or flag (keep the file but mark the content as rejected)
+	QualitySampleSeconds int     // Only compare the start of the video, 0 compares all of it
+
+	// The hls_package task writes a rendition for each height (and a master.m3u8) to STREAM_DIRECTORY
+	HlsRenditions     []int
+	HlsSegmentSeconds int
+	HlsSegmentType    string // fmp4 or mpegts
+	HlsCodec          string
+
+	// Streaming a browser-incompatible video through ffmpeg (/api/transcode/:id), each stream is an ffmpeg process
+	TranscodeConcurrency int
+	TranscodeCodec       string
+	TranscodePreset      string
+
+	StartQueueWorkers       bool   // Should we process requested tasks on this server
+	RequeueInterruptedTasks bool   // On startup put pending / in progress tasks back to new (otherwise error them)
+	TaskMaxAttempts         int    // How many times a failed task is run before it is an error (1 = no retry)
+	TaskRetryDelay          int    // Seconds before the first retry, doubles on each following attempt
+	TaskRetryMaxDelay       int    // Upper bound in seconds on the retry backoff
+	TaskPollInterval        int    // Seconds between a worker process checking the DB for tasks
+	ClaimTasksFromDB        bool   // Set by cmd/worker, tasks are claimed from the DB rather than queued by the web server
+	WorkerLeaseSeconds      int    // How long a remote worker holds a task without a heartbeat
+	WorkerToken             string // If set remote workers must send it in the X-Worker-Token header
+	TaskHeartbeatInterval   int    // Seconds between running tasks recording a heartbeat (and the reaper checking)
+	TaskHeartbeatTimeout    int    // Seconds without a heartbeat before an in progress task is failed
+	TaskMaxRuntime          int    // Seconds an in progress task can run before it is failed, 0 is no limit
+
+	// Per operation overrides of TaskHeartbeatTimeout (video_encoding=600,screen_capture=120)
+	TaskHeartbeatTimeouts map[string]int
+
+	// Per operation overrides of TaskMaxRuntime, encodes of a long video can take most of a day
+	TaskMaxRuntimes map[string]int
+
+	// Per operation overrides of TaskMaxAttempts, TaskRetryDelay and TaskRetryMaxDelay (video_encoding=2)
+	TaskOperationMaxAttempts    map[string]int
+	TaskOperationRetryDelays    map[string]int
+	TaskOperationRetryMaxDelays map[string]int
+
+	// Encoding has its own queue so it cannot starve the cheaper tasks (screens, tagging etc)
+	TaskQueueSize       int // How many tasks can wait in the task queue before adding one blocks
+	TaskConcurrency     int // How many tasks in the task queue run at once
+	EncodingQueueSize   int
+	EncodingConcurrency int
+
+	// Per operation limits within a queue (tag_content=2), unset operations only have the queue limits
+	TaskOperationConcurrency map[string]int
+	TaskOperationQueueSizes  map[string]int
+
+	// Tasks wait in the DB (or memory) until there is room in a queue, past this many waiting new
+	// requests are refused with a 429.  0 is unlimited.
+	TaskBacklogLimit int
+
+	// Seconds running tasks get to finish on a SIGTERM before they are canceled and put back
+	ShutdownGracePeriod int
+
+	// Seconds in flight requests get to finish on a SIGTERM, before the task queues are drained
+	ShutdownHttpGracePeriod int
+
+	// Recurring task operations (nightly encoding, duplicate sweeps) run by the scheduler
+	Schedules []TaskSchedule
+
+	// ffmpeg / ffprobe output for each task is written to TaskLogDir/task_<id>.log, past TaskLogMaxBytes
+	// the log is rotated keeping TaskLogMaxFiles old copies.  Logs are purged after TaskLogRetentionDays.
+	TaskLogDir           string
+	TaskLogMaxBytes      int64
+	TaskLogMaxFiles      int
+	TaskLogRetentionDays int    // 0 keeps the logs forever
+	FfmpegLogLevel       string // The ffmpeg -loglevel for the task logs (error, warning, info, verbose)
 
 	// Matchers that will determine which content elements to be included or excluded
 	IncContent      ContentMatcher
@@ -156,6 +323,20 @@ func SetCfg(cfg DirConfigEntry) {
 	appCfg = cfg
 }
 
+func DefaultTaskMaxRuntimes() map[string]int {
+	return map[string]int{"video_encoding": 24 * 3600, "hls_package": 24 * 3600}
+}
+
+// An encode failure is rarely fixed by an immediate retry and it is expensive to repeat, nothing
+// transient about the content lookups for tagging.
+func DefaultTaskOperationMaxAttempts() map[string]int {
+	return map[string]int{"video_encoding": 2, "hls_package": 2, "tag_content": 1}
+}
+
+func DefaultTaskOperationRetryDelays() map[string]int {
+	return map[string]int{"video_encoding": 300, "hls_package": 300}
+}
+
 func GetCfgDefaults() DirConfigEntry {
 	return DirConfigEntry{
 		Initialized:              false,
@@ -180,11 +361,63 @@ func GetCfgDefaults() DirConfigEntry {
 		EncodingDestination:    DefaultEncodingDestination,
 
 		EncodingFilenameModifier: DefaultEncodingFilenameModifier,
+		EncodingProfiles:         []EncodingProfile{},
+		EncodingMinBitrate:       DefaultEncodingMinBitrate,
+		EncodingMinSavings:       DefaultEncodingMinSavings,
+		EncodingAudioTracks:      DefaultEncodingAudioTracks,
+		EncodingSubtitles:        true,
+		EncodingKeepMetadata:     true,
+		QualityMetric:            "",
+		QualityMinVmaf:           DefaultQualityMinVmaf,
+		QualityMinSsim:           DefaultQualityMinSsim,
+		QualityMinPsnr:           DefaultQualityMinPsnr,
+		QualityRejectAction:      DefaultQualityRejectAction,
+		QualitySampleSeconds:     0,
+		HlsRenditions:            MustParseIntList(DefaultHlsRenditions),
+		HlsSegmentSeconds:        DefaultHlsSegmentSeconds,
+		HlsSegmentType:           DefaultHlsSegmentType,
+		HlsCodec:                 DefaultHlsCodec,
+		TranscodeConcurrency:     DefaultTranscodeConcurrency,
+		TranscodeCodec:           DefaultTranscodeCodec,
+		TranscodePreset:          DefaultTranscodePreset,
 		RemoveDuplicateFiles:     false,
 		RemoveLocation:           "",
 
 		// Should this server start up processing tasks for tasking screens, encoding etc.
-		StartQueueWorkers: true,
+		StartQueueWorkers:       true,
+		RequeueInterruptedTasks: true,
+		TaskMaxAttempts:         DefaultTaskMaxAttempts,
+		TaskRetryDelay:          DefaultTaskRetryDelay,
+		TaskRetryMaxDelay:       DefaultTaskRetryMaxDelay,
+		TaskPollInterval:        DefaultTaskPollInterval,
+		ClaimTasksFromDB:        false,
+		WorkerLeaseSeconds:      DefaultWorkerLeaseSeconds,
+		WorkerToken:             "",
+		TaskHeartbeatInterval:   DefaultTaskHeartbeatInterval,
+		TaskHeartbeatTimeout:    DefaultTaskHeartbeatTimeout,
+		TaskHeartbeatTimeouts:   map[string]int{},
+		TaskMaxRuntime:          DefaultTaskMaxRuntime,
+		TaskMaxRuntimes:         DefaultTaskMaxRuntimes(),
+
+		TaskOperationMaxAttempts:    DefaultTaskOperationMaxAttempts(),
+		TaskOperationRetryDelays:    DefaultTaskOperationRetryDelays(),
+		TaskOperationRetryMaxDelays: map[string]int{},
+
+		TaskQueueSize:            DefaultTaskQueueSize,
+		TaskConcurrency:          DefaultTaskConcurrency,
+		EncodingQueueSize:        DefaultEncodingQueueSize,
+		EncodingConcurrency:      DefaultEncodingConcurrency,
+		TaskOperationConcurrency: map[string]int{},
+		TaskOperationQueueSizes:  map[string]int{},
+		TaskBacklogLimit:         DefaultTaskBacklogLimit,
+		ShutdownGracePeriod:      DefaultShutdownGracePeriod,
+		ShutdownHttpGracePeriod:  DefaultShutdownHttpGracePeriod,
+		Schedules:                []TaskSchedule{},
+		TaskLogDir:               DefaultTaskLogDir(),
+		TaskLogMaxBytes:          DefaultTaskLogMaxBytes,
+		TaskLogMaxFiles:          DefaultTaskLogMaxFiles,
+		TaskLogRetentionDays:     DefaultTaskLogRetentionDays,
+		FfmpegLogLevel:           DefaultFfmpegLogLevel,
 
 		// Just grab all files by default
 		IncContent:             IncludeAllFiles,
@@ -270,6 +503,81 @@ func GetEnvInt(key string, defaultInt int) int {
 	return defaultInt
 }
 
+func GetEnvFloat(key string, defaultFloat float64) float64 {
+	valStr := os.Getenv(key)
+	if valStr != "" {
+		val, err := strconv.ParseFloat(valStr, 64)
+		if err != nil {
+			log.Fatalf("Failed to parse Float key(%s) val (%s) err %s", key, valStr, err)
+		}
+		return val
+	}
+	return defaultFloat
+}
+
+// Parses positive ints separated by commas ie: 1080,720,480
+func MustParseIntList(valStr string) []int {
+	vals := []int{}
+	for _, numStr := range strings.Split(valStr, ",") {
+		if strings.TrimSpace(numStr) == "" {
+			continue
+		}
+		val, err := strconv.Atoi(strings.TrimSpace(numStr))
+		if err != nil || val <= 0 {
+			log.Fatalf("Failed to parse Int list (%s) value (%s) err %s", valStr, numStr, err)
+		}
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// Parses key=int pairs separated by commas ie: video_encoding=600,screen_capture=120
+func GetEnvIntMap(key string, defaultMap map[string]int) map[string]int {
+	valStr := os.Getenv(key)
+	if valStr == "" {
+		return defaultMap
+	}
+	vals := map[string]int{}
+	for _, pair := range strings.Split(valStr, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, numStr, found := strings.Cut(pair, "=")
+		val, err := strconv.Atoi(strings.TrimSpace(numStr))
+		if !found || err != nil {
+			log.Fatalf("Failed to parse Int map key(%s) pair (%s) err %s", key, pair, err)
+		}
+		vals[strings.TrimSpace(name)] = val
+	}
+	return vals
+}
+
+// Parses a JSON list of TaskSchedule, the cron and window are validated when the scheduler loads them
+func GetEnvSchedules(key string) []TaskSchedule {
+	valStr := os.Getenv(key)
+	if strings.TrimSpace(valStr) == "" {
+		return []TaskSchedule{}
+	}
+	schedules := []TaskSchedule{}
+	if err := json.Unmarshal([]byte(valStr), &schedules); err != nil {
+		log.Fatalf("Failed to parse schedules key(%s) value (%s) err %s", key, valStr, err)
+	}
+	return schedules
+}
+
+// Parses a JSON list of EncodingProfile, each profile is validated when it is used
+func GetEnvEncodingProfiles(key string) []EncodingProfile {
+	valStr := os.Getenv(key)
+	if strings.TrimSpace(valStr) == "" {
+		return []EncodingProfile{}
+	}
+	profiles := []EncodingProfile{}
+	if err := json.Unmarshal([]byte(valStr), &profiles); err != nil {
+		log.Fatalf("Failed to parse encoding profiles key(%s) value (%s) err %s", key, valStr, err)
+	}
+	return profiles
+}
+
 // Should I move this into the config itself?
 func InitConfigEnvy(cfg *DirConfigEntry) *DirConfigEntry {
 
@@ -302,6 +610,36 @@ func InitConfigEnvy(cfg *DirConfigEntry) *DirConfigEntry {
 	cfg.Limit = GetEnvInt("LIMIT", DefaultLimit)
 	cfg.CoreCount = GetEnvInt("CORE_COUNT", 4)
 	cfg.StartQueueWorkers = GetEnvBool("START_QUEUE_WORKERS", true)
+	cfg.RequeueInterruptedTasks = GetEnvBool("REQUEUE_INTERRUPTED_TASKS", true)
+	cfg.TaskMaxAttempts = GetEnvInt("TASK_MAX_ATTEMPTS", DefaultTaskMaxAttempts)
+	cfg.TaskRetryDelay = GetEnvInt("TASK_RETRY_DELAY", DefaultTaskRetryDelay)
+	cfg.TaskRetryMaxDelay = GetEnvInt("TASK_RETRY_MAX_DELAY", DefaultTaskRetryMaxDelay)
+	cfg.TaskPollInterval = GetEnvInt("TASK_POLL_INTERVAL", DefaultTaskPollInterval)
+	cfg.WorkerLeaseSeconds = GetEnvInt("WORKER_LEASE_SECONDS", DefaultWorkerLeaseSeconds)
+	cfg.WorkerToken = GetEnvString("WORKER_TOKEN", "")
+	cfg.TaskHeartbeatInterval = GetEnvInt("TASK_HEARTBEAT_INTERVAL", DefaultTaskHeartbeatInterval)
+	cfg.TaskHeartbeatTimeout = GetEnvInt("TASK_HEARTBEAT_TIMEOUT", DefaultTaskHeartbeatTimeout)
+	cfg.TaskHeartbeatTimeouts = GetEnvIntMap("TASK_HEARTBEAT_TIMEOUTS", map[string]int{})
+	cfg.TaskMaxRuntime = GetEnvInt("TASK_MAX_RUNTIME", DefaultTaskMaxRuntime)
+	cfg.TaskMaxRuntimes = GetEnvIntMap("TASK_MAX_RUNTIMES", DefaultTaskMaxRuntimes())
+	cfg.TaskOperationMaxAttempts = GetEnvIntMap("TASK_OPERATION_MAX_ATTEMPTS", DefaultTaskOperationMaxAttempts())
+	cfg.TaskOperationRetryDelays = GetEnvIntMap("TASK_OPERATION_RETRY_DELAYS", DefaultTaskOperationRetryDelays())
+	cfg.TaskOperationRetryMaxDelays = GetEnvIntMap("TASK_OPERATION_RETRY_MAX_DELAYS", map[string]int{})
+	cfg.TaskQueueSize = GetEnvInt("TASK_QUEUE_SIZE", DefaultTaskQueueSize)
+	cfg.TaskConcurrency = GetEnvInt("TASK_CONCURRENCY", DefaultTaskConcurrency)
+	cfg.EncodingQueueSize = GetEnvInt("ENCODING_QUEUE_SIZE", DefaultEncodingQueueSize)
+	cfg.EncodingConcurrency = GetEnvInt("ENCODING_CONCURRENCY", DefaultEncodingConcurrency)
+	cfg.TaskOperationConcurrency = GetEnvIntMap("TASK_OPERATION_CONCURRENCY", map[string]int{})
+	cfg.TaskOperationQueueSizes = GetEnvIntMap("TASK_OPERATION_QUEUE_SIZES", map[string]int{})
+	cfg.TaskBacklogLimit = GetEnvInt("TASK_BACKLOG_LIMIT", DefaultTaskBacklogLimit)
+	cfg.ShutdownGracePeriod = GetEnvInt("SHUTDOWN_GRACE_PERIOD", DefaultShutdownGracePeriod)
+	cfg.ShutdownHttpGracePeriod = GetEnvInt("SHUTDOWN_HTTP_GRACE_PERIOD", DefaultShutdownHttpGracePeriod)
+	cfg.Schedules = GetEnvSchedules("SCHEDULES")
+	cfg.TaskLogDir = GetEnvString("TASK_LOG_DIR", DefaultTaskLogDir())
+	cfg.TaskLogMaxBytes = int64(GetEnvInt("TASK_LOG_MAX_BYTES", DefaultTaskLogMaxBytes))
+	cfg.TaskLogMaxFiles = GetEnvInt("TASK_LOG_MAX_FILES", DefaultTaskLogMaxFiles)
+	cfg.TaskLogRetentionDays = GetEnvInt("TASK_LOG_RETENTION_DAYS", DefaultTaskLogRetentionDays)
+	cfg.FfmpegLogLevel = GetEnvString("FFMPEG_LOG_LEVEL", DefaultFfmpegLogLevel)
 	cfg.PreviewCount = GetEnvInt("PREVIEW", DefaultPreviewCount)
 
 	// Could make this an enum?
@@ -329,6 +667,37 @@ func InitConfigEnvy(cfg *DirConfigEntry) *DirConfigEntry {
 
 	// TODO: Make this a little saner on the name side
 	cfg.EncodingFilenameModifier = GetEnvString("ENCODING_FILENAME_MODIFIER", DefaultEncodingFilenameModifier)
+	cfg.EncodingProfiles = GetEnvEncodingProfiles("ENCODING_PROFILES")
+	cfg.EncodingMinBitrate = GetEnvInt("ENCODING_MIN_BITRATE", DefaultEncodingMinBitrate)
+	cfg.EncodingMinSavings = GetEnvFloat("ENCODING_MIN_SAVINGS", DefaultEncodingMinSavings)
+	cfg.EncodingAudioTracks = GetEnvString("ENCODING_AUDIO_TRACKS", DefaultEncodingAudioTracks)
+	if !slices.Contains(ValidEncodingAudioTracks, cfg.EncodingAudioTracks) {
+		log.Fatalf("ENCODING_AUDIO_TRACKS %s is not one of %s", cfg.EncodingAudioTracks, ValidEncodingAudioTracks)
+	}
+	cfg.EncodingSubtitles = GetEnvBool("ENCODING_SUBTITLES", true)
+	cfg.EncodingKeepMetadata = GetEnvBool("ENCODING_KEEP_METADATA", true)
+	cfg.QualityMetric = GetEnvString("QUALITY_METRIC", "")
+	if !slices.Contains(ValidQualityMetrics, cfg.QualityMetric) {
+		log.Fatalf("QUALITY_METRIC %s is not one of %s", cfg.QualityMetric, ValidQualityMetrics)
+	}
+	cfg.QualityMinVmaf = GetEnvFloat("QUALITY_MIN_VMAF", DefaultQualityMinVmaf)
+	cfg.QualityMinSsim = GetEnvFloat("QUALITY_MIN_SSIM", DefaultQualityMinSsim)
+	cfg.QualityMinPsnr = GetEnvFloat("QUALITY_MIN_PSNR", DefaultQualityMinPsnr)
+	cfg.QualityRejectAction = GetEnvString("QUALITY_REJECT_ACTION", DefaultQualityRejectAction)
+	if !slices.Contains(ValidQualityRejectActions, cfg.QualityRejectAction) {
+		log.Fatalf("QUALITY_REJECT_ACTION %s is not one of %s", cfg.QualityRejectAction, ValidQualityRejectActions)
+	}
+	cfg.QualitySampleSeconds = GetEnvInt("QUALITY_SAMPLE_SECONDS", 0)
+	cfg.HlsRenditions = MustParseIntList(GetEnvString("HLS_RENDITIONS", DefaultHlsRenditions))
+	cfg.HlsSegmentSeconds = GetEnvInt("HLS_SEGMENT_SECONDS", DefaultHlsSegmentSeconds)
+	cfg.HlsSegmentType = GetEnvString("HLS_SEGMENT_TYPE", DefaultHlsSegmentType)
+	if !slices.Contains(ValidHlsSegmentTypes, cfg.HlsSegmentType) {
+		log.Fatalf("HLS_SEGMENT_TYPE %s is not one of %s", cfg.HlsSegmentType, ValidHlsSegmentTypes)
+	}
+	cfg.HlsCodec = GetEnvString("HLS_CODEC", DefaultHlsCodec)
+	cfg.TranscodeConcurrency = GetEnvInt("TRANSCODE_CONCURRENCY", DefaultTranscodeConcurrency)
+	cfg.TranscodeCodec = GetEnvString("TRANSCODE_CODEC", DefaultTranscodeCodec)
+	cfg.TranscodePreset = GetEnvString("TRANSCODE_PRESET", DefaultTranscodePreset)
 	cfg.RemoveDuplicateFiles = GetEnvBool("REMOVE_DUPLICATE_FILES", false)
 	cfg.RemoveLocation = GetEnvString("REMOVE_LOCATION", "")
 
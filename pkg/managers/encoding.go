@@ -9,6 +9,7 @@ import (
 	"contented/pkg/config"
 	"contented/pkg/models"
 	"contented/pkg/utils"
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -42,7 +43,9 @@ func EncodeVideos(cm ContentManager) error {
 	lineBreak := "===================================================="
 	log.Printf("Encoding complete\n%s\n", lineBreak)
 	for _, res := range all_results {
-		if res.Err == nil {
+		if res.Err == nil && res.Discarded != "" {
+			log.Printf("Encoding Discarded %s media ID %d\n", res.Discarded, res.MC_ID)
+		} else if res.Err == nil {
 			msg := fmt.Sprintf("Encoding Success %s media ID %d\n", res.NewVideo, res.MC_ID)
 			log.Print(msg)
 		}
@@ -79,11 +82,16 @@ func EncodeContainer(c *models.Container, cm ContentManager) (*utils.EncodingRes
 	// Remember that references in a range loop CHANGE the pointer on each loop so you MUST
 	// re-assign a variable if you want to build a new object with pointers.
 	toEncode := utils.EncodingRequests{}
+	profile := utils.DefaultEncodingProfile(cm.GetCfg())
 	for _, mc := range *content {
 		srcFile, _ := utils.GetFilePathInContainer(mc.Src, c.GetFqPath())
 
 		// DstFile should split off the final extension \.xyz and replace it
 		dstFile := utils.GetVideoConversionName(srcFile)
+		if reason := DiscardedEncodeReason(&mc, &profile); reason != "" {
+			log.Print(reason)
+			continue
+		}
 		msg, err, encode := utils.ShouldEncodeVideo(srcFile, dstFile)
 
 		if encode {
@@ -122,7 +130,7 @@ func EncodeContainerContent(toEncode *utils.EncodingRequests, cm ContentManager)
 	// Starts the workers
 	for i := 0; i < processors; i++ {
 		pw := utils.EncodingWorker{Id: i, In: input}
-		go StartEncoder(pw)
+		go StartEncoder(pw, cm)
 	}
 
 	for _, req := range *toEncode {
@@ -145,14 +153,15 @@ func EncodeContainerContent(toEncode *utils.EncodingRequests, cm ContentManager)
 	return &results, nil
 }
 
-func StartEncoder(ew utils.EncodingWorker) {
+func StartEncoder(ew utils.EncodingWorker, cm ContentManager) {
+	profile := utils.DefaultEncodingProfile(cm.GetCfg())
 	for req := range ew.In {
 		c := req.C
 		mc := req.Mc
 
 		// Should check the on disk size and add a check to look at a post encode filesize
 		log.Printf("Worker %d doing encoding for %d - %s\n", ew.Id, mc.ID, mc.Src)
-		msg, err, converted := utils.ConvertVideoToH265(req.SrcFile, req.DstFile)
+		msg, err, converted := utils.ConvertVideoToH265(context.Background(), req.SrcFile, req.DstFile, nil)
 		if err == nil && !converted {
 			err = fmt.Errorf("a request was made to convert %s but it did not encode %s", req.SrcFile, msg)
 		}
@@ -163,6 +172,26 @@ func StartEncoder(ew utils.EncodingWorker) {
 			_, encodedSize, err, _ = utils.IsValidVideo(req.DstFile)
 		}
 
+		// Same as the encoding task, an encode that does not save enough is removed and remembered
+		discarded := ""
+		if err == nil {
+			srcBytes, saved, sErr := GetEncodeSavings(cm, mc, req.DstFile)
+			if sErr != nil {
+				err = sErr
+			} else if !EnoughSavings(cm.GetCfg(), srcBytes, saved) {
+				discarded = DiscardEncodeOutput(cm, mc, &profile, req.DstFile, srcBytes, saved)
+			}
+		}
+		if err == nil && discarded == "" {
+			quality, qErr := CheckEncodeQuality(context.Background(), cm, mc, req.DstFile)
+			if qErr != nil {
+				err = qErr
+			} else if quality != nil && !quality.Passed {
+				_, rejected := RejectEncodeOutput(cm, mc, req.DstFile, quality)
+				err = fmt.Errorf("%w: %s", ErrQualityRejected, rejected)
+			}
+		}
+
 		log.Printf("Size of the media %d and encoded size %d", mc.SizeBytes, encodedSize)
 		req.Out <- utils.EncodingResult{
 			C_ID:        c.ID,
@@ -170,7 +199,56 @@ func StartEncoder(ew utils.EncodingWorker) {
 			NewVideo:    req.DstFile,
 			InitialSize: mc.SizeBytes,
 			EncodedSize: encodedSize,
+			Discarded:   discarded,
 			Err:         err,
 		}
 	}
 }
+
+// A dry run of EncodeVideos with the profile, the decision and estimated size for every video.
+// An empty containerID plans the whole library.
+func PlanEncodeVideos(cm ContentManager, profile *config.EncodingProfile, containerID string) (*utils.EncodePlan, error) {
+	cnts := &models.Containers{}
+	if containerID != "" {
+		id, err := strconv.ParseInt(containerID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cnt, err := cm.GetContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		*cnts = append(*cnts, *cnt)
+	} else {
+		all, _, err := cm.ListContainers(ContainerQuery{PerPage: 9001})
+		if err != nil {
+			return nil, err
+		}
+		cnts = all
+	}
+
+	plan := utils.NewEncodePlan(profile)
+	for _, cnt := range *cnts {
+		contents, _, err := cm.ListContent(ContentQuery{ContainerID: strconv.FormatInt(cnt.ID, 10), PerPage: 90000})
+		if err != nil {
+			return nil, err
+		}
+		for _, mc := range *contents {
+			if !mc.IsVideo() {
+				continue
+			}
+			srcFile, pathErr := utils.GetFilePathInContainer(mc.Src, cnt.GetFqPath())
+			entry := utils.EncodePlanEntry{File: srcFile, Decision: utils.EncodePlanError}
+			if pathErr != nil {
+				entry.Reason = pathErr.Error()
+			} else {
+				dstFile := utils.GetProfileConversionName(srcFile, profile)
+				entry = utils.PlanVideoEncode(srcFile, dstFile, profile, DiscardedEncodeReason(&mc, profile))
+			}
+			entry.ContentID = mc.ID
+			entry.ContainerID = cnt.ID
+			plan.Add(entry)
+		}
+	}
+	return plan, nil
+}
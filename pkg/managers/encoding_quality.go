@@ -0,0 +1,86 @@
+package managers
+
+/**
+ * The optional quality gate after an encode (QUALITY_METRIC).  An encode scoring under the
+ * threshold is removed (or kept but flagged with QUALITY_REJECT_ACTION=flag) and the task errors
+ * with the score, a flagged encode is never treated as the keeper when removing duplicates.
+ */
+import (
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var ErrQualityRejected = errors.New("encode rejected by the quality check")
+
+// Score the encode against the source, nil when the quality check is turned off
+func CheckEncodeQuality(ctx context.Context, man ContentManager, source *models.Content, dstFile string) (*models.VideoQuality, error) {
+	cfg := man.GetCfg()
+	if cfg.QualityMetric == "" {
+		return nil, nil
+	}
+	content, cnt, err := GetContentAndContainer(man, source.ID)
+	if err != nil {
+		return nil, err
+	}
+	srcFile := filepath.Join(cnt.GetFqPath(), content.Src)
+	return utils.CompareVideoQuality(ctx, cfg, srcFile, dstFile)
+}
+
+// Store the score on the encoded content
+func RecordEncodeQuality(man ContentManager, encoded *models.Content, quality *models.VideoQuality) (*models.Content, error) {
+	if quality == nil {
+		return encoded, nil
+	}
+	encoded.QualityMetric = quality.Metric
+	encoded.QualityScore = quality.Score
+	encoded.QualityRejected = !quality.Passed
+	if err := man.UpdateContent(encoded); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// Delete or flag an encode that failed the quality check then error the task with the score.  A
+// retry would produce the same encode so the task does not go back through the retry policy.
+func RejectEncode(man ContentManager, task *models.TaskRequest, source *models.Content, dstFile string, quality *models.VideoQuality) error {
+	encoded, msg := RejectEncodeOutput(man, source, dstFile, quality)
+	result := models.EncodingTaskResult{SourceID: source.ID, SourceBytes: source.SizeBytes, Encoded: true, Quality: quality}
+	if encoded != nil {
+		task.CreatedID = &encoded.ID
+		result = GetEncodingResult(source, encoded, dstFile, true)
+		result.Quality = quality
+	}
+	task.SetResult(result)
+	ErrorTask(man, task, msg)
+	return fmt.Errorf("%w: %s", ErrQualityRejected, msg)
+}
+
+// Remove the failing encode, or keep it as flagged content with QUALITY_REJECT_ACTION=flag, shared
+// by the task and EncodeVideos.  Returns the flagged content (if any) and why it was rejected.
+func RejectEncodeOutput(man ContentManager, source *models.Content, dstFile string, quality *models.VideoQuality) (*models.Content, string) {
+	msg := fmt.Sprintf(
+		"Encode %s scored %s %.4f under the minimum %.4f",
+		filepath.Base(dstFile), quality.Metric, quality.Score, quality.Threshold,
+	)
+	if man.GetCfg().QualityRejectAction == "flag" {
+		encoded, err := CreateContentAfterEncoding(man, source, dstFile)
+		if err == nil {
+			encoded, err = RecordEncodeQuality(man, encoded, quality)
+		}
+		if err != nil {
+			log.Printf("Could not flag the rejected encode %s %s", dstFile, err)
+			return nil, msg
+		}
+		return encoded, fmt.Sprintf("%s, flagged as content %d", msg, encoded.ID)
+	}
+	if err := os.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove the rejected encode %s %s", dstFile, err)
+	}
+	return nil, fmt.Sprintf("%s, removed the encode", msg)
+}
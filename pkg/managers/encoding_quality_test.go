@@ -0,0 +1,91 @@
+package managers
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectEncodeMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateRejectEncode(t, man)
+}
+
+func TestRejectEncodeDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateRejectEncode(t, man)
+}
+
+func ValidateRejectEncode(t *testing.T, man ContentManager) {
+	cfg := man.GetCfg()
+	defer func() { cfg.QualityRejectAction = config.DefaultQualityRejectAction }()
+
+	cnt := &models.Container{Name: "quality_check"}
+	fqPath, err := test_common.CreateContainerPath(cnt)
+	assert.NoError(t, err)
+	defer os.RemoveAll(fqPath)
+	assert.NoError(t, man.CreateContainer(cnt))
+	assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), "test_0.mp4"), []byte("source"), 0644))
+	source := models.Content{Src: "test_0.mp4", ContentType: "video/mp4", ContainerID: &cnt.ID}
+	assert.NoError(t, man.CreateContent(&source))
+
+	quality, err := CheckEncodeQuality(test_common.GetContext(), man, &source, "missing.mp4")
+	assert.NoError(t, err)
+	assert.Nil(t, quality, "No metric configured means no quality check")
+
+	worse := &models.VideoQuality{Metric: "ssim", Score: 0.81, Threshold: 0.95, Passed: false}
+	dstFile := filepath.Join(cnt.GetFqPath(), "test_0_h265.mp4")
+
+	// Rejected encodes are deleted by default and the task errors without a retry
+	cfg.QualityRejectAction = "delete"
+	assert.NoError(t, os.WriteFile(dstFile, []byte("worse encode"), 0644))
+	task, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &source.ID})
+	assert.NoError(t, err)
+	err = RejectEncode(man, task, &source, dstFile, worse)
+	assert.ErrorIs(t, err, ErrQualityRejected)
+	_, statErr := os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(statErr), "The rejected encode is removed")
+
+	failed, err := man.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.ERROR, failed.Status)
+	assert.Contains(t, failed.ErrMsg, "0.8100")
+	result := models.EncodingTaskResult{}
+	assert.NoError(t, failed.Result.Decode(&result))
+	assert.Equal(t, worse.Score, result.Quality.Score, "The score is kept in the result")
+
+	// EncodeVideos rejects the same way without a task
+	assert.NoError(t, os.WriteFile(dstFile, []byte("worse encode"), 0644))
+	kept, msg := RejectEncodeOutput(man, &source, dstFile, worse)
+	assert.Nil(t, kept)
+	assert.Contains(t, msg, "removed the encode")
+	_, statErr = os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(statErr), "The rejected encode is removed without a task")
+
+	// Flagging keeps the encode as content marked as rejected
+	cfg.QualityRejectAction = "flag"
+	assert.NoError(t, os.WriteFile(dstFile, []byte("worse encode"), 0644))
+	task, err = man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &source.ID, Codec: "libx264"})
+	assert.NoError(t, err)
+	err = RejectEncode(man, task, &source, dstFile, worse)
+	assert.ErrorIs(t, err, ErrQualityRejected)
+
+	flagged, err := man.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.ERROR, flagged.Status)
+	assert.NotNil(t, flagged.CreatedID)
+	if flagged.CreatedID != nil {
+		encoded, err := man.GetContent(*flagged.CreatedID)
+		assert.NoError(t, err)
+		assert.True(t, encoded.QualityRejected)
+		assert.Equal(t, "ssim", encoded.QualityMetric)
+		assert.Equal(t, worse.Score, encoded.QualityScore)
+	}
+}
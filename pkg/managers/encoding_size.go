@@ -0,0 +1,121 @@
+package managers
+
+/**
+ * An encode has to make the file smaller (by ENCODING_MIN_SAVINGS percent) or it is deleted and the
+ * task finishes without creating content, leaving the source as it was.  The result records the
+ * bytes saved (negative when the encode came out larger) so it is clear why nothing was kept.
+ * The source remembers the discard so the nightly encode and the plan do not try it again.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// The size of the source file and how many bytes the encode saves over it
+func GetEncodeSavings(man ContentManager, source *models.Content, dstFile string) (int64, int64, error) {
+	content, cnt, err := GetContentAndContainer(man, source.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	srcStat, err := os.Stat(filepath.Join(cnt.GetFqPath(), content.Src))
+	if err != nil {
+		return 0, 0, err
+	}
+	dstStat, err := os.Stat(dstFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	return srcStat.Size(), srcStat.Size() - dstStat.Size(), nil
+}
+
+// Is the encode enough smaller than the source to be worth keeping
+func EnoughSavings(cfg *config.DirConfigEntry, srcBytes int64, saved int64) bool {
+	minSaved := float64(srcBytes) * cfg.EncodingMinSavings / 100.0
+	return saved > 0 && float64(saved) >= minSaved
+}
+
+// Delete an encode that did not save enough space and finish the task with the reason
+func DiscardEncode(man ContentManager, task *models.TaskRequest, source *models.Content, dstFile string, srcBytes int64, saved int64) (*models.TaskRequest, error) {
+	profile, err := TaskEncodingProfile(man.GetCfg(), task)
+	if err != nil {
+		log.Printf("Could not determine the profile of the discarded encode on task %d %s", task.ID, err)
+	}
+	reason := DiscardEncodeOutput(man, source, profile, dstFile, srcBytes, saved)
+	task.SetResult(models.EncodingTaskResult{
+		SourceID:    source.ID,
+		SourceBytes: srcBytes,
+		SizeBytes:   srcBytes - saved,
+		Encoded:     true,
+		Discarded:   true,
+		BytesSaved:  saved,
+		Reason:      reason,
+	})
+	return ChangeTaskState(man, task, models.TaskStatus.DONE, reason)
+}
+
+// Delete the encode and remember the profile on the source, shared by the task and EncodeVideos.
+// Returns the reason the encode was removed.
+func DiscardEncodeOutput(man ContentManager, source *models.Content, profile *config.EncodingProfile, dstFile string, srcBytes int64, saved int64) string {
+	utils.RemovePartialOutput(dstFile)
+	percent := 0.0
+	if srcBytes > 0 {
+		percent = float64(saved) * 100.0 / float64(srcBytes)
+	}
+	reason := fmt.Sprintf(
+		"Encode %s saved %d bytes (%.1f%%) under ENCODING_MIN_SAVINGS %.1f%%, removed the encode",
+		filepath.Base(dstFile), saved, percent, man.GetCfg().EncodingMinSavings,
+	)
+	if profile != nil {
+		if err := RecordEncodeDiscarded(man, source, profile); err != nil {
+			log.Printf("Could not record the discarded encode on content %d %s", source.ID, err)
+		}
+	}
+	return reason
+}
+
+// Mark the source so the same encode is not run again, earlier discards with other profiles are kept
+func RecordEncodeDiscarded(man ContentManager, source *models.Content, profile *config.EncodingProfile) error {
+	content, err := man.GetContent(source.ID)
+	if err != nil {
+		return err
+	}
+	content.EncodeDiscards = content.EncodeDiscards.Add(models.EncodeDiscardKey(profile.Name, profile.Codec))
+	if err := man.UpdateContent(content); err != nil {
+		return err
+	}
+	source.EncodeDiscards = content.EncodeDiscards
+	return nil
+}
+
+// Why the content should not be encoded with the profile, empty if an earlier encode was not discarded
+func DiscardedEncodeReason(content *models.Content, profile *config.EncodingProfile) string {
+	if !content.EncodeWasDiscarded(profile.Name, profile.Codec) {
+		return ""
+	}
+	return fmt.Sprintf(
+		"%s was already encoded with profile %s (%s) and did not save ENCODING_MIN_SAVINGS %.1f%%",
+		content.Src, profile.Name, profile.Codec, config.GetCfg().EncodingMinSavings,
+	)
+}
+
+// Finish a task where nothing was encoded (already in the codec, low bitrate etc) and there is no
+// earlier encode to use instead.
+func SkipEncode(man ContentManager, task *models.TaskRequest, source *models.Content, reason string) (*models.TaskRequest, error) {
+	task.SetResult(models.EncodingTaskResult{
+		SourceID:    source.ID,
+		SourceBytes: source.SizeBytes,
+		Reason:      reason,
+	})
+	return ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Skipped video encoding %s", reason))
+}
+
+// A skipped encode can still have an earlier encode of the source on disk
+func encodeExists(dstFile string) bool {
+	_, err := os.Stat(dstFile)
+	return err == nil
+}
@@ -0,0 +1,119 @@
+package managers
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"contented/pkg/utils"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscardEncodeMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateDiscardEncode(t, man)
+}
+
+func TestDiscardEncodeDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateDiscardEncode(t, man)
+}
+
+func ValidateDiscardEncode(t *testing.T, man ContentManager) {
+	cfg := man.GetCfg()
+	defer func() { cfg.EncodingMinSavings = config.DefaultEncodingMinSavings }()
+	cfg.EncodingMinSavings = 5
+
+	cnt := &models.Container{Name: "size_check"}
+	fqPath, err := test_common.CreateContainerPath(cnt)
+	assert.NoError(t, err)
+	defer os.RemoveAll(fqPath)
+	assert.NoError(t, man.CreateContainer(cnt))
+	assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), "test_0.mp4"), []byte(strings.Repeat("s", 1000)), 0644))
+	source := models.Content{Src: "test_0.mp4", ContentType: "video/mp4", ContainerID: &cnt.ID}
+	assert.NoError(t, man.CreateContent(&source))
+	dstFile := filepath.Join(cnt.GetFqPath(), "test_0_h265.mp4")
+
+	// Only a few bytes smaller is under the 5% margin
+	assert.NoError(t, os.WriteFile(dstFile, []byte(strings.Repeat("e", 980)), 0644))
+	srcBytes, saved, err := GetEncodeSavings(man, &source, dstFile)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), srcBytes)
+	assert.Equal(t, int64(20), saved)
+	assert.False(t, EnoughSavings(cfg, srcBytes, saved))
+	assert.True(t, EnoughSavings(cfg, srcBytes, 50))
+	assert.False(t, EnoughSavings(cfg, srcBytes, -200), "A larger encode is never kept")
+
+	// A larger encode is removed and the task is done with the bytes lost
+	assert.NoError(t, os.WriteFile(dstFile, []byte(strings.Repeat("e", 1200)), 0644))
+	srcBytes, saved, err = GetEncodeSavings(man, &source, dstFile)
+	assert.NoError(t, err)
+	task, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &source.ID})
+	assert.NoError(t, err)
+	_, err = DiscardEncode(man, task, &source, dstFile, srcBytes, saved)
+	assert.NoError(t, err)
+	_, statErr := os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(statErr), "The larger encode is removed")
+
+	done, err := man.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.DONE, done.Status)
+	assert.Nil(t, done.CreatedID, "No content is created for a discarded encode")
+	result := models.EncodingTaskResult{}
+	assert.NoError(t, done.Result.Decode(&result))
+	assert.True(t, result.Discarded)
+	assert.Equal(t, int64(-200), result.BytesSaved)
+	assert.Equal(t, int64(1200), result.SizeBytes)
+	assert.Contains(t, result.Reason, "ENCODING_MIN_SAVINGS")
+
+	// The source remembers the discard so it is not encoded the same way every night
+	discarded, err := man.GetContent(source.ID)
+	assert.NoError(t, err)
+	profile := utils.DefaultEncodingProfile(cfg)
+	assert.True(t, discarded.EncodeWasDiscarded(profile.Name, profile.Codec))
+	assert.Contains(t, DiscardedEncodeReason(discarded, &profile), "ENCODING_MIN_SAVINGS")
+	otherCodec := profile
+	otherCodec.Codec = "libsvtav1"
+	assert.Equal(t, "", DiscardedEncodeReason(discarded, &otherCodec), "Another codec can still be tried")
+
+	// Discarding the other codec as well does not forget the first one (EncodeVideos has no task)
+	assert.NoError(t, os.WriteFile(dstFile, []byte(strings.Repeat("e", 1100)), 0644))
+	reason := DiscardEncodeOutput(man, discarded, &otherCodec, dstFile, 1000, -100)
+	assert.Contains(t, reason, "ENCODING_MIN_SAVINGS")
+	_, statErr = os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(statErr), "The encode without a task is removed too")
+	discarded, err = man.GetContent(source.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(discarded.EncodeDiscards))
+	assert.True(t, discarded.EncodeWasDiscarded(profile.Name, profile.Codec), "The first discard is kept")
+	assert.True(t, discarded.EncodeWasDiscarded(otherCodec.Name, otherCodec.Codec))
+
+	msg, encodeErr, shouldEncode, _ := EncodeVideoContent(context.Background(), man, discarded, &profile, nil)
+	assert.NoError(t, encodeErr)
+	assert.False(t, shouldEncode, msg)
+	nightly := config.TaskSchedule{Name: "nightly", Operation: "video_encoding", ContainerIDs: []int64{cnt.ID}}
+	scheduled, err := ScheduledTasks(man, nightly)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(scheduled), "The nightly encode skips the discarded source")
+
+	// Skipping records why nothing was encoded
+	task, err = man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &source.ID})
+	assert.NoError(t, err)
+	_, err = SkipEncode(man, task, &source, "bitrate is already under ENCODING_MIN_BITRATE")
+	assert.NoError(t, err)
+	skipped, err := man.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.DONE, skipped.Status)
+	result = models.EncodingTaskResult{}
+	assert.NoError(t, skipped.Result.Decode(&result))
+	assert.False(t, result.Encoded)
+	assert.False(t, result.Discarded)
+	assert.Contains(t, result.Reason, "ENCODING_MIN_BITRATE")
+}
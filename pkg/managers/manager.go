@@ -13,6 +13,7 @@ import (
 	"contented/pkg/config"
 	"contented/pkg/models"
 	"contented/pkg/utils"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,8 +22,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/exp/maps"
@@ -38,10 +41,16 @@ type TaskQuery struct {
 	PerPage     int    `json:"per_page" default:"100"`
 	ContentID   string `json:"content_id" default:""`
 	ContainerID string `json:"container_id" default:""`
-	Order       string `json:"order" default:"created_at"`
-	Status      string `json:"status" default:""`
-	Direction   string `json:"direction" default:"desc"`
-	Search      string `json:"search" default:""`
+	PipelineID  string `json:"pipeline_id" default:""`
+	Schedule    string `json:"schedule" default:""`
+	Operation   string `json:"operation" default:""`
+
+	IdempotencyKey string `json:"idempotency_key" default:""`
+	Order          string `json:"order" default:"created_at"`
+	Status         string `json:"status" default:""`
+	Direction      string `json:"direction" default:"desc"`
+	Search         string `json:"search" default:""`
+	Result         string `json:"result" default:""` // JSON the result must contain ({"encoded": true})
 }
 
 func (t TaskQuery) String() string {
@@ -49,6 +58,17 @@ func (t TaskQuery) String() string {
 	return string(jt)
 }
 
+// The result filter has to be valid JSON before it is handed to the DB
+func (t TaskQuery) ResultFilter() (models.TaskResult, error) {
+	if t.Result == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(t.Result)) {
+		return nil, fmt.Errorf("the result filter is not valid json %s", t.Result)
+	}
+	return models.TaskResult(t.Result), nil
+}
+
 type ScreensQuery struct {
 	Text      string `json:"text" default:""`
 	Page      int    `json:"page" default:"1"`
@@ -167,7 +187,12 @@ type ContentManager interface {
 	// For processing encoding requests
 	CreateTask(task *models.TaskRequest) (*models.TaskRequest, error)
 	UpdateTask(task *models.TaskRequest, currentStatus models.TaskStatusType) (*models.TaskRequest, error)
-	NextTask() (*models.TaskRequest, error) // Assigns it (not really required yet)
+	NextTask(operations ...models.TaskOperationType) (*models.TaskRequest, error) // Claims a new task (optionally by operation)
+	RecordTaskHeartbeat(id int64, heartbeat time.Time) error                      // Only touches heartbeat_at of an in progress task
+	ClaimScheduleRun(name string, slot time.Time) (bool, error)                   // True for the one process that gets to run the slot
+	GetScheduleRun(name string) (*models.ScheduleRun, error)                      // An empty run if the schedule has no state yet
+	SetSchedulePaused(name string, paused bool) error                             // Survives a restart and is seen by every server
+	RecordScheduleResult(name string, ranAt time.Time, queued int, errMsg string) error
 
 	// For the API exposed
 	ListTasksContext() (*models.TaskRequests, int64, error)
@@ -410,7 +435,7 @@ func GetContentAndContainer(cm ContentManager, contentID int64) (*models.Content
 	return content, cnt, nil
 }
 
-func CreateScreensForContent(cm ContentManager, contentID int64, count int, offset int) ([]string, string, error) {
+func CreateScreensForContent(ctx context.Context, cm ContentManager, contentID int64, count int, offset int, onProgress utils.ProgressCallback) (models.Screens, string, error) {
 	// It would be good to have the screens element take a few more params and have a wrapper on the
 	// Content manager level.
 	content, cnt, err := GetContentAndContainer(cm, contentID)
@@ -424,8 +449,16 @@ func CreateScreensForContent(cm ContentManager, contentID int64, count int, offs
 
 	log.Printf("Src file %s and Destination %s", srcFile, dstFile)
 	utils.MakePreviewPath(dstPath)
-	screens, ptrn, err := utils.CreateSeekScreens(srcFile, dstFile, count, offset)
+	screens, ptrn, err := utils.CreateSeekScreens(ctx, srcFile, dstFile, count, offset, onProgress)
+	if ctx.Err() != nil {
+		// Do not keep around a partial set of screens for a canceled task
+		for _, sFile := range screens {
+			utils.RemovePartialOutput(sFile)
+		}
+		return nil, ptrn, ctx.Err()
+	}
 
+	created := models.Screens{}
 	for idx, sFile := range screens {
 		src := strings.ReplaceAll(sFile, dstPath, "")
 		s := models.Screen{
@@ -439,25 +472,131 @@ func CreateScreensForContent(cm ContentManager, contentID int64, count int, offs
 		if sErr != nil {
 			log.Printf("Failed to create a screen %s", sErr)
 		} else {
-			log.Printf("Screen not actually in the DB? %s", s)
+			created = append(created, s)
 		}
 	}
-	return screens, ptrn, err
+	return created, ptrn, err
 }
 
 // Should get a bunch of crap here (TODO: Error should always come last)
-func EncodeVideoContent(man ContentManager, content *models.Content, codec string) (string, error, bool, string) {
+func EncodeVideoContent(ctx context.Context, man ContentManager, content *models.Content, profile *config.EncodingProfile, onProgress utils.ProgressCallback) (string, error, bool, string) {
 	content, cnt, err := GetContentAndContainer(man, content.ID)
 	if err != nil {
 		return "No content to encode", err, false, ""
 	}
 	path := cnt.GetFqPath()
 	srcFile := filepath.Join(path, content.Src)
-	dstFile := utils.GetVideoConversionName(srcFile)
-	msg, eErr, shouldEncode := utils.ConvertVideoToH265(srcFile, dstFile)
+	dstFile := utils.GetProfileConversionName(srcFile, profile)
+	if reason := DiscardedEncodeReason(content, profile); reason != "" {
+		return reason, nil, false, dstFile
+	}
+	msg, eErr, shouldEncode := utils.ConvertVideo(ctx, srcFile, dstFile, profile, onProgress)
 	return msg, eErr, shouldEncode, dstFile
 }
 
+// Write the HLS package for the content to the container stream directory
+func PackageHlsContent(ctx context.Context, man ContentManager, content *models.Content, onProgress utils.ProgressCallback) ([]utils.HlsRendition, error) {
+	content, cnt, err := GetContentAndContainer(man, content.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !content.IsVideo() {
+		return nil, fmt.Errorf("content %s was not a video %s", content.Src, content.ContentType)
+	}
+	srcFile := filepath.Join(cnt.GetFqPath(), content.Src)
+	return utils.CreateHlsStream(ctx, man.GetCfg(), srcFile, utils.GetContentStreamDst(cnt, content.ID), onProgress)
+}
+
+// Where a file in the HLS package for the content is served from
+func StreamUrl(contentID int64, name string) string {
+	return fmt.Sprintf("/api/stream/%d/%s", contentID, name)
+}
+
+// Like FindActualFile but for a playlist or segment in the HLS package of the content
+func FindStreamFile(man ContentManager, mc *models.Content, name string) (string, error) {
+	if mc.ContainerID == nil {
+		return "", fmt.Errorf("content %d has no container", mc.ID)
+	}
+	cnt, err := man.GetContainer(*mc.ContainerID)
+	if err != nil {
+		return "", err
+	}
+	return utils.GetStreamFilePath(cnt, mc.ID, name)
+}
+
+// Extract the text subtitle streams of the video to WebVTT, the previously extracted tracks are
+// replaced and the sidecar tracks kept.  Returns the updated content and the streams skipped.
+func ExtractContentSubtitles(ctx context.Context, man ContentManager, content *models.Content) (*models.Content, []utils.SubtitleStream, error) {
+	content, cnt, err := GetContentAndContainer(man, content.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !content.IsVideo() {
+		return nil, nil, fmt.Errorf("content %s was not a video %s", content.Src, content.ContentType)
+	}
+	sidecars := models.SubtitleTracks{}
+	for _, track := range content.Subtitles {
+		if !track.Extracted {
+			sidecars = append(sidecars, track)
+		}
+	}
+	srcFile := filepath.Join(cnt.GetFqPath(), content.Src)
+	extracted, skipped, err := utils.ExtractSubtitles(ctx, srcFile, utils.GetContentSubtitleDst(cnt, content.ID), sidecars)
+	if err != nil {
+		return nil, nil, err
+	}
+	content.Subtitles = append(sidecars, extracted...)
+	if len(content.Subtitles) == 0 {
+		content.Subtitles = nil
+	}
+	if err := man.UpdateContent(content); err != nil {
+		return nil, nil, err
+	}
+	return content, skipped, nil
+}
+
+// Like FindActualFile but for a subtitle track of the content
+func FindSubtitleFile(man ContentManager, mc *models.Content, lang string) (*models.SubtitleTrack, string, error) {
+	track := mc.Subtitles.Find(lang)
+	if track == nil {
+		return nil, "", fmt.Errorf("content %d has no %s subtitles", mc.ID, lang)
+	}
+	if mc.ContainerID == nil {
+		return nil, "", fmt.Errorf("content %d has no container", mc.ID)
+	}
+	cnt, err := man.GetContainer(*mc.ContainerID)
+	if err != nil {
+		return nil, "", err
+	}
+	fqPath, err := utils.GetSubtitleFilePath(cnt, mc.ID, track)
+	return track, fqPath, err
+}
+
+// The profile an encoding task runs with, a codec or max width / height on the task override it
+func TaskEncodingProfile(cfg *config.DirConfigEntry, task *models.TaskRequest) (*config.EncodingProfile, error) {
+	profile, err := utils.GetEncodingProfile(cfg, task.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if task.Codec != "" && task.Codec != profile.Codec {
+		profile.Codec = task.Codec
+		profile.CodecName = utils.EncoderCodecName(task.Codec) // Empty is unknown until the output is probed
+		if encoder := utils.GetVideoEncoder(task.Codec); encoder != nil && !slices.Contains(encoder.Containers, profile.Container) {
+			profile.Container = encoder.Containers[0]
+		}
+	}
+	if task.Width > 0 {
+		profile.MaxWidth = task.Width
+	}
+	if task.Height > 0 {
+		profile.MaxHeight = task.Height
+	}
+	if err := utils.ValidateEncodingProfile(*profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
 /**
  * Do it ugly.  TODO: Make it less ugly.
  */
@@ -487,7 +626,7 @@ func AssignTagsAndUpdate(man ContentManager, tags models.Tags) error {
 			log.Printf("Failed to page over content %s", pageErr)
 			return pageErr
 		}
-		tagErr := AssignTagsToContents(man, contents, &tags)
+		_, tagErr := AssignTagsToContents(man, contents, &tags)
 		if tagErr != nil {
 			return tagErr
 		}
@@ -498,14 +637,15 @@ func AssignTagsAndUpdate(man ContentManager, tags models.Tags) error {
 /**
  * Used to assign a bunch of tags and then do an update to that content.
  */
-func AssignTagsToContents(man ContentManager, contents *models.Contents, tags *models.Tags) error {
+// Returns the contents that matched a tag (and were saved) with the tags they were given
+func AssignTagsToContents(man ContentManager, contents *models.Contents, tags *models.Tags) (models.Contents, error) {
 	if contents == nil || len(*contents) == 0 {
 		log.Printf("No content to tag")
-		return nil
+		return models.Contents{}, nil
 	}
 	if tags == nil || len(*tags) == 0 {
 		log.Printf("No tags to match against")
-		return nil
+		return models.Contents{}, nil
 	}
 
 	tagMap := models.TagsMap{}
@@ -522,13 +662,13 @@ func AssignTagsToContents(man ContentManager, contents *models.Contents, tags *m
 	updatedContent := maps.Values(updatedMap)
 	upErr := man.UpdateContents(updatedContent)
 	if upErr != nil {
-		return upErr
+		return nil, upErr
 	}
-	return nil
+	return updatedContent, nil
 }
 
 // HMMMM, should this be smarter?
-func WebpFromContent(man ContentManager, content *models.Content) (string, error) {
+func WebpFromContent(ctx context.Context, man ContentManager, content *models.Content) (string, error) {
 	sr := ScreensQuery{ContentID: strconv.FormatInt(content.ID, 10)}
 	screens, count, err := man.ListScreens(sr)
 	if err != nil {
@@ -550,7 +690,7 @@ func WebpFromContent(man ContentManager, content *models.Content) (string, error
 	dstFile := utils.GetPreviewPathDestination(content.Src, dstPath, "video")
 	globMatch := utils.GetScreensOutputGlob(dstFile)
 
-	webp, err := utils.CreateWebpFromScreens(globMatch, dstFile)
+	webp, err := utils.CreateWebpFromScreens(ctx, globMatch, dstFile)
 	if err != nil {
 		return webp, err
 	}
@@ -579,14 +719,22 @@ func CreateContentAfterEncoding(man ContentManager, originalContent *models.Cont
 			return nil, err
 		}
 		if contents != nil && len(*contents) == 1 {
-			cnts := *contents
-			return &cnts[0], nil
+			// Loaded again so the existing tags are kept when the original tags are added
+			existing, err := man.GetContent((*contents)[0].ID)
+			if err != nil {
+				return nil, err
+			}
+			if CarryOverContentInfo(originalContent, existing) {
+				if err := man.UpdateContent(existing); err != nil {
+					return nil, err
+				}
+			}
+			return existing, nil
 		}
 
 		newId := utils.AssignNumerical(0, "contents")
 		newContent := utils.GetContent(newId, f, path)
-		newContent.Description = originalContent.Description
-		newContent.Tags = originalContent.Tags
+		CarryOverContentInfo(originalContent, &newContent)
 		newContent.ContainerID = originalContent.ContainerID
 		createErr := man.CreateContent(&newContent)
 		if createErr != nil {
@@ -599,6 +747,24 @@ func CreateContentAfterEncoding(man ContentManager, originalContent *models.Cont
 	return nil, fmt.Errorf("%s file did not exist", newFile)
 }
 
+// Copy the description and tags of the original onto the encode, an existing description is not
+// replaced.  Returns true if the encoded content changed.
+func CarryOverContentInfo(original *models.Content, encoded *models.Content) bool {
+	changed := false
+	if encoded.Description == "" && original.Description != "" {
+		encoded.Description = original.Description
+		changed = true
+	}
+	for _, tag := range original.Tags {
+		hasTag := slices.ContainsFunc(encoded.Tags, func(t models.Tag) bool { return t.ID == tag.ID })
+		if !hasTag {
+			encoded.Tags = append(encoded.Tags, tag)
+			changed = true
+		}
+	}
+	return changed
+}
+
 /**
  * Remove the screens for a content element and also remove the files from disk.
  * Should this be "best effort" and still at least try and remove the screens even if the disk removes fail?
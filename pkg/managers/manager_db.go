@@ -13,8 +13,12 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // DB version of content management
@@ -687,11 +691,23 @@ func (cm ContentManagerDB) CreateTask(t *models.TaskRequest) (*models.TaskReques
 		return nil, errors.New("cannot create without a valid task")
 	}
 	tx := cm.GetConnection()
-	t.Status = models.TaskStatus.NEW // The defaults do not seem to work right...
+	// The defaults do not seem to work right, pipeline steps are created waiting on their parent
+	if t.Status != models.TaskStatus.WAITING {
+		t.Status = models.TaskStatus.NEW
+	}
 	res := tx.Create(t)
 	if res.Error != nil {
+		// 23505 is a unique_violation
+		var pgErr *pgconn.PgError
+		if errors.As(res.Error, &pgErr) && pgErr.Code == "23505" &&
+			(pgErr.ConstraintName == models.TaskInFlightWorkIndex || pgErr.ConstraintName == models.TaskInFlightKeyIndex) {
+			return nil, fmt.Errorf("%w (%s)", ErrTaskInFlight, pgErr.ConstraintName)
+		}
 		return nil, res.Error
 	}
+	if t.Status == models.TaskStatus.NEW {
+		cm.NotifyTaskAvailable(t)
+	}
 	return t, nil
 }
 
@@ -711,6 +727,9 @@ func (cm ContentManagerDB) UpdateTask(t *models.TaskRequest, currentState models
 		if res.Error != nil {
 			return nil, res.Error
 		}
+		if t.Status == models.TaskStatus.NEW && currentState != models.TaskStatus.NEW {
+			cm.NotifyTaskAvailable(t) // Retried or requeued
+		}
 	} else {
 		msg := fmt.Sprintf("The current DB status %s != exec status %s", checkStatus.Status, currentState)
 		log.Print(msg)
@@ -729,20 +748,102 @@ func (cm ContentManagerDB) GetTask(id int64) (*models.TaskRequest, error) {
 	return &task, res.Error
 }
 
-// Get the next task for processing (not super thread safe but enough for mem manager)
-func (cm ContentManagerDB) NextTask() (*models.TaskRequest, error) {
-	tasks := models.TaskRequests{}
+// A targeted update so a heartbeat cannot overwrite the status or progress the handler saved
+func (cm ContentManagerDB) RecordTaskHeartbeat(id int64, heartbeat time.Time) error {
+	tx := cm.GetConnection()
+	res := tx.Model(&models.TaskRequest{}).
+		Where("id = ? AND status = ?", id, models.TaskStatus.IN_PROGRESS).
+		UpdateColumn("heartbeat_at", heartbeat)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("task %d %w", id, ErrTaskNotInProgress)
+	}
+	return nil
+}
+
+// Every web server runs the scheduler, the upsert only changes the row when the slot is newer than
+// the last run so just one of them sees a row affected and queues the run.
+func (cm ContentManagerDB) ClaimScheduleRun(name string, slot time.Time) (bool, error) {
+	now := time.Now().UTC()
 	tx := cm.GetConnection()
-	res := tx.Limit(1).Where("status = ?", models.TaskStatus.NEW).Find(&tasks)
+	res := tx.Exec(`INSERT INTO schedule_runs (name, last_run, created_at, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_run = EXCLUDED.last_run, updated_at = EXCLUDED.updated_at
+		WHERE schedule_runs.last_run < EXCLUDED.last_run`, name, slot.UTC(), now, now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+func (cm ContentManagerDB) GetScheduleRun(name string) (*models.ScheduleRun, error) {
+	run := models.ScheduleRun{}
+	res := cm.GetConnection().Where("name = ?", name).Limit(1).Find(&run)
 	if res.Error != nil {
 		return nil, res.Error
 	}
-	if len(tasks) == 1 {
-		task := tasks[0]
+	if res.RowsAffected == 0 {
+		return &models.ScheduleRun{Name: name}, nil
+	}
+	return &run, nil
+}
+
+// The row may not exist until the first slot is claimed, a zero last_run still lets that claim win
+func (cm ContentManagerDB) SetSchedulePaused(name string, paused bool) error {
+	now := time.Now().UTC()
+	return cm.GetConnection().Exec(`INSERT INTO schedule_runs (name, last_run, paused, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET paused = EXCLUDED.paused, updated_at = EXCLUDED.updated_at`,
+		name, time.Time{}, paused, now, now).Error
+}
+
+func (cm ContentManagerDB) RecordScheduleResult(name string, ranAt time.Time, queued int, errMsg string) error {
+	now := time.Now().UTC()
+	return cm.GetConnection().Exec(`INSERT INTO schedule_runs (name, last_run, ran_at, last_queued, last_error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET ran_at = EXCLUDED.ran_at, last_queued = EXCLUDED.last_queued,
+		last_error = EXCLUDED.last_error, updated_at = EXCLUDED.updated_at`,
+		name, time.Time{}, ranAt.UTC(), queued, errMsg, now, now).Error
+}
+
+// Claim the next new task that is ready to run, highest priority first then oldest (priority desc,
+// id asc).  The row is locked FOR UPDATE SKIP LOCKED so several worker processes can pull from the
+// table without being handed the same task or waiting on each other's claims.
+func (cm ContentManagerDB) NextTask(operations ...models.TaskOperationType) (*models.TaskRequest, error) {
+	task := models.TaskRequest{}
+	err := cm.GetConnection().Transaction(func(tx *gorm.DB) error {
+		q := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", models.TaskStatus.NEW).
+			Where("(retry_at IS NULL OR retry_at <= ?)", time.Now().UTC())
+		if len(operations) > 0 {
+			q = q.Where("operation IN ?", operations)
+		}
+		res := q.Order("priority desc, id asc").Limit(1).Find(&task)
+		if res.Error != nil {
+			return res.Error
+		}
+		if task.ID == 0 {
+			return ErrNoTaskAvailable
+		}
+		claimed := time.Now().UTC()
 		task.Status = models.TaskStatus.PENDING
-		return cm.UpdateTask(&task, models.TaskStatus.NEW)
+		task.Message = "Claimed by a worker"
+		task.HeartbeatAt = &claimed // The claim counts as a heartbeat until the task starts
+		ClearLease(&task)           // A new task has no owner, drop anything left by an expired lease
+		return tx.Save(&task).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Wake up any worker processes listening for tasks (best effort, they also poll)
+func (cm ContentManagerDB) NotifyTaskAvailable(t *models.TaskRequest) {
+	tx := cm.GetConnection()
+	res := tx.Exec("SELECT pg_notify(?, ?)", TaskNotifyChannel, strconv.FormatInt(t.ID, 10))
+	if res.Error != nil {
+		log.Printf("Failed to notify workers of task %d %s", t.ID, res.Error)
 	}
-	return nil, errors.New("no tasks to pull off the queue")
 }
 
 func (cm ContentManagerDB) ListTasksContext() (*models.TaskRequests, int64, error) {
@@ -754,8 +855,12 @@ func (cm ContentManagerDB) ListTasksContext() (*models.TaskRequests, int64, erro
 		PerPage:     limit,
 		ContentID:   StringDefault(params.Get("content_id"), ""),
 		ContainerID: StringDefault(params.Get("container_id"), ""),
+		PipelineID:  StringDefault(params.Get("pipeline_id"), ""),
+		Schedule:    StringDefault(params.Get("schedule"), ""),
+		Operation:   StringDefault(params.Get("operation"), ""),
 		Status:      StringDefault(params.Get("status"), ""), // Check it is in the Status values?
 		Search:      StringDefault(params.Get("search"), ""),
+		Result:      StringDefault(params.Get("result"), ""),
 	}
 	return cm.ListTasks(query)
 }
@@ -773,6 +878,25 @@ func (cm ContentManagerDB) ListTasks(query TaskQuery) (*models.TaskRequests, int
 	if query.ContainerID != "" {
 		q = q.Where("container_id = ?", query.ContainerID)
 	}
+	if query.PipelineID != "" {
+		q = q.Where("pipeline_id = ?", query.PipelineID)
+	}
+	if query.Schedule != "" {
+		q = q.Where("schedule = ?", query.Schedule)
+	}
+	if query.Operation != "" {
+		q = q.Where("operation = ?", query.Operation)
+	}
+	if query.IdempotencyKey != "" {
+		q = q.Where("idempotency_key = ?", query.IdempotencyKey)
+	}
+	result, resultErr := query.ResultFilter()
+	if resultErr != nil {
+		return nil, 0, resultErr
+	}
+	if result != nil {
+		q = q.Where("result @> ?::jsonb", string(result))
+	}
 	// TODO: Add in another search for searching errors potentially
 	if query.Search != "" {
 		search := ("%" + query.Search + "%")
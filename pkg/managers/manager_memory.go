@@ -17,8 +17,14 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Guards the tasks and schedule runs in the memory store, the dispatcher, reaper, scheduler and
+// the API all use them from their own goroutines.  Tasks are handed out as copies.
+var memTaskLock sync.Mutex
+
 // Provides the support for looking up content by ID while only using memory
 type ContentManagerMemory struct {
 	cfg *config.DirConfigEntry
@@ -812,51 +818,154 @@ func (cm ContentManagerMemory) CreateTask(t *models.TaskRequest) (*models.TaskRe
 	if t == nil {
 		return nil, errors.New("requires a valid task")
 	}
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
 	mem := cm.GetStore()
+	if existing := FindInFlightConflict(mem.ValidTasks, t); existing != nil {
+		return nil, fmt.Errorf("%w as task %d", ErrTaskInFlight, existing.ID)
+	}
 	task, err := mem.CreateTask(t)
 	if err != nil {
 		return nil, err
 	}
-	return cm.GetTask(task.ID)
+	return cm.getTask(task.ID)
 }
 
 // Updates and creates will need to actually fully refresh things for background tasks to actually work
 func (cm ContentManagerMemory) UpdateTask(t *models.TaskRequest, currentState models.TaskStatusType) (*models.TaskRequest, error) {
-	// Probably does NOT properly update the memStorage
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	return cm.updateTask(t, currentState)
+}
+
+// Callers must hold memTaskLock
+func (cm ContentManagerMemory) updateTask(t *models.TaskRequest, currentState models.TaskStatusType) (*models.TaskRequest, error) {
 	mem := cm.GetStore()
 	_, err := mem.UpdateTask(t, currentState)
 	if err != nil {
 		log.Printf("Couldn't find task to update %s", err)
 		return nil, err
 	}
-	return cm.GetTask(t.ID)
+	return cm.getTask(t.ID)
 }
 
 func (cm ContentManagerMemory) GetTask(id int64) (*models.TaskRequest, error) {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	return cm.getTask(id)
+}
+
+// A copy so the caller can change it without racing other readers, callers must hold memTaskLock
+func (cm ContentManagerMemory) getTask(id int64) (*models.TaskRequest, error) {
 	mem := cm.GetStore()
-	for idx, task := range mem.ValidTasks {
+	for _, task := range mem.ValidTasks {
 		if task.ID == id {
-			return &mem.ValidTasks[idx], nil
+			return &task, nil
 		}
 	}
 	return nil, fmt.Errorf("task not found %d", id)
 }
 
-// Get the next task for processing (not super thread safe but enough for mem manager)
-// Where we will ensure only 1 reader.
-func (cm ContentManagerMemory) NextTask() (*models.TaskRequest, error) {
+func (cm ContentManagerMemory) RecordTaskHeartbeat(id int64, heartbeat time.Time) error {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
 	mem := cm.GetStore()
-	for _, task := range mem.ValidTasks {
-		if task.Status == models.TaskStatus.NEW {
-			task.Status = models.TaskStatus.PENDING
-			updated, err := cm.UpdateTask(&task, task.Status)
-			if err != nil {
-				return nil, err
-			}
-			return updated, nil
+	for idx, task := range mem.ValidTasks {
+		if task.ID == id && task.Status == models.TaskStatus.IN_PROGRESS {
+			mem.ValidTasks[idx].HeartbeatAt = &heartbeat
+			return nil
 		}
 	}
-	return nil, nil
+	return fmt.Errorf("task %d %w", id, ErrTaskNotInProgress)
+}
+
+// Memory is a single process so this only stops a slot running twice
+func (cm ContentManagerMemory) ClaimScheduleRun(name string, slot time.Time) (bool, error) {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	mem := cm.GetStore()
+	if mem.ScheduleRuns == nil {
+		mem.ScheduleRuns = map[string]models.ScheduleRun{}
+	}
+	run, ok := mem.ScheduleRuns[name]
+	if ok && !run.LastRun.Before(slot) {
+		return false, nil
+	}
+	run.Name = name
+	run.LastRun = slot
+	mem.ScheduleRuns[name] = run
+	return true, nil
+}
+
+func (cm ContentManagerMemory) GetScheduleRun(name string) (*models.ScheduleRun, error) {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	run, ok := cm.GetStore().ScheduleRuns[name]
+	if !ok {
+		return &models.ScheduleRun{Name: name}, nil
+	}
+	return &run, nil
+}
+
+// Only lasts as long as the process, there is nothing else to share it with
+func (cm ContentManagerMemory) SetSchedulePaused(name string, paused bool) error {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	mem := cm.GetStore()
+	if mem.ScheduleRuns == nil {
+		mem.ScheduleRuns = map[string]models.ScheduleRun{}
+	}
+	run := mem.ScheduleRuns[name]
+	run.Name = name
+	run.Paused = &paused
+	mem.ScheduleRuns[name] = run
+	return nil
+}
+
+func (cm ContentManagerMemory) RecordScheduleResult(name string, ranAt time.Time, queued int, errMsg string) error {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	mem := cm.GetStore()
+	if mem.ScheduleRuns == nil {
+		mem.ScheduleRuns = map[string]models.ScheduleRun{}
+	}
+	run := mem.ScheduleRuns[name]
+	run.Name = name
+	run.RanAt = &ranAt
+	run.LastQueued = queued
+	run.LastError = errMsg
+	mem.ScheduleRuns[name] = run
+	return nil
+}
+
+// Claim the highest priority new task that is ready to run, the lock makes finding and claiming
+// it one step so two workers are never handed the same task.
+func (cm ContentManagerMemory) NextTask(operations ...models.TaskOperationType) (*models.TaskRequest, error) {
+	memTaskLock.Lock()
+	defer memTaskLock.Unlock()
+	mem := cm.GetStore()
+	now := time.Now().UTC()
+	var next *models.TaskRequest
+	for idx, task := range mem.ValidTasks {
+		if task.Status != models.TaskStatus.NEW || !TaskMatchesOperations(task, operations) {
+			continue
+		}
+		if task.RetryAt != nil && task.RetryAt.After(now) {
+			continue
+		}
+		if next == nil || task.Priority > next.Priority {
+			next = &mem.ValidTasks[idx]
+		}
+	}
+	if next == nil {
+		return nil, ErrNoTaskAvailable
+	}
+	task := *next
+	task.Status = models.TaskStatus.PENDING
+	task.Message = "Claimed by a worker"
+	task.HeartbeatAt = &now // The claim counts as a heartbeat until the task starts
+	ClearLease(&task)       // A new task has no owner, drop anything left by an expired lease
+	return cm.updateTask(&task, models.TaskStatus.NEW)
 }
 
 /*
@@ -866,17 +975,23 @@ func (cm ContentManagerMemory) ListTasksContext() (*models.TaskRequests, int64,
 	params := cm.Params()
 	_, limit, page := GetPagination(params, cm.GetCfg().Limit)
 	query := TaskQuery{
-		Page:      page,
-		PerPage:   limit,
-		ContentID: StringDefault(params.Get("content_id"), ""),
-		Status:    StringDefault(params.Get("status"), ""),
+		Page:        page,
+		PerPage:     limit,
+		ContentID:   StringDefault(params.Get("content_id"), ""),
+		ContainerID: StringDefault(params.Get("container_id"), ""),
+		PipelineID:  StringDefault(params.Get("pipeline_id"), ""),
+		Schedule:    StringDefault(params.Get("schedule"), ""),
+		Operation:   StringDefault(params.Get("operation"), ""),
+		Status:      StringDefault(params.Get("status"), ""),
+		Result:      StringDefault(params.Get("result"), ""),
 	}
 	return cm.ListTasks(query)
 }
 
 func (cm ContentManagerMemory) ListTasks(query TaskQuery) (*models.TaskRequests, int64, error) {
-	mem := cm.GetStore()
-	task_arr := mem.ValidTasks
+	memTaskLock.Lock()
+	task_arr := append(models.TaskRequests{}, cm.GetStore().ValidTasks...)
+	memTaskLock.Unlock()
 	if query.ContentID != "" {
 		contentID, err := strconv.ParseInt(query.ContentID, 10, 64)
 		filtered_tasks := models.TaskRequests{}
@@ -890,6 +1005,59 @@ func (cm ContentManagerMemory) ListTasks(query TaskQuery) (*models.TaskRequests,
 		}
 		task_arr = filtered_tasks
 	}
+	if query.PipelineID != "" {
+		pipelineID, err := strconv.ParseInt(query.PipelineID, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.PipelineID != nil && *task.PipelineID == pipelineID {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
+	if query.ContainerID != "" {
+		containerID, err := strconv.ParseInt(query.ContainerID, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.ContainerID != nil && *task.ContainerID == containerID {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
+	if query.Operation != "" {
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.Operation.String() == query.Operation {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
+	if query.IdempotencyKey != "" {
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.IdempotencyKey == query.IdempotencyKey {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
+	if query.Schedule != "" {
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.Schedule == query.Schedule {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
 	if query.Status != "" {
 		filtered_tasks := models.TaskRequests{}
 		for _, task := range task_arr {
@@ -899,6 +1067,19 @@ func (cm ContentManagerMemory) ListTasks(query TaskQuery) (*models.TaskRequests,
 		}
 		task_arr = filtered_tasks
 	}
+	result, resultErr := query.ResultFilter()
+	if resultErr != nil {
+		return nil, 0, resultErr
+	}
+	if result != nil {
+		filtered_tasks := models.TaskRequests{}
+		for _, task := range task_arr {
+			if task.Result.Contains(result) {
+				filtered_tasks = append(filtered_tasks, task)
+			}
+		}
+		task_arr = filtered_tasks
+	}
 	total := len(task_arr)
 	offset, end := GetOffsetEnd(query.Page, query.PerPage, total)
 	if end > 0 { // If it is empty a slice ending in 0 = boom
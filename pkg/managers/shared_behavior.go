@@ -232,10 +232,12 @@ func FindDuplicateContents(cm ContentManager, cnt *models.Container, cs ContentQ
 		return DuplicateContents{}, errors
 	}
 
-	// We are only going to look for dupes in the same folder initially
-	contentNames := models.ContentMapBySrc{}
+	// We are only going to look for dupes in the same folder initially, an encode can change the
+	// extension (show.avi => show_h265.mp4, show_av1.webm) so originals are found by name without it
+	contentNames := map[string]models.Contents{}
 	for _, content := range *contents {
-		contentNames[content.Src] = content
+		stem := strings.TrimSuffix(content.Src, filepath.Ext(content.Src))
+		contentNames[stem] = append(contentNames[stem], content)
 	}
 
 	// Initially we are only going to look for encoding dupes that are video
@@ -244,41 +246,48 @@ func FindDuplicateContents(cm ContentManager, cnt *models.Container, cs ContentQ
 	// TODO: If I can trust the content.Encoding is always already set I could update to query on that
 	// field in addition to the contentType but that is really only useful if I expend the video dupe
 	// check to be a more complicated image hash & time lookup.
-	log.Printf("Finding video already in %s so we can remove their dupes", cfg.EncodingFilenameModifier)
+	log.Printf("Finding video already encoded by a profile (%s) so we can remove their dupes", cfg.EncodingFilenameModifier)
 
 	duplicates := DuplicateContents{}
 	for _, content := range *contents {
-		if content.Encoding == cfg.CodecForConversionName {
-			originalName := strings.Replace(content.Src, cfg.EncodingFilenameModifier, "", 1)
-			if originalName == content.Src {
+		if content.QualityRejected {
+			continue // Never keep an encode that failed the quality check over the original
+		}
+		profile, originalStem := utils.EncodedByProfile(cfg, content.Src, content.Encoding)
+		if profile == nil {
+			continue
+		}
+		originals, ok := contentNames[originalStem]
+		if !ok {
+			log.Printf("No dupe with this name found %s", originalStem)
+			continue
+		}
+		for _, mContent := range originals {
+			if mContent.ID == content.ID || !mContent.IsVideo() {
 				continue
 			}
-			if mContent, ok := contentNames[originalName]; ok {
-				log.Printf("Found a for a dupe called %s", originalName)
-				encodedPath := filepath.Join(cntPath, content.Src)
-				dupePath := filepath.Join(cntPath, mContent.Src)
-
-				foundDupe, checkErr := utils.IsDuplicateVideo(encodedPath, dupePath)
-				if checkErr != nil {
-					// TODO: not a failure case but maybe it should be or at least measured?
-					errMsg := fmt.Sprintf("Error attempting to determine if a video was a dupe %s file %s", checkErr, originalName)
-					errors = append(errors, errMsg)
-					log.Print(errMsg)
-				} else if foundDupe {
-					log.Printf("Found a duplicate at %s", dupePath)
-					dupe := DuplicateContent{
-						KeepContentID: content.ID,
-						KeepSrc:       content.Src,
-						ContainerID:   &cnt.ID,
-						ContainerName: cnt.Name,
-						DuplicateID:   mContent.ID,
-						DuplicateSrc:  mContent.Src,
-						FqPath:        dupePath,
-					}
-					duplicates = append(duplicates, dupe)
+			log.Printf("Found a for a dupe called %s encoded by profile %s", mContent.Src, profile.Name)
+			encodedPath := filepath.Join(cntPath, content.Src)
+			dupePath := filepath.Join(cntPath, mContent.Src)
+
+			foundDupe, checkErr := utils.IsDuplicateVideo(encodedPath, dupePath)
+			if checkErr != nil {
+				// TODO: not a failure case but maybe it should be or at least measured?
+				errMsg := fmt.Sprintf("Error attempting to determine if a video was a dupe %s file %s", checkErr, mContent.Src)
+				errors = append(errors, errMsg)
+				log.Print(errMsg)
+			} else if foundDupe {
+				log.Printf("Found a duplicate at %s", dupePath)
+				dupe := DuplicateContent{
+					KeepContentID: content.ID,
+					KeepSrc:       content.Src,
+					ContainerID:   &cnt.ID,
+					ContainerName: cnt.Name,
+					DuplicateID:   mContent.ID,
+					DuplicateSrc:  mContent.Src,
+					FqPath:        dupePath,
 				}
-			} else {
-				log.Printf("No dupe with this name found %s", originalName)
+				duplicates = append(duplicates, dupe)
 			}
 		}
 	}
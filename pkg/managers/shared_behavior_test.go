@@ -571,3 +571,56 @@ func ValidateContainerDuplicateRemoval(t *testing.T, man ContentManager) {
 	defer os.RemoveAll(removeLocation)
 	defer test_common.RemoveTestContent()
 }
+
+func TestContentAfterEncodingMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateContentAfterEncoding(t, man)
+}
+
+func TestContentAfterEncodingDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateContentAfterEncoding(t, man)
+}
+
+func ValidateContentAfterEncoding(t *testing.T, man ContentManager) {
+	cnt := &models.Container{Name: "after_encoding"}
+	fqPath, err := test_common.CreateContainerPath(cnt)
+	assert.NoError(t, err)
+	defer os.RemoveAll(fqPath)
+	assert.NoError(t, man.CreateContainer(cnt))
+	assert.NoError(t, man.CreateTag(&models.Tag{ID: "carried"}))
+	assert.NoError(t, man.CreateTag(&models.Tag{ID: "added_later"}))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), "movie.avi"), []byte("source"), 0644))
+	source := models.Content{
+		Src: "movie.avi", ContentType: "video/x-msvideo", ContainerID: &cnt.ID,
+		Description: "The original", Tags: models.Tags{{ID: "carried"}},
+	}
+	assert.NoError(t, man.CreateContent(&source))
+
+	dstFile := filepath.Join(cnt.GetFqPath(), "movie_h265.mp4")
+	assert.NoError(t, os.WriteFile(dstFile, []byte("encoded"), 0644))
+	encoded, err := CreateContentAfterEncoding(man, &source, dstFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "The original", encoded.Description)
+	assert.Equal(t, 1, len(encoded.Tags))
+
+	// Encoding again finds the existing content and only adds what it is missing
+	encoded.Description = "Edited after encoding"
+	assert.NoError(t, man.UpdateContent(encoded))
+	source.Tags = append(source.Tags, models.Tag{ID: "added_later"})
+	again, err := CreateContentAfterEncoding(man, &source, dstFile)
+	assert.NoError(t, err)
+	assert.Equal(t, encoded.ID, again.ID)
+
+	reloaded, err := man.GetContent(encoded.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Edited after encoding", reloaded.Description, "An existing description is kept")
+	tagIDs := []string{}
+	for _, tag := range reloaded.Tags {
+		tagIDs = append(tagIDs, tag.ID)
+	}
+	assert.ElementsMatch(t, []string{"carried", "added_later"}, tagIDs)
+}
@@ -0,0 +1,112 @@
+package managers
+
+/**
+ * Submitting the same work twice (a double click, re-running a container encode) should not
+ * create a second task racing the first one on the same output file.  A task that is still in
+ * flight for the same operation, target and options is returned instead.  Clients can also send
+ * an idempotency key, a retry with the key gets the original task back even once it is finished.
+ */
+import (
+	"contented/pkg/models"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// How long a task can be found by its idempotency key
+const IdempotencyKeyTTL = 24 * time.Hour
+
+const MaxIdempotencyKeyLength = 255
+
+// Creating a task when the same work is already in flight, the DB enforces this with a unique index
+// so two processes cannot both create it.
+var ErrTaskInFlight = errors.New("the same work is already in flight")
+
+// A pipeline step WAITING on its parent is already queued, it counts the same as NEW
+var inFlightStatuses = models.InFlightTaskStatuses
+
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > MaxIdempotencyKeyLength {
+		return fmt.Errorf("the idempotency key is longer than %d characters", MaxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+// An existing task for the same work as tr (which has not been created yet), nil if there is none
+func FindExistingTask(man ContentManager, tr *models.TaskRequest) (*models.TaskRequest, error) {
+	if tr.IdempotencyKey != "" {
+		keyed, err := FindIdempotentTask(man, tr)
+		if err != nil || keyed != nil {
+			return keyed, err
+		}
+	}
+	return FindInFlightTask(man, tr)
+}
+
+// A task created with the same key (in any state) that does the same work
+func FindIdempotentTask(man ContentManager, tr *models.TaskRequest) (*models.TaskRequest, error) {
+	query := TaskQuery{
+		IdempotencyKey: tr.IdempotencyKey,
+		Operation:      tr.Operation.String(),
+		PerPage:        man.GetCfg().Limit,
+	}
+	tasks, _, err := man.ListTasks(query)
+	if err != nil {
+		return nil, err
+	}
+	expired := time.Now().Add(-IdempotencyKeyTTL)
+	for _, task := range *tasks {
+		if task.CreatedAt.After(expired) && task.IsSameWork(*tr) {
+			return &task, nil
+		}
+	}
+	return nil, nil
+}
+
+// A new, waiting, pending or running task that does the same work
+func FindInFlightTask(man ContentManager, tr *models.TaskRequest) (*models.TaskRequest, error) {
+	query := TaskQuery{Operation: tr.Operation.String(), PerPage: man.GetCfg().Limit}
+	if tr.ContentID != nil {
+		query.ContentID = strconv.FormatInt(*tr.ContentID, 10)
+	}
+	if tr.ContainerID != nil {
+		query.ContainerID = strconv.FormatInt(*tr.ContainerID, 10)
+	}
+	for _, status := range inFlightStatuses {
+		query.Status = status.String()
+		tasks, _, err := man.ListTasks(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range *tasks {
+			if task.IsSameWork(*tr) {
+				return &task, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// The in flight task the new one clashed with, mirrors the unique indexes for the memory manager
+func FindInFlightConflict(tasks models.TaskRequests, tr *models.TaskRequest) *models.TaskRequest {
+	sameTarget := func(a *int64, b *int64) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return *a == *b
+	}
+	for _, task := range tasks {
+		if !task.Status.IsInFlight() {
+			continue
+		}
+		if task.IsSameWork(*tr) {
+			return &task
+		}
+		if tr.IdempotencyKey != "" && task.IdempotencyKey == tr.IdempotencyKey && task.Operation == tr.Operation &&
+			sameTarget(task.ContentID, tr.ContentID) && sameTarget(task.ContainerID, tr.ContainerID) {
+			return &task
+		}
+	}
+	return nil
+}
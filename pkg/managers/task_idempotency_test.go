@@ -0,0 +1,117 @@
+package managers
+
+import (
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindExistingTaskMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateFindExistingTask(t, man)
+}
+
+func TestFindExistingTaskDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateFindExistingTask(t, man)
+}
+
+func TestIsSameWork(t *testing.T) {
+	one, two := int64(1), int64(2)
+	encode := models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &one, Codec: "libx265"}
+	assert.True(t, encode.IsSameWork(models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &one, Codec: "libx265", Priority: 10}), "Priority is not part of the work")
+	assert.False(t, encode.IsSameWork(models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &two, Codec: "libx265"}))
+	assert.False(t, encode.IsSameWork(models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &one, Codec: "libsvtav1"}))
+	assert.False(t, encode.IsSameWork(models.TaskRequest{Operation: models.TaskOperation.SCREENS, ContentID: &one, Codec: "libx265"}))
+	assert.False(t, encode.IsSameWork(models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContainerID: &one, Codec: "libx265"}))
+
+	assert.NoError(t, ValidateIdempotencyKey("retry-me"))
+	assert.Error(t, ValidateIdempotencyKey(strings.Repeat("k", MaxIdempotencyKeyLength+1)))
+}
+
+func ValidateFindExistingTask(t *testing.T, man ContentManager) {
+	contentID := int64(7)
+	request := func() *models.TaskRequest {
+		return &models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &contentID, Codec: "libx265"}
+	}
+	existing, err := FindExistingTask(man, request())
+	assert.NoError(t, err)
+	assert.Nil(t, existing, "Nothing is queued yet")
+
+	created, err := man.CreateTask(request())
+	assert.NoError(t, err)
+	existing, err = FindExistingTask(man, request())
+	assert.NoError(t, err)
+	assert.NotNil(t, existing, "The new task is in flight")
+	assert.Equal(t, created.ID, existing.ID)
+
+	otherCodec := request()
+	otherCodec.Codec = "libsvtav1"
+	existing, err = FindExistingTask(man, otherCodec)
+	assert.NoError(t, err)
+	assert.Nil(t, existing, "Different options are different work")
+
+	started, err := ChangeTaskState(man, created, models.TaskStatus.IN_PROGRESS, "Started")
+	assert.NoError(t, err)
+	existing, _ = FindExistingTask(man, request())
+	assert.NotNil(t, existing, "Running tasks are still in flight")
+
+	_, err = ChangeTaskState(man, started, models.TaskStatus.DONE, "Done")
+	assert.NoError(t, err)
+	existing, _ = FindExistingTask(man, request())
+	assert.Nil(t, existing, "The work can be requested again once it is done")
+
+	// A key finds the task even when it is finished
+	keyed := request()
+	keyed.IdempotencyKey = "encode-7"
+	keyedTask, err := man.CreateTask(keyed)
+	assert.NoError(t, err)
+	_, err = ChangeTaskState(man, keyedTask, models.TaskStatus.ERROR, "Broke")
+	assert.NoError(t, err)
+
+	retry := request()
+	retry.IdempotencyKey = "encode-7"
+	existing, err = FindExistingTask(man, retry)
+	assert.NoError(t, err)
+	assert.NotNil(t, existing, "The key returns the original task")
+	assert.Equal(t, keyedTask.ID, existing.ID)
+
+	existing, _ = FindExistingTask(man, request())
+	assert.Nil(t, existing, "Without the key an errored task is not in flight")
+
+	// A pipeline step waiting on its parent is already queued
+	otherID := int64(8)
+	waiting := request()
+	waiting.ContentID = &otherID
+	waiting.Status = models.TaskStatus.WAITING
+	waitingTask, err := man.CreateTask(waiting)
+	assert.NoError(t, err)
+	waitingDupe := request()
+	waitingDupe.ContentID = &otherID
+	existing, err = FindExistingTask(man, waitingDupe)
+	assert.NoError(t, err)
+	assert.NotNil(t, existing, "Waiting tasks are in flight")
+	assert.Equal(t, waitingTask.ID, existing.ID)
+
+	// Skipping the check (another process got there first) is rejected by the manager
+	_, err = man.CreateTask(waitingDupe)
+	assert.ErrorIs(t, err, ErrTaskInFlight)
+
+	keyedOther := request()
+	keyedOther.ContentID = &otherID
+	keyedOther.Codec = "libsvtav1"
+	keyedOther.IdempotencyKey = "encode-8"
+	_, err = man.CreateTask(keyedOther)
+	assert.NoError(t, err)
+	keyedClash := request()
+	keyedClash.ContentID = &otherID
+	keyedClash.Codec = "libvpx-vp9"
+	keyedClash.IdempotencyKey = "encode-8"
+	_, err = man.CreateTask(keyedClash)
+	assert.ErrorIs(t, err, ErrTaskInFlight, "The key can only be in flight once per target")
+}
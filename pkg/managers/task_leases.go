@@ -0,0 +1,239 @@
+package managers
+
+/**
+ * Leases for tasks run by remote agents over the /api/workers HTTP protocol.  The server owns
+ * the lease, an agent has to heartbeat before it expires or the task goes back into the queue.
+ */
+import (
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+var ErrLeaseLost = errors.New("the task is no longer leased to this worker")
+var ErrTaskLeased = errors.New("the task is leased to a remote worker")
+var ErrUploadInvalid = errors.New("the uploaded encode is not valid")
+
+// Operations that can be handed to a remote agent (they need to upload a single result file)
+var RemoteTaskOperations = []models.TaskOperationType{
+	models.TaskOperation.ENCODING,
+}
+
+func IsRemoteOperation(operation models.TaskOperationType) bool {
+	for _, op := range RemoteTaskOperations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func GetLeaseDuration(man ContentManager) time.Duration {
+	seconds := man.GetCfg().WorkerLeaseSeconds
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Claim the next task for one of the operations and lease it to the worker
+func LeaseTask(man ContentManager, workerID string, operations []models.TaskOperationType) (*models.TaskRequest, error) {
+	if workerID == "" {
+		return nil, errors.New("a worker_id is required to lease a task")
+	}
+	for _, op := range operations {
+		if !IsRemoteOperation(op) {
+			return nil, fmt.Errorf("operation %s cannot be run by a remote worker", op)
+		}
+	}
+	if len(operations) == 0 {
+		operations = RemoteTaskOperations
+	}
+
+	// Anything a dead worker was holding should be available to claim again
+	ExpireTaskLeases(man)
+
+	task, err := ClaimNextTask(man, operations...)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().UTC().Add(GetLeaseDuration(man))
+	task.WorkerID = workerID
+	task.LeaseExpiresAt = &expires
+	return ChangeTaskState(man, task, models.TaskStatus.IN_PROGRESS, fmt.Sprintf("Leased by worker %s", workerID))
+}
+
+// The task has to be in progress and held by this worker for it to do anything with it
+func CheckLease(task *models.TaskRequest, workerID string) error {
+	if task.Status == models.TaskStatus.CANCELED {
+		return ErrTaskCanceled
+	}
+	if task.Status != models.TaskStatus.IN_PROGRESS || task.WorkerID == "" || task.WorkerID != workerID {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Extend the lease and record any progress the worker reported
+func RenewLease(man ContentManager, task *models.TaskRequest, workerID string, progress utils.TaskProgress) (*models.TaskRequest, error) {
+	if err := CheckLease(task, workerID); err != nil {
+		return nil, err
+	}
+	expires := time.Now().UTC().Add(GetLeaseDuration(man))
+	task.LeaseExpiresAt = &expires
+	return UpdateTaskProgress(man, task, progress)
+}
+
+// The worker is giving the task back without running it (shutting down etc), it does not use up
+// an attempt.
+func ReleaseTask(man ContentManager, task *models.TaskRequest, workerID string) (*models.TaskRequest, error) {
+	if err := CheckLease(task, workerID); err != nil {
+		return nil, err
+	}
+	if task.Attempts > 0 {
+		task.Attempts -= 1
+	}
+	ClearLease(task)
+	return ChangeTaskState(man, task, models.TaskStatus.NEW, fmt.Sprintf("Released by worker %s", workerID))
+}
+
+// The worker could not run the task, it is retried under the normal retry policy
+func FailRemoteTask(man ContentManager, task *models.TaskRequest, workerID string, errMsg string) (*models.TaskRequest, error) {
+	if err := CheckLease(task, workerID); err != nil {
+		return nil, err
+	}
+	ClearLease(task)
+	return FailTask(man, task, fmt.Sprintf("Worker %s failed %s", workerID, errMsg))
+}
+
+func ClearLease(task *models.TaskRequest) *models.TaskRequest {
+	task.WorkerID = ""
+	task.LeaseExpiresAt = nil
+	return task
+}
+
+// Any in progress task whose lease ran out is failed, which puts it back in the queue under
+// the retry policy.
+func ExpireTaskLeases(man ContentManager) (models.TaskRequests, error) {
+	inProgress, err := listAllTasksByStatus(man, models.TaskStatus.IN_PROGRESS, man.GetCfg().Limit)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	expired := models.TaskRequests{}
+	for _, task := range inProgress {
+		if task.LeaseExpiresAt == nil || task.LeaseExpiresAt.After(now) {
+			continue
+		}
+		workerID := task.WorkerID
+		ClearLease(&task)
+		msg := fmt.Sprintf("Lease expired for worker %s", workerID)
+		log.Printf("Task %d %s", task.ID, msg)
+		updated, failErr := FailTask(man, &task, msg)
+		if failErr != nil {
+			log.Printf("Failed to expire the lease on task %d %s", task.ID, failErr)
+			continue
+		}
+		expired = append(expired, *updated)
+	}
+	return expired, nil
+}
+
+// Where a remote encode result should be written, the same place a local encode would put it
+func RemoteEncodingDestination(man ContentManager, task *models.TaskRequest, content *models.Content) (string, error) {
+	profile, err := TaskEncodingProfile(man.GetCfg(), task)
+	if err != nil {
+		return "", err
+	}
+	content, cnt, err := GetContentAndContainer(man, content.ID)
+	if err != nil {
+		return "", err
+	}
+	srcFile := filepath.Join(cnt.GetFqPath(), content.Src)
+	return utils.GetProfileConversionName(srcFile, profile), nil
+}
+
+// Write the upload from a remote worker to dstFile.  It is saved under the temp output name (so an
+// orphaned upload is cleaned up like any other) and only renamed into place once it probes with the
+// duration of the source, a truncated upload fails the task and leaves dstFile alone.
+func SaveRemoteEncode(ctx context.Context, man ContentManager, task *models.TaskRequest, workerID string, dstFile string, save func(tmpFile string) error) error {
+	if err := CheckLease(task, workerID); err != nil {
+		return err
+	}
+	if task.ContentID == nil {
+		return errors.New("encoding task has no content")
+	}
+	content, cnt, err := GetContentAndContainer(man, *task.ContentID)
+	if err != nil {
+		return err
+	}
+	srcFile := filepath.Join(cnt.GetFqPath(), content.Src)
+	srcDuration, _, durationErr := utils.GetTotalVideoLength(srcFile)
+	if durationErr != nil {
+		log.Printf("Could not get the duration of %s, the upload is only probed %s", srcFile, durationErr)
+	}
+	if err := utils.WriteOutputAtomic(ctx, dstFile, save, utils.ValidateEncodeDuration(srcDuration)); err != nil {
+		ClearLease(task)
+		FailTask(man, task, fmt.Sprintf("The upload from worker %s was not a valid encode %s", workerID, err))
+		return fmt.Errorf("%w %s", ErrUploadInvalid, err)
+	}
+	return nil
+}
+
+// A gate failed after the upload was in place, remove it so the next encode does not see a finished file
+func failRemoteEncode(man ContentManager, task *models.TaskRequest, dstFile string, msg string) {
+	utils.RemovePartialOutput(dstFile)
+	ClearLease(task)
+	FailTask(man, task, msg)
+}
+
+// The worker uploaded the encoded file to dstFile, hook it up as content and finish the task
+func CompleteRemoteEncoding(ctx context.Context, man ContentManager, task *models.TaskRequest, workerID string, dstFile string) (*models.TaskRequest, error) {
+	if err := CheckLease(task, workerID); err != nil {
+		return nil, err
+	}
+	if task.ContentID == nil {
+		return nil, errors.New("encoding task has no content")
+	}
+	content, err := man.GetContent(*task.ContentID)
+	if err != nil {
+		return nil, err
+	}
+	srcBytes, saved, sErr := GetEncodeSavings(man, content, dstFile)
+	if sErr != nil {
+		failRemoteEncode(man, task, dstFile, fmt.Sprintf("Failed to compare the encode size %s", sErr))
+		return nil, sErr
+	}
+	if !EnoughSavings(man.GetCfg(), srcBytes, saved) {
+		ClearLease(task)
+		return DiscardEncode(man, task, content, dstFile, srcBytes, saved)
+	}
+	quality, qErr := CheckEncodeQuality(ctx, man, content, dstFile)
+	if qErr != nil {
+		failRemoteEncode(man, task, dstFile, fmt.Sprintf("Failed to check the encode quality %s", qErr))
+		return nil, qErr
+	}
+	if quality != nil && !quality.Passed {
+		ClearLease(task)
+		return nil, RejectEncode(man, task, content, dstFile, quality)
+	}
+	encodedContent, eErr := CreateContentAfterEncoding(man, content, dstFile)
+	if eErr == nil {
+		encodedContent, eErr = RecordEncodeQuality(man, encodedContent, quality)
+	}
+	if eErr != nil {
+		failRemoteEncode(man, task, dstFile, fmt.Sprintf("Failed to determine the newly encoded file %s", eErr))
+		return nil, eErr
+	}
+	task.CreatedID = &encodedContent.ID
+	result := GetEncodingResult(content, encodedContent, dstFile, true)
+	result.Quality = quality
+	task.SetResult(result)
+	ClearLease(task)
+	return ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Completed remote video encoding by worker %s", workerID))
+}
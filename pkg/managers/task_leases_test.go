@@ -0,0 +1,155 @@
+package managers
+
+import (
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"contented/pkg/utils"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskLeasesMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskLeases(t, man)
+}
+
+func TestTaskLeasesDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskLeases(t, man)
+}
+
+func ValidateTaskLeases(t *testing.T, man ContentManager) {
+	_, opErr := LeaseTask(man, "agent-1", []models.TaskOperationType{models.TaskOperation.TAGGING})
+	assert.Error(t, opErr, "Tagging cannot be run remotely")
+	_, noneErr := LeaseTask(man, "agent-1", nil)
+	assert.ErrorIs(t, noneErr, ErrNoTaskAvailable, "Nothing to lease yet")
+
+	tr := ApplyRetryPolicy(man.GetCfg(), &models.TaskRequest{Operation: models.TaskOperation.ENCODING})
+	created, err := man.CreateTask(tr)
+	assert.NoError(t, err)
+
+	leased, err := LeaseTask(man, "agent-1", nil)
+	assert.NoError(t, err, "It should lease the encoding task")
+	assert.Equal(t, created.ID, leased.ID)
+	assert.Equal(t, models.TaskStatus.IN_PROGRESS, leased.Status)
+	assert.Equal(t, "agent-1", leased.WorkerID)
+	assert.NotNil(t, leased.LeaseExpiresAt)
+	assert.Equal(t, 1, leased.Attempts)
+
+	_, _, takeErr := TakeContentTask(man, leased.ID, "ENCODING")
+	assert.ErrorIs(t, takeErr, ErrTaskLeased, "A local queue should not run a leased task")
+	assert.ErrorIs(t, CheckLease(leased, "agent-2"), ErrLeaseLost, "Only the lease holder can use it")
+
+	renewed, err := RenewLease(man, leased, "agent-1", utils.TaskProgress{Percent: 40, Frames: 100})
+	assert.NoError(t, err, "It should renew the lease")
+	assert.Equal(t, 40.0, renewed.Progress)
+
+	released, err := ReleaseTask(man, renewed, "agent-1")
+	assert.NoError(t, err, "It should give the task back")
+	assert.Equal(t, models.TaskStatus.NEW, released.Status)
+	assert.Equal(t, 0, released.Attempts, "Releasing should not use an attempt")
+	assert.Equal(t, "", released.WorkerID)
+
+	// A worker that stops heartbeating loses the task back to the queue
+	again, err := LeaseTask(man, "agent-2", nil)
+	assert.NoError(t, err, "It should lease the released task")
+	past := time.Now().UTC().Add(-time.Minute)
+	again.LeaseExpiresAt = &past
+	_, upErr := man.UpdateTask(again, models.TaskStatus.IN_PROGRESS)
+	assert.NoError(t, upErr)
+
+	expired, err := ExpireTaskLeases(man)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(expired), "The stale lease should expire")
+	check, _ := man.GetTask(created.ID)
+	assert.Equal(t, models.TaskStatus.NEW, check.Status, "It should be retried")
+	assert.Equal(t, "", check.WorkerID)
+	assert.Nil(t, check.LeaseExpiresAt)
+
+	// The handlers load the task for each request, like a heartbeat after the expiry would
+	stale, _ := man.GetTask(again.ID)
+	_, lostErr := RenewLease(man, stale, "agent-2", utils.TaskProgress{})
+	assert.ErrorIs(t, lostErr, ErrLeaseLost, "The old lease holder should be told to stop")
+
+	// Recovery on a restart leaves a live lease alone but takes back an expired one
+	retry, _ := man.GetTask(created.ID)
+	retry.RetryAt = nil
+	_, upErr = man.UpdateTask(retry, models.TaskStatus.NEW)
+	assert.NoError(t, upErr)
+	third, err := LeaseTask(man, "agent-3", nil)
+	assert.NoError(t, err)
+	recovered, err := RecoverTasks(man, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(recovered), "The lease is still live")
+
+	third.LeaseExpiresAt = &past
+	_, upErr = man.UpdateTask(third, models.TaskStatus.IN_PROGRESS)
+	assert.NoError(t, upErr)
+	recovered, err = RecoverTasks(man, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(recovered), "The expired lease is recovered")
+	assert.Equal(t, "", recovered[0].WorkerID, "Recovery clears the lease")
+	assert.Nil(t, recovered[0].LeaseExpiresAt)
+
+	claimed, err := man.NextTask(models.TaskOperation.ENCODING)
+	assert.NoError(t, err, "The local queue can claim it again")
+	assert.Equal(t, created.ID, claimed.ID)
+	assert.Equal(t, "", claimed.WorkerID)
+}
+
+func TestSaveRemoteEncodeMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateSaveRemoteEncode(t, man)
+}
+
+func TestSaveRemoteEncodeDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateSaveRemoteEncode(t, man)
+}
+
+func ValidateSaveRemoteEncode(t *testing.T, man ContentManager) {
+	cnt := &models.Container{Name: "remote_upload"}
+	fqPath, err := test_common.CreateContainerPath(cnt)
+	assert.NoError(t, err)
+	defer os.RemoveAll(fqPath)
+	assert.NoError(t, man.CreateContainer(cnt))
+	assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), "remote.mp4"), []byte(strings.Repeat("s", 1000)), 0644))
+	source := models.Content{Src: "remote.mp4", ContentType: "video/mp4", ContainerID: &cnt.ID}
+	assert.NoError(t, man.CreateContent(&source))
+
+	tr := ApplyRetryPolicy(man.GetCfg(), &models.TaskRequest{Operation: models.TaskOperation.ENCODING, ContentID: &source.ID})
+	_, err = man.CreateTask(tr)
+	assert.NoError(t, err)
+	leased, err := LeaseTask(man, "agent-1", nil)
+	assert.NoError(t, err)
+	dstFile, err := RemoteEncodingDestination(man, leased, &source)
+	assert.NoError(t, err)
+
+	// Anything that does not probe as the encode (truncated, junk) never lands on the destination
+	truncated := func(tmpFile string) error {
+		return os.WriteFile(tmpFile, []byte("truncated"), 0644)
+	}
+	assert.ErrorIs(t, SaveRemoteEncode(context.Background(), man, leased, "agent-2", dstFile, truncated), ErrLeaseLost)
+	err = SaveRemoteEncode(context.Background(), man, leased, "agent-1", dstFile, truncated)
+	assert.ErrorIs(t, err, ErrUploadInvalid)
+	_, statErr := os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(statErr), "The bad upload is not renamed into place")
+	_, tmpErr := os.Stat(utils.TempOutputName(dstFile))
+	assert.True(t, os.IsNotExist(tmpErr), "The temp upload is removed")
+
+	failed, err := man.GetTask(leased.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, models.TaskStatus.IN_PROGRESS, failed.Status, "The task is failed")
+	assert.Contains(t, failed.ErrMsg, "not a valid encode")
+	assert.Equal(t, "", failed.WorkerID)
+}
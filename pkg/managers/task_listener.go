@@ -0,0 +1,33 @@
+package managers
+
+/**
+ * Worker processes (cmd/worker) LISTEN on the task channel so a new or retried task is picked up
+ * right away instead of waiting on the next poll of the task_requests table.
+ */
+import (
+	"contented/pkg/models"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const TaskNotifyChannel = "task_requests"
+
+// Returns a listener whose Notify channel fires when a task becomes available.  The caller
+// should still poll, notifications are lost while the connection is reconnecting.
+func ListenForTasks() (*pq.Listener, error) {
+	dsn := models.GetDsn(models.GetEnvString("GO_ENV", "development"))
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Task listener connection problem %s", err)
+		}
+	}
+	listener := pq.NewListener(dsn, time.Second, time.Minute, reportProblem)
+	if err := listener.Listen(TaskNotifyChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Printf("Listening for tasks on channel %s", TaskNotifyChannel)
+	return listener, nil
+}
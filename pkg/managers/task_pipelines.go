@@ -0,0 +1,225 @@
+package managers
+
+/**
+ * A pipeline is an ordered set of tasks for a piece of content (encode, check for duplicates,
+ * screens then a webp).  All the steps are created up front, every step after the first is
+ * WAITING on the step before it.  When a step is done the next one becomes NEW (picking up any
+ * content it created), an error or cancel is carried through the rest of the steps.
+ */
+import (
+	"contented/pkg/models"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// The full workflow for a newly added video
+var DefaultPipeline = []models.TaskOperationType{
+	models.TaskOperation.ENCODING,
+	models.TaskOperation.DUPES,
+	models.TaskOperation.SCREENS,
+	models.TaskOperation.WEBP,
+}
+
+// Create the steps in order, they should already have their operation and options set.  The
+// pipeline ID is the ID of the first step.
+func CreatePipeline(man ContentManager, steps models.TaskRequests) (models.TaskRequests, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("a pipeline needs at least one step")
+	}
+	created := models.TaskRequests{}
+	var pipelineID *int64
+	var parentID *int64
+	for idx, step := range steps {
+		step.PipelineID = pipelineID
+		step.ParentID = parentID
+		step.Status = models.TaskStatus.WAITING
+		if idx == 0 {
+			step.Status = models.TaskStatus.NEW
+		}
+		ApplyRetryPolicy(man.GetCfg(), &step)
+		task, err := man.CreateTask(&step)
+		if err != nil {
+			CancelPipelineSteps(man, created, fmt.Sprintf("Failed to create the pipeline %s", err))
+			return nil, err
+		}
+		if idx == 0 {
+			// The first step has to exist before it can be the pipeline ID
+			pipelineID = &task.ID
+			task.PipelineID = pipelineID
+			first, upErr := man.UpdateTask(task, task.Status)
+			if upErr != nil {
+				CancelPipelineSteps(man, models.TaskRequests{*task}, "Failed to create the pipeline")
+				return nil, upErr
+			}
+			task = first
+		}
+		parentID = &task.ID
+		created = append(created, *task)
+	}
+	return created, nil
+}
+
+// All the steps in the pipeline in the order they run
+func GetPipeline(man ContentManager, pipelineID int64) (models.TaskRequests, error) {
+	query := TaskQuery{PipelineID: strconv.FormatInt(pipelineID, 10), PerPage: 100}
+	tasks, total, err := man.ListTasks(query)
+	if err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("pipeline %d not found", pipelineID)
+	}
+	steps := *tasks
+	sort.Slice(steps, func(i, j int) bool { return steps[i].ID < steps[j].ID })
+	return steps, nil
+}
+
+// The overall status, the first step that did not finish decides it
+func PipelineStatus(steps models.TaskRequests) models.TaskStatusType {
+	for _, step := range steps {
+		switch step.Status {
+		case models.TaskStatus.DONE:
+			continue
+		case models.TaskStatus.WAITING:
+			// Only reached when every step before it is done and the step is about to start
+			return models.TaskStatus.PENDING
+		default:
+			return step.Status
+		}
+	}
+	return models.TaskStatus.DONE
+}
+
+// Called when a pipeline step finishes, starts the next step or carries a failure forward
+func AdvancePipeline(man ContentManager, task *models.TaskRequest) (*models.TaskRequest, error) {
+	if task.PipelineID == nil {
+		return nil, nil
+	}
+	next, err := NextPipelineStep(man, task)
+	if next == nil || err != nil {
+		return nil, err
+	}
+	switch task.Status {
+	case models.TaskStatus.DONE:
+		// Later steps work on whatever the step created (the encoded video)
+		if task.CreatedID != nil {
+			if err := carryCreatedContent(man, task, next.ID); err != nil {
+				return nil, err
+			}
+			next.ContentID = task.CreatedID
+		} else if next.ContentID == nil {
+			next.ContentID = task.ContentID
+		}
+		log.Printf("Pipeline %d starting step %d %s", *task.PipelineID, next.ID, next.Operation)
+		return ChangeTaskState(man, next, models.TaskStatus.NEW, fmt.Sprintf("Started after step %d finished", task.ID))
+	case models.TaskStatus.ERROR:
+		return ErrorTask(man, next, fmt.Sprintf("Pipeline step %d failed", task.ID))
+	case models.TaskStatus.CANCELED:
+		return CancelTask(man, next, fmt.Sprintf("Pipeline step %d was canceled", task.ID))
+	}
+	return nil, nil
+}
+
+// Every waiting step after the next one that still points at the content this step replaced moves
+// on to the created content, a step like DUPES creates nothing so SCREENS would otherwise go back
+// to the original.
+func carryCreatedContent(man ContentManager, task *models.TaskRequest, nextID int64) error {
+	steps, err := GetPipeline(man, *task.PipelineID)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if step.ID <= nextID || step.Status != models.TaskStatus.WAITING {
+			continue
+		}
+		if step.ContentID != nil && task.ContentID != nil && *step.ContentID != *task.ContentID {
+			continue
+		}
+		later := step
+		later.ContentID = task.CreatedID
+		if _, err := man.UpdateTask(&later, models.TaskStatus.WAITING); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The step waiting on this task, nil if it was the last one or the next step is not waiting
+func NextPipelineStep(man ContentManager, task *models.TaskRequest) (*models.TaskRequest, error) {
+	steps, err := GetPipeline(man, *task.PipelineID)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if step.ParentID != nil && *step.ParentID == task.ID && step.Status == models.TaskStatus.WAITING {
+			next := step
+			return &next, nil
+		}
+	}
+	return nil, nil
+}
+
+// A step that errored was retried, put the steps after it back to waiting on it
+func ResumePipeline(man ContentManager, task *models.TaskRequest) error {
+	if task.PipelineID == nil {
+		return nil
+	}
+	steps, err := GetPipeline(man, *task.PipelineID)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if step.ID <= task.ID || step.Status != models.TaskStatus.ERROR {
+			continue
+		}
+		waiting := step
+		waiting.Attempts = 0
+		waiting.ErrMsg = ""
+		if _, err := ChangeTaskState(man, &waiting, models.TaskStatus.WAITING, fmt.Sprintf("Waiting on the retry of step %d", task.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel the first unfinished step, which cancels everything after it as well
+func CancelPipeline(man ContentManager, pipelineID int64, msg string) (models.TaskRequests, error) {
+	steps, err := GetPipeline(man, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if step.Status == models.TaskStatus.DONE {
+			continue
+		}
+		if !IsCancelable(step.Status) {
+			return steps, fmt.Errorf("pipeline %d already finished with %s", pipelineID, step.Status)
+		}
+		active := step
+		if _, err := CancelTask(man, &active, msg); err != nil {
+			return steps, err
+		}
+		break
+	}
+	return GetPipeline(man, pipelineID)
+}
+
+func CancelPipelineSteps(man ContentManager, steps models.TaskRequests, msg string) {
+	for _, step := range steps {
+		if _, err := CancelTask(man, &step, msg); err != nil {
+			log.Printf("Failed to cancel pipeline step %d %s", step.ID, err)
+		}
+	}
+}
+
+// Tasks that have not finished can still be canceled
+func IsCancelable(status models.TaskStatusType) bool {
+	switch status {
+	case models.TaskStatus.NEW, models.TaskStatus.WAITING, models.TaskStatus.PENDING, models.TaskStatus.IN_PROGRESS:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package managers
+
+import (
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidatePipeline(t, man)
+}
+
+func TestPipelineDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidatePipeline(t, man)
+}
+
+func CreateTestPipeline(t *testing.T, man ContentManager) models.TaskRequests {
+	contentID := int64(1)
+	steps := models.TaskRequests{}
+	for _, op := range DefaultPipeline {
+		steps = append(steps, models.TaskRequest{Operation: op, ContentID: &contentID})
+	}
+	created, err := CreatePipeline(man, steps)
+	assert.NoError(t, err, "It should create the pipeline")
+	assert.Equal(t, len(DefaultPipeline), len(created))
+	return created
+}
+
+func ValidatePipeline(t *testing.T, man ContentManager) {
+	_, emptyErr := CreatePipeline(man, models.TaskRequests{})
+	assert.Error(t, emptyErr, "A pipeline needs steps")
+
+	created := CreateTestPipeline(t, man)
+	first := created[0]
+	assert.Equal(t, models.TaskStatus.NEW, first.Status, "Only the first step is ready")
+	assert.Equal(t, first.ID, *first.PipelineID, "The pipeline is identified by the first step")
+	for idx, step := range created[1:] {
+		assert.Equal(t, models.TaskStatus.WAITING, step.Status, "Later steps wait")
+		assert.Equal(t, first.ID, *step.PipelineID)
+		assert.Equal(t, created[idx].ID, *step.ParentID, "Each step waits on the one before it")
+	}
+
+	steps, err := GetPipeline(man, first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, len(created), len(steps))
+	assert.Equal(t, models.TaskStatus.NEW, PipelineStatus(steps))
+
+	// Finishing the encode should start the next step on the encoded content
+	encodedID := int64(42)
+	started, err := ChangeTaskState(man, &first, models.TaskStatus.IN_PROGRESS, "Started")
+	assert.NoError(t, err)
+	started.CreatedID = &encodedID
+	_, err = ChangeTaskState(man, started, models.TaskStatus.DONE, "Encoded")
+	assert.NoError(t, err)
+
+	steps, _ = GetPipeline(man, first.ID)
+	assert.Equal(t, models.TaskStatus.NEW, steps[1].Status, "The next step should be ready")
+	assert.Equal(t, encodedID, *steps[1].ContentID, "It should work on the created content")
+	assert.Equal(t, models.TaskStatus.WAITING, steps[2].Status, "The rest are still waiting")
+	assert.Equal(t, encodedID, *steps[2].ContentID, "Screens are taken of the encode, not the original")
+	assert.Equal(t, encodedID, *steps[3].ContentID, "The webp is built from the encode")
+	assert.Equal(t, models.TaskStatus.NEW, PipelineStatus(steps))
+
+	// An error is carried through the rest of the pipeline
+	_, err = ErrorTask(man, &steps[1], "Failed for a test")
+	assert.NoError(t, err)
+	steps, _ = GetPipeline(man, first.ID)
+	assert.Equal(t, models.TaskStatus.ERROR, steps[2].Status)
+	assert.Equal(t, models.TaskStatus.ERROR, steps[3].Status)
+	assert.Equal(t, models.TaskStatus.ERROR, PipelineStatus(steps))
+
+	// Retrying the failed step puts the later steps back to waiting on it
+	_, err = RetryTask(man, &steps[1])
+	assert.NoError(t, err)
+	steps, _ = GetPipeline(man, first.ID)
+	assert.Equal(t, models.TaskStatus.NEW, steps[1].Status)
+	assert.Equal(t, models.TaskStatus.WAITING, steps[2].Status)
+	assert.Equal(t, models.TaskStatus.WAITING, steps[3].Status)
+
+	// Canceling the pipeline cancels the active step and everything after it
+	steps, err = CancelPipeline(man, first.ID, "Canceled for a test")
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.DONE, steps[0].Status, "Finished steps are left alone")
+	for _, step := range steps[1:] {
+		assert.Equal(t, models.TaskStatus.CANCELED, step.Status)
+	}
+	_, err = CancelPipeline(man, first.ID, "Again")
+	assert.Error(t, err, "A canceled pipeline cannot be canceled again")
+
+	_, missingErr := GetPipeline(man, -1)
+	assert.Error(t, missingErr)
+}
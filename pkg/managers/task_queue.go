@@ -4,10 +4,16 @@
 package managers
 
 import (
+	"contented/pkg/config"
 	"contented/pkg/models"
+	"contented/pkg/utils"
+	"contented/pkg/worker"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,21 +22,10 @@ import (
 /**
  * TODO: Move all the editing queue tasks into a new file.
  */
-type DuplicateContent struct {
-	KeepContentID int64  `json:"keep_id"`
-	ContainerID   *int64 `json:"container_id"`
-	ContainerName string `json:"container_name"`
-	DuplicateID   int64  `json:"duplicate_id"`
-	KeepSrc       string `json:"keep_src"`
-	DuplicateSrc  string `json:"duplicate_src"`
-	FqPath        string `json:"-"`
-}
-type DuplicateContents []DuplicateContent
-
-func (dupe DuplicateContent) String() string {
-	s, _ := json.MarshalIndent(dupe, "", "  ")
-	return string(s)
-}
+
+// The duplicates are also the result of a DUPES task so they live with the other results
+type DuplicateContent = models.DuplicateContent
+type DuplicateContents = models.DuplicateContents
 
 func (sr ContentQuery) String() string {
 	s, _ := json.MarshalIndent(sr, "", "  ")
@@ -45,13 +40,119 @@ func ChangeTaskState(man ContentManager, task *models.TaskRequest, newStatus mod
 		return nil, fmt.Errorf("task %s already in state %s", task, newStatus)
 	}
 	if newStatus == models.TaskStatus.IN_PROGRESS {
-		task.StartedAt = time.Now().UTC()
+		started := time.Now().UTC()
+		task.StartedAt = started
+		task.HeartbeatAt = &started
+		task.Attempts += 1
+		task.RetryAt = nil
+		if task.WorkerID == "" {
+			task.LogFile = utils.TaskLogName(task.ID) // Written by HandleTask, leased tasks log remotely
+		}
+	}
+	if newStatus == models.TaskStatus.DONE {
+		task.Progress = 100
+		task.EtaSeconds = 0
 	}
 	task.Status = newStatus
 	task.Message = strings.ReplaceAll(msg, man.GetCfg().Dir, "")
-	return man.UpdateTask(task, status)
+	updated, err := man.UpdateTask(task, status)
+	if err == nil && IsFinished(newStatus) {
+		AdvancePipeline(man, updated)
+	}
+	return updated, err
+}
+
+func IsFinished(status models.TaskStatusType) bool {
+	return status == models.TaskStatus.DONE || status == models.TaskStatus.ERROR || status == models.TaskStatus.CANCELED
+}
+
+// How often a running task will write its progress back to the manager
+var TaskProgressInterval = 2 * time.Second
+
+// Returns a callback that records ffmpeg progress on the task.  It is throttled so a long encode
+// does not hammer the DB, but the final progress report is always recorded.
+func TaskProgressUpdater(man ContentManager, task *models.TaskRequest) utils.ProgressCallback {
+	lastUpdate := time.Time{}
+	return func(progress utils.TaskProgress) {
+		if !progress.Done && time.Since(lastUpdate) < TaskProgressInterval {
+			return
+		}
+		lastUpdate = time.Now()
+		UpdateTaskProgress(man, task, progress)
+	}
+}
+
+// Save the progress without changing the task state, fails if the task was changed (canceled)
+func UpdateTaskProgress(man ContentManager, task *models.TaskRequest, progress utils.TaskProgress) (*models.TaskRequest, error) {
+	task.Progress = progress.Percent
+	task.FramesProcessed = progress.Frames
+	task.Speed = progress.Speed
+	task.EtaSeconds = progress.EtaSeconds
+	heartbeat := time.Now().UTC()
+	task.HeartbeatAt = &heartbeat
+	updated, err := man.UpdateTask(task, task.Status)
+	if err != nil {
+		log.Printf("Failed to update progress for task %d err %s", task.ID, err)
+	}
+	return updated, err
+}
+
+// How many times and how quickly a failed task will be tried again
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// The TASK_MAX_ATTEMPTS / TASK_RETRY_DELAY configuration with the TASK_OPERATION_MAX_ATTEMPTS,
+// TASK_OPERATION_RETRY_DELAYS and TASK_OPERATION_RETRY_MAX_DELAYS overrides for the operation.
+func GetRetryPolicy(cfg *config.DirConfigEntry, operation models.TaskOperationType) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:  cfg.TaskMaxAttempts,
+		InitialDelay: time.Duration(cfg.TaskRetryDelay) * time.Second,
+		MaxDelay:     time.Duration(cfg.TaskRetryMaxDelay) * time.Second,
+	}
+	op := operation.String()
+	if override := cfg.TaskOperationMaxAttempts[op]; override > 0 {
+		policy.MaxAttempts = override
+	}
+	if override := cfg.TaskOperationRetryDelays[op]; override > 0 {
+		policy.InitialDelay = time.Duration(override) * time.Second
+	}
+	if override := cfg.TaskOperationRetryMaxDelays[op]; override > 0 {
+		policy.MaxDelay = time.Duration(override) * time.Second
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
 }
 
+// Exponential backoff, the first retry waits InitialDelay and then doubles up to the MaxDelay
+func (rp RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := rp.InitialDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if rp.MaxDelay > 0 && delay >= rp.MaxDelay {
+			break
+		}
+	}
+	if rp.MaxDelay > 0 && delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+	return delay
+}
+
+// Set the max attempts for a new task based on the operation policy (if not already set)
+func ApplyRetryPolicy(cfg *config.DirConfigEntry, task *models.TaskRequest) *models.TaskRequest {
+	if task.MaxAttempts <= 0 {
+		task.MaxAttempts = GetRetryPolicy(cfg, task.Operation).MaxAttempts
+	}
+	return task
+}
+
+// Fail the task, if there are attempts left under the retry policy the task goes back to new
+// with a RetryAt time for the worker to pick it up again, otherwise it is an ERROR.
 func FailTask(man ContentManager, task *models.TaskRequest, errMsg string) (*models.TaskRequest, error) {
 	log.Print(errMsg)
 
@@ -59,11 +160,191 @@ func FailTask(man ContentManager, task *models.TaskRequest, errMsg string) (*mod
 	if status == models.TaskStatus.ERROR {
 		return nil, fmt.Errorf("task %s already in state %s", task, models.TaskStatus.ERROR)
 	}
-	task.Status = models.TaskStatus.ERROR
+	policy := GetRetryPolicy(man.GetCfg(), task.Operation)
+	maxAttempts := task.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = policy.MaxAttempts
+	}
+	if task.Attempts <= 0 || task.Attempts >= maxAttempts {
+		return ErrorTask(man, task, errMsg)
+	}
+
+	retryAt := time.Now().UTC().Add(policy.Backoff(task.Attempts))
+	task.Status = models.TaskStatus.NEW
+	task.RetryAt = &retryAt
 	task.ErrMsg = strings.ReplaceAll(errMsg, man.GetCfg().Dir, "")
+	task.Message = fmt.Sprintf("Attempt %d of %d failed, retrying at %s", task.Attempts, maxAttempts, retryAt.Format(time.RFC3339))
+	log.Printf("Task %d %s", task.ID, task.Message)
 	return man.UpdateTask(task, status)
 }
 
+// Move the task straight to ERROR, no retries.
+func ErrorTask(man ContentManager, task *models.TaskRequest, errMsg string) (*models.TaskRequest, error) {
+	status := task.Status.Copy()
+	if status == models.TaskStatus.ERROR {
+		return nil, fmt.Errorf("task %s already in state %s", task, models.TaskStatus.ERROR)
+	}
+	task.Status = models.TaskStatus.ERROR
+	task.RetryAt = nil
+	task.ErrMsg = strings.ReplaceAll(errMsg, man.GetCfg().Dir, "")
+	updated, err := man.UpdateTask(task, status)
+	if err == nil {
+		AdvancePipeline(man, updated)
+	}
+	return updated, err
+}
+
+// Manually put an ERROR task back to new with a fresh set of attempts
+func RetryTask(man ContentManager, task *models.TaskRequest) (*models.TaskRequest, error) {
+	if task.Status != models.TaskStatus.ERROR {
+		return nil, fmt.Errorf("only tasks in %s can be retried, task %d is %s", models.TaskStatus.ERROR, task.ID, task.Status)
+	}
+	task.Attempts = 0
+	task.RetryAt = nil
+	task.Progress = 0
+	task.FramesProcessed = 0
+	task.Speed = 0
+	task.EtaSeconds = -1
+	task.Result = nil
+	ApplyRetryPolicy(man.GetCfg(), task)
+	retried, err := ChangeTaskState(man, task, models.TaskStatus.NEW, "Manually retried")
+	if err == nil {
+		if pErr := ResumePipeline(man, retried); pErr != nil {
+			log.Printf("Failed to resume the pipeline for task %d %s", task.ID, pErr)
+		}
+	}
+	return retried, err
+}
+
+var ErrTaskCanceled = errors.New("task was canceled")
+var ErrNoTaskAvailable = errors.New("no tasks to pull off the queue")
+
+// An empty operations list matches any task
+func TaskMatchesOperations(task models.TaskRequest, operations []models.TaskOperationType) bool {
+	if len(operations) == 0 {
+		return true
+	}
+	for _, op := range operations {
+		if task.Operation == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Move a task into the canceled state (tasks already canceled are left alone)
+func CancelTask(man ContentManager, task *models.TaskRequest, msg string) (*models.TaskRequest, error) {
+	if task.Status == models.TaskStatus.CANCELED {
+		return task, nil
+	}
+	return ChangeTaskState(man, task, models.TaskStatus.CANCELED, msg)
+}
+
+// If the task context was canceled while running the task is canceled, otherwise it is an error
+func CancelOrFailTask(ctx context.Context, man ContentManager, task *models.TaskRequest, errMsg string) (*models.TaskRequest, error) {
+	if errors.Is(context.Cause(ctx), worker.ErrShutdown) {
+		log.Printf("Task %d interrupted by a shutdown %s", task.ID, errMsg)
+		return InterruptTask(man, task, "Interrupted by a shutdown, it will run again")
+	}
+	if ctx.Err() != nil {
+		log.Printf("Task %d canceled while running %s", task.ID, errMsg)
+		return CancelTask(man, task, "Task was canceled while in progress")
+	}
+	return FailTask(man, task, errMsg)
+}
+
+// Put a task that was stopped part way back to NEW, it was not the fault of the task so the
+// attempt does not count.
+func InterruptTask(man ContentManager, task *models.TaskRequest, msg string) (*models.TaskRequest, error) {
+	if task.Attempts > 0 {
+		task.Attempts -= 1
+	}
+	task.Progress = 0
+	task.FramesProcessed = 0
+	task.Speed = 0
+	task.EtaSeconds = -1
+	return ChangeTaskState(man, task, models.TaskStatus.NEW, msg)
+}
+
+/**
+ * Find all the tasks that never finished (the process died, box rebooted etc).  Tasks that were
+ * pending or in progress are either put back to new or failed based on requeue.  The returned
+ * tasks are all in the new state and ordered oldest first so they can be queued up again.
+ *
+ * Tasks still heartbeating (or under an unexpired lease) belong to a worker process that is
+ * running, those are left alone and the reaper deals with them if the worker goes away.
+ */
+func RecoverTasks(man ContentManager, requeue bool) (models.TaskRequests, error) {
+	unfinished := []models.TaskStatusType{
+		models.TaskStatus.NEW,
+		models.TaskStatus.PENDING,
+		models.TaskStatus.IN_PROGRESS,
+	}
+
+	recovered := models.TaskRequests{}
+	perPage := man.GetCfg().Limit
+	now := time.Now().UTC()
+	for _, status := range unfinished {
+		tasks, err := listAllTasksByStatus(man, status, perPage)
+		if err != nil {
+			return recovered, err
+		}
+		for _, task := range tasks {
+			if status == models.TaskStatus.NEW {
+				recovered = append(recovered, task)
+				continue
+			}
+			if TaskOwnerAlive(man.GetCfg(), task, now) {
+				log.Printf("Task %d is %s in a running worker, leaving it for the reaper", task.ID, status)
+				continue
+			}
+			ClearLease(&task)
+			if !requeue {
+				msg := fmt.Sprintf("Task was interrupted while %s, the server restarted before it completed", status)
+				ErrorTask(man, &task, msg)
+				continue
+			}
+			msg := fmt.Sprintf("Task was interrupted while %s, re-queued after a restart", status)
+			updated, upErr := ChangeTaskState(man, &task, models.TaskStatus.NEW, msg)
+			if upErr != nil {
+				log.Printf("Failed to requeue interrupted task %d %s", task.ID, upErr)
+				continue
+			}
+			recovered = append(recovered, *updated)
+		}
+	}
+	sort.SliceStable(recovered, func(i, j int) bool {
+		return recovered[i].ID < recovered[j].ID
+	})
+	log.Printf("Recovered %d unfinished tasks", len(recovered))
+	return recovered, nil
+}
+
+// Pages through all the tasks in a given state (ListTasks caps a page at the config limit)
+func listAllTasksByStatus(man ContentManager, status models.TaskStatusType, perPage int) (models.TaskRequests, error) {
+	all := models.TaskRequests{}
+	for page := 1; ; page++ {
+		query := TaskQuery{
+			Page:    page,
+			Offset:  (page - 1) * perPage,
+			PerPage: perPage,
+			Status:  status.String(),
+		}
+		tasks, total, err := man.ListTasks(query)
+		if err != nil {
+			return all, err
+		}
+		if tasks == nil || len(*tasks) == 0 {
+			break
+		}
+		all = append(all, *tasks...)
+		if int64(len(all)) >= total {
+			break
+		}
+	}
+	return all, nil
+}
+
 /**
  * Grab a content related task
  */
@@ -73,7 +354,15 @@ func TakeContentTask(man ContentManager, id int64, operation string) (*models.Ta
 		log.Printf("%s Could not look up the task successfully %s", operation, tErr)
 		return task, nil, tErr
 	}
-	task, pErr := ChangeTaskState(man, task, models.TaskStatus.PENDING, "Starting to execute task")
+	if task.Status == models.TaskStatus.CANCELED {
+		log.Printf("%s Task %d was canceled before it started", operation, id)
+		return task, nil, ErrTaskCanceled
+	}
+	if task.WorkerID != "" {
+		log.Printf("%s Task %d is leased to worker %s", operation, id, task.WorkerID)
+		return task, nil, ErrTaskLeased
+	}
+	task, pErr := TakePendingTask(man, task)
 	if pErr != nil {
 		msg := fmt.Sprintf("%s Couldn't move task into pending %s", operation, pErr)
 		FailTask(man, task, msg)
@@ -94,6 +383,44 @@ func TakeContentTask(man ContentManager, id int64, operation string) (*models.Ta
 	return task, content, nil
 }
 
+// Tasks claimed by a worker process (NextTask) are already pending
+func TakePendingTask(man ContentManager, task *models.TaskRequest) (*models.TaskRequest, error) {
+	if task.Status == models.TaskStatus.PENDING {
+		return task, nil
+	}
+	return ChangeTaskState(man, task, models.TaskStatus.PENDING, "Starting to execute task")
+}
+
+// The task was claimed but could not be queued locally, put it back for the next claim
+func UnclaimTask(man ContentManager, task *models.TaskRequest) (*models.TaskRequest, error) {
+	if task.Status != models.TaskStatus.PENDING {
+		return nil, fmt.Errorf("only %s tasks can be unclaimed, task %d is %s", models.TaskStatus.PENDING, task.ID, task.Status)
+	}
+	return ChangeTaskState(man, task, models.TaskStatus.NEW, "Returned to the queue")
+}
+
+func UnclaimTaskByID(man ContentManager, id int64) (*models.TaskRequest, error) {
+	task, err := man.GetTask(id)
+	if err != nil {
+		return nil, err
+	}
+	taskCopy := *task
+	return UnclaimTask(man, &taskCopy)
+}
+
+// How many tasks are waiting to run (new or claimed but not started)
+func TaskQueueDepth(man ContentManager) (int64, error) {
+	depth := int64(0)
+	for _, status := range []models.TaskStatusType{models.TaskStatus.NEW, models.TaskStatus.PENDING} {
+		_, total, err := man.ListTasks(TaskQuery{Status: status.String(), PerPage: 1})
+		if err != nil {
+			return depth, err
+		}
+		depth += total
+	}
+	return depth, nil
+}
+
 /**
  * Grab a container related task that requires a container
  */
@@ -120,7 +447,15 @@ func TakeTask(man ContentManager, id int64, operation string) (*models.TaskReque
 		log.Printf("%s Could not look up the task successfully %s", operation, tErr)
 		return task, nil, nil, tErr
 	}
-	task, pErr := ChangeTaskState(man, task, models.TaskStatus.PENDING, "Starting to execute task")
+	if task.Status == models.TaskStatus.CANCELED {
+		log.Printf("%s Task %d was canceled before it started", operation, id)
+		return task, nil, nil, ErrTaskCanceled
+	}
+	if task.WorkerID != "" {
+		log.Printf("%s Task %d is leased to worker %s", operation, id, task.WorkerID)
+		return task, nil, nil, ErrTaskLeased
+	}
+	task, pErr := TakePendingTask(man, task)
 	if pErr != nil {
 		msg := fmt.Sprintf("%s Couldn't move task into pending %s", operation, pErr)
 		FailTask(man, task, msg)
@@ -159,20 +494,26 @@ func TakeTask(man ContentManager, id int64, operation string) (*models.TaskReque
 /**
  * Capture a set of screens given a task
  */
-func ScreenCaptureTask(man ContentManager, id int64) error {
+func ScreenCaptureTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers Screen Tasks taskID attempting to start %d", id)
 	task, _, err := TakeContentTask(man, id, "Screenshots")
 	if err != nil {
 		return err
 	}
-	screens, pattern, sErr := CreateScreensForContent(man, *task.ContentID, task.NumberOfScreens, task.StartTimeSeconds)
+	screens, pattern, sErr := CreateScreensForContent(ctx, man, *task.ContentID, task.NumberOfScreens, task.StartTimeSeconds, TaskProgressUpdater(man, task))
 	if sErr != nil {
 		failMsg := fmt.Sprintf("Failing to create screen %s", sErr)
-		FailTask(man, task, failMsg)
+		CancelOrFailTask(ctx, man, task, failMsg)
 		return sErr
 	}
+	result := models.ScreensTaskResult{ScreenIDs: []int64{}, Pattern: strings.ReplaceAll(pattern, man.GetCfg().Dir, "")}
+	for _, screen := range screens {
+		result.ScreenIDs = append(result.ScreenIDs, screen.ID)
+	}
+	task.SetResult(result)
+
 	// Should strip the path information out of the task state
-	ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Successfully created screens %s", pattern))
+	ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Successfully created %d screens %s", len(screens), pattern))
 	log.Printf("Screens %s and the pattern %s", screens, pattern)
 
 	// TODO: Come up with a way to submit a follow-up task to create a webp from the screens
@@ -182,29 +523,84 @@ func ScreenCaptureTask(man ContentManager, id int64) error {
 /**
  * Capture a set of screens given a task
  */
-func WebpFromScreensTask(man ContentManager, id int64) error {
+func WebpFromScreensTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers WebP taskID attempting to start %d", id)
 	task, content, err := TakeContentTask(man, id, "WebpFromScreensTask")
 	if err != nil {
 		return err
 	}
 
-	webp, err := WebpFromContent(man, content)
+	webp, err := WebpFromContent(ctx, man, content)
 	if err != nil {
 		failMsg := fmt.Sprintf("Failing to create screen %s", err)
-		FailTask(man, task, failMsg)
+		CancelOrFailTask(ctx, man, task, failMsg)
 		return err
 	}
 
+	task.SetResult(models.WebpTaskResult{Preview: strings.ReplaceAll(webp, man.GetCfg().Dir, "")})
+
 	// Should strip the path information out of the task state
 	ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Successfully created webp %s", webp))
 	return err
 }
 
+// Package the video content as HLS for the /api/stream routes
+func HlsPackageTask(ctx context.Context, man ContentManager, id int64) error {
+	log.Printf("Managers HLS packaging taskID attempting to start %d", id)
+	task, content, err := TakeContentTask(man, id, "HlsPackageTask")
+	if err != nil {
+		return err
+	}
+	ladder, hlsErr := PackageHlsContent(ctx, man, content, TaskProgressUpdater(man, task))
+	if hlsErr != nil {
+		failMsg := fmt.Sprintf("Failed to package hls %s", hlsErr)
+		CancelOrFailTask(ctx, man, task, failMsg)
+		return hlsErr
+	}
+	result := models.HlsTaskResult{Master: StreamUrl(content.ID, utils.HlsMasterPlaylist), Renditions: []string{}}
+	for _, rendition := range ladder {
+		result.Renditions = append(result.Renditions, rendition.Name())
+	}
+	task.SetResult(result)
+	_, doneErr := ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("Packaged hls renditions %s", strings.Join(result.Renditions, ", ")))
+	return doneErr
+}
+
+// Extract the subtitle streams of the video content for /api/contents/:id/subtitles/:lang
+func ExtractSubtitlesTask(ctx context.Context, man ContentManager, id int64) error {
+	log.Printf("Managers subtitle extraction taskID attempting to start %d", id)
+	task, content, err := TakeContentTask(man, id, "ExtractSubtitlesTask")
+	if err != nil {
+		return err
+	}
+	updated, skipped, subErr := ExtractContentSubtitles(ctx, man, content)
+	if subErr != nil {
+		failMsg := fmt.Sprintf("Failed to extract subtitles %s", subErr)
+		CancelOrFailTask(ctx, man, task, failMsg)
+		return subErr
+	}
+	result := models.SubtitlesTaskResult{Extracted: []string{}, Skipped: []string{}}
+	for _, track := range updated.Subtitles {
+		if track.Extracted {
+			result.Extracted = append(result.Extracted, track.Lang)
+		}
+	}
+	for _, stream := range skipped {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("%d:%s", stream.Index, stream.Codec))
+	}
+	task.SetResult(result)
+	msg := fmt.Sprintf("Extracted %d subtitle streams %s", len(result.Extracted), strings.Join(result.Extracted, ", "))
+	if len(skipped) > 0 {
+		msg += fmt.Sprintf(", skipped bitmap subtitles %s", strings.Join(result.Skipped, ", "))
+	}
+	_, doneErr := ChangeTaskState(man, task, models.TaskStatus.DONE, msg)
+	return doneErr
+}
+
 /**
  * Remove a duplicate content
  */
-func RemoveDuplicateContentTask(man ContentManager, id int64) error {
+func RemoveDuplicateContentTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers duplicate content taskID attempting to start %d", id)
 	task, cnt, _, err := TakeContainerTask(man, id, "RemoveDuplicateContentTask")
 	if err != nil {
@@ -217,6 +613,7 @@ func RemoveDuplicateContentTask(man ContentManager, id int64) error {
 		return err
 	}
 	// Remove the content from the database
+	task.SetResult(models.RemoveDuplicatesTaskResult{Removed: removed})
 	successMsg := fmt.Sprintf("Successfully removed %d duplicate contents from container %d", removed, cnt.ID)
 	ChangeTaskState(man, task, models.TaskStatus.DONE, successMsg)
 	return err
@@ -225,7 +622,7 @@ func RemoveDuplicateContentTask(man ContentManager, id int64) error {
 /**
  * Capture a set of screens given a task
  */
-func DetectDuplicatesTask(man ContentManager, id int64) error {
+func DetectDuplicatesTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers duplicate content taskID attempting to start %d", id)
 	task, container, content, err := TakeContainerTask(man, id, "DetectDuplicatesTask")
 
@@ -259,10 +656,11 @@ func DetectDuplicatesTask(man ContentManager, id int64) error {
 		return err
 	}
 
-	// JSON encode the duplicate information into the summary
-	summary := fmt.Sprintf("%s", dupes)
-
-	// TODO: This should actually generate something semi useful for the UI
+	if dupes == nil {
+		dupes = DuplicateContents{}
+	}
+	task.SetResult(models.DuplicatesTaskResult{Duplicates: dupes})
+	summary := fmt.Sprintf("Found %d duplicates", len(dupes))
 	ChangeTaskState(man, task, models.TaskStatus.DONE, summary)
 	return err
 }
@@ -270,7 +668,7 @@ func DetectDuplicatesTask(man ContentManager, id int64) error {
 /**
  * Tag a piece of content, get this working on one item and then consider some other operation.
  */
-func TaggingContentTask(man ContentManager, id int64) error {
+func TaggingContentTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers Tagging taskID attempting to start %d", id)
 	task, content, err := TakeContentTask(man, id, "TaggingContentTask")
 	if err != nil {
@@ -288,36 +686,105 @@ func TaggingContentTask(man ContentManager, id int64) error {
 
 	// TODO: Make it so this can work on a single piece of content (refactor AssignTagsAndUpdate)
 	contents := models.Contents{*content}
-	assignmentError := AssignTagsToContents(man, &contents, tags)
+	tagged, assignmentError := AssignTagsToContents(man, &contents, tags)
 	if assignmentError != nil {
 		failMsg := fmt.Sprintf("Failed to tag content %s", err)
 		FailTask(man, task, failMsg)
 		return err
 	}
 
+	// Only the tags that were saved, no match leaves the content (and so the result) without tags
+	result := models.TaggingTaskResult{Tags: []string{}}
+	for _, taggedContent := range tagged {
+		for _, tag := range taggedContent.Tags {
+			result.Tags = append(result.Tags, tag.ID)
+		}
+	}
+	sort.Strings(result.Tags)
+	task.SetResult(result)
+
 	// Should strip the path information out of the task state
-	ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("successfully tagged content %d", content.ID))
+	ChangeTaskState(man, task, models.TaskStatus.DONE, fmt.Sprintf("successfully tagged content %d with %d tags", content.ID, len(result.Tags)))
 	return err
 }
 
+// What was written by an encode, a failed probe of the new file leaves out the codec and bit rate
+func GetEncodingResult(source *models.Content, encoded *models.Content, dstFile string, didEncode bool) models.EncodingTaskResult {
+	result := models.EncodingTaskResult{
+		SourceID:    source.ID,
+		Output:      encoded.Src,
+		SizeBytes:   encoded.SizeBytes,
+		Encoded:     didEncode,
+		SourceBytes: source.SizeBytes,
+	}
+	codec, size, bitRate, err := utils.GetVideoStats(dstFile)
+	if err != nil {
+		log.Printf("Could not probe the encoded file %s %s", dstFile, err)
+		return result
+	}
+	result.Codec = codec
+	result.SizeBytes = size
+	result.BitRate = bitRate
+	if source.SizeBytes > 0 {
+		result.BytesSaved = source.SizeBytes - size
+	}
+	return result
+}
+
 /**
  * Could definitely make this a method assuming the next task uses the same logic.
  */
-func EncodingVideoTask(man ContentManager, id int64) error {
+func EncodingVideoTask(ctx context.Context, man ContentManager, id int64) error {
 	log.Printf("Managers Video encoding taskID attempting to start %d", id)
 	task, content, err := TakeContentTask(man, id, "VideoEncoding")
 	if err != nil {
 		return err
 	}
-	msg, encodeErr, shouldEncode, newFile := EncodeVideoContent(man, content, task.Codec)
+	profile, profileErr := TaskEncodingProfile(man.GetCfg(), task)
+	if profileErr != nil {
+		FailTask(man, task, fmt.Sprintf("Invalid encoding profile %s", profileErr))
+		return profileErr
+	}
+	msg, encodeErr, shouldEncode, newFile := EncodeVideoContent(ctx, man, content, profile, TaskProgressUpdater(man, task))
 	log.Printf("Video Encode video %s %s %t", msg, encodeErr, shouldEncode)
 	if encodeErr != nil {
 		failMsg := fmt.Sprintf("Failed to encode %s", encodeErr)
-		FailTask(man, task, failMsg)
+		CancelOrFailTask(ctx, man, task, failMsg)
 		return encodeErr
 	}
 
+	if !shouldEncode && !encodeExists(newFile) {
+		_, skipErr := SkipEncode(man, task, content, msg)
+		return skipErr
+	}
+
+	var quality *models.VideoQuality
+	if shouldEncode {
+		srcBytes, saved, sErr := GetEncodeSavings(man, content, newFile)
+		if sErr != nil {
+			FailTask(man, task, fmt.Sprintf("Failed to compare the encode size %s", sErr))
+			return sErr
+		}
+		if !EnoughSavings(man.GetCfg(), srcBytes, saved) {
+			_, discardErr := DiscardEncode(man, task, content, newFile, srcBytes, saved)
+			return discardErr
+		}
+		var qErr error
+		quality, qErr = CheckEncodeQuality(ctx, man, content, newFile)
+		if qErr != nil {
+			failMsg := fmt.Sprintf("Failed to check the encode quality %s", qErr)
+			CancelOrFailTask(ctx, man, task, failMsg)
+			return qErr
+		}
+		if quality != nil && !quality.Passed {
+			return RejectEncode(man, task, content, newFile, quality)
+		}
+	}
+
 	encodedContent, eErr := CreateContentAfterEncoding(man, content, newFile)
+	if eErr == nil {
+		encodedContent, eErr = RecordEncodeQuality(man, encodedContent, quality)
+	}
 	if eErr != nil {
 		failMsg := fmt.Sprintf("Failed to determine the newly encoded file %s", eErr)
 		FailTask(man, task, failMsg)
@@ -325,6 +792,12 @@ func EncodingVideoTask(man ContentManager, id int64) error {
 	}
 
 	task.CreatedID = &encodedContent.ID // Note that this could already have existed.
+	result := GetEncodingResult(content, encodedContent, newFile, shouldEncode)
+	result.Quality = quality
+	if !shouldEncode {
+		result.Reason = msg
+	}
+	task.SetResult(result)
 	taskMsg := fmt.Sprintf("Completed video encoding %s and had to encode %t", msg, shouldEncode)
 	_, doneErr := ChangeTaskState(man, task, models.TaskStatus.DONE, taskMsg)
 	return doneErr
@@ -0,0 +1,411 @@
+package managers
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"contented/pkg/utils"
+	"contented/pkg/worker"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverTasksMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateRecoverTasks(t, man)
+}
+
+func TestRecoverTasksDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateRecoverTasks(t, man)
+}
+
+// Each task gets its own content ID, the same work cannot be in flight twice
+var taskInStateContentID int64
+
+// Creates a task and then forces it into the status provided
+func CreateTaskInState(t *testing.T, man ContentManager, status models.TaskStatusType) *models.TaskRequest {
+	taskInStateContentID++
+	contentID := taskInStateContentID
+	task, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING, ContentID: &contentID})
+	assert.NoError(t, err, "It should create a task")
+	if status == models.TaskStatus.NEW {
+		return task
+	}
+	task.Status = status
+	updated, upErr := man.UpdateTask(task, models.TaskStatus.NEW)
+	assert.NoError(t, upErr, "It should be able to move the task state")
+	return updated
+}
+
+// The last heartbeat was long enough ago that the worker running the task must have gone away
+func AgeTaskHeartbeat(t *testing.T, man ContentManager, task *models.TaskRequest) *models.TaskRequest {
+	old := time.Now().UTC().Add(-2 * GetTaskTimeout(man.GetCfg(), task.Operation))
+	task.HeartbeatAt = &old
+	updated, err := man.UpdateTask(task, task.Status)
+	assert.NoError(t, err)
+	return updated
+}
+
+func ValidateRecoverTasks(t *testing.T, man ContentManager) {
+	newTask := CreateTaskInState(t, man, models.TaskStatus.NEW)
+	pending := AgeTaskHeartbeat(t, man, CreateTaskInState(t, man, models.TaskStatus.PENDING))
+	inProgress := AgeTaskHeartbeat(t, man, CreateTaskInState(t, man, models.TaskStatus.IN_PROGRESS))
+	done := CreateTaskInState(t, man, models.TaskStatus.DONE)
+	running := StartTestTask(t, man, models.TaskOperation.TAGGING)
+
+	recovered, err := RecoverTasks(man, true)
+	assert.NoError(t, err, "It should be able to recover tasks")
+	assert.Equal(t, 3, len(recovered), "New, pending and in progress tasks should be recovered")
+
+	live, _ := man.GetTask(running.ID)
+	assert.Equal(t, models.TaskStatus.IN_PROGRESS, live.Status, "A task another worker is heartbeating is left alone")
+
+	ids := []int64{}
+	for _, task := range recovered {
+		assert.Equal(t, models.TaskStatus.NEW, task.Status, "All recovered tasks should be queueable")
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []int64{newTask.ID, pending.ID, inProgress.ID}, ids, "Oldest tasks should be first")
+
+	check, _ := man.GetTask(done.ID)
+	assert.Equal(t, models.TaskStatus.DONE, check.Status, "Finished tasks should not be touched")
+
+	// Now when recovery is not a requeue the interrupted tasks should be errors
+	interrupted := AgeTaskHeartbeat(t, man, CreateTaskInState(t, man, models.TaskStatus.IN_PROGRESS))
+	stillNew, errRecover := RecoverTasks(man, false)
+	assert.NoError(t, errRecover)
+	assert.Equal(t, 3, len(stillNew), "Only the new tasks should come back")
+
+	failed, _ := man.GetTask(interrupted.ID)
+	assert.Equal(t, models.TaskStatus.ERROR, failed.Status, "It should error the interrupted task")
+	assert.Contains(t, failed.ErrMsg, "interrupted", "And explain why")
+}
+
+func TestTaskProgressMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskProgress(t, man)
+}
+
+func TestTaskProgressDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskProgress(t, man)
+}
+
+func ValidateTaskProgress(t *testing.T, man ContentManager) {
+	task := CreateTaskInState(t, man, models.TaskStatus.IN_PROGRESS)
+	onProgress := TaskProgressUpdater(man, task)
+
+	onProgress(utils.TaskProgress{Percent: 10, Frames: 100, Speed: 2, EtaSeconds: 45})
+	check, _ := man.GetTask(task.ID)
+	assert.Equal(t, 10.0, check.Progress, "The first report should be saved")
+	assert.Equal(t, int64(100), check.FramesProcessed)
+	assert.Equal(t, 2.0, check.Speed)
+	assert.Equal(t, int64(45), check.EtaSeconds)
+	assert.Equal(t, models.TaskStatus.IN_PROGRESS, check.Status, "It should not change the state")
+
+	onProgress(utils.TaskProgress{Percent: 20, Frames: 200, Speed: 2, EtaSeconds: 40})
+	throttled, _ := man.GetTask(task.ID)
+	assert.Equal(t, 10.0, throttled.Progress, "Reports inside the interval are skipped")
+
+	onProgress(utils.TaskProgress{Percent: 100, Frames: 1000, EtaSeconds: 0, Done: true})
+	final, _ := man.GetTask(task.ID)
+	assert.Equal(t, 100.0, final.Progress, "The final report is always saved")
+	assert.Equal(t, int64(1000), final.FramesProcessed)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialDelay: 10 * time.Second, MaxDelay: 60 * time.Second}
+	assert.Equal(t, 10*time.Second, policy.Backoff(1))
+	assert.Equal(t, 20*time.Second, policy.Backoff(2))
+	assert.Equal(t, 40*time.Second, policy.Backoff(3))
+	assert.Equal(t, 60*time.Second, policy.Backoff(4), "It should cap at the max delay")
+	assert.Equal(t, 60*time.Second, policy.Backoff(20))
+
+	cfg := config.GetCfgDefaults()
+	cfg.TaskMaxAttempts = 4
+	assert.Equal(t, 4, GetRetryPolicy(&cfg, models.TaskOperation.SCREENS).MaxAttempts, "Defaults come from config")
+	assert.Equal(t, 1, GetRetryPolicy(&cfg, models.TaskOperation.TAGGING).MaxAttempts, "Operations can override")
+
+	cfg.TaskOperationMaxAttempts = map[string]int{"screen_capture": 6}
+	cfg.TaskOperationRetryDelays = map[string]int{"screen_capture": 5}
+	cfg.TaskOperationRetryMaxDelays = map[string]int{"screen_capture": 20}
+	policy = GetRetryPolicy(&cfg, models.TaskOperation.SCREENS)
+	assert.Equal(t, 6, policy.MaxAttempts, "The overrides come from config")
+	assert.Equal(t, 5*time.Second, policy.InitialDelay)
+	assert.Equal(t, 20*time.Second, policy.MaxDelay)
+	assert.Equal(t, cfg.TaskMaxAttempts, GetRetryPolicy(&cfg, models.TaskOperation.TAGGING).MaxAttempts)
+}
+
+func TestFailTaskRetryMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateFailTaskRetry(t, man)
+}
+
+func TestFailTaskRetryDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateFailTaskRetry(t, man)
+}
+
+func ValidateFailTaskRetry(t *testing.T, man ContentManager) {
+	tr := ApplyRetryPolicy(man.GetCfg(), &models.TaskRequest{Operation: models.TaskOperation.SCREENS})
+	assert.Equal(t, man.GetCfg().TaskMaxAttempts, tr.MaxAttempts, "The policy should set max attempts")
+	tr.MaxAttempts = 2
+	task, err := man.CreateTask(tr)
+	assert.NoError(t, err)
+
+	// Never started so there was no attempt to retry
+	running, runErr := ChangeTaskState(man, task, models.TaskStatus.IN_PROGRESS, "Running")
+	assert.NoError(t, runErr)
+	assert.Equal(t, 1, running.Attempts, "Starting the task is an attempt")
+
+	retry, failErr := FailTask(man, running, "Locked file")
+	assert.NoError(t, failErr)
+	assert.Equal(t, models.TaskStatus.NEW, retry.Status, "It should be put back to new for a retry")
+	assert.NotNil(t, retry.RetryAt, "It should have a backoff time")
+	assert.True(t, retry.RetryAt.After(time.Now()), "In the future")
+	assert.Equal(t, "Locked file", retry.ErrMsg)
+
+	again, _ := ChangeTaskState(man, retry, models.TaskStatus.IN_PROGRESS, "Running again")
+	assert.Equal(t, 2, again.Attempts)
+	assert.Nil(t, again.RetryAt, "Running clears the retry time")
+
+	failed, finalErr := FailTask(man, again, "Still locked")
+	assert.NoError(t, finalErr)
+	assert.Equal(t, models.TaskStatus.ERROR, failed.Status, "Out of attempts is an error")
+
+	// A manual retry gets a fresh set of attempts
+	manual, manualErr := RetryTask(man, failed)
+	assert.NoError(t, manualErr)
+	assert.Equal(t, models.TaskStatus.NEW, manual.Status)
+	assert.Equal(t, 0, manual.Attempts)
+
+	_, notErr := RetryTask(man, manual)
+	assert.Error(t, notErr, "Only error tasks can be retried")
+}
+
+func TestNextTaskMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTask(t, man)
+}
+
+func TestNextTaskDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTask(t, man)
+}
+
+func ValidateNextTask(t *testing.T, man ContentManager) {
+	_, noneErr := man.NextTask()
+	assert.ErrorIs(t, noneErr, ErrNoTaskAvailable, "Nothing to claim yet")
+
+	encoding, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.ENCODING})
+	tagging, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING})
+
+	claimed, err := man.NextTask(models.TaskOperation.TAGGING)
+	assert.NoError(t, err, "It should claim a tagging task")
+	assert.Equal(t, tagging.ID, claimed.ID, "Only the operation asked for is claimed")
+	assert.Equal(t, models.TaskStatus.PENDING, claimed.Status, "A claimed task is pending")
+
+	// Claimed tasks can still be started by the normal task functions
+	taken, takeErr := TakePendingTask(man, claimed)
+	assert.NoError(t, takeErr)
+	assert.Equal(t, models.TaskStatus.PENDING, taken.Status)
+
+	// Waiting on a retry backoff
+	retryAt := time.Now().UTC().Add(time.Hour)
+	encoding.RetryAt = &retryAt
+	_, upErr := man.UpdateTask(encoding, models.TaskStatus.NEW)
+	assert.NoError(t, upErr)
+	_, waitErr := man.NextTask()
+	assert.ErrorIs(t, waitErr, ErrNoTaskAvailable, "Tasks waiting on a retry are not claimed")
+
+	past := time.Now().UTC().Add(-time.Minute)
+	encoding.RetryAt = &past
+	man.UpdateTask(encoding, models.TaskStatus.NEW)
+	ready, readyErr := man.NextTask()
+	assert.NoError(t, readyErr)
+	assert.Equal(t, encoding.ID, ready.ID, "Once the backoff passes it can be claimed")
+
+	_, emptyErr := man.NextTask()
+	assert.ErrorIs(t, emptyErr, ErrNoTaskAvailable, "Tasks are only claimed once")
+}
+
+func TestNextTaskPriorityMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTaskPriority(t, man)
+}
+
+func TestNextTaskPriorityDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTaskPriority(t, man)
+}
+
+func ValidateNextTaskPriority(t *testing.T, man ContentManager) {
+	batch, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING, Priority: models.TaskPriority.LOW})
+	contentID := int64(1)
+	normal, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING, ContentID: &contentID})
+	urgent, _ := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.SCREENS, Priority: models.TaskPriority.HIGH})
+
+	expected := []int64{urgent.ID, normal.ID, batch.ID}
+	for _, id := range expected {
+		claimed, err := man.NextTask()
+		assert.NoError(t, err)
+		assert.Equal(t, id, claimed.ID, "Higher priority tasks are claimed first")
+	}
+}
+
+func TestNextTaskConcurrentMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTaskConcurrent(t, man)
+}
+
+func TestNextTaskConcurrentDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateNextTaskConcurrent(t, man)
+}
+
+// Several workers claiming at once (with heartbeats going on) never get the same task
+func ValidateNextTaskConcurrent(t *testing.T, man ContentManager) {
+	total := 20
+	for i := 0; i < total; i++ {
+		contentID := int64(i + 1)
+		_, err := man.CreateTask(&models.TaskRequest{Operation: models.TaskOperation.TAGGING, ContentID: &contentID})
+		assert.NoError(t, err)
+	}
+
+	claims := make(chan int64, total)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, err := man.NextTask(models.TaskOperation.TAGGING)
+				if err != nil {
+					return
+				}
+				man.RecordTaskHeartbeat(task.ID, time.Now().UTC())
+				claims <- task.ID
+			}
+		}()
+	}
+	wg.Wait()
+	close(claims)
+
+	seen := map[int64]bool{}
+	for id := range claims {
+		assert.False(t, seen[id], "Task %d was claimed twice", id)
+		seen[id] = true
+	}
+	assert.Equal(t, total, len(seen), "Every task is claimed once")
+}
+
+func TestTaskQueueDepthMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskQueueDepth(t, man)
+}
+
+func TestTaskQueueDepthDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateTaskQueueDepth(t, man)
+}
+
+func ValidateTaskQueueDepth(t *testing.T, man ContentManager) {
+	CreateTaskInState(t, man, models.TaskStatus.NEW)
+	CreateTaskInState(t, man, models.TaskStatus.DONE)
+	claimed := CreateTaskInState(t, man, models.TaskStatus.PENDING)
+	depth, err := TaskQueueDepth(man)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), depth, "New and pending tasks are waiting")
+
+	unclaimed, err := UnclaimTask(man, claimed)
+	assert.NoError(t, err, "A claimed task can go back to the queue")
+	assert.Equal(t, models.TaskStatus.NEW, unclaimed.Status)
+	_, badErr := UnclaimTask(man, unclaimed)
+	assert.Error(t, badErr, "Only pending tasks can be unclaimed")
+}
+
+func TestCancelOrFailTaskMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateCancelOrFailTask(t, man)
+}
+
+func TestCancelOrFailTaskDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateCancelOrFailTask(t, man)
+}
+
+func ValidateCancelOrFailTask(t *testing.T, man ContentManager) {
+	// A shutdown puts the task back without using up the attempt
+	running := StartTestTask(t, man, models.TaskOperation.ENCODING)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(worker.ErrShutdown)
+	interrupted, err := CancelOrFailTask(ctx, man, running, "ffmpeg was killed")
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.NEW, interrupted.Status, "It should run again after a restart")
+	assert.Equal(t, 0, interrupted.Attempts, "The interruption is not an attempt")
+
+	// Anything else canceling the task is a user cancel
+	running = StartTestTask(t, man, models.TaskOperation.ENCODING)
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(nil)
+	canceled, err := CancelOrFailTask(ctx, man, running, "ffmpeg was killed")
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.CANCELED, canceled.Status)
+
+	running = StartTestTask(t, man, models.TaskOperation.ENCODING)
+	failed, err := CancelOrFailTask(context.Background(), man, running, "ffmpeg failed")
+	assert.NoError(t, err)
+	assert.Equal(t, "ffmpeg failed", failed.ErrMsg, "A real failure goes through the retry policy")
+}
+
+func TestTaskEncodingProfile(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.EncodingProfiles = []config.EncodingProfile{
+		{Name: "phone", Codec: "libx264", CodecName: "h264", MaxHeight: 720, FilenameModifier: "_720p"},
+	}
+
+	def, err := TaskEncodingProfile(&cfg, &models.TaskRequest{Codec: cfg.CodecForConversion})
+	assert.NoError(t, err)
+	assert.Equal(t, config.DefaultEncodingProfileName, def.Name)
+	assert.Equal(t, cfg.CodecForConversionName, def.CodecName, "The default codec is left alone")
+
+	phone, err := TaskEncodingProfile(&cfg, &models.TaskRequest{Profile: "phone", Height: 480})
+	assert.NoError(t, err)
+	assert.Equal(t, 480, phone.MaxHeight, "The task size overrides the profile")
+	assert.Equal(t, 0, phone.MaxWidth)
+
+	other, err := TaskEncodingProfile(&cfg, &models.TaskRequest{Profile: "phone", Codec: "libx265"})
+	assert.NoError(t, err)
+	assert.Equal(t, "libx265", other.Codec)
+	assert.Equal(t, "hevc", other.CodecName, "The codec name comes from the encoder")
+	assert.Equal(t, 720, other.MaxHeight)
+
+	vp9, err := TaskEncodingProfile(&cfg, &models.TaskRequest{Profile: "phone", Codec: "libvpx-vp9"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vp9", vp9.CodecName)
+	assert.Equal(t, "webm", vp9.Container, "vp9 cannot go in the profile mp4 so it moves to webm")
+
+	_, err = TaskEncodingProfile(&cfg, &models.TaskRequest{Profile: "missing"})
+	assert.ErrorIs(t, err, utils.ErrUnknownEncodingProfile)
+}
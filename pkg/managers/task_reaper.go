@@ -0,0 +1,151 @@
+package managers
+
+/**
+ * Heartbeats for running tasks and the reaper that fails in progress tasks which stopped
+ * heartbeating (a crashed worker process, a hung handler) so they do not sit IN_PROGRESS forever.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The task was finished, canceled or reaped by someone else while the handler was running
+var ErrTaskNotInProgress = errors.New("is not in progress, only in progress tasks heartbeat")
+
+// Record that the task is still being worked on, only the heartbeat is written so it cannot
+// race the handler saving progress or finishing the task.
+func HeartbeatTask(man ContentManager, id int64) (*models.TaskRequest, error) {
+	if err := man.RecordTaskHeartbeat(id, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return man.GetTask(id)
+}
+
+// A panic is a bug in the handler so running it again would just panic again, error the task
+// with the stack trace.
+func PanicTask(man ContentManager, id int64, recovered any, stack []byte) (*models.TaskRequest, error) {
+	task, err := man.GetTask(id)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status == models.TaskStatus.DONE || task.Status == models.TaskStatus.CANCELED {
+		return task, nil
+	}
+	return ErrorTask(man, task, fmt.Sprintf("Task panicked: %v\n%s", recovered, stack))
+}
+
+// How long an in progress task of this operation can go without a heartbeat
+func GetTaskTimeout(cfg *config.DirConfigEntry, operation models.TaskOperationType) time.Duration {
+	seconds := cfg.TaskHeartbeatTimeout
+	if override, ok := cfg.TaskHeartbeatTimeouts[operation.String()]; ok && override > 0 {
+		seconds = override
+	}
+	if seconds <= 0 {
+		seconds = config.DefaultTaskHeartbeatTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// How long an in progress task of this operation can run no matter how it heartbeats, 0 is no limit
+func GetTaskMaxRuntime(cfg *config.DirConfigEntry, operation models.TaskOperationType) time.Duration {
+	seconds := cfg.TaskMaxRuntime
+	if override, ok := cfg.TaskMaxRuntimes[operation.String()]; ok && override > 0 {
+		seconds = override
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Tasks started before heartbeats existed only have their start time
+func LastHeartbeat(task models.TaskRequest) time.Time {
+	if task.HeartbeatAt != nil {
+		return *task.HeartbeatAt
+	}
+	if !task.StartedAt.IsZero() {
+		return task.StartedAt
+	}
+	return task.UpdatedAt
+}
+
+// A task is held by a worker that is still running while its lease has not expired (remote
+// workers) or it has heartbeat within the timeout for its operation.
+func TaskOwnerAlive(cfg *config.DirConfigEntry, task models.TaskRequest, now time.Time) bool {
+	if task.WorkerID != "" {
+		return task.LeaseExpiresAt != nil && task.LeaseExpiresAt.After(now)
+	}
+	return now.Sub(LastHeartbeat(task)) < GetTaskTimeout(cfg, task.Operation)
+}
+
+// Fail any in progress task that has not heartbeat within the timeout for its operation (or ran
+// past the max runtime), which requeues it under the retry policy.  Expired remote worker leases
+// are handled here as well, and tasks claimed by a worker that died before starting them go back
+// to new.
+func ReapStaleTasks(man ContentManager) (models.TaskRequests, error) {
+	reaped, err := ExpireTaskLeases(man)
+	if err != nil {
+		return reaped, err
+	}
+	unclaimed, err := ReapStalePendingTasks(man)
+	reaped = append(reaped, unclaimed...)
+	if err != nil {
+		return reaped, err
+	}
+	inProgress, err := listAllTasksByStatus(man, models.TaskStatus.IN_PROGRESS, man.GetCfg().Limit)
+	if err != nil {
+		return reaped, err
+	}
+	now := time.Now().UTC()
+	for _, task := range inProgress {
+		if task.WorkerID != "" {
+			continue // Remote workers renew a lease instead
+		}
+		msg := ""
+		maxRuntime := GetTaskMaxRuntime(man.GetCfg(), task.Operation)
+		if maxRuntime > 0 && !task.StartedAt.IsZero() && now.Sub(task.StartedAt) > maxRuntime {
+			msg = fmt.Sprintf("Still running after %s (max runtime %s)", now.Sub(task.StartedAt).Round(time.Second), maxRuntime)
+		} else if !TaskOwnerAlive(man.GetCfg(), task, now) {
+			timeout := GetTaskTimeout(man.GetCfg(), task.Operation)
+			msg = fmt.Sprintf("No heartbeat since %s (timeout %s)", LastHeartbeat(task).Format(time.RFC3339), timeout)
+		} else {
+			continue
+		}
+		log.Printf("Reaping task %d %s", task.ID, msg)
+		updated, failErr := FailTask(man, ClearLease(&task), msg)
+		if failErr != nil {
+			log.Printf("Failed to reap stale task %d %s", task.ID, failErr)
+			continue
+		}
+		reaped = append(reaped, *updated)
+	}
+	return reaped, nil
+}
+
+// A claimed task is started as soon as it is queued, one still pending past the timeout was
+// claimed by a worker that went away.  It never ran so it goes back to new without using an attempt.
+func ReapStalePendingTasks(man ContentManager) (models.TaskRequests, error) {
+	pending, err := listAllTasksByStatus(man, models.TaskStatus.PENDING, man.GetCfg().Limit)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	unclaimed := models.TaskRequests{}
+	for _, task := range pending {
+		if task.WorkerID != "" || TaskOwnerAlive(man.GetCfg(), task, now) {
+			continue
+		}
+		log.Printf("Task %d has been pending since %s, returning it to the queue", task.ID, LastHeartbeat(task).Format(time.RFC3339))
+		updated, upErr := UnclaimTask(man, ClearLease(&task))
+		if upErr != nil {
+			log.Printf("Failed to unclaim stale task %d %s", task.ID, upErr)
+			continue
+		}
+		unclaimed = append(unclaimed, *updated)
+	}
+	return unclaimed, nil
+}
@@ -0,0 +1,134 @@
+package managers
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTaskTimeout(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.TaskHeartbeatTimeout = 60
+	cfg.TaskHeartbeatTimeouts = map[string]int{models.TaskOperation.ENCODING.String(): 600}
+	assert.Equal(t, 60*time.Second, GetTaskTimeout(&cfg, models.TaskOperation.SCREENS))
+	assert.Equal(t, 600*time.Second, GetTaskTimeout(&cfg, models.TaskOperation.ENCODING), "Operations can override")
+}
+
+func TestGetTaskMaxRuntime(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.TaskMaxRuntime = 60
+	cfg.TaskMaxRuntimes = map[string]int{models.TaskOperation.ENCODING.String(): 600}
+	assert.Equal(t, 60*time.Second, GetTaskMaxRuntime(&cfg, models.TaskOperation.SCREENS))
+	assert.Equal(t, 600*time.Second, GetTaskMaxRuntime(&cfg, models.TaskOperation.ENCODING), "Operations can override")
+	cfg.TaskMaxRuntime = 0
+	assert.Equal(t, time.Duration(0), GetTaskMaxRuntime(&cfg, models.TaskOperation.SCREENS), "0 is no limit")
+}
+
+func TestReapStaleTasksMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateReapStaleTasks(t, man)
+}
+
+func TestReapStaleTasksDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateReapStaleTasks(t, man)
+}
+
+func StartTestTask(t *testing.T, man ContentManager, operation models.TaskOperationType) *models.TaskRequest {
+	taskInStateContentID++
+	contentID := taskInStateContentID
+	created, err := man.CreateTask(ApplyRetryPolicy(man.GetCfg(), &models.TaskRequest{Operation: operation, ContentID: &contentID}))
+	assert.NoError(t, err)
+	started, err := ChangeTaskState(man, created, models.TaskStatus.IN_PROGRESS, "Started for a test")
+	assert.NoError(t, err)
+	assert.NotNil(t, started.HeartbeatAt, "Starting should count as a heartbeat")
+	return started
+}
+
+func ValidateReapStaleTasks(t *testing.T, man ContentManager) {
+	fresh := StartTestTask(t, man, models.TaskOperation.SCREENS)
+	stale := StartTestTask(t, man, models.TaskOperation.SCREENS)
+
+	beat, err := HeartbeatTask(man, stale.ID)
+	assert.NoError(t, err, "An in progress task can heartbeat")
+	assert.NotNil(t, beat.HeartbeatAt)
+
+	old := time.Now().UTC().Add(-2 * GetTaskTimeout(man.GetCfg(), models.TaskOperation.SCREENS))
+	beat.HeartbeatAt = &old
+	_, upErr := man.UpdateTask(beat, models.TaskStatus.IN_PROGRESS)
+	assert.NoError(t, upErr)
+
+	reaped, err := ReapStaleTasks(man)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reaped), "Only the stale task should be reaped")
+	assert.Equal(t, stale.ID, reaped[0].ID)
+
+	check, _ := man.GetTask(stale.ID)
+	assert.Equal(t, models.TaskStatus.NEW, check.Status, "It has attempts left so it is retried")
+	assert.NotNil(t, check.RetryAt)
+	assert.Contains(t, check.ErrMsg, "No heartbeat")
+
+	running, _ := man.GetTask(fresh.ID)
+	assert.Equal(t, models.TaskStatus.IN_PROGRESS, running.Status, "A task heartbeating is left alone")
+
+	_, doneErr := HeartbeatTask(man, stale.ID)
+	assert.ErrorIs(t, doneErr, ErrTaskNotInProgress, "A task that is not running cannot heartbeat")
+	notRunning, _ := man.GetTask(stale.ID)
+	assert.Equal(t, models.TaskStatus.NEW, notRunning.Status, "The heartbeat does not touch the status")
+
+	// Heartbeating is not enough when the task has been running far too long (a hung handler)
+	hung := StartTestTask(t, man, models.TaskOperation.SCREENS)
+	hung.StartedAt = time.Now().UTC().Add(-2 * GetTaskMaxRuntime(man.GetCfg(), models.TaskOperation.SCREENS))
+	_, upErr = man.UpdateTask(hung, models.TaskStatus.IN_PROGRESS)
+	assert.NoError(t, upErr)
+	_, beatErr := HeartbeatTask(man, hung.ID)
+	assert.NoError(t, beatErr)
+	reaped, err = ReapStaleTasks(man)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reaped), "The hung task is reaped")
+	assert.Equal(t, hung.ID, reaped[0].ID)
+	assert.Contains(t, reaped[0].ErrMsg, "max runtime")
+
+	CreateTaskInState(t, man, models.TaskStatus.NEW)
+	claimed, claimErr := man.NextTask(models.TaskOperation.TAGGING)
+	assert.NoError(t, claimErr)
+	assert.Equal(t, models.TaskStatus.PENDING, claimed.Status)
+	reaped, err = ReapStaleTasks(man)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(reaped), "A task that was just claimed is left for its worker")
+
+	AgeTaskHeartbeat(t, man, claimed)
+	reaped, err = ReapStaleTasks(man)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reaped), "A claim that never started is returned to the queue")
+	unclaimed, _ := man.GetTask(claimed.ID)
+	assert.Equal(t, models.TaskStatus.NEW, unclaimed.Status)
+	assert.Equal(t, 0, unclaimed.Attempts, "It never ran so no attempt is used")
+}
+
+func TestPanicTaskMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidatePanicTask(t, man)
+}
+
+func TestPanicTaskDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidatePanicTask(t, man)
+}
+
+func ValidatePanicTask(t *testing.T, man ContentManager) {
+	task := StartTestTask(t, man, models.TaskOperation.SCREENS)
+	panicked, err := PanicTask(man, task.ID, "nil map", []byte("goroutine 1 [running]:"))
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.ERROR, panicked.Status, "A panic is not retried")
+	assert.True(t, strings.Contains(panicked.ErrMsg, "goroutine 1"), "It should have the stack trace")
+}
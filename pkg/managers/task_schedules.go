@@ -0,0 +1,286 @@
+package managers
+
+/**
+ * Recurring schedules (config SCHEDULES) queue one of the existing task operations for every
+ * container or a chosen few.  Anything that already has an unfinished task for the operation is
+ * skipped so a slow nightly run does not pile up.  A schedule with a window only has its tasks
+ * start inside that window, claimed outside of it they are pushed back to the next opening.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/utils"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Operations a schedule can queue, DUPES is per container the rest are per content
+var ScheduleOperations = []models.TaskOperationType{
+	models.TaskOperation.ENCODING,
+	models.TaskOperation.SCREENS,
+	models.TaskOperation.WEBP,
+	models.TaskOperation.TAGGING,
+	models.TaskOperation.DUPES,
+}
+
+var unfinishedStatuses = []models.TaskStatusType{
+	models.TaskStatus.NEW,
+	models.TaskStatus.WAITING,
+	models.TaskStatus.PENDING,
+	models.TaskStatus.IN_PROGRESS,
+}
+
+// Check the schedule config, returns the parsed cron and window (nil if it has none)
+func ValidateSchedule(sched config.TaskSchedule) (*utils.CronExpression, *utils.TimeWindow, error) {
+	if sched.Name == "" {
+		return nil, nil, errors.New("a schedule needs a name")
+	}
+	if !IsScheduleOperation(models.TaskOperationType(sched.Operation)) {
+		return nil, nil, fmt.Errorf("schedule %s operation %s cannot be scheduled", sched.Name, sched.Operation)
+	}
+	cron, err := utils.ParseCron(sched.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	window, err := utils.ParseTimeWindow(sched.Window)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cron, window, nil
+}
+
+func IsScheduleOperation(operation models.TaskOperationType) bool {
+	for _, op := range ScheduleOperations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// The window for the named schedule, nil if it has none (or the schedule is gone from the config)
+func ScheduleWindow(cfg *config.DirConfigEntry, name string) *utils.TimeWindow {
+	if name == "" {
+		return nil
+	}
+	for _, sched := range cfg.Schedules {
+		if sched.Name == name {
+			window, err := utils.ParseTimeWindow(sched.Window)
+			if err != nil {
+				log.Printf("Ignoring the invalid window for schedule %s %s", name, err)
+				return nil
+			}
+			return window
+		}
+	}
+	return nil
+}
+
+// Build (but do not create) the tasks for a run of the schedule
+func ScheduledTasks(man ContentManager, sched config.TaskSchedule) (models.TaskRequests, error) {
+	operation := models.TaskOperationType(sched.Operation)
+	if !IsScheduleOperation(operation) {
+		return nil, fmt.Errorf("operation %s cannot be scheduled", sched.Operation)
+	}
+	if operation == models.TaskOperation.TAGGING {
+		if _, total, err := man.ListAllTags(TagQuery{PerPage: 1}); err != nil || total == 0 {
+			return nil, errors.New("no tags currently found in the system")
+		}
+	}
+
+	containerIDs := sched.ContainerIDs
+	if len(containerIDs) == 0 {
+		all, err := listAllContainerIDs(man)
+		if err != nil {
+			return nil, err
+		}
+		containerIDs = all
+	}
+	queued, err := unfinishedTaskKeys(man, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := man.GetCfg()
+	profile := utils.DefaultEncodingProfile(cfg)
+	tasks := models.TaskRequests{}
+	for _, containerID := range containerIDs {
+		if operation == models.TaskOperation.DUPES {
+			_, total, err := man.SearchContent(ContentQuery{
+				ContainerID: strconv.FormatInt(containerID, 10),
+				ContentType: "video",
+				PerPage:     1,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if total == 0 || queued[scheduleKey(&containerID, nil)] {
+				continue
+			}
+			cID := containerID
+			tasks = append(tasks, newScheduledTask(sched, operation, &cID, nil))
+			continue
+		}
+
+		contents, err := listAllContainerContent(man, containerID, operation != models.TaskOperation.TAGGING)
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range contents {
+			if queued[scheduleKey(nil, &content.ID)] {
+				continue
+			}
+			if operation == models.TaskOperation.ENCODING {
+				if IsIgnoredCodec(cfg, content.Encoding) || DiscardedEncodeReason(&content, &profile) != "" {
+					continue
+				}
+			}
+			contentID := content.ID
+			task := newScheduledTask(sched, operation, nil, &contentID)
+			switch operation {
+			case models.TaskOperation.ENCODING:
+				task.Codec = cfg.CodecForConversion
+			case models.TaskOperation.SCREENS:
+				task.NumberOfScreens = cfg.PreviewNumberOfScreens
+				task.StartTimeSeconds = cfg.PreviewFirstScreenOffset
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+func newScheduledTask(sched config.TaskSchedule, operation models.TaskOperationType, containerID *int64, contentID *int64) models.TaskRequest {
+	return models.TaskRequest{
+		ContainerID: containerID,
+		ContentID:   contentID,
+		Operation:   operation,
+		Priority:    models.TaskPriority.LOW,
+		Schedule:    sched.Name,
+	}
+}
+
+// Content that is known to already be in the target codec does not need to be sent to ffmpeg
+func IsIgnoredCodec(cfg *config.DirConfigEntry, encoding string) bool {
+	if encoding == "" || cfg.CodecsToIgnore == "" {
+		return false
+	}
+	ignore, err := regexp.Compile(cfg.CodecsToIgnore)
+	if err != nil {
+		return false
+	}
+	return ignore.MatchString(encoding)
+}
+
+func scheduleKey(containerID *int64, contentID *int64) string {
+	if contentID != nil {
+		return "content:" + strconv.FormatInt(*contentID, 10)
+	}
+	if containerID != nil {
+		return "container:" + strconv.FormatInt(*containerID, 10)
+	}
+	return ""
+}
+
+// Everything that is waiting on or running the operation
+func unfinishedTaskKeys(man ContentManager, operation models.TaskOperationType) (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, status := range unfinishedStatuses {
+		tasks, err := listAllTasksByStatus(man, status, man.GetCfg().Limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			if task.Operation == operation {
+				keys[scheduleKey(task.ContainerID, task.ContentID)] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+func listAllContainerIDs(man ContentManager) ([]int64, error) {
+	ids := []int64{}
+	perPage := man.GetCfg().Limit
+	for page := 1; ; page++ {
+		containers, total, err := man.ListContainers(ContainerQuery{
+			Page:    page,
+			Offset:  (page - 1) * perPage,
+			PerPage: perPage,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if containers == nil || len(*containers) == 0 {
+			break
+		}
+		for _, c := range *containers {
+			ids = append(ids, c.ID)
+		}
+		if int64(len(ids)) >= total {
+			break
+		}
+	}
+	return ids, nil
+}
+
+func listAllContainerContent(man ContentManager, containerID int64, videoOnly bool) (models.Contents, error) {
+	all := models.Contents{}
+	perPage := man.GetCfg().Limit
+	for page := 1; ; page++ {
+		query := ContentQuery{
+			ContainerID: strconv.FormatInt(containerID, 10),
+			Page:        page,
+			Offset:      (page - 1) * perPage,
+			PerPage:     perPage,
+		}
+		if videoOnly {
+			query.ContentType = "video"
+		}
+		contents, total, err := man.ListContent(query)
+		if err != nil {
+			return nil, err
+		}
+		if contents == nil || len(*contents) == 0 {
+			break
+		}
+		all = append(all, *contents...)
+		if int64(len(all)) >= total {
+			break
+		}
+	}
+	return all, nil
+}
+
+// A claimed (pending) task goes back to new and will not be claimed again until the time passes
+func DeferTask(man ContentManager, task *models.TaskRequest, until time.Time, msg string) (*models.TaskRequest, error) {
+	if task.Status != models.TaskStatus.PENDING {
+		return nil, fmt.Errorf("only %s tasks can be deferred, task %d is %s", models.TaskStatus.PENDING, task.ID, task.Status)
+	}
+	retryAt := until.UTC()
+	task.RetryAt = &retryAt
+	return ChangeTaskState(man, task, models.TaskStatus.NEW, msg)
+}
+
+// NextTask but scheduled tasks claimed outside of their window are deferred until it opens
+func ClaimNextTask(man ContentManager, operations ...models.TaskOperationType) (*models.TaskRequest, error) {
+	for {
+		task, err := man.NextTask(operations...)
+		if err != nil {
+			return nil, err
+		}
+		window := ScheduleWindow(man.GetCfg(), task.Schedule)
+		now := time.Now()
+		if window.Contains(now) {
+			return task, nil
+		}
+		msg := fmt.Sprintf("Waiting for the %s schedule window %s", task.Schedule, window)
+		if _, deferErr := DeferTask(man, task, window.NextStart(now), msg); deferErr != nil {
+			return nil, deferErr
+		}
+	}
+}
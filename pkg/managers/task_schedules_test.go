@@ -0,0 +1,168 @@
+package managers
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"contented/pkg/test_common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduledTasksMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateScheduledTasks(t, man)
+}
+
+func TestScheduledTasksDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateScheduledTasks(t, man)
+}
+
+func TestValidateSchedule(t *testing.T) {
+	valid := config.TaskSchedule{Name: "nightly", Cron: "0 1 * * *", Operation: "video_encoding", Window: "01:00-06:00"}
+	cron, window, err := ValidateSchedule(valid)
+	assert.NoError(t, err)
+	assert.NotNil(t, cron)
+	assert.Equal(t, "01:00-06:00", window.String())
+
+	for _, bad := range []config.TaskSchedule{
+		{Cron: "0 1 * * *", Operation: "video_encoding"},
+		{Name: "bad_op", Cron: "0 1 * * *", Operation: "remove_duplicate_files"},
+		{Name: "bad_cron", Cron: "0 1 *", Operation: "video_encoding"},
+		{Name: "bad_window", Cron: "0 1 * * *", Operation: "video_encoding", Window: "1-6"},
+	} {
+		_, _, err := ValidateSchedule(bad)
+		assert.Error(t, err, bad.Name)
+	}
+}
+
+func ValidateScheduledTasks(t *testing.T, man ContentManager) {
+	cnt, _ := test_common.GetContentByDirName("dir1")
+	assert.NoError(t, man.CreateContainer(cnt))
+	video := models.Content{Src: "scheduled.mp4", ContentType: "video/mp4", ContainerID: &cnt.ID}
+	assert.NoError(t, man.CreateContent(&video))
+	encoded := models.Content{Src: "scheduled_h265.mp4", ContentType: "video/mp4", ContainerID: &cnt.ID, Encoding: "hevc"}
+	assert.NoError(t, man.CreateContent(&encoded))
+	image := models.Content{Src: "scheduled.png", ContentType: "image/png", ContainerID: &cnt.ID}
+	assert.NoError(t, man.CreateContent(&image))
+
+	sched := config.TaskSchedule{Name: "nightly", Operation: "video_encoding", ContainerIDs: []int64{cnt.ID}}
+	tasks, err := ScheduledTasks(man, sched)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tasks), "Only the video not already in the target codec is encoded")
+	assert.Equal(t, video.ID, *tasks[0].ContentID)
+	assert.Equal(t, "nightly", tasks[0].Schedule)
+	assert.Equal(t, models.TaskPriority.LOW, tasks[0].Priority)
+
+	// A task that is still waiting should not be queued twice
+	_, err = man.CreateTask(&tasks[0])
+	assert.NoError(t, err)
+	again, err := ScheduledTasks(man, sched)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(again), "The content already has an encoding task waiting")
+
+	screens, err := ScheduledTasks(man, config.TaskSchedule{Name: "screens", Operation: "screen_capture", ContainerIDs: []int64{cnt.ID}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(screens), "Screens are for every video")
+
+	dupes, err := ScheduledTasks(man, config.TaskSchedule{Name: "dupes", Operation: "detect_duplicates", ContainerIDs: []int64{cnt.ID}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dupes), "Duplicates are checked per container")
+	assert.Equal(t, cnt.ID, *dupes[0].ContainerID)
+	assert.Nil(t, dupes[0].ContentID)
+
+	all, err := ScheduledTasks(man, config.TaskSchedule{Name: "all", Operation: "detect_duplicates"})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(all), 1, "No containers means every container")
+
+	_, err = ScheduledTasks(man, config.TaskSchedule{Name: "invalid", Operation: "remove_duplicate_files"})
+	assert.Error(t, err, "Removing duplicates is too destructive to schedule")
+
+	ValidateScheduleWindow(t, man, cnt.ID)
+}
+
+// A scheduled task claimed outside of its window goes back to new until the window opens
+func ValidateScheduleWindow(t *testing.T, man ContentManager, containerID int64) {
+	cfg := man.GetCfg()
+	now := time.Now()
+	closed := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	cfg.Schedules = []config.TaskSchedule{{Name: "closed", Cron: "@daily", Operation: "detect_duplicates", Window: closed}}
+	defer func() { cfg.Schedules = []config.TaskSchedule{} }()
+
+	task := models.TaskRequest{Operation: models.TaskOperation.DUPES, ContainerID: &containerID, Schedule: "closed"}
+	created, err := man.CreateTask(&task)
+	assert.NoError(t, err)
+
+	_, err = ClaimNextTask(man, models.TaskOperation.DUPES)
+	assert.ErrorIs(t, err, ErrNoTaskAvailable, "The only task is outside of its window")
+
+	deferred, err := man.GetTask(created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStatus.NEW, deferred.Status)
+	assert.NotNil(t, deferred.RetryAt)
+	assert.True(t, deferred.RetryAt.After(now), "It waits for the window to open")
+	assert.Contains(t, deferred.Message, "closed")
+}
+
+func TestClaimScheduleRunMemory(t *testing.T) {
+	cfg := test_common.InitMemoryFakeAppEmpty()
+	man := GetManagerTestSuite(cfg)
+	ValidateClaimScheduleRun(t, man)
+}
+
+func TestClaimScheduleRunDB(t *testing.T) {
+	cfg, _ := test_common.InitFakeApp(true)
+	man := GetManagerTestSuite(cfg)
+	ValidateClaimScheduleRun(t, man)
+}
+
+func ValidateClaimScheduleRun(t *testing.T, man ContentManager) {
+	slot := time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC)
+	claimed, err := man.ClaimScheduleRun("nightly", slot)
+	assert.NoError(t, err)
+	assert.True(t, claimed, "The first server claims the slot")
+
+	claimed, err = man.ClaimScheduleRun("nightly", slot)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "Another server cannot claim the same slot")
+
+	claimed, err = man.ClaimScheduleRun("weekly", slot)
+	assert.NoError(t, err)
+	assert.True(t, claimed, "Slots are claimed per schedule")
+
+	claimed, err = man.ClaimScheduleRun("nightly", slot.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, claimed, "The next slot can be claimed")
+	claimed, err = man.ClaimScheduleRun("nightly", slot)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "An older slot is never claimed again")
+
+	// The pause and the last result are kept with the claim
+	run, err := man.GetScheduleRun("monthly")
+	assert.NoError(t, err)
+	assert.Nil(t, run.Paused, "A schedule without state follows the config")
+	assert.Nil(t, run.RanAt)
+	assert.NoError(t, man.SetSchedulePaused("monthly", true))
+	claimed, err = man.ClaimScheduleRun("monthly", slot)
+	assert.NoError(t, err)
+	assert.True(t, claimed, "Pausing before the first run does not block the claim")
+	assert.NoError(t, man.RecordScheduleResult("monthly", slot, 3, "backlog full"))
+	run, err = man.GetScheduleRun("monthly")
+	assert.NoError(t, err)
+	assert.NotNil(t, run.Paused)
+	assert.True(t, *run.Paused)
+	assert.NotNil(t, run.RanAt)
+	assert.Equal(t, 3, run.LastQueued)
+	assert.Equal(t, "backlog full", run.LastError)
+	assert.True(t, slot.Equal(run.LastRun), "Recording the result leaves the claimed slot")
+
+	assert.NoError(t, man.SetSchedulePaused("monthly", false))
+	run, err = man.GetScheduleRun("monthly")
+	assert.NoError(t, err)
+	assert.False(t, *run.Paused)
+	assert.Equal(t, 3, run.LastQueued, "Resuming keeps the last result")
+}
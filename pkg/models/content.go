@@ -3,12 +3,14 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"slices"
 	"strings"
 	"time"
 
 	//"contented/pkg/actions"
 
+	"github.com/tidwall/gjson"
 	"gorm.io/gorm"
 )
 
@@ -50,8 +52,28 @@ type Content struct {
 
 	// Allow for marking something as a duplicate for ease of review
 	Duplicate bool `json:"duplicate" db:"duplicate" default:"false"`
+
+	// For encoded content how it compares to the source (QUALITY_METRIC), an empty metric was not checked
+	QualityMetric   string  `json:"quality_metric" db:"quality_metric" default:""`
+	QualityScore    float64 `json:"quality_score" db:"quality_score" default:"0"`
+	QualityRejected bool    `json:"quality_rejected" db:"quality_rejected" default:"false"` // Below the minimum, never replaces the source
+
+	// Encodes (profile and codec) that did not save ENCODING_MIN_SAVINGS and were removed.  The source
+	// is not encoded those ways again, remove an entry to allow a retry.
+	EncodeDiscards EncodeDiscards `json:"encode_discards,omitempty" db:"encode_discards" gorm:"type:jsonb;default:null"`
+
+	// Sidecar subtitle files found next to the video and streams extracted by the subtitle task
+	Subtitles SubtitleTracks `json:"subtitles,omitempty" db:"subtitles" gorm:"type:jsonb;default:null"`
+
+	// Computed when the content is rendered, false means the UI should use /api/transcode/:id for the video
+	BrowserPlayable bool `json:"browser_playable" db:"-" gorm:"-"`
 }
 
+// Containers and codecs a <video> element can play in all the common browsers (hevc is Safari only)
+var BrowserVideoExtensions = []string{".mp4", ".m4v", ".webm", ".ogv"}
+var BrowserVideoCodecs = []string{"h264", "vp8", "vp9", "av1", "theora"}
+var BrowserAudioCodecs = []string{"aac", "mp3", "opus", "vorbis", "flac"}
+
 // It seems odd there is no arbitrary json field => proper sort on the struct but then many of
 // these struct elements do not have a default sort implemented soooo I guess this makes sense.
 type ContentJsonSort func(i, j int) bool
@@ -163,11 +185,55 @@ func (m ContentMap) String() string {
 	return string(jm)
 }
 
+// Was an encode of this source with the profile and codec already thrown away for saving too little
+func (content Content) EncodeWasDiscarded(profileName string, codec string) bool {
+	return content.EncodeDiscards.Has(EncodeDiscardKey(profileName, codec))
+}
+
 // String is not required by pop and may be deleted
 func (content Content) IsVideo() bool {
 	return strings.Contains(content.ContentType, "video")
 }
 
+// Can the browser play the file from /api/view directly.  Without the probe metadata (it is
+// optional when loading a lot of content) only the extension and Encoding are checked.
+func (content Content) IsBrowserPlayable() bool {
+	if !content.IsVideo() {
+		return false
+	}
+	if !slices.Contains(BrowserVideoExtensions, strings.ToLower(filepath.Ext(content.Src))) {
+		return false
+	}
+	if video := content.VideoCodec(); video != "" && !slices.Contains(BrowserVideoCodecs, video) {
+		return false
+	}
+	audio := content.metaStream("audio").Get("codec_name").String()
+	return audio == "" || slices.Contains(BrowserAudioCodecs, audio)
+}
+
+// The codec of the first video stream in the probe metadata, falls back to Encoding
+func (content Content) VideoCodec() string {
+	if codec := content.metaStream("video").Get("codec_name").String(); codec != "" {
+		return codec
+	}
+	return content.Encoding
+}
+
+func (content Content) metaStream(codecType string) gjson.Result {
+	if content.Meta == "" || !gjson.Valid(content.Meta) {
+		return gjson.Result{}
+	}
+	return gjson.Get(content.Meta, fmt.Sprintf(`streams.#(codec_type=="%s")`, codecType))
+}
+
+// Fills in the computed browser_playable flag
+func (content Content) MarshalJSON() ([]byte, error) {
+	type contentJson Content
+	out := contentJson(content)
+	out.BrowserPlayable = content.IsBrowserPlayable()
+	return json.Marshal(out)
+}
+
 // This is a little risky as the tags might not be loaded on the object and there isn't
 // a great way to tell 'loaded' vs just doesn't have tags
 func (m *Content) HasTag(tag string) bool {
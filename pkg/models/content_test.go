@@ -1,6 +1,8 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 )
 
@@ -54,3 +56,57 @@ func TestContent(t *testing.T) {
 		t.Errorf("Failed to get the correct tags back %d", len(check.Tags))
 	}
 }
+
+func TestContentBrowserPlayable(t *testing.T) {
+	probe := func(video string, audio string) string {
+		return fmt.Sprintf(`{"streams": [{"codec_type": "video", "codec_name": "%s"}, {"codec_type": "audio", "codec_name": "%s"}]}`, video, audio)
+	}
+	checks := []struct {
+		content  Content
+		playable bool
+	}{
+		{Content{Src: "a.mp4", ContentType: "video/mp4", Meta: probe("h264", "aac")}, true},
+		{Content{Src: "a.MP4", ContentType: "video/mp4", Meta: probe("h264", "aac")}, true},
+		{Content{Src: "a.webm", ContentType: "video/webm", Meta: probe("vp9", "opus")}, true},
+		{Content{Src: "a.mp4", ContentType: "video/mp4", Meta: probe("hevc", "aac")}, false},
+		{Content{Src: "a.mp4", ContentType: "video/mp4", Meta: probe("h264", "ac3")}, false},
+		{Content{Src: "a.mkv", ContentType: "video/x-matroska", Meta: probe("h264", "aac")}, false},
+		{Content{Src: "a.avi", ContentType: "video/x-msvideo"}, false},
+		{Content{Src: "a.mp4", ContentType: "video/mp4"}, true},
+		{Content{Src: "a.mp4", ContentType: "video/mp4", Encoding: "hevc"}, false},
+		{Content{Src: "a.png", ContentType: "image/png"}, false},
+	}
+	for _, check := range checks {
+		if check.content.IsBrowserPlayable() != check.playable {
+			t.Errorf("%s %s playable should be %t", check.content.Src, check.content.Meta, check.playable)
+		}
+	}
+
+	js, _ := json.Marshal(checks[0].content)
+	decoded := Content{}
+	json.Unmarshal(js, &decoded)
+	if !decoded.BrowserPlayable {
+		t.Errorf("The browser_playable flag should be set in the JSON %s", js)
+	}
+}
+
+func TestSubtitleTracks(t *testing.T) {
+	tracks := SubtitleTracks{{Lang: "en", Src: "a.en.srt", Format: "srt"}, {Lang: "fre", Src: "fre.vtt", Format: "vtt", Extracted: true}}
+	value, err := tracks.Value()
+	if err != nil {
+		t.Errorf("Failed to get the value %s", err)
+	}
+	scanned := SubtitleTracks{}
+	if err := scanned.Scan([]byte(value.(string))); err != nil || len(scanned) != 2 || !scanned[1].Extracted {
+		t.Errorf("Tracks did not survive a round trip %s %s", scanned, err)
+	}
+	if scanned.Find("fre") == nil || scanned.Find("de") != nil {
+		t.Errorf("Find should match the language exactly %s", scanned)
+	}
+	if empty, _ := (SubtitleTracks{}).Value(); empty != nil {
+		t.Errorf("No tracks should be stored as null not %s", empty)
+	}
+	if err := scanned.Scan(nil); err != nil || scanned != nil {
+		t.Errorf("A null should scan to no tracks %s", scanned)
+	}
+}
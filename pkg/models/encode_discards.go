@@ -0,0 +1,54 @@
+package models
+
+/**
+ * The encodes of a source that did not save ENCODING_MIN_SAVINGS and were removed, one key per
+ * profile and codec (see EncodeDiscardKey).  Stored as a JSON list on the content so discarding a
+ * second profile does not forget the first.
+ */
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+type EncodeDiscards []string
+
+func EncodeDiscardKey(profileName string, codec string) string {
+	return profileName + ":" + codec
+}
+
+func (discards EncodeDiscards) Has(key string) bool {
+	return slices.Contains(discards, key)
+}
+
+func (discards EncodeDiscards) Add(key string) EncodeDiscards {
+	if discards.Has(key) {
+		return discards
+	}
+	return append(discards, key)
+}
+
+func (discards EncodeDiscards) Value() (driver.Value, error) {
+	if len(discards) == 0 {
+		return nil, nil
+	}
+	jd, err := json.Marshal(discards)
+	if err != nil {
+		return nil, err
+	}
+	return string(jd), nil
+}
+
+func (discards *EncodeDiscards) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		*discards = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, discards)
+	case string:
+		return json.Unmarshal([]byte(v), discards)
+	}
+	return fmt.Errorf("cannot scan %T into EncodeDiscards", value)
+}
@@ -33,8 +33,7 @@ func InitGorm(reset bool) *gorm.DB {
 	if GormDB == nil || reset {
 
 		env := GetEnvString("GO_ENV", "development")
-		host, user, dbName, password, port := GetDbConfig(env)
-		dsn := fmt.Sprintf("host=%s user=%s dbname=%s password=%s port=%s sslmode=disable", host, user, dbName, password, port)
+		dsn := GetDsn(env)
 		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 
 		if err != nil {
@@ -96,6 +95,12 @@ func GetDbConfig(environmentDefault string) (string, string, string, string, str
 	return host, user, dbName, password, port
 }
 
+// Connection string for the app database (also used by the task LISTEN connection)
+func GetDsn(env string) string {
+	host, user, dbName, password, port := GetDbConfig(env)
+	return fmt.Sprintf("host=%s user=%s dbname=%s password=%s port=%s sslmode=disable", host, user, dbName, password, port)
+}
+
 // Not sure if I can use this in a saner way wrapped by Gorm
 func InitSqlPool(db *gorm.DB) *sql.DB {
 	sqlDB, err := db.DB()
@@ -115,7 +120,12 @@ func InitSqlPool(db *gorm.DB) *sql.DB {
 }
 
 func MigrateDb(db *gorm.DB) *gorm.DB {
-	db.AutoMigrate(&Container{}, &Content{}, &Screen{}, &Tag{}, &TaskRequest{})
+	db.AutoMigrate(&Container{}, &Content{}, &Screen{}, &Tag{}, &TaskRequest{}, &ScheduleRun{})
+	for _, index := range TaskInFlightIndexes {
+		if err := db.Exec(index).Error; err != nil {
+			log.Printf("Failed to create the task index %s", err)
+		}
+	}
 	return db
 }
 
@@ -161,6 +171,7 @@ func ResetDB(db *gorm.DB) *gorm.DB {
 	CheckReset(db.Exec("DELETE FROM tags"))
 	CheckReset(db.Exec("DELETE FROM screens"))
 	CheckReset(db.Exec("DELETE FROM task_requests"))
+	CheckReset(db.Exec("DELETE FROM schedule_runs"))
 	CheckReset(db.Exec("DELETE FROM contents"))
 	CheckReset(db.Exec("DELETE FROM containers"))
 	return db
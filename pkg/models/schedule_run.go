@@ -0,0 +1,32 @@
+package models
+
+/**
+ * The state of each schedule that has to be shared between web servers and survive a restart.
+ * The schedules themselves live in the config, this row records the last cron slot claimed (so
+ * just one server queues a run), a pause set from the API and what the last run queued.
+ */
+import (
+	"encoding/json"
+	"time"
+)
+
+type ScheduleRun struct {
+	Name    string    `json:"name" db:"name" gorm:"primaryKey"`
+	LastRun time.Time `json:"last_run" db:"last_run"` // The last cron slot claimed
+
+	// Set by pause or resume and overrides "paused" in the config, nil follows the config
+	Paused *bool `json:"paused" db:"paused"`
+
+	// When tasks were last queued (cron slot or a trigger) and how that went
+	RanAt      *time.Time `json:"ran_at" db:"ran_at"`
+	LastQueued int        `json:"last_queued" db:"last_queued" default:"0"`
+	LastError  string     `json:"last_error" db:"last_error" default:""`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func (sr ScheduleRun) String() string {
+	js, _ := json.Marshal(sr)
+	return string(js)
+}
@@ -0,0 +1,59 @@
+package models
+
+/**
+ * Subtitle tracks for a video, either a sidecar file next to the video (movie.en.srt) or a WebVTT
+ * file extracted from a subtitle stream by the subtitle extraction task.  The tracks are stored
+ * as a JSON list on the content rather than in their own table.
+ */
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+type SubtitleTrack struct {
+	Lang      string `json:"lang"`      // The key for /api/contents/:id/subtitles/:lang (en, en.forced, und)
+	Src       string `json:"src"`       // File name next to the video, or in the content subtitle directory if extracted
+	Format    string `json:"format"`    // srt or vtt
+	Extracted bool   `json:"extracted"` // Pulled out of the video rather than a sidecar file
+}
+
+type SubtitleTracks []SubtitleTrack
+
+func (tracks SubtitleTracks) Find(lang string) *SubtitleTrack {
+	for idx := range tracks {
+		if tracks[idx].Lang == lang {
+			return &tracks[idx]
+		}
+	}
+	return nil
+}
+
+func (tracks SubtitleTracks) String() string {
+	jt, _ := json.Marshal(tracks)
+	return string(jt)
+}
+
+func (tracks SubtitleTracks) Value() (driver.Value, error) {
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	jt, err := json.Marshal(tracks)
+	if err != nil {
+		return nil, err
+	}
+	return string(jt), nil
+}
+
+func (tracks *SubtitleTracks) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		*tracks = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, tracks)
+	case string:
+		return json.Unmarshal([]byte(v), tracks)
+	}
+	return fmt.Errorf("cannot scan %T into SubtitleTracks", value)
+}
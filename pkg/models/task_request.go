@@ -15,6 +15,7 @@ type TaskStatusType string
 
 var TaskStatus = struct {
 	NEW         TaskStatusType
+	WAITING     TaskStatusType
 	PENDING     TaskStatusType
 	IN_PROGRESS TaskStatusType
 	CANCELED    TaskStatusType
@@ -23,6 +24,7 @@ var TaskStatus = struct {
 	INVALID     TaskStatusType
 }{
 	NEW:         "new",
+	WAITING:     "waiting",
 	PENDING:     "pending",
 	IN_PROGRESS: "in_progress",
 	CANCELED:    "canceled",
@@ -35,6 +37,8 @@ func (ts TaskStatusType) String() string {
 	switch ts {
 	case TaskStatus.NEW:
 		return "new"
+	case TaskStatus.WAITING:
+		return "waiting"
 	case TaskStatus.PENDING:
 		return "pending"
 	case TaskStatus.IN_PROGRESS:
@@ -55,6 +59,8 @@ func GetTaskStatus(name string) TaskStatusType {
 	switch name {
 	case "new":
 		return TaskStatus.NEW
+	case "waiting":
+		return TaskStatus.WAITING
 	case "pending":
 		return TaskStatus.PENDING
 	case "in_progress":
@@ -73,6 +79,23 @@ func (ts TaskStatusType) Copy() TaskStatusType {
 	return GetTaskStatus(ts.String())
 }
 
+// Tasks that are queued, waiting on a pipeline step or running.  Only one of these can do the same work.
+var InFlightTaskStatuses = []TaskStatusType{
+	TaskStatus.NEW,
+	TaskStatus.WAITING,
+	TaskStatus.PENDING,
+	TaskStatus.IN_PROGRESS,
+}
+
+func (ts TaskStatusType) IsInFlight() bool {
+	for _, status := range InFlightTaskStatuses {
+		if ts == status {
+			return true
+		}
+	}
+	return false
+}
+
 type TaskOperationType string
 
 var TaskOperation = struct {
@@ -82,6 +105,8 @@ var TaskOperation = struct {
 	TAGGING                TaskOperationType
 	DUPES                  TaskOperationType
 	REMOVE_DUPLICATE_FILES TaskOperationType
+	HLS                    TaskOperationType
+	SUBTITLES              TaskOperationType
 }{
 	ENCODING:               "video_encoding",
 	SCREENS:                "screen_capture",
@@ -89,6 +114,8 @@ var TaskOperation = struct {
 	TAGGING:                "tag_content",
 	DUPES:                  "detect_duplicates",
 	REMOVE_DUPLICATE_FILES: "remove_duplicate_files",
+	HLS:                    "hls_package",
+	SUBTITLES:              "subtitle_extraction",
 }
 
 func (to TaskOperationType) String() string {
@@ -105,10 +132,26 @@ func (to TaskOperationType) String() string {
 		return "detect_duplicates"
 	case TaskOperation.REMOVE_DUPLICATE_FILES:
 		return "remove_duplicate_files"
+	case TaskOperation.HLS:
+		return "hls_package"
+	case TaskOperation.SUBTITLES:
+		return "subtitle_extraction"
 	}
 	return "unknown"
 }
 
+// Higher priority tasks are run first, container wide batches default to LOW so a single request
+// made from the UI does not wait behind them.
+var TaskPriority = struct {
+	LOW    int
+	NORMAL int
+	HIGH   int
+}{
+	LOW:    -10,
+	NORMAL: 0,
+	HIGH:   10,
+}
+
 // TaskRequest is used by pop to map your task_requests database table to your go code.
 type TaskRequest struct {
 	ID        int64          `json:"id" gorm:"primaryKey"`
@@ -121,23 +164,107 @@ type TaskRequest struct {
 	ContainerID *int64 `json:"container_id" db:"container_id" gorm:"default:null"`
 	CreatedID   *int64 `json:"created_id" db:"created_id" gorm:"default:null"`
 
+	// Steps of a pipeline share the PipelineID (the first step) and wait on their ParentID to finish
+	PipelineID *int64 `json:"pipeline_id" db:"pipeline_id" gorm:"default:null;index"`
+	ParentID   *int64 `json:"parent_id" db:"parent_id" gorm:"default:null"`
+
+	// The name of the config schedule that queued the task (empty if it was requested directly)
+	Schedule string `json:"schedule" default:"" db:"schedule" gorm:"index"`
+
+	// Optional client supplied key (Idempotency-Key header), repeating the request gets these tasks back
+	IdempotencyKey string `json:"idempotency_key" default:"" db:"idempotency_key" gorm:"index"`
+
+	// The ffmpeg / ffprobe output of the task (GET /api/task_requests/:id/log), empty if it never ran
+	LogFile string `json:"log_file" default:"" db:"log_file"`
+
 	// TODO: Make it optional on ContentId so things cna work on a container?
 	StartedAt time.Time `json:"started_at" db:"started_at"`
 
 	Status    TaskStatusType    `json:"status" db:"status" default:"new" `
 	Operation TaskOperationType `json:"operation" db:"operation"`
+	Priority  int               `json:"priority" db:"priority" default:"0"`
 
 	// Initial default time would be nice
 	Message string `json:"message" default:"" db:"message"`
 	ErrMsg  string `json:"err_msg" default:"" db:"err_msg"`
 
+	// What the task produced, the schema depends on the operation (see task_result.go)
+	Result TaskResult `json:"result" db:"result" gorm:"type:jsonb;default:null"`
+
 	// Is it worth having two different queues for this?  Probably not, both use ffmpeg resource
 	// Add once I have the basic processor in place
 	NumberOfScreens  int    `json:"number_of_screens" default:"12" db:"number_of_screens"`
 	StartTimeSeconds int    `json:"start_time_seconds" default:"0" db:"start_time_seconds"`
 	Codec            string `json:"codec" default:"libx265" db:"codec"`
-	Width            int    `json:"width" default:"-1" db:"width"`
-	Height           int    `json:"height" default:"-1" db:"height"`
+	Width            int    `json:"width" default:"-1" db:"width"`   // Max width of an encode, <= 0 uses the profile
+	Height           int    `json:"height" default:"-1" db:"height"` // Max height of an encode, <= 0 uses the profile
+
+	// The encoding profile (config ENCODING_PROFILES) an encode uses, empty is the default profile
+	Profile string `json:"profile" default:"" db:"profile"`
+
+	// Failed tasks are retried (status back to new) after RetryAt until Attempts hits MaxAttempts
+	Attempts    int        `json:"attempts" default:"0" db:"attempts"`
+	MaxAttempts int        `json:"max_attempts" default:"0" db:"max_attempts"`
+	RetryAt     *time.Time `json:"retry_at" db:"retry_at" gorm:"default:null"`
+
+	// Written periodically while the task runs, the reaper fails in progress tasks that stop heartbeating
+	HeartbeatAt *time.Time `json:"heartbeat_at" db:"heartbeat_at" gorm:"default:null"`
+
+	// Remote workers (/api/workers) hold a lease on the task that they must keep renewing
+	WorkerID       string     `json:"worker_id" default:"" db:"worker_id"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at" db:"lease_expires_at" gorm:"default:null"`
+
+	// Updated periodically while ffmpeg is running (percentage is 0-100, eta is -1 if unknown)
+	Progress        float64 `json:"progress" default:"0" db:"progress"`
+	FramesProcessed int64   `json:"frames_processed" default:"0" db:"frames_processed"`
+	Speed           float64 `json:"speed" default:"0" db:"speed"`
+	EtaSeconds      int64   `json:"eta_seconds" default:"-1" db:"eta_seconds"`
+}
+
+// Unique across the in flight tasks so two processes cannot queue the same work at once.  The work
+// index has the same columns IsSameWork compares.  The key is shared by a batch of tasks so that
+// index is on the key and the target, not the key alone.
+const TaskInFlightWorkIndex = "task_requests_in_flight_work"
+const TaskInFlightKeyIndex = "task_requests_in_flight_key"
+
+const inFlightTaskWhere = "status IN ('new', 'waiting', 'pending', 'in_progress') AND deleted_at IS NULL"
+
+var TaskInFlightIndexes = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS " + TaskInFlightWorkIndex + " ON task_requests " +
+		"(operation, COALESCE(content_id, 0), COALESCE(container_id, 0), codec, profile, number_of_screens, start_time_seconds, width, height) " +
+		"WHERE " + inFlightTaskWhere,
+	"CREATE UNIQUE INDEX IF NOT EXISTS " + TaskInFlightKeyIndex + " ON task_requests " +
+		"(idempotency_key, operation, COALESCE(content_id, 0), COALESCE(container_id, 0)) " +
+		"WHERE idempotency_key <> '' AND " + inFlightTaskWhere,
+}
+
+// Would the task do exactly the same work as the other one (same operation, target and options)
+func (t TaskRequest) IsSameWork(other TaskRequest) bool {
+	sameID := func(a *int64, b *int64) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return *a == *b
+	}
+	return t.Operation == other.Operation &&
+		sameID(t.ContentID, other.ContentID) &&
+		sameID(t.ContainerID, other.ContainerID) &&
+		t.Codec == other.Codec &&
+		t.Profile == other.Profile &&
+		t.NumberOfScreens == other.NumberOfScreens &&
+		t.StartTimeSeconds == other.StartTimeSeconds &&
+		t.Width == other.Width &&
+		t.Height == other.Height
+}
+
+// Store the result for the operation, it is returned with the task
+func (t *TaskRequest) SetResult(result any) error {
+	r, err := NewTaskResult(result)
+	if err != nil {
+		return err
+	}
+	t.Result = r
+	return nil
 }
 
 // String is not required by pop and may be deleted
@@ -73,3 +73,53 @@ func TestTaskRequestsContainer(t *testing.T) {
 	check.Status = TaskStatus.ERROR
 	NoError(db.Save(&check), "Could not update task status", t)
 }
+
+func TestTaskRequestResult(t *testing.T) {
+	db := InitGorm(false)
+	SetupTests(db, t)
+
+	tr := TaskRequest{Status: TaskStatus.DONE, Operation: TaskOperation.TAGGING}
+	if err := tr.SetResult(TaggingTaskResult{Tags: []string{"donut"}}); err != nil {
+		t.Errorf("It should set the result %s", err)
+	}
+	NoError(db.Create(&tr), "It should save the result", t)
+
+	check := TaskRequest{}
+	NoError(db.Find(&check, tr.ID), "It should have the task request", t)
+	tagged := TaggingTaskResult{}
+	if err := check.Result.Decode(&tagged); err != nil || len(tagged.Tags) != 1 {
+		t.Errorf("The result did not come back out of the DB %s %s", check.Result, err)
+	}
+
+	empty := TaskRequest{Status: TaskStatus.NEW, Operation: TaskOperation.TAGGING}
+	NoError(db.Create(&empty), "A task without a result is fine", t)
+	NoError(db.Find(&check, empty.ID), "It should load a task without a result", t)
+	if !check.Result.IsEmpty() {
+		t.Errorf("There should not be a result %s", check.Result)
+	}
+}
+
+func TestTaskResultContains(t *testing.T) {
+	result, _ := NewTaskResult(EncodingTaskResult{SourceID: 3, Encoded: true, Codec: "hevc"})
+	dupes, _ := NewTaskResult(DuplicatesTaskResult{Duplicates: DuplicateContents{{KeepContentID: 1, DuplicateID: 2}}})
+
+	checks := []struct {
+		result   TaskResult
+		subset   string
+		contains bool
+	}{
+		{result, `{"encoded": true}`, true},
+		{result, `{"encoded": true, "codec": "hevc"}`, true},
+		{result, `{"encoded": false}`, false},
+		{result, `{"missing": 1}`, false},
+		{dupes, `{"duplicates": [{"duplicate_id": 2}]}`, true},
+		{dupes, `{"duplicates": [{"duplicate_id": 5}]}`, false},
+		{nil, `{"encoded": true}`, false},
+		{result, ``, true},
+	}
+	for _, check := range checks {
+		if check.result.Contains(TaskResult(check.subset)) != check.contains {
+			t.Errorf("%s contains %s should be %t", check.result, check.subset, check.contains)
+		}
+	}
+}
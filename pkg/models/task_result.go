@@ -0,0 +1,201 @@
+package models
+
+/**
+ * Structured results for a finished task, kept apart from the human readable Message so the UI
+ * and scripts can consume them.  The result is stored as raw JSON (a jsonb column in the DB),
+ * decode it with the struct matching the operation of the task.
+ */
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+type TaskResult json.RawMessage
+
+// ENCODING output file (relative to the container) and the stats of what was written
+type EncodingTaskResult struct {
+	SourceID    int64  `json:"source_id"`
+	Output      string `json:"output"`
+	SizeBytes   int64  `json:"size_bytes"`
+	BitRate     int64  `json:"bit_rate"`
+	Codec       string `json:"codec"`
+	Encoded     bool   `json:"encoded"` // False if there already was a valid encode
+	SourceBytes int64  `json:"source_bytes"`
+	BytesSaved  int64  `json:"bytes_saved"`      // Negative if the encode is larger than the source
+	Discarded   bool   `json:"discarded"`        // The encode did not save enough space and was removed
+	Reason      string `json:"reason,omitempty"` // Why nothing was encoded or the encode was discarded
+
+	Quality *VideoQuality `json:"quality,omitempty"` // Nil if the quality was not checked
+}
+
+// How an encode compares to the source, scores are 0-100 for vmaf, 0-1 for ssim and dB for psnr
+type VideoQuality struct {
+	Metric    string  `json:"metric"`
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	Passed    bool    `json:"passed"`
+}
+
+// SCREENS the screens created for the content
+type ScreensTaskResult struct {
+	ScreenIDs []int64 `json:"screen_ids"`
+	Pattern   string  `json:"pattern"`
+}
+
+// WEBP the preview that was created from the screens
+type WebpTaskResult struct {
+	Preview string `json:"preview"`
+}
+
+// HLS the url of the master playlist and the renditions (ie 720p) that were packaged
+type HlsTaskResult struct {
+	Master     string   `json:"master"`
+	Renditions []string `json:"renditions"`
+}
+
+// SUBTITLES the languages (subtitle route keys) extracted and any streams that could not be
+type SubtitlesTaskResult struct {
+	Extracted []string `json:"extracted"`
+	Skipped   []string `json:"skipped"` // Bitmap subtitles (pgs, dvd) cannot be converted to WebVTT
+}
+
+// TAGGING the tags (names) applied to the content
+type TaggingTaskResult struct {
+	Tags []string `json:"tags"`
+}
+
+// DUPES pairs of content where one is likely a duplicate of the other
+type DuplicatesTaskResult struct {
+	Duplicates DuplicateContents `json:"duplicates"`
+}
+
+// REMOVE_DUPLICATE_FILES how many content entries were removed
+type RemoveDuplicatesTaskResult struct {
+	Removed int `json:"removed"`
+}
+
+type DuplicateContent struct {
+	KeepContentID int64  `json:"keep_id"`
+	ContainerID   *int64 `json:"container_id"`
+	ContainerName string `json:"container_name"`
+	DuplicateID   int64  `json:"duplicate_id"`
+	KeepSrc       string `json:"keep_src"`
+	DuplicateSrc  string `json:"duplicate_src"`
+	FqPath        string `json:"-"`
+}
+type DuplicateContents []DuplicateContent
+
+func (dupe DuplicateContent) String() string {
+	s, _ := json.MarshalIndent(dupe, "", "  ")
+	return string(s)
+}
+
+func NewTaskResult(result any) (TaskResult, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return TaskResult(b), nil
+}
+
+// Decode the result into the struct for the operation
+func (r TaskResult) Decode(dest any) error {
+	if r.IsEmpty() {
+		return fmt.Errorf("there is no result to decode")
+	}
+	return json.Unmarshal(r, dest)
+}
+
+func (r TaskResult) IsEmpty() bool {
+	return len(r) == 0 || bytes.Equal(r, []byte("null"))
+}
+
+// Every key / value in the subset is in the result (the same as the postgres @> operator)
+func (r TaskResult) Contains(subset TaskResult) bool {
+	if subset.IsEmpty() {
+		return true
+	}
+	if r.IsEmpty() {
+		return false
+	}
+	var doc, sub any
+	if json.Unmarshal(r, &doc) != nil || json.Unmarshal(subset, &sub) != nil {
+		return false
+	}
+	return jsonContains(doc, sub)
+}
+
+func jsonContains(doc any, sub any) bool {
+	switch subVal := sub.(type) {
+	case map[string]any:
+		docMap, ok := doc.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, val := range subVal {
+			docVal, found := docMap[key]
+			if !found || !jsonContains(docVal, val) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		docArr, ok := doc.([]any)
+		if !ok {
+			return false
+		}
+		for _, val := range subVal {
+			found := false
+			for _, docVal := range docArr {
+				if jsonContains(docVal, val) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return doc == sub
+	}
+}
+
+func (r TaskResult) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (r *TaskResult) UnmarshalJSON(data []byte) error {
+	if r == nil {
+		return fmt.Errorf("TaskResult: UnmarshalJSON on nil pointer")
+	}
+	*r = append((*r)[0:0], data...)
+	return nil
+}
+
+func (r TaskResult) Value() (driver.Value, error) {
+	if r.IsEmpty() {
+		return nil, nil
+	}
+	return string(r), nil
+}
+
+func (r *TaskResult) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		*r = nil
+	case []byte:
+		*r = append(TaskResult{}, v...)
+	case string:
+		*r = TaskResult(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a TaskResult", value)
+	}
+	return nil
+}
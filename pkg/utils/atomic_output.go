@@ -0,0 +1,175 @@
+package utils
+
+/**
+ * ffmpeg output is written to a temp name next to the final file (the same directory so the rename
+ * is atomic), probed and only then renamed into place.  A killed or crashed ffmpeg leaves a temp
+ * file behind rather than a truncated output that looks like a finished encode, RemoveTempOutputs
+ * cleans those up when the app starts.
+ */
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Marks a file (or HLS package directory) that is still being written
+const TempOutputMarker = ".contented-tmp"
+
+// Temp outputs modified more recently than this are left alone at startup, a worker process sharing
+// the library could still be writing them.
+const TempOutputMinAge = 15 * time.Minute
+
+// Checks the temp output before it is renamed into place
+type OutputValidator func(ctx context.Context, tmpFile string) error
+
+// The temp name for dstFile, the extension is kept so ffmpeg picks the same muxer
+func TempOutputName(dstFile string) string {
+	ext := filepath.Ext(dstFile)
+	return strings.TrimSuffix(dstFile, ext) + TempOutputMarker + ext
+}
+
+func IsTempOutput(name string) bool {
+	return strings.Contains(filepath.Base(name), TempOutputMarker)
+}
+
+// ffprobe has to be able to read the output and find a stream in it
+func ProbeOutput(ctx context.Context, tmpFile string) (string, error) {
+	stat, err := os.Stat(tmpFile)
+	if err != nil {
+		return "", err
+	}
+	if stat.Size() == 0 {
+		return "", fmt.Errorf("output %s is empty", tmpFile)
+	}
+	info, err := ProbeContext(ctx, tmpFile)
+	if err != nil {
+		return "", fmt.Errorf("output %s could not be probed %w", tmpFile, err)
+	}
+	if len(gjson.Get(info, "streams").Array()) == 0 {
+		return "", fmt.Errorf("output %s has no streams", tmpFile)
+	}
+	return info, nil
+}
+
+func validateProbe(ctx context.Context, tmpFile string) error {
+	_, err := ProbeOutput(ctx, tmpFile)
+	return err
+}
+
+// The encode has to probe and be within a second of the source duration (0 skips the check)
+func ValidateEncodeDuration(srcDuration float64) OutputValidator {
+	return func(ctx context.Context, tmpFile string) error {
+		info, err := ProbeOutput(ctx, tmpFile)
+		if err != nil {
+			return err
+		}
+		duration := gjson.Get(info, "format.duration").Float()
+		if srcDuration > 0 && math.Abs(duration-srcDuration) > 1 {
+			return fmt.Errorf("output %s duration %.2f does not match the source %.2f", tmpFile, duration, srcDuration)
+		}
+		return nil
+	}
+}
+
+// Call write with the temp name for dstFile, then validate the temp file and rename it to dstFile.
+// When anything fails the temp file is removed and dstFile is left as it was.  A nil validate only
+// probes the output.
+func WriteOutputAtomic(ctx context.Context, dstFile string, write func(tmpFile string) error, validate OutputValidator) error {
+	if validate == nil {
+		validate = validateProbe
+	}
+	tmpFile := TempOutputName(dstFile)
+	err := write(tmpFile)
+	if ctx.Err() != nil {
+		RemovePartialOutput(tmpFile)
+		return ctx.Err()
+	}
+	if err == nil {
+		err = validate(ctx, tmpFile)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, dstFile)
+	}
+	if err != nil {
+		RemovePartialOutput(tmpFile)
+	}
+	return err
+}
+
+// Validate and rename the files ffmpeg wrote for an image sequence written to the temp name of the
+// dstPattern (name.%03d.jpg), invalid images are removed.  Returns the files renamed into place.
+func RenameTempSequence(ctx context.Context, dstPattern string) ([]string, error) {
+	tmpBase := filepath.Base(TempOutputName(dstPattern))
+	idx := strings.Index(tmpBase, "%")
+	if idx == -1 {
+		return nil, fmt.Errorf("%s is not an image sequence pattern", dstPattern)
+	}
+	prefix, suffix := tmpBase[:idx], TempOutputMarker+filepath.Ext(tmpBase)
+
+	dir := filepath.Dir(dstPattern)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	renamed := []string{}
+	errs := []error{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		tmpFile := filepath.Join(dir, name)
+		dstFile := filepath.Join(dir, strings.Replace(name, TempOutputMarker, "", 1))
+		if err := validateProbe(ctx, tmpFile); err != nil {
+			errs = append(errs, err)
+			RemovePartialOutput(tmpFile)
+			continue
+		}
+		if err := os.Rename(tmpFile, dstFile); err != nil {
+			errs = append(errs, err)
+			RemovePartialOutput(tmpFile)
+			continue
+		}
+		renamed = append(renamed, dstFile)
+	}
+	return renamed, errors.Join(errs...)
+}
+
+// Remove the temp outputs under dir left behind by a crash or kill, returns how many were removed.
+// Anything modified within minAge is skipped.
+func RemoveTempOutputs(dir string, minAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-minAge)
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s looking for temp outputs %s", path, err)
+			return nil
+		}
+		if path == dir || !IsTempOutput(d.Name()) {
+			return nil
+		}
+		info, infoErr := d.Info()
+		if infoErr == nil && info.ModTime().Before(cutoff) {
+			if rmErr := os.RemoveAll(path); rmErr != nil {
+				log.Printf("Failed to remove temp output %s %s", path, rmErr)
+			} else {
+				log.Printf("Removed orphaned temp output %s", path)
+				removed++
+			}
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
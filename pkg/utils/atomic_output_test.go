@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"contented/pkg/models"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempOutputName(t *testing.T) {
+	assert.Equal(t, "/lib/movie_h265.contented-tmp.mp4", TempOutputName("/lib/movie_h265.mp4"))
+	assert.Equal(t, "/lib/a.screens.%03dss00000.contented-tmp.jpg", TempOutputName("/lib/a.screens.%03dss00000.jpg"))
+	assert.True(t, IsTempOutput(TempOutputName("/lib/movie.mp4")))
+	assert.False(t, IsTempOutput("/lib/movie.mp4"))
+}
+
+func TestWriteOutputAtomic(t *testing.T) {
+	dir := t.TempDir()
+	dstFile := filepath.Join(dir, "encoded.mp4")
+	assert.NoError(t, os.WriteFile(dstFile, []byte("previous"), 0644))
+	write := func(tmpFile string) error {
+		assert.Equal(t, TempOutputName(dstFile), tmpFile)
+		return os.WriteFile(tmpFile, []byte("partial"), 0644)
+	}
+	pass := func(ctx context.Context, tmpFile string) error { return nil }
+	fail := func(ctx context.Context, tmpFile string) error { return errors.New("truncated") }
+
+	failed := func(tmpFile string) error {
+		write(tmpFile)
+		return errors.New("ffmpeg exited 1")
+	}
+	assert.Error(t, WriteOutputAtomic(context.Background(), dstFile, failed, pass))
+	assertOutput(t, dstFile, "previous", "A failed write leaves the existing output")
+
+	assert.ErrorContains(t, WriteOutputAtomic(context.Background(), dstFile, write, fail), "truncated")
+	assertOutput(t, dstFile, "previous", "Output that does not validate is not moved into place")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, WriteOutputAtomic(ctx, dstFile, write, pass), context.Canceled)
+	assertOutput(t, dstFile, "previous", "A canceled write is removed")
+
+	assert.NoError(t, WriteOutputAtomic(context.Background(), dstFile, write, pass))
+	assertOutput(t, dstFile, "partial", "Valid output replaces the old one")
+}
+
+func assertOutput(t *testing.T, dstFile string, expect string, msg string) {
+	data, err := os.ReadFile(dstFile)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, string(data), msg)
+	_, statErr := os.Stat(TempOutputName(dstFile))
+	assert.True(t, os.IsNotExist(statErr), "The temp file is always gone %s", msg)
+}
+
+func TestRenameTempSequence(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "a.screens.%03dss00000.jpg")
+	empty := filepath.Join(dir, "a.screens.001ss00000.contented-tmp.jpg")
+	other := filepath.Join(dir, "b.screens.001ss00000.contented-tmp.jpg")
+	assert.NoError(t, os.WriteFile(empty, []byte{}, 0644))
+	assert.NoError(t, os.WriteFile(other, []byte{}, 0644))
+
+	renamed, err := RenameTempSequence(context.Background(), pattern)
+	assert.Error(t, err, "An empty screen is not valid")
+	assert.Empty(t, renamed)
+	_, statErr := os.Stat(empty)
+	assert.True(t, os.IsNotExist(statErr), "Invalid screens are removed")
+	_, statErr = os.Stat(other)
+	assert.NoError(t, statErr, "Screens for other content are left alone")
+
+	_, err = RenameTempSequence(context.Background(), filepath.Join(dir, "single.jpg"))
+	assert.Error(t, err)
+}
+
+func TestRemoveTempOutputs(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	orphan := filepath.Join(dir, "sub", "movie_h265.contented-tmp.mp4")
+	writing := filepath.Join(dir, "sub", "other_h265.contented-tmp.mp4")
+	hlsDir := filepath.Join(dir, "stream", "3"+TempOutputMarker)
+	kept := filepath.Join(dir, "sub", "movie.mp4")
+	assert.NoError(t, os.MkdirAll(hlsDir, 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0755))
+	for _, name := range []string{orphan, writing, kept, filepath.Join(hlsDir, "720p.m3u8")} {
+		assert.NoError(t, os.WriteFile(name, []byte("1"), 0644))
+	}
+	for _, name := range []string{orphan, kept, hlsDir} {
+		assert.NoError(t, os.Chtimes(name, old, old))
+	}
+
+	removed, err := RemoveTempOutputs(dir, TempOutputMinAge)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed, "The old temp file and temp HLS directory")
+	for name, exists := range map[string]bool{orphan: false, hlsDir: false, writing: true, kept: true} {
+		_, statErr := os.Stat(name)
+		assert.Equal(t, exists, statErr == nil, "%s exists %t", name, exists)
+	}
+}
+
+func TestFindContentSkipsTempOutputs(t *testing.T) {
+	cnt := models.Container{ID: 1, Path: t.TempDir(), Name: "temp_outputs"}
+	assert.NoError(t, os.MkdirAll(cnt.GetFqPath(), 0755))
+	for _, name := range []string{"a.mp4", "a_h265.contented-tmp.mp4"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), name), []byte("1"), 0644))
+	}
+	contents := FindContent(cnt, 10, 0)
+	assert.Equal(t, 1, len(contents), "An unfinished encode is not content")
+}
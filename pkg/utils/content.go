@@ -90,11 +90,14 @@ func FindContentMatcher(cnt models.Container, limit int64, start_offset int, yup
 	total := 0
 	imgs := []os.FileInfo{} // To get indexing 'right' you have to exclude directories
 	for _, img := range maybe_content {
-		if !img.IsDir() {
+		// Output ffmpeg has not finished writing (or an orphan from a crash)
+		if !img.IsDir() && !IsTempOutput(img.Name()) {
 			info, _ := img.Info()
 			imgs = append(imgs, info)
 		}
 	}
+	// Subtitle files are attached to their video rather than being content themselves
+	imgs, subtitles := MatchSidecarSubtitles(imgs)
 
 	for idx, img := range imgs {
 		if !img.IsDir() {
@@ -103,6 +106,7 @@ func FindContentMatcher(cnt models.Container, limit int64, start_offset int, yup
 				content := GetContent(id, img, fqDirPath)
 				content.ContainerID = &cnt.ID
 				content.Idx = idx
+				content.Subtitles = subtitles[img.Name()]
 
 				if yup(content.Src, content.ContentType) && !nope(content.Src, content.ContentType) {
 					arr = append(arr, content)
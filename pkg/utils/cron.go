@@ -0,0 +1,228 @@
+package utils
+
+/**
+ * Minimal cron expressions for the task scheduler (minute hour day-of-month month day-of-week)
+ * plus daily time windows ("01:00-06:00") to keep heavy work to the quiet hours.  Supports *,
+ * lists (1,15), ranges (1-5), steps (*\/15, 0-30/10) and the @hourly / @daily / @weekly /
+ * @monthly shortcuts.  Times are in the local timezone of the server.
+ */
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CronExpression struct {
+	Expr    string
+	minutes [60]bool
+	hours   [24]bool
+	days    [32]bool // 1-31
+	months  [13]bool // 1-12
+	weekday [7]bool  // 0 is Sunday
+
+	// Standard cron matches either day field when both are restricted
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+func ParseCron(expr string) (*CronExpression, error) {
+	expanded := strings.TrimSpace(expr)
+	if shortcut, ok := cronShortcuts[expanded]; ok {
+		expanded = shortcut
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields (minute hour day month weekday)", expr)
+	}
+	cron := &CronExpression{Expr: expr}
+	if err := parseCronField(fields[0], 0, 59, cron.minutes[:]); err != nil {
+		return nil, fmt.Errorf("cron %q minute %s", expr, err)
+	}
+	if err := parseCronField(fields[1], 0, 23, cron.hours[:]); err != nil {
+		return nil, fmt.Errorf("cron %q hour %s", expr, err)
+	}
+	if err := parseCronField(fields[2], 1, 31, cron.days[:]); err != nil {
+		return nil, fmt.Errorf("cron %q day of month %s", expr, err)
+	}
+	if err := parseCronField(fields[3], 1, 12, cron.months[:]); err != nil {
+		return nil, fmt.Errorf("cron %q month %s", expr, err)
+	}
+
+	// 7 is also Sunday
+	weekday := [8]bool{}
+	if err := parseCronField(fields[4], 0, 7, weekday[:]); err != nil {
+		return nil, fmt.Errorf("cron %q day of week %s", expr, err)
+	}
+	copy(cron.weekday[:], weekday[:7])
+	cron.weekday[0] = cron.weekday[0] || weekday[7]
+
+	cron.anyDay = fields[2] == "*"
+	cron.anyWeekday = fields[4] == "*"
+	return cron, nil
+}
+
+func parseCronField(field string, min int, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			s, err := strconv.Atoi(stepPart)
+			if err != nil || s <= 0 {
+				return fmt.Errorf("invalid step %q", part)
+			}
+			step = s
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			lowStr, highStr, isRange := strings.Cut(rangePart, "-")
+			low, err := strconv.Atoi(lowStr)
+			if err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			start, end = low, low
+			if isRange {
+				high, err := strconv.Atoi(highStr)
+				if err != nil {
+					return fmt.Errorf("invalid range %q", part)
+				}
+				end = high
+			} else if hasStep {
+				end = max // 5/15 means starting at 5
+			}
+		}
+		if start < min || end > max || start > end {
+			return fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c *CronExpression) matchesDay(t time.Time) bool {
+	dayMatch := c.days[t.Day()]
+	weekdayMatch := c.weekday[int(t.Weekday())]
+	if c.anyDay || c.anyWeekday {
+		return dayMatch && weekdayMatch
+	}
+	return dayMatch || weekdayMatch
+}
+
+// Next is the first matching minute strictly after t, zero if nothing matches within 5 years
+// (the 31st of February).
+func (c *CronExpression) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		if !c.months[int(next.Month())] {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !c.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !c.hours[next.Hour()] {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+		if !c.minutes[next.Minute()] {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+func (c *CronExpression) String() string {
+	return c.Expr
+}
+
+// A daily window between two clock times, the end can be past midnight (22:00-04:00)
+type TimeWindow struct {
+	Start time.Duration // Offset from midnight
+	End   time.Duration
+}
+
+// Parse "HH:MM-HH:MM", an empty string is no window (nil)
+func ParseTimeWindow(window string) (*TimeWindow, error) {
+	window = strings.TrimSpace(window)
+	if window == "" {
+		return nil, nil
+	}
+	startStr, endStr, found := strings.Cut(window, "-")
+	if !found {
+		return nil, fmt.Errorf("time window %q should look like 01:00-06:00", window)
+	}
+	start, err := parseClock(startStr)
+	if err != nil {
+		return nil, fmt.Errorf("time window %q %s", window, err)
+	}
+	end, err := parseClock(endStr)
+	if err != nil {
+		return nil, fmt.Errorf("time window %q %s", window, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("time window %q is empty", window)
+	}
+	return &TimeWindow{Start: start, End: end}, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// Contains is true if the clock time of t is inside the window (the end is exclusive)
+func (w *TimeWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	clock := sinceMidnight(t)
+	if w.Start < w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
+}
+
+// NextStart is t if it is inside the window, otherwise when the window opens next
+func (w *TimeWindow) NextStart(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start := midnight.Add(w.Start)
+	if !start.After(t) {
+		start = midnight.AddDate(0, 0, 1).Add(w.Start)
+	}
+	return start
+}
+
+func (w *TimeWindow) String() string {
+	if w == nil {
+		return ""
+	}
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
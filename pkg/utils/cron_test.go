@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{"* * * * *", "0 1 * * *", "*/15 0-6 1,15 * 1-5", "30 4 * * 7", "@daily", "5/10 * * * *"}
+	for _, expr := range valid {
+		_, err := ParseCron(expr)
+		assert.NoError(t, err, expr)
+	}
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"}
+	for _, expr := range invalid {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return parsed
+	}
+	checks := []struct {
+		expr string
+		from string
+		next string
+	}{
+		{"0 1 * * *", "2024-03-10 00:30", "2024-03-10 01:00"},
+		{"0 1 * * *", "2024-03-10 01:00", "2024-03-11 01:00"},
+		{"*/15 * * * *", "2024-03-10 10:07", "2024-03-10 10:15"},
+		{"30 4 * * 0", "2024-03-11 00:00", "2024-03-17 04:30"}, // Next Sunday
+		{"0 0 1 * *", "2024-12-15 12:00", "2025-01-01 00:00"},
+		{"0 0 13 * 5", "2024-03-10 00:00", "2024-03-13 00:00"}, // 13th or a Friday, the 13th comes first
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+	}
+	for _, check := range checks {
+		cron, err := ParseCron(check.expr)
+		assert.NoError(t, err)
+		assert.Equal(t, at(check.next), cron.Next(at(check.from)), check.expr)
+	}
+
+	never, _ := ParseCron("0 0 31 2 *")
+	assert.True(t, never.Next(time.Now()).IsZero(), "February 31st never comes")
+}
+
+func TestTimeWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return parsed
+	}
+	none, err := ParseTimeWindow("")
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+	assert.True(t, none.Contains(at("2024-03-10 12:00")), "No window is always open")
+
+	night, err := ParseTimeWindow("01:00-06:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "01:00-06:00", night.String())
+	assert.True(t, night.Contains(at("2024-03-10 01:00")))
+	assert.False(t, night.Contains(at("2024-03-10 06:00")), "The end is exclusive")
+	assert.Equal(t, at("2024-03-11 01:00"), night.NextStart(at("2024-03-10 12:00")))
+	assert.Equal(t, at("2024-03-10 01:00"), night.NextStart(at("2024-03-10 00:10")))
+
+	wrap, err := ParseTimeWindow("22:00-04:00")
+	assert.NoError(t, err)
+	assert.True(t, wrap.Contains(at("2024-03-10 23:30")))
+	assert.True(t, wrap.Contains(at("2024-03-10 03:59")))
+	assert.False(t, wrap.Contains(at("2024-03-10 12:00")))
+	assert.Equal(t, at("2024-03-10 22:00"), wrap.NextStart(at("2024-03-10 12:00")))
+
+	for _, bad := range []string{"01:00", "25:00-06:00", "01:00-01:00"} {
+		_, err := ParseTimeWindow(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,285 @@
+package utils
+
+/**
+ * A dry run of an encoding pass.  Each video goes through the same ShouldEncodeVideo decision as a
+ * real encode but nothing is written, instead the output size and CPU time are estimated so a large
+ * library can be checked before it is encoded.  The estimates are rough ratios per codec (and the
+ * profile bitrate when there is no crf), not a trial encode.
+ */
+import (
+	"contented/pkg/config"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	EncodePlanEncode = "encode"
+	EncodePlanSkip   = "skip"
+	EncodePlanError  = "error"
+)
+
+// How many bits a codec needs for the same quality relative to h264
+var CodecBitsRatio = map[string]float64{
+	"mpeg1video": 2.5,
+	"mpeg2video": 2.0,
+	"h263":       1.8,
+	"flv1":       1.8,
+	"wmv1":       1.8,
+	"wmv2":       1.8,
+	"msmpeg4v2":  1.6,
+	"msmpeg4v3":  1.6,
+	"mpeg4":      1.5,
+	"wmv3":       1.4,
+	"vc1":        1.3,
+	"theora":     1.4,
+	"vp8":        1.1,
+	"h264":       1.0,
+	"vp9":        0.65,
+	"hevc":       0.6,
+	"av1":        0.5,
+}
+
+// Used for codecs missing from CodecBitsRatio (mostly old ones)
+const DefaultCodecBitsRatio = 1.3
+
+// Used for encoders without CpuSeconds in VideoEncoders
+const DefaultEncoderCpuSeconds = 2.0
+
+const planReferencePixels = 1920 * 1080
+
+type EncodePlanEntry struct {
+	ContentID           int64   `json:"content_id"`
+	ContainerID         int64   `json:"container_id"`
+	File                string  `json:"file"`
+	Codec               string  `json:"codec"`
+	Width               int     `json:"width"`
+	Height              int     `json:"height"`
+	BitRate             int64   `json:"bit_rate"`
+	Duration            float64 `json:"duration"`
+	SizeBytes           int64   `json:"size_bytes"`
+	Decision            string  `json:"decision"` // encode, skip or error
+	Reason              string  `json:"reason"`
+	EstimatedBytes      int64   `json:"estimated_bytes"` // Only set when the decision is encode
+	EstimatedCpuSeconds float64 `json:"estimated_cpu_seconds"`
+}
+
+// Totals for all the files with the same source codec
+type EncodePlanTotal struct {
+	Codec               string  `json:"codec"`
+	Files               int     `json:"files"`
+	Encode              int     `json:"encode"`
+	SourceBytes         int64   `json:"source_bytes"` // Of the files that would be encoded
+	EstimatedBytes      int64   `json:"estimated_bytes"`
+	EstimatedSavings    int64   `json:"estimated_savings"`
+	EstimatedCpuSeconds float64 `json:"estimated_cpu_seconds"`
+}
+
+type EncodePlan struct {
+	Profile string            `json:"profile"`
+	Codec   string            `json:"codec"` // The encoder the profile uses
+	Entries []EncodePlanEntry `json:"entries"`
+	Totals  []EncodePlanTotal `json:"totals"` // By source codec, largest savings first
+	Total   EncodePlanTotal   `json:"total"`
+}
+
+func NewEncodePlan(profile *config.EncodingProfile) *EncodePlan {
+	return &EncodePlan{
+		Profile: profile.Name,
+		Codec:   profile.Codec,
+		Entries: []EncodePlanEntry{},
+		Totals:  []EncodePlanTotal{},
+		Total:   EncodePlanTotal{Codec: "all"},
+	}
+}
+
+// Add an entry and update the totals for its codec
+func (plan *EncodePlan) Add(entry EncodePlanEntry) {
+	plan.Entries = append(plan.Entries, entry)
+	codec := entry.Codec
+	if codec == "" {
+		codec = "unknown"
+	}
+	idx := -1
+	for i, total := range plan.Totals {
+		if total.Codec == codec {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		plan.Totals = append(plan.Totals, EncodePlanTotal{Codec: codec})
+		idx = len(plan.Totals) - 1
+	}
+	plan.Totals[idx].add(entry)
+	plan.Total.add(entry)
+	sort.SliceStable(plan.Totals, func(i, j int) bool {
+		return plan.Totals[i].EstimatedSavings > plan.Totals[j].EstimatedSavings
+	})
+}
+
+func (total *EncodePlanTotal) add(entry EncodePlanEntry) {
+	total.Files++
+	if entry.Decision != EncodePlanEncode {
+		return
+	}
+	total.Encode++
+	total.SourceBytes += entry.SizeBytes
+	total.EstimatedBytes += entry.EstimatedBytes
+	total.EstimatedSavings += entry.SizeBytes - entry.EstimatedBytes
+	total.EstimatedCpuSeconds += entry.EstimatedCpuSeconds
+}
+
+// Run the encoding decision for the srcFile without encoding it and estimate the result.  A
+// skipReason (an earlier encode was discarded) skips the source but still reports its stats.
+func PlanVideoEncode(srcFile string, dstFile string, profile *config.EncodingProfile, skipReason string) EncodePlanEntry {
+	entry := EncodePlanEntry{File: srcFile}
+	codecName, size, invalid, srcInfo := IsValidVideo(srcFile)
+	entry.Codec = codecName
+	entry.SizeBytes = size
+	if invalid != nil {
+		entry.Decision = EncodePlanSkip
+		entry.Reason = fmt.Sprintf("Not valid video %s", invalid)
+		return entry
+	}
+	entry.Width, entry.Height = GetVideoResolution(srcInfo)
+	entry.BitRate = EstimateVideoBitrate(srcInfo)
+	entry.Duration = gjson.Get(srcInfo, "format.duration").Float()
+	if skipReason != "" {
+		entry.Decision = EncodePlanSkip
+		entry.Reason = skipReason
+		return entry
+	}
+
+	msg, err, shouldEncode, scale := shouldEncodeProbed(srcFile, codecName, srcInfo, dstFile, profile)
+	entry.Reason = msg
+	switch {
+	case err != nil:
+		entry.Decision = EncodePlanError
+		entry.Reason = fmt.Sprintf("%s %s", msg, err)
+	case shouldEncode:
+		entry.Decision = EncodePlanEncode
+		entry.EstimatedBytes, entry.EstimatedCpuSeconds = EstimateEncode(profile, &entry, scale)
+	default:
+		entry.Decision = EncodePlanSkip
+	}
+	return entry
+}
+
+// The output size and CPU seconds to encode the entry with the profile
+func EstimateEncode(profile *config.EncodingProfile, entry *EncodePlanEntry, scale bool) (int64, float64) {
+	pixelRatio := 1.0
+	if scale && entry.Width > 0 && entry.Height > 0 {
+		width, height := ScaledSize(profile.MaxWidth, profile.MaxHeight, entry.Width, entry.Height)
+		pixelRatio = float64(width*height) / float64(entry.Width*entry.Height)
+	}
+
+	estimated := int64(0)
+	if bitRate := ParseBitrate(profile.Bitrate); profile.Crf == 0 && bitRate > 0 && entry.Duration > 0 {
+		estimated = int64(float64(bitRate) * entry.Duration / 8)
+	} else {
+		targetCodec := profile.CodecName
+		if targetCodec == "" {
+			targetCodec = EncoderCodecName(profile.Codec)
+		}
+		ratio := codecBitsRatio(targetCodec) / codecBitsRatio(entry.Codec)
+		estimated = int64(math.Round(float64(entry.SizeBytes) * ratio * pixelRatio))
+	}
+
+	cpuSeconds := DefaultEncoderCpuSeconds
+	if encoder := GetVideoEncoder(profile.Codec); encoder != nil && encoder.CpuSeconds > 0 {
+		cpuSeconds = encoder.CpuSeconds
+	}
+	pixels := 1.0
+	if entry.Width > 0 && entry.Height > 0 {
+		pixels = float64(entry.Width*entry.Height) * pixelRatio / planReferencePixels
+	}
+	return estimated, cpuSeconds * entry.Duration * pixels
+}
+
+func codecBitsRatio(codec string) float64 {
+	if ratio, ok := CodecBitsRatio[codec]; ok {
+		return ratio
+	}
+	return DefaultCodecBitsRatio
+}
+
+// The size the ScaleFilter would produce for a width x height source
+func ScaledSize(maxWidth int, maxHeight int, width int, height int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	return int(float64(width) * scale), int(float64(height) * scale)
+}
+
+// An ffmpeg bitrate (800k, 4M or plain bits) in bits per second, 0 if it cannot be parsed
+func ParseBitrate(bitRate string) int64 {
+	bitRate = strings.TrimSpace(bitRate)
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(bitRate, "k") || strings.HasSuffix(bitRate, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(bitRate, "M"):
+		multiplier = 1000 * 1000
+	}
+	if multiplier > 1 {
+		bitRate = bitRate[:len(bitRate)-1]
+	}
+	value, err := strconv.ParseFloat(bitRate, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return int64(value * multiplier)
+}
+
+// A human readable size for the plan table
+func FormatBytes(size int64) string {
+	abs := math.Abs(float64(size))
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for abs >= 1024 && unit < len(units)-1 {
+		abs /= 1024
+		unit++
+	}
+	if size < 0 {
+		abs = -abs
+	}
+	return fmt.Sprintf("%.1f%s", abs, units[unit])
+}
+
+// Write the plan as a table with the totals by codec at the end
+func (plan *EncodePlan) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Encoding plan for profile %s (%s)\n\n", plan.Profile, plan.Codec)
+	fmt.Fprintln(w, "FILE\tCODEC\tRESOLUTION\tBITRATE\tDURATION\tSIZE\tDECISION\tESTIMATED\tREASON")
+	for _, entry := range plan.Entries {
+		estimated := "-"
+		if entry.Decision == EncodePlanEncode {
+			estimated = FormatBytes(entry.EstimatedBytes)
+		}
+		reason := strings.ReplaceAll(entry.Reason, "\n", " ")
+		fmt.Fprintf(w, "%s\t%s\t%dx%d\t%dk\t%.0fs\t%s\t%s\t%s\t%s\n",
+			filepath.Base(entry.File), entry.Codec, entry.Width, entry.Height, entry.BitRate/1000,
+			entry.Duration, FormatBytes(entry.SizeBytes), entry.Decision, estimated, reason,
+		)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CODEC\tFILES\tENCODE\tSOURCE\tESTIMATED\tSAVINGS\tCPU HOURS")
+	for _, total := range append(plan.Totals, plan.Total) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%.1f\n",
+			total.Codec, total.Files, total.Encode, FormatBytes(total.SourceBytes),
+			FormatBytes(total.EstimatedBytes), FormatBytes(total.EstimatedSavings), total.EstimatedCpuSeconds/3600,
+		)
+	}
+	return w.Flush()
+}
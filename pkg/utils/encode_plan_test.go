@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"contented/pkg/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBitrate(t *testing.T) {
+	assert.Equal(t, int64(800000), ParseBitrate("800k"))
+	assert.Equal(t, int64(4000000), ParseBitrate("4M"))
+	assert.Equal(t, int64(2500000), ParseBitrate("2.5M"))
+	assert.Equal(t, int64(1500000), ParseBitrate("1500000"))
+	assert.Equal(t, int64(0), ParseBitrate(""))
+	assert.Equal(t, int64(0), ParseBitrate("fast"))
+}
+
+func TestEstimateEncode(t *testing.T) {
+	profile := config.EncodingProfile{Name: "test", Codec: "libx265", CodecName: "hevc"}
+	entry := EncodePlanEntry{Codec: "h264", Width: 1920, Height: 1080, Duration: 100, SizeBytes: 1000000}
+	size, cpu := EstimateEncode(&profile, &entry, false)
+	assert.Equal(t, int64(600000), size, "hevc needs 60% of the h264 bits")
+	assert.Equal(t, 400.0, cpu, "libx265 takes 4 CPU seconds per 1080p second")
+
+	profile.MaxWidth, profile.MaxHeight = 960, 540
+	size, cpu = EstimateEncode(&profile, &entry, true)
+	assert.Equal(t, int64(150000), size, "A quarter of the pixels")
+	assert.Equal(t, 100.0, cpu)
+
+	// A fixed bitrate ignores the source size
+	bitrate := config.EncodingProfile{Name: "bitrate", Codec: "libx264", Bitrate: "800k"}
+	size, cpu = EstimateEncode(&bitrate, &entry, false)
+	assert.Equal(t, int64(10000000), size, "800kbps for 100 seconds")
+	assert.Equal(t, 100.0, cpu)
+
+	unknown := EncodePlanEntry{Codec: "cinepak", Duration: 10, SizeBytes: 1300}
+	size, cpu = EstimateEncode(&config.EncodingProfile{Codec: "libx264"}, &unknown, false)
+	assert.Equal(t, int64(1000), size, "Unknown codecs use the default ratio")
+	assert.Equal(t, 10.0, cpu, "No resolution is treated as 1080p")
+	_, cpu = EstimateEncode(&config.EncodingProfile{Codec: "made_up"}, &unknown, false)
+	assert.Equal(t, DefaultEncoderCpuSeconds*10, cpu, "Unknown encoders use the default speed")
+}
+
+func TestEncodePlanTotals(t *testing.T) {
+	plan := NewEncodePlan(&config.EncodingProfile{Name: "default", Codec: "libx265"})
+	plan.Add(EncodePlanEntry{File: "/a/one.avi", Codec: "mpeg4", Decision: EncodePlanEncode, SizeBytes: 1000, EstimatedBytes: 400, EstimatedCpuSeconds: 10})
+	plan.Add(EncodePlanEntry{File: "/a/two.mp4", Codec: "h264", Decision: EncodePlanEncode, SizeBytes: 3000, EstimatedBytes: 1800, EstimatedCpuSeconds: 30})
+	plan.Add(EncodePlanEntry{File: "/a/three.mp4", Codec: "hevc", Decision: EncodePlanSkip, SizeBytes: 500, Reason: "Already in the desired codec"})
+	plan.Add(EncodePlanEntry{File: "/a/four.avi", Codec: "mpeg4", Decision: EncodePlanEncode, SizeBytes: 1000, EstimatedBytes: 1200, EstimatedCpuSeconds: 5})
+
+	assert.Equal(t, 4, len(plan.Entries))
+	assert.Equal(t, []string{"h264", "mpeg4", "hevc"}, []string{plan.Totals[0].Codec, plan.Totals[1].Codec, plan.Totals[2].Codec}, "Largest savings first")
+	mpeg4 := plan.Totals[1]
+	assert.Equal(t, 2, mpeg4.Files)
+	assert.Equal(t, int64(400), mpeg4.EstimatedSavings, "A larger estimate counts against the savings")
+	assert.Equal(t, 15.0, mpeg4.EstimatedCpuSeconds)
+	assert.Equal(t, 0, plan.Totals[2].Encode)
+
+	assert.Equal(t, 4, plan.Total.Files)
+	assert.Equal(t, 3, plan.Total.Encode)
+	assert.Equal(t, int64(5000), plan.Total.SourceBytes, "Skipped files are not in the source bytes")
+	assert.Equal(t, int64(1600), plan.Total.EstimatedSavings)
+
+	out := bytes.Buffer{}
+	assert.NoError(t, plan.WriteTable(&out))
+	assert.Contains(t, out.String(), "three.mp4")
+	assert.Contains(t, out.String(), "Already in the desired codec")
+	assert.Contains(t, out.String(), "CPU HOURS")
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512.0B", FormatBytes(512))
+	assert.Equal(t, "1.5KB", FormatBytes(1536))
+	assert.Equal(t, "-2.0GB", FormatBytes(-2*1024*1024*1024))
+}
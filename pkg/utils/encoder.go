@@ -1,11 +1,12 @@
 package utils
 
 /**
- * These functions deal with using ffmpeg to encode video to new formats (h265)
+ * These functions deal with using ffmpeg to encode video to new formats (h265, av1, vp9)
  */
 import (
 	"contented/pkg/config"
 	"contented/pkg/models"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/tidwall/gjson"
@@ -31,6 +33,9 @@ type EncodingResult struct {
 	// We should ensure that there are some stats gathered around this.
 	InitialSize int64
 	EncodedSize int64
+
+	// Why the encode was removed after it finished (it did not save ENCODING_MIN_SAVINGS etc)
+	Discarded string
 }
 
 type EncodingRequest struct {
@@ -81,40 +86,103 @@ func IsValidVideo(srcFile string) (string, int64, error, string) {
 	return codecName, fileSize, nil, vidInfo
 }
 
+// The codec, size and bit rate (bits per second) of a video, used to report what an encode wrote
+func GetVideoStats(srcFile string) (string, int64, int64, error) {
+	codecName, fileSize, err, vidInfo := IsValidVideo(srcFile)
+	if err != nil {
+		return codecName, fileSize, 0, err
+	}
+	bitRate := gjson.Get(vidInfo, "format.bit_rate").Int()
+	return codecName, fileSize, bitRate, nil
+}
+
 // Expand this into something that can trim down the video info to the little bits we care about
 func GetVideoInfo(srcFile string) (string, error) {
 	return ffmpeg.Probe(srcFile)
 }
 
+// The bitrate (bits per second) of the video stream, mkv often only has the overall bitrate so that
+// or the size over the duration is used instead.  0 if it could not be determined.
+func EstimateVideoBitrate(vidInfo string) int64 {
+	if bitRate := gjson.Get(vidInfo, `streams.#(codec_type=="video").bit_rate`).Int(); bitRate > 0 {
+		return bitRate
+	}
+	if bitRate := gjson.Get(vidInfo, "format.bit_rate").Int(); bitRate > 0 {
+		return bitRate
+	}
+	duration := gjson.Get(vidInfo, "format.duration").Float()
+	size := gjson.Get(vidInfo, "format.size").Int()
+	if duration > 0 && size > 0 {
+		return int64(float64(size*8) / duration)
+	}
+	return 0
+}
+
+// The width and height of the first video stream, 0 if they could not be determined
+func GetVideoResolution(vidInfo string) (int, int) {
+	stream := gjson.Get(vidInfo, `streams.#(codec_type=="video")`)
+	return int(stream.Get("width").Int()), int(stream.Get("height").Int())
+}
+
 /**
  *  This returns a message about what is happening with the encoding (should it do it etc).
  */
 func ShouldEncodeVideo(srcFile string, dstFile string) (string, error, bool) {
+	profile := DefaultEncodingProfile(config.GetCfg())
+	return ShouldEncodeVideoProfile(srcFile, dstFile, &profile)
+}
+
+// ShouldEncodeVideo for a profile, video already in the profile codec is still encoded if it is
+// larger than the profile max resolution.
+func ShouldEncodeVideoProfile(srcFile string, dstFile string, profile *config.EncodingProfile) (string, error, bool) {
+	msg, err, shouldEncode, _ := shouldEncodeVideo(srcFile, dstFile, profile)
+	return msg, err, shouldEncode
+}
+
+// Also returns if the source has to be scaled down to fit the profile
+func shouldEncodeVideo(srcFile string, dstFile string, profile *config.EncodingProfile) (string, error, bool, bool) {
 	codecName, _, videoInvalid, srcInfo := IsValidVideo(srcFile)
 	if videoInvalid != nil {
-		return fmt.Sprintf("Not valid video %s", videoInvalid), nil, false
+		return fmt.Sprintf("Not valid video %s", videoInvalid), nil, false, false
 	}
+	return shouldEncodeProbed(srcFile, codecName, srcInfo, dstFile, profile)
+}
 
+// The encoding decision for a source that was already probed (IsValidVideo)
+func shouldEncodeProbed(srcFile string, codecName string, srcInfo string, dstFile string, profile *config.EncodingProfile) (string, error, bool, bool) {
 	// Check that the converted file doesn't exist
 	cfg := config.GetCfg()
-	log.Printf("The current src codec %s checking if we should convert to %s", codecName, cfg.CodecForConversion)
+	width, height := GetVideoResolution(srcInfo)
+	scale := NeedsScaling(profile, width, height)
+	log.Printf("The current src codec %s %dx%d checking if we should convert to %s with profile %s", codecName, width, height, profile.Codec, profile.Name)
+
+	if !scale {
+		// The Codec is NOT the name of the thing you convert to (libx265 makes hevc)
+		if profile.Codec == codecName || profile.CodecName == codecName {
+			okMsg := fmt.Sprintf("%s Already in the desired codec %s", srcFile, profile.Codec)
+			return okMsg, nil, false, scale
+		}
 
-	// The CodecForConversion is NOT the name of the thing you convert to...
-	if cfg.CodecForConversion == codecName {
-		okMsg := fmt.Sprintf("%s Already in the desired codec %s", srcFile, cfg.CodecForConversion)
-		return okMsg, nil, false
-	}
+		// The conversion lists are for the default pass over the library, a named profile is asked for
+		if profile.Name == config.DefaultEncodingProfileName {
+			matcher := regexp.MustCompile(cfg.CodecsToConvert)
+			if !matcher.MatchString(codecName) {
+				ignoreMsg := fmt.Sprintf("%s Not on the conversion list %s", srcFile, cfg.CodecsToConvert)
+				return ignoreMsg, nil, false, scale
+			}
+			ignore := regexp.MustCompile(cfg.CodecsToIgnore)
+			if ignore.MatchString(codecName) {
+				ignoreMsg := fmt.Sprintf("%s ignored because it matched %s", srcFile, cfg.CodecsToIgnore)
+				return ignoreMsg, nil, false, scale
+			}
+		}
 
-	// TODO: Config setting where if the filesize is too small we should _NOT_ reencode
-	matcher := regexp.MustCompile(cfg.CodecsToConvert)
-	if !matcher.MatchString(codecName) {
-		ignoreMsg := fmt.Sprintf("%s Not on the conversion list %s", srcFile, cfg.CodecsToConvert)
-		return ignoreMsg, nil, false
-	}
-	ignore := regexp.MustCompile(cfg.CodecsToIgnore)
-	if ignore.MatchString(codecName) {
-		ignoreMsg := fmt.Sprintf("%s ignored because it matched %s", srcFile, cfg.CodecsToIgnore)
-		return ignoreMsg, nil, false
+		// Already efficient sources tend to come out of an encode larger than they went in
+		bitRate := EstimateVideoBitrate(srcInfo)
+		if cfg.EncodingMinBitrate > 0 && bitRate > 0 && bitRate < int64(cfg.EncodingMinBitrate)*1000 {
+			lowMsg := fmt.Sprintf("%s bitrate %dk is already under ENCODING_MIN_BITRATE %dk", srcFile, bitRate/1000, cfg.EncodingMinBitrate)
+			return lowMsg, nil, false, scale
+		}
 	}
 
 	// Now checks that the video is ACTUALLY proper or at least the same time
@@ -125,7 +193,7 @@ func ShouldEncodeVideo(srcFile string, dstFile string) (string, error, bool) {
 			// This should fail a test (might need to dump junk in the file)
 			msg := fmt.Sprintf("File %s exists but cannot probe dst video info (likely corrupt so re-encode) err: %s", dstFile, err)
 			log.Print(msg)
-			return msg, nil, true
+			return msg, nil, true, scale
 		} else {
 			// Check the times (the name maybe the same but the content might differ if the time is off then re-encode)
 			existsMsg := fmt.Sprintf("Destination file already exists %s checking if it is valid", dstFile)
@@ -138,81 +206,109 @@ func ShouldEncodeVideo(srcFile string, dstFile string) (string, error, bool) {
 			if int(srcDuration) == int(dstDuration) { // Within minimal amount length?
 				existsMsg = fmt.Sprintf("Done %s exists and has source duration %d", dstFile, int(srcDuration))
 				log.Print(existsMsg)
-				return existsMsg, nil, false
+				return existsMsg, nil, false, scale
 			} else {
 				msg := fmt.Sprintf("%s Existed but did NOT have the same duration src(%f) vs dst(%f)", dstFile, srcDuration, dstDuration)
 				log.Print(msg)
-				return msg, nil, true
+				return msg, nil, true, scale
 			}
 		}
 	}
-	msg := fmt.Sprintf("File will be converted from %s to %s\nOld File: %s\nNew File: %s", codecName, cfg.CodecForConversion, srcFile, dstFile)
-	return msg, nil, true
+	msg := fmt.Sprintf("File will be converted from %s to %s (profile %s)\nOld File: %s\nNew File: %s", codecName, profile.Codec, profile.Name, srcFile, dstFile)
+	if scale {
+		msg += fmt.Sprintf("\nScaled down from %dx%d", width, height)
+	}
+	return msg, nil, true, scale
 }
 
 // Just rename to something with the previous extension stripped
 func GetVideoConversionName(srcFile string) string {
-	path := filepath.Dir(srcFile)
-	filename := filepath.Base(srcFile)
-	ext := filepath.Ext(filename)
+	profile := DefaultEncodingProfile(config.GetCfg())
+	return GetProfileConversionName(srcFile, &profile)
+}
 
-	cfg := config.GetCfg()
-	if cfg.EncodingDestination != "" {
-		path = cfg.EncodingDestination
-	}
-	stripExtension := regexp.MustCompile(fmt.Sprintf("%s$", ext))
-	extension := fmt.Sprintf("%s.mp4", cfg.EncodingFilenameModifier)
-	newFilename := stripExtension.ReplaceAllString(filename, extension)
-	return filepath.Join(path, newFilename)
+// ConvertVideo with the default profile (CODEC_FOR_CONVERSION)
+func ConvertVideoToH265(ctx context.Context, srcFile string, dstFile string, onProgress ProgressCallback) (string, error, bool) {
+	profile := DefaultEncodingProfile(config.GetCfg())
+	return ConvertVideo(ctx, srcFile, dstFile, &profile, onProgress)
 }
 
-// This will check if we should convert the source file then run the ffmpeg converter
+// This will check if we should convert the source file then run the ffmpeg converter with the
+// profile settings.  If the context is canceled ffmpeg is killed and the partial dstFile is
+// removed.  The onProgress callback (optional) is called as ffmpeg reports how far along it is.
 // Returns
 //   - (msg: string) : What happened in human readable form
 //   - (err: error) : did we hit a full error state
 //   - (encoded: bool) : Did actual encoding take place vs just 'should not do it (ie: already encoded)'
-func ConvertVideoToH265(srcFile string, dstFile string) (string, error, bool) {
-	reason, err, shouldConvert := ShouldEncodeVideo(srcFile, dstFile)
+func ConvertVideo(ctx context.Context, srcFile string, dstFile string, profile *config.EncodingProfile, onProgress ProgressCallback) (string, error, bool) {
+	// The same probe picks the streams to keep, so a source that cannot be probed is never encoded
+	codecName, _, videoInvalid, srcInfo := IsValidVideo(srcFile)
+	if videoInvalid != nil {
+		reason := fmt.Sprintf("Not valid video %s", videoInvalid)
+		TaskLogf(ctx, "Not converting %s", reason)
+		return reason, nil, false
+	}
+	reason, err, shouldConvert, scale := shouldEncodeProbed(srcFile, codecName, srcInfo, dstFile, profile)
 	if !shouldConvert {
 		log.Printf("Not converting %s", reason)
+		TaskLogf(ctx, "Not converting %s", reason)
 		return reason, err, shouldConvert
 	}
+	log.Printf("About to convert %s to codec %s", reason, profile.Codec)
 
-	// If codec in list of conversion codecs, then do it
-	cfg := config.GetCfg()
-	log.Printf("About to convert %s to codec %s", reason, cfg.CodecForConversion)
-
-	// ffmpeg
-	//	-hwaccel cuvid
-	//	-hwaccel_output_format cuda
-	//	-c:v hevc_nvenc -preset slow -movflags faststart output.mp4
-	// Might need a new version of the ffmpeg-go library
-
-	var encode_err error
-	if cfg.CodecForConversion == "hevc_nvenc" {
-		kwArgs := ffmpeg.KwArgs{"c:v": cfg.CodecForConversion, "tag:v": "hvc1", "preset": "slow", "movflags": "faststart"}
-
-		encode_err = ffmpeg.Input(srcFile).
-			Output(dstFile, kwArgs).
-			GlobalArgs("-hwaccel", "cuda").
-			GlobalArgs("-hwaccel_device", fmt.Sprintf("%d", 0)).
-			GlobalArgs("-hwaccel_output_format", "cuda").
-			GlobalArgs("-loglevel", "quiet").
-			OverWriteOutput().ErrorToStdOut().Run()
-	} else {
-		encode_err = ffmpeg.Input(srcFile).
-			Output(dstFile, ffmpeg.KwArgs{"c:v": cfg.CodecForConversion, "tag:v": "hvc1"}).
-			GlobalArgs("-loglevel", "quiet").
-			OverWriteOutput().ErrorToStdOut().Run()
+	duration, _, durationErr := GetTotalVideoLength(srcFile)
+	if durationErr != nil {
+		log.Printf("Could not determine duration for progress of %s err %s", srcFile, durationErr)
+		TaskLogf(ctx, "Could not determine duration for progress of %s err %s", srcFile, durationErr)
 	}
+	progress := NewProgressWriter(duration, onProgress)
 
+	cfg := config.GetCfg()
+	kwArgs := AddStreamArgs(ctx, cfg, EncodingOutputArgs(profile, scale), srcInfo, profile)
+	TaskLogf(ctx, "Encoding %s to %s with profile %s %v", srcFile, dstFile, profile.Name, kwArgs)
+	encode_err := WriteOutputAtomic(ctx, dstFile, func(tmpFile string) error {
+		return ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(srcFile)}, tmpFile, kwArgs).
+			GlobalArgs(EncodingGlobalArgs(profile, scale)...).
+			GlobalArgs(FfmpegLogArgs()...).
+			GlobalArgs(ProgressArgs()...).
+			OverWriteOutput().WithOutput(progress).WithErrorOutput(TaskLog(ctx)).Run()
+	}, ValidateEncodeDuration(duration))
+
+	if ctx.Err() != nil {
+		log.Printf("Encoding canceled for %s, the partial output was removed", srcFile)
+		return "", ctx.Err(), false
+	}
 	if encode_err != nil {
 		log.Printf("Encoding error when actually running ffmpeg  %s", encode_err)
 		return "", encode_err, false
 	}
+	if cfg.EncodingKeepMetadata {
+		if err := CopyModTime(srcFile, dstFile); err != nil {
+			TaskLogf(ctx, "Could not copy the modification time of %s to %s %s", srcFile, dstFile, err)
+		}
+	}
 	return "Success: " + reason, nil, true
 }
 
+// Give dstFile the modification time of srcFile, scanned content uses it as the created_at
+func CopyModTime(srcFile string, dstFile string) error {
+	srcStat, err := os.Stat(srcFile)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dstFile, time.Now(), srcStat.ModTime())
+}
+
+// Best effort cleanup of a file ffmpeg did not finish writing
+func RemovePartialOutput(dstFile string) {
+	if _, err := os.Stat(dstFile); os.IsNotExist(err) {
+		return
+	}
+	if err := os.Remove(dstFile); err != nil {
+		log.Printf("Failed to remove partial output %s err %s", dstFile, err)
+	}
+}
+
 /*
  * Given two video files see if they are likely the same video
  */
@@ -226,9 +322,8 @@ func IsDuplicateVideo(encodedFile string, dupeFile string) (bool, error) {
 	encodedDuration := gjson.Get(encodedMeta, "format.duration").Float()
 	log.Printf("Src %s had codec %s, size %d and runtime %f", encodedFile, encodedCodec, encodedSize, encodedDuration)
 
-	cfg := config.GetCfg()
-	if encodedCodec != cfg.CodecForConversionName {
-		msg := fmt.Sprintf("Encoded File %s was not what we want %s", encodedFile, encodedCodec)
+	if !IsEncodedCodec(config.GetCfg(), encodedCodec) {
+		msg := fmt.Sprintf("Encoded File %s was not in a codec an encoding profile makes %s", encodedFile, encodedCodec)
 		return false, errors.New(msg)
 	}
 
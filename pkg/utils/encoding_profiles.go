@@ -0,0 +1,342 @@
+package utils
+
+/**
+ * Encoding profiles are named sets of ffmpeg settings so the same library can get a phone friendly
+ * 720p pass and an archival pass.  The default profile is built from the CODEC_FOR_CONVERSION
+ * settings, anything else comes from ENCODING_PROFILES.  Profiles can target hevc, h264, av1 or vp9
+ * and the output container defaults to the one that suits the codec (webm for vp9).
+ */
+import (
+	"contented/pkg/config"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var ValidEncodingContainers = []string{"mp4", "mkv", "mov", "webm"}
+
+// webm only holds opus or vorbis audio, libopus is used when the profile does not pick one
+var WebmAudioCodecs = []string{"libopus", "opus", "libvorbis", "vorbis"}
+
+var ErrUnknownEncodingProfile = errors.New("unknown encoding profile")
+
+// An ffmpeg encoder, what a probe of the output reports and the containers that can hold it
+type VideoEncoder struct {
+	Codec      string
+	CodecName  string
+	Containers []string // The first is the default for the encoder
+	CpuSeconds float64  // Rough CPU seconds to encode a second of 1080p video, only used for estimates
+}
+
+// Encoders not listed here can still be used but get no container checks and default to mp4
+var VideoEncoders = []VideoEncoder{
+	{Codec: "libx265", CodecName: "hevc", Containers: []string{"mp4", "mkv", "mov"}, CpuSeconds: 4},
+	{Codec: "hevc_nvenc", CodecName: "hevc", Containers: []string{"mp4", "mkv", "mov"}, CpuSeconds: 0.3},
+	{Codec: "libx264", CodecName: "h264", Containers: []string{"mp4", "mkv", "mov"}, CpuSeconds: 1},
+	{Codec: "h264_nvenc", CodecName: "h264", Containers: []string{"mp4", "mkv", "mov"}, CpuSeconds: 0.2},
+	{Codec: "libsvtav1", CodecName: "av1", Containers: []string{"mp4", "mkv", "webm"}, CpuSeconds: 3},
+	{Codec: "libaom-av1", CodecName: "av1", Containers: []string{"mp4", "mkv", "webm"}, CpuSeconds: 20},
+	{Codec: "av1_nvenc", CodecName: "av1", Containers: []string{"mp4", "mkv", "webm"}, CpuSeconds: 0.3},
+	{Codec: "libvpx-vp9", CodecName: "vp9", Containers: []string{"webm", "mkv", "mp4"}, CpuSeconds: 6},
+}
+
+func GetVideoEncoder(codec string) *VideoEncoder {
+	for _, encoder := range VideoEncoders {
+		if encoder.Codec == codec {
+			return &encoder
+		}
+	}
+	return nil
+}
+
+// What a probe will report for video from the encoder (libx265 makes hevc), empty if unknown
+func EncoderCodecName(codec string) string {
+	if encoder := GetVideoEncoder(codec); encoder != nil {
+		return encoder.CodecName
+	}
+	return ""
+}
+
+// The container an encoder writes to when the profile does not say
+func DefaultEncodingContainer(codec string) string {
+	if encoder := GetVideoEncoder(codec); encoder != nil {
+		return encoder.Containers[0]
+	}
+	return "mp4"
+}
+
+// The profile built out of the CODEC_FOR_CONVERSION / ENCODING_FILENAME_MODIFIER settings
+func DefaultEncodingProfile(cfg *config.DirConfigEntry) config.EncodingProfile {
+	profile := config.EncodingProfile{
+		Name:             config.DefaultEncodingProfileName,
+		Codec:            cfg.CodecForConversion,
+		CodecName:        cfg.CodecForConversionName,
+		Container:        DefaultEncodingContainer(cfg.CodecForConversion),
+		FilenameModifier: cfg.EncodingFilenameModifier,
+	}
+	if IsNvencCodec(cfg.CodecForConversion) {
+		profile.Preset = "slow"
+	}
+	return profile
+}
+
+// All the profiles a task can pick, the default profile is first
+func ListEncodingProfiles(cfg *config.DirConfigEntry) []config.EncodingProfile {
+	profiles := []config.EncodingProfile{DefaultEncodingProfile(cfg)}
+	for _, profile := range cfg.EncodingProfiles {
+		if profile.Name != config.DefaultEncodingProfileName {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles
+}
+
+// Lookup a profile by name, empty is the default profile.  The profile is validated and has the
+// codec name and container filled in.
+func GetEncodingProfile(cfg *config.DirConfigEntry, name string) (*config.EncodingProfile, error) {
+	if name == "" {
+		name = config.DefaultEncodingProfileName
+	}
+	for _, profile := range ListEncodingProfiles(cfg) {
+		if profile.Name != name {
+			continue
+		}
+		if profile.CodecName == "" {
+			profile.CodecName = EncoderCodecName(profile.Codec)
+		}
+		if profile.Container == "" {
+			profile.Container = DefaultEncodingContainer(profile.Codec)
+		}
+		if err := ValidateEncodingProfile(profile); err != nil {
+			return nil, err
+		}
+		return &profile, nil
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownEncodingProfile, name)
+}
+
+func ValidateEncodingProfile(profile config.EncodingProfile) error {
+	if profile.Name == "" {
+		return errors.New("an encoding profile needs a name")
+	}
+	if profile.Codec == "" {
+		return fmt.Errorf("encoding profile %s needs a codec", profile.Name)
+	}
+	if profile.Crf < 0 || profile.Crf > 63 {
+		return fmt.Errorf("encoding profile %s crf %d must be between 0 and 63", profile.Name, profile.Crf)
+	}
+	if profile.MaxWidth < 0 || profile.MaxHeight < 0 {
+		return fmt.Errorf("encoding profile %s cannot have a negative max resolution", profile.Name)
+	}
+	if profile.Container != "" && !slices.Contains(ValidEncodingContainers, profile.Container) {
+		return fmt.Errorf("encoding profile %s container %s is not one of %s", profile.Name, profile.Container, ValidEncodingContainers)
+	}
+	encoder := GetVideoEncoder(profile.Codec)
+	if encoder != nil && profile.Container != "" && !slices.Contains(encoder.Containers, profile.Container) {
+		return fmt.Errorf("encoding profile %s codec %s cannot be written to %s, use one of %s", profile.Name, profile.Codec, profile.Container, encoder.Containers)
+	}
+	if encoder != nil && profile.CodecName != "" && profile.CodecName != encoder.CodecName {
+		return fmt.Errorf("encoding profile %s codec %s makes %s not %s", profile.Name, profile.Codec, encoder.CodecName, profile.CodecName)
+	}
+	if profile.Container == "webm" && profile.AudioCodec != "" && !slices.Contains(WebmAudioCodecs, profile.AudioCodec) {
+		return fmt.Errorf("encoding profile %s audio %s cannot be written to webm, use one of %s", profile.Name, profile.AudioCodec, WebmAudioCodecs)
+	}
+	if profile.Name != config.DefaultEncodingProfileName && profile.FilenameModifier == "" {
+		return fmt.Errorf("encoding profile %s needs a filename_modifier so it does not overwrite other encodes", profile.Name)
+	}
+	return nil
+}
+
+func IsNvencCodec(codec string) bool {
+	return strings.HasSuffix(codec, "_nvenc")
+}
+
+// Would a source of width x height be scaled down by the profile (unknown sizes are not)
+func NeedsScaling(profile *config.EncodingProfile, width int, height int) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	return (profile.MaxWidth > 0 && width > profile.MaxWidth) || (profile.MaxHeight > 0 && height > profile.MaxHeight)
+}
+
+// Scale down to fit the max resolution keeping the aspect ratio (and an even size for the encoders)
+func ScaleFilter(maxWidth int, maxHeight int) string {
+	switch {
+	case maxWidth > 0 && maxHeight > 0:
+		return fmt.Sprintf("scale=w='min(iw,%d)':h='min(ih,%d)':force_original_aspect_ratio=decrease:force_divisible_by=2", maxWidth, maxHeight)
+	case maxWidth > 0:
+		return fmt.Sprintf("scale=w='min(iw,%d)':h=-2", maxWidth)
+	case maxHeight > 0:
+		return fmt.Sprintf("scale=w=-2:h='min(ih,%d)'", maxHeight)
+	}
+	return ""
+}
+
+// Add the stream selection to the encoding arguments, see StreamOutputArgs.  vidInfo is the probe
+// the encode decision was made with, without one only the first video and the audio are mapped.
+func AddStreamArgs(ctx context.Context, cfg *config.DirConfigEntry, kwArgs ffmpeg.KwArgs, vidInfo string, profile *config.EncodingProfile) ffmpeg.KwArgs {
+	if vidInfo == "" {
+		TaskLogf(ctx, "No probe of the source streams, only mapping the video and audio")
+	}
+	container := profile.Container
+	if container == "" {
+		container = DefaultEncodingContainer(profile.Codec)
+	}
+	return StreamOutputArgs(cfg, kwArgs, container, vidInfo)
+}
+
+// Without a -map ffmpeg keeps one video and one audio stream, this maps the first video, the audio
+// (ENCODING_AUDIO_TRACKS) and the subtitles the container can hold (ENCODING_SUBTITLES).  The global
+// metadata and chapters are copied with ENCODING_KEEP_METADATA.
+func StreamOutputArgs(cfg *config.DirConfigEntry, kwArgs ffmpeg.KwArgs, container string, vidInfo string) ffmpeg.KwArgs {
+	maps := []string{"0:v:0", "0:a?"}
+	if cfg.EncodingAudioTracks == "first" {
+		maps[1] = "0:a:0?"
+	}
+	if cfg.EncodingSubtitles {
+		subtitles, codec := SubtitleOutputArgs(container, GetSubtitleStreams(vidInfo))
+		if len(subtitles) > 0 {
+			maps = append(maps, subtitles...)
+			kwArgs["c:s"] = codec
+		}
+	}
+	kwArgs["map"] = maps
+	if cfg.EncodingKeepMetadata {
+		kwArgs["map_metadata"] = 0
+		kwArgs["map_chapters"] = 0
+	}
+	return kwArgs
+}
+
+// The ffmpeg output arguments for the profile
+func EncodingOutputArgs(profile *config.EncodingProfile, scale bool) ffmpeg.KwArgs {
+	kwArgs := ffmpeg.KwArgs{"c:v": profile.Codec}
+	if profile.CodecName == "hevc" && profile.Container != "mkv" {
+		kwArgs["tag:v"] = "hvc1" // Otherwise Apple devices will not play the hevc
+	}
+	// libaom and libvpx only do constant quality when the bitrate is 0, they use cpu-used for speed
+	constantQuality := profile.Codec == "libaom-av1" || profile.Codec == "libvpx-vp9"
+	if profile.Crf > 0 {
+		if IsNvencCodec(profile.Codec) {
+			kwArgs["cq"] = profile.Crf
+		} else {
+			kwArgs["crf"] = profile.Crf
+		}
+		if constantQuality {
+			kwArgs["b:v"] = 0
+		}
+	} else if profile.Bitrate != "" {
+		kwArgs["b:v"] = profile.Bitrate
+	}
+	if profile.Preset != "" {
+		if constantQuality {
+			kwArgs["cpu-used"] = profile.Preset
+		} else {
+			kwArgs["preset"] = profile.Preset
+		}
+	}
+	if profile.Codec == "libvpx-vp9" {
+		kwArgs["row-mt"] = 1 // Otherwise vp9 only uses a couple of cores
+	}
+	if profile.PixelFormat != "" {
+		kwArgs["pix_fmt"] = profile.PixelFormat
+	}
+	if scale {
+		kwArgs["vf"] = ScaleFilter(profile.MaxWidth, profile.MaxHeight)
+	}
+	audioCodec := profile.AudioCodec
+	if audioCodec == "" && profile.Container == "webm" {
+		audioCodec = "libopus"
+	}
+	if audioCodec != "" {
+		kwArgs["c:a"] = audioCodec
+	}
+	if profile.AudioBitrate != "" && audioCodec != "copy" {
+		kwArgs["b:a"] = profile.AudioBitrate
+	}
+	if profile.Container == "" || profile.Container == "mp4" || profile.Container == "mov" {
+		kwArgs["movflags"] = "faststart"
+	}
+	return kwArgs
+}
+
+// Hardware decoding for nvenc, frames stay on the GPU unless they have to be scaled by a filter
+func EncodingGlobalArgs(profile *config.EncodingProfile, scale bool) []string {
+	if !IsNvencCodec(profile.Codec) {
+		return []string{}
+	}
+	args := []string{"-hwaccel", "cuda", "-hwaccel_device", "0"}
+	if !scale {
+		args = append(args, "-hwaccel_output_format", "cuda")
+	}
+	return args
+}
+
+// Strip the source extension and add the profile modifier and container extension
+func GetProfileConversionName(srcFile string, profile *config.EncodingProfile) string {
+	path := filepath.Dir(srcFile)
+	filename := filepath.Base(srcFile)
+	ext := filepath.Ext(filename)
+
+	cfg := config.GetCfg()
+	if cfg.EncodingDestination != "" {
+		path = cfg.EncodingDestination
+	}
+	container := profile.Container
+	if container == "" {
+		container = DefaultEncodingContainer(profile.Codec)
+	}
+	stripExtension := regexp.MustCompile(fmt.Sprintf("%s$", regexp.QuoteMeta(ext)))
+	extension := fmt.Sprintf("%s.%s", profile.FilenameModifier, container)
+	newFilename := stripExtension.ReplaceAllString(filename, extension)
+	return filepath.Join(path, newFilename)
+}
+
+// The profiles that make a full size copy of the source, their output can replace the original.
+// A profile that scales down (a 720p pass for phones) is never treated as a duplicate.
+func DuplicateEncodingProfiles(cfg *config.DirConfigEntry) []config.EncodingProfile {
+	profiles := []config.EncodingProfile{}
+	for _, profile := range ListEncodingProfiles(cfg) {
+		if profile.MaxWidth > 0 || profile.MaxHeight > 0 || profile.FilenameModifier == "" {
+			continue
+		}
+		if profile.CodecName == "" {
+			profile.CodecName = EncoderCodecName(profile.Codec)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// Is the codec what one of the profiles encodes to (so the video was already encoded by us)
+func IsEncodedCodec(cfg *config.DirConfigEntry, codecName string) bool {
+	for _, profile := range ListEncodingProfiles(cfg) {
+		if codecName != "" && (profile.CodecName == codecName || EncoderCodecName(profile.Codec) == codecName) {
+			return true
+		}
+	}
+	return false
+}
+
+// The profile that would have produced the file (codec and filename modifier match) and the
+// name the original had without its extension, nil if the file does not look like an encode.
+func EncodedByProfile(cfg *config.DirConfigEntry, filename string, codecName string) (*config.EncodingProfile, string) {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, profile := range DuplicateEncodingProfiles(cfg) {
+		if profile.CodecName != codecName || !strings.HasSuffix(stem, profile.FilenameModifier) {
+			continue
+		}
+		originalStem := strings.TrimSuffix(stem, profile.FilenameModifier)
+		if originalStem == "" {
+			continue
+		}
+		return &profile, originalStem
+	}
+	return nil, ""
+}
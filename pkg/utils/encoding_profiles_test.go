@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"contented/pkg/config"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+func TestGetEncodingProfile(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.EncodingProfiles = []config.EncodingProfile{
+		{Name: "phone", Codec: "libx264", CodecName: "h264", MaxHeight: 720, FilenameModifier: "_720p"},
+		{Name: "broken", Codec: "libx264", Container: "avi", FilenameModifier: "_broken"},
+	}
+
+	def, err := GetEncodingProfile(&cfg, "")
+	assert.NoError(t, err)
+	assert.Equal(t, config.DefaultEncodingProfileName, def.Name)
+	assert.Equal(t, cfg.CodecForConversion, def.Codec)
+	assert.Equal(t, cfg.EncodingFilenameModifier, def.FilenameModifier)
+
+	phone, err := GetEncodingProfile(&cfg, "phone")
+	assert.NoError(t, err)
+	assert.Equal(t, "mp4", phone.Container, "The container defaults to mp4")
+
+	_, err = GetEncodingProfile(&cfg, "missing")
+	assert.True(t, errors.Is(err, ErrUnknownEncodingProfile))
+	_, err = GetEncodingProfile(&cfg, "broken")
+	assert.Error(t, err, "avi is not a supported container")
+
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "no_codec", FilenameModifier: "_x"}))
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "same_name", Codec: "libx264"}), "It would overwrite the default encode")
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "crf", Codec: "libx264", Crf: 70, FilenameModifier: "_x"}))
+}
+
+func TestEncodingOutputArgs(t *testing.T) {
+	phone := config.EncodingProfile{
+		Name: "phone", Codec: "libx264", CodecName: "h264", Crf: 26, Preset: "medium", PixelFormat: "yuv420p",
+		MaxWidth: 1280, MaxHeight: 720, AudioCodec: "aac", AudioBitrate: "128k", Container: "mp4",
+	}
+	args := EncodingOutputArgs(&phone, true)
+	assert.Equal(t, "libx264", args["c:v"])
+	assert.Equal(t, 26, args["crf"])
+	assert.Equal(t, "medium", args["preset"])
+	assert.Equal(t, "yuv420p", args["pix_fmt"])
+	assert.Equal(t, "aac", args["c:a"])
+	assert.Equal(t, "128k", args["b:a"])
+	assert.Equal(t, "faststart", args["movflags"])
+	assert.Contains(t, args["vf"], "min(ih,720)")
+	assert.Nil(t, args["tag:v"], "Only hevc gets the hvc1 tag")
+	assert.Nil(t, EncodingOutputArgs(&phone, false)["vf"], "No scaling when the source is small enough")
+	assert.Equal(t, 0, len(EncodingGlobalArgs(&phone, true)))
+
+	nvenc := config.EncodingProfile{Name: "nvenc", Codec: "hevc_nvenc", CodecName: "hevc", Crf: 24, Bitrate: "4M", Container: "mkv"}
+	args = EncodingOutputArgs(&nvenc, false)
+	assert.Equal(t, 24, args["cq"], "nvenc takes cq rather than crf")
+	assert.Nil(t, args["b:v"], "The crf wins over a bitrate")
+	assert.Nil(t, args["movflags"])
+	assert.Contains(t, EncodingGlobalArgs(&nvenc, false), "-hwaccel_output_format")
+	assert.NotContains(t, EncodingGlobalArgs(&nvenc, true), "-hwaccel_output_format", "Scaling happens off the GPU")
+
+	assert.True(t, NeedsScaling(&phone, 1920, 1080))
+	assert.False(t, NeedsScaling(&phone, 1280, 720))
+	assert.False(t, NeedsScaling(&phone, 0, 0), "Unknown sizes are left alone")
+	assert.Equal(t, "scale=w='min(iw,640)':h=-2", ScaleFilter(640, 0))
+	assert.Equal(t, "", ScaleFilter(0, 0))
+}
+
+func TestGetProfileConversionName(t *testing.T) {
+	archive := config.EncodingProfile{Name: "archive", Codec: "libx265", Container: "mkv", FilenameModifier: "_archive"}
+	dst := GetProfileConversionName("/videos/show.avi", &archive)
+	assert.Equal(t, filepath.Join("/videos", "show_archive.mkv"), dst)
+
+	def := DefaultEncodingProfile(config.GetCfg())
+	assert.Equal(t, GetVideoConversionName("/videos/show.avi"), GetProfileConversionName("/videos/show.avi", &def))
+}
+
+func TestAv1AndVp9Profiles(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.EncodingProfiles = []config.EncodingProfile{
+		{Name: "av1", Codec: "libsvtav1", Crf: 30, Preset: "6", FilenameModifier: "_av1"},
+		{Name: "vp9", Codec: "libvpx-vp9", Crf: 33, Preset: "2", FilenameModifier: "_vp9"},
+		{Name: "aom", Codec: "libaom-av1", Crf: 28, Container: "webm", FilenameModifier: "_aom"},
+		{Name: "phone", Codec: "libx264", MaxHeight: 720, FilenameModifier: "_720p"},
+	}
+
+	av1, err := GetEncodingProfile(&cfg, "av1")
+	assert.NoError(t, err)
+	assert.Equal(t, "av1", av1.CodecName, "The codec name comes from the encoder")
+	assert.Equal(t, "mp4", av1.Container)
+	args := EncodingOutputArgs(av1, false)
+	assert.Equal(t, 30, args["crf"])
+	assert.Equal(t, "6", args["preset"])
+	assert.Nil(t, args["tag:v"])
+	assert.Nil(t, args["b:v"])
+
+	vp9, err := GetEncodingProfile(&cfg, "vp9")
+	assert.NoError(t, err)
+	assert.Equal(t, "webm", vp9.Container, "vp9 defaults to webm")
+	args = EncodingOutputArgs(vp9, false)
+	assert.Equal(t, 0, args["b:v"], "libvpx needs a 0 bitrate for constant quality")
+	assert.Equal(t, "2", args["cpu-used"])
+	assert.Nil(t, args["preset"])
+	assert.Equal(t, "libopus", args["c:a"], "webm cannot hold aac")
+	assert.Nil(t, args["movflags"])
+	assert.Equal(t, filepath.Join("/videos", "show_vp9.webm"), GetProfileConversionName("/videos/show.avi", vp9))
+
+	aom, err := GetEncodingProfile(&cfg, "aom")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, EncodingOutputArgs(aom, false)["b:v"])
+
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "x", Codec: "libx265", Container: "webm", FilenameModifier: "_x"}), "hevc cannot go in webm")
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "x", Codec: "libvpx-vp9", Container: "webm", AudioCodec: "aac", FilenameModifier: "_x"}))
+	assert.Error(t, ValidateEncodingProfile(config.EncodingProfile{Name: "x", Codec: "libsvtav1", CodecName: "hevc", FilenameModifier: "_x"}))
+	assert.NoError(t, ValidateEncodingProfile(config.EncodingProfile{Name: "x", Codec: "some_new_encoder", Container: "mkv", FilenameModifier: "_x"}), "Unknown encoders are allowed")
+	assert.Equal(t, "mp4", DefaultEncodingContainer("some_new_encoder"))
+}
+
+func TestEncodedByProfile(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	cfg.EncodingProfiles = []config.EncodingProfile{
+		{Name: "av1", Codec: "libsvtav1", FilenameModifier: "_av1"},
+		{Name: "phone", Codec: "libx264", MaxHeight: 720, FilenameModifier: "_720p"},
+	}
+	assert.True(t, IsEncodedCodec(&cfg, "hevc"))
+	assert.True(t, IsEncodedCodec(&cfg, "av1"))
+	assert.False(t, IsEncodedCodec(&cfg, "mpeg4"))
+	assert.False(t, IsEncodedCodec(&cfg, ""))
+
+	profile, original := EncodedByProfile(&cfg, "show_av1.webm", "av1")
+	assert.NotNil(t, profile)
+	assert.Equal(t, "show", original)
+	profile, original = EncodedByProfile(&cfg, "show"+cfg.EncodingFilenameModifier+".mp4", cfg.CodecForConversionName)
+	assert.NotNil(t, profile)
+	assert.Equal(t, config.DefaultEncodingProfileName, profile.Name)
+	assert.Equal(t, "show", original)
+
+	profile, _ = EncodedByProfile(&cfg, "show_av1.webm", "vp9")
+	assert.Nil(t, profile, "The codec has to match what the profile makes")
+	profile, _ = EncodedByProfile(&cfg, "show_720p.mp4", "h264")
+	assert.Nil(t, profile, "A scaled down encode never replaces the original")
+	profile, _ = EncodedByProfile(&cfg, "_av1.mp4", "av1")
+	assert.Nil(t, profile)
+}
+
+func TestStreamOutputArgs(t *testing.T) {
+	probe := `{"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "tags": {"language": "eng"}},
+		{"index": 2, "codec_type": "audio", "codec_name": "aac", "tags": {"language": "jpn"}},
+		{"index": 3, "codec_type": "subtitle", "codec_name": "subrip"}
+	]}`
+	cfg := config.GetCfgDefaults()
+	kwArgs := StreamOutputArgs(&cfg, ffmpeg.KwArgs{}, "mp4", probe)
+	assert.Equal(t, []string{"0:v:0", "0:a?", "0:3"}, kwArgs["map"], "Every audio track and the subtitles")
+	assert.Equal(t, "mov_text", kwArgs["c:s"])
+	assert.Equal(t, 0, kwArgs["map_metadata"])
+	assert.Equal(t, 0, kwArgs["map_chapters"])
+
+	cfg.EncodingAudioTracks = "first"
+	cfg.EncodingSubtitles = false
+	cfg.EncodingKeepMetadata = false
+	kwArgs = StreamOutputArgs(&cfg, ffmpeg.KwArgs{}, "mp4", probe)
+	assert.Equal(t, []string{"0:v:0", "0:a:0?"}, kwArgs["map"])
+	assert.NotContains(t, kwArgs, "c:s")
+	assert.NotContains(t, kwArgs, "map_metadata")
+	assert.NotContains(t, kwArgs, "map_chapters")
+
+	// Without a probe the default video and audio are still mapped
+	cfg = config.GetCfgDefaults()
+	kwArgs = AddStreamArgs(context.Background(), &cfg, ffmpeg.KwArgs{}, "", &config.EncodingProfile{Codec: "libx265"})
+	assert.Equal(t, []string{"0:v:0", "0:a?"}, kwArgs["map"])
+	assert.NotContains(t, kwArgs, "c:s")
+}
+
+func TestCopyModTime(t *testing.T) {
+	dir := t.TempDir()
+	srcFile, dstFile := filepath.Join(dir, "a.avi"), filepath.Join(dir, "a_h265.mp4")
+	assert.NoError(t, os.WriteFile(srcFile, []byte("src"), 0644))
+	assert.NoError(t, os.WriteFile(dstFile, []byte("dst"), 0644))
+	modTime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(srcFile, modTime, modTime))
+
+	assert.NoError(t, CopyModTime(srcFile, dstFile))
+	stat, err := os.Stat(dstFile)
+	assert.NoError(t, err)
+	assert.True(t, modTime.Equal(stat.ModTime()), "The encode sorts with the original")
+	assert.Error(t, CopyModTime(filepath.Join(dir, "missing.avi"), dstFile))
+}
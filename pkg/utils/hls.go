@@ -0,0 +1,244 @@
+package utils
+
+/**
+ * Package a video as HLS so large originals can be played over a slow link.  Each rendition is a
+ * separate ffmpeg run writing <height>p.m3u8 and its segments into one directory per content under
+ * the container STREAM_DIRECTORY, the master.m3u8 is written last so it only exists once the whole
+ * ladder is there.
+ */
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const HlsMasterPlaylist = "master.m3u8"
+
+// Only flat names in the stream directory can be served (no directories or ..)
+var hlsFileRE = regexp.MustCompile(`^[A-Za-z0-9_]+\.(m3u8|m4s|ts|mp4)$`)
+
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/iso.segment",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+}
+
+// Video bitrates (kbps) for the common heights, anything else is scaled from the 1080p bitrate
+var hlsBitrates = map[int]int{2160: 14000, 1440: 9000, 1080: 5000, 720: 2800, 480: 1400, 360: 800, 240: 400}
+
+type HlsRendition struct {
+	Width        int
+	Height       int
+	VideoBitrate int // kbps
+	Playlist     string
+}
+
+// The bandwidth (bits per second) for the master playlist, includes the audio
+func (r HlsRendition) Bandwidth() int {
+	return (r.VideoBitrate + 128) * 1000
+}
+
+func (r HlsRendition) Name() string {
+	return fmt.Sprintf("%dp", r.Height)
+}
+
+// The directory all the HLS packages for a container go in
+func GetStreamDst(cnt *models.Container) string {
+	return filepath.Join(cnt.GetFqPath(), config.STREAM_DIRECTORY)
+}
+
+func GetContentStreamDst(cnt *models.Container, contentID int64) string {
+	return filepath.Join(GetStreamDst(cnt), strconv.FormatInt(contentID, 10))
+}
+
+// The full path to a file in the HLS package, the name is checked so it cannot leave the package
+func GetStreamFilePath(cnt *models.Container, contentID int64, name string) (string, error) {
+	if !hlsFileRE.MatchString(name) {
+		return "", fmt.Errorf("invalid stream file name %s", name)
+	}
+	return GetFilePathInContainer(name, GetContentStreamDst(cnt, contentID))
+}
+
+func HlsContentType(name string) string {
+	if ctype, ok := hlsContentTypes[filepath.Ext(name)]; ok {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+func hlsBitrate(height int) int {
+	if bitrate, ok := hlsBitrates[height]; ok {
+		return bitrate
+	}
+	// Bitrate roughly follows the pixel count
+	return int(math.Round(float64(hlsBitrates[1080]) * math.Pow(float64(height)/1080.0, 2)))
+}
+
+// The renditions for a source, heights taller than the source are dropped but there is always at
+// least one (at the source height if it is smaller than every configured rendition).
+func HlsLadder(heights []int, srcWidth int, srcHeight int) []HlsRendition {
+	sorted := append([]int{}, heights...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	ladder := []HlsRendition{}
+	for _, height := range sorted {
+		if srcHeight > 0 && height > srcHeight {
+			continue
+		}
+		ladder = append(ladder, newHlsRendition(height, srcWidth, srcHeight))
+	}
+	if len(ladder) == 0 && srcHeight > 0 {
+		ladder = append(ladder, newHlsRendition(srcHeight-srcHeight%2, srcWidth, srcHeight))
+	}
+	return ladder
+}
+
+func newHlsRendition(height int, srcWidth int, srcHeight int) HlsRendition {
+	width := 0
+	if srcWidth > 0 && srcHeight > 0 {
+		width = int(math.Round(float64(srcWidth)*float64(height)/float64(srcHeight)/2.0)) * 2
+	}
+	rendition := HlsRendition{Width: width, Height: height, VideoBitrate: hlsBitrate(height)}
+	rendition.Playlist = rendition.Name() + ".m3u8"
+	return rendition
+}
+
+// The master playlist pointing at each of the rendition playlists
+func HlsMasterPlaylistContent(ladder []HlsRendition) string {
+	lines := []string{"#EXTM3U", "#EXT-X-VERSION:3", "#EXT-X-INDEPENDENT-SEGMENTS"}
+	for _, rendition := range ladder {
+		info := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", rendition.Bandwidth())
+		if rendition.Width > 0 {
+			info += fmt.Sprintf(",RESOLUTION=%dx%d", rendition.Width, rendition.Height)
+		}
+		lines = append(lines, info, rendition.Playlist)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// The ffmpeg output arguments for one rendition written to dstDir
+func HlsOutputArgs(cfg *config.DirConfigEntry, rendition HlsRendition, dstDir string) ffmpeg.KwArgs {
+	segmentExt := "m4s"
+	if cfg.HlsSegmentType == "mpegts" {
+		segmentExt = "ts"
+	}
+	segmentSeconds := cfg.HlsSegmentSeconds
+	if segmentSeconds <= 0 {
+		segmentSeconds = config.DefaultHlsSegmentSeconds
+	}
+	kwArgs := ffmpeg.KwArgs{
+		"c:v":                  cfg.HlsCodec,
+		"vf":                   fmt.Sprintf("scale=-2:%d", rendition.Height),
+		"b:v":                  fmt.Sprintf("%dk", rendition.VideoBitrate),
+		"maxrate":              fmt.Sprintf("%dk", rendition.VideoBitrate*107/100),
+		"bufsize":              fmt.Sprintf("%dk", rendition.VideoBitrate*3/2),
+		"pix_fmt":              "yuv420p",
+		"force_key_frames":     fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds), // Segments must start on a keyframe
+		"c:a":                  "aac",
+		"b:a":                  "128k",
+		"ac":                   2,
+		"f":                    "hls",
+		"hls_time":             segmentSeconds,
+		"hls_playlist_type":    "vod",
+		"hls_segment_type":     cfg.HlsSegmentType,
+		"hls_segment_filename": filepath.Join(dstDir, fmt.Sprintf("%s_%%05d.%s", rendition.Name(), segmentExt)),
+	}
+	if cfg.HlsSegmentType == "fmp4" {
+		kwArgs["hls_fmp4_init_filename"] = rendition.Name() + "_init.mp4"
+	}
+	return kwArgs
+}
+
+// Package srcFile into dstDir (anything already there is replaced), returns the renditions written.
+// The package is written to a temp directory next to dstDir which replaces it once every rendition
+// is done.  The onProgress callback covers the whole ladder.
+func CreateHlsStream(ctx context.Context, cfg *config.DirConfigEntry, srcFile string, dstDir string, onProgress ProgressCallback) ([]HlsRendition, error) {
+	srcInfo, err := ProbeContext(ctx, srcFile)
+	if err != nil {
+		return nil, err
+	}
+	width, height := GetVideoResolution(srcInfo)
+	ladder := HlsLadder(cfg.HlsRenditions, width, height)
+	if len(ladder) == 0 {
+		return nil, fmt.Errorf("no hls renditions for %s at %dx%d", srcFile, width, height)
+	}
+	tmpDir := dstDir + TempOutputMarker
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeHlsStream(ctx, cfg, srcFile, tmpDir, ladder, onProgress); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err := os.RemoveAll(dstDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, dstDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return ladder, nil
+}
+
+// Write each rendition and the master playlist into dstDir
+func writeHlsStream(ctx context.Context, cfg *config.DirConfigEntry, srcFile string, dstDir string, ladder []HlsRendition, onProgress ProgressCallback) error {
+	duration, _, durationErr := GetTotalVideoLength(srcFile)
+	if durationErr != nil {
+		TaskLogf(ctx, "Could not determine duration for progress of %s err %s", srcFile, durationErr)
+	}
+	for idx, rendition := range ladder {
+		progress := NewProgressWriter(duration, hlsLadderProgress(idx, len(ladder), duration, onProgress))
+		playlist := filepath.Join(dstDir, rendition.Playlist)
+		kwArgs := HlsOutputArgs(cfg, rendition, dstDir)
+		TaskLogf(ctx, "Packaging %s rendition %s %v", srcFile, rendition.Name(), kwArgs)
+
+		runErr := ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(srcFile)}, playlist, kwArgs).
+			GlobalArgs(FfmpegLogArgs()...).
+			GlobalArgs(ProgressArgs()...).
+			OverWriteOutput().WithOutput(progress).WithErrorOutput(TaskLog(ctx)).Run()
+		if ctx.Err() != nil {
+			log.Printf("HLS packaging canceled for %s removing %s", srcFile, dstDir)
+			return ctx.Err()
+		}
+		if runErr != nil {
+			return fmt.Errorf("failed to package rendition %s %w", rendition.Name(), runErr)
+		}
+		if _, err := ProbeOutput(ctx, playlist); err != nil {
+			return err
+		}
+	}
+	master := filepath.Join(dstDir, HlsMasterPlaylist)
+	return os.WriteFile(master, []byte(HlsMasterPlaylistContent(ladder)), 0644)
+}
+
+// Scale the progress of one rendition into the progress over the whole ladder, the remaining
+// renditions are assumed to take as long as the current one.
+func hlsLadderProgress(idx int, total int, duration float64, onProgress ProgressCallback) ProgressCallback {
+	if onProgress == nil {
+		return nil
+	}
+	return func(progress TaskProgress) {
+		progress.Percent = (float64(idx)*100.0 + progress.Percent) / float64(total)
+		progress.Done = progress.Done && idx == total-1
+		if progress.EtaSeconds >= 0 && progress.Speed > 0 {
+			progress.EtaSeconds += int64(duration/progress.Speed) * int64(total-idx-1)
+		}
+		onProgress(progress)
+	}
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHlsLadder(t *testing.T) {
+	ladder := HlsLadder([]int{480, 1080, 720}, 1280, 720)
+	assert.Equal(t, 2, len(ladder), "Renditions taller than the source are dropped")
+	assert.Equal(t, 720, ladder[0].Height, "Tallest rendition first")
+	assert.Equal(t, 1280, ladder[0].Width)
+	assert.Equal(t, "480p.m3u8", ladder[1].Playlist)
+	assert.Equal(t, 854, ladder[1].Width, "Width keeps the aspect ratio and stays even")
+
+	small := HlsLadder([]int{1080, 720}, 640, 361)
+	assert.Equal(t, 1, len(small), "A small source still gets a rendition")
+	assert.Equal(t, 360, small[0].Height)
+
+	master := HlsMasterPlaylistContent(ladder)
+	assert.True(t, strings.HasPrefix(master, "#EXTM3U\n"))
+	assert.Contains(t, master, "#EXT-X-STREAM-INF:BANDWIDTH=2928000,RESOLUTION=1280x720\n720p.m3u8\n")
+	assert.Contains(t, master, "480p.m3u8")
+}
+
+func TestHlsOutputArgs(t *testing.T) {
+	cfg := config.DirConfigEntry{HlsCodec: "libx264", HlsSegmentType: "fmp4", HlsSegmentSeconds: 4}
+	rendition := HlsLadder([]int{720}, 1280, 720)[0]
+	args := HlsOutputArgs(&cfg, rendition, "/tmp/stream")
+	assert.Equal(t, "hls", args["f"])
+	assert.Equal(t, 4, args["hls_time"])
+	assert.Equal(t, "/tmp/stream/720p_%05d.m4s", args["hls_segment_filename"])
+	assert.Equal(t, "720p_init.mp4", args["hls_fmp4_init_filename"])
+
+	cfg.HlsSegmentType = "mpegts"
+	args = HlsOutputArgs(&cfg, rendition, "/tmp/stream")
+	assert.Equal(t, "/tmp/stream/720p_%05d.ts", args["hls_segment_filename"])
+	_, hasInit := args["hls_fmp4_init_filename"]
+	assert.False(t, hasInit, "Only fmp4 has an init segment")
+
+	assert.Equal(t, "application/vnd.apple.mpegurl", HlsContentType("master.m3u8"))
+	assert.Equal(t, "video/mp2t", HlsContentType("720p_00001.ts"))
+	assert.Equal(t, "application/octet-stream", HlsContentType("notes.txt"))
+}
+
+func TestGetStreamFilePath(t *testing.T) {
+	cnt := &models.Container{Path: t.TempDir(), Name: "stream_test"}
+	streamDir := GetContentStreamDst(cnt, 12)
+	assert.NoError(t, os.MkdirAll(streamDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(streamDir, HlsMasterPlaylist), []byte("#EXTM3U\n"), 0644))
+
+	fqPath, err := GetStreamFilePath(cnt, 12, HlsMasterPlaylist)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(cnt.GetFqPath(), config.STREAM_DIRECTORY, "12", HlsMasterPlaylist), fqPath)
+
+	_, err = GetStreamFilePath(cnt, 12, "720p.m3u8")
+	assert.True(t, os.IsNotExist(err), "Missing files are an error")
+	for _, name := range []string{"../12/master.m3u8", "..", "sub/720p.m3u8", "notes.txt"} {
+		_, err = GetStreamFilePath(cnt, 12, name)
+		assert.Error(t, err, "Invalid name %s", name)
+	}
+}
@@ -28,6 +28,7 @@ type MemoryStorage struct {
 	ValidScreens    models.ScreenMap
 	ValidTags       models.TagsMap
 	ValidTasks      models.TaskRequests // Not a Map as we want the order to matter
+	ScheduleRuns    map[string]models.ScheduleRun
 	Sequences       SequenceMap
 }
 
@@ -69,6 +70,7 @@ func InitializeMemory(dirRoot string) *MemoryStorage {
 	memStorage.ValidScreens = screens
 	memStorage.ValidTags = tags
 	memStorage.ValidTasks = models.TaskRequests{}
+	memStorage.ScheduleRuns = map[string]models.ScheduleRun{}
 
 	memStorage.Initialized = true
 	memStorage.Loading = false
@@ -83,6 +85,7 @@ func InitializeEmptyMemory() *MemoryStorage {
 	memStorage.ValidScreens = models.ScreenMap{}
 	memStorage.ValidTags = models.TagsMap{}
 	memStorage.ValidTasks = models.TaskRequests{}
+	memStorage.ScheduleRuns = map[string]models.ScheduleRun{}
 	return &memStorage
 }
 
@@ -159,7 +162,9 @@ func (ms MemoryStorage) CreateTask(tr *models.TaskRequest) (*models.TaskRequest,
 	tr.ID = AssignNumerical(tr.ID, "taskrequests")
 	tr.CreatedAt = time.Now()
 	tr.UpdatedAt = time.Now()
-	tr.Status = models.TaskStatus.NEW
+	if tr.Status != models.TaskStatus.WAITING {
+		tr.Status = models.TaskStatus.NEW
+	}
 	memStorage.ValidTasks = append(memStorage.ValidTasks, *tr)
 	return tr, nil
 }
@@ -189,7 +194,7 @@ func (ms MemoryStorage) UpdateTask(t *models.TaskRequest, currentState models.Ta
 		// prevent MOST update errors in the memory view.
 		log.Printf("Looking at %s trying to find id(%d) in state %s", task, t.ID, currentState)
 		if task.ID == t.ID && (currentState == task.Status || task.Status == t.Status) {
-			t.UpdatedAt = time.Now() // TODO: This is not thread safe
+			t.UpdatedAt = time.Now() // The memory manager holds its task lock around this
 			memStorage.ValidTasks[idx] = *t
 			updated = true
 			break
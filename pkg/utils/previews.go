@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"contented/pkg/config"
 	"contented/pkg/models"
+	"context"
 	"errors"
 	"fmt"
 	"image"
@@ -311,7 +312,7 @@ func CreateScreensFromVideoSized(srcFile string, dstFile string, previewScreensO
 		log.Printf("File size is large for %s using SEEK screen", srcFile)
 
 		// Currently I get a list of screens but don't do anything with it.
-		_, screenFmt, err := CreateSeekScreens(srcFile, dstFile, totalScreens, frameOffsetSeconds)
+		_, screenFmt, err := CreateSeekScreens(context.Background(), srcFile, dstFile, totalScreens, frameOffsetSeconds, nil)
 		return screenFmt, err
 	} else {
 		log.Printf("File size is small %s using SELECT filter", srcFile)
@@ -328,7 +329,7 @@ func CreateWebpFromVideo(srcFile string, dstFile string) (string, error) {
 		return "", err
 	}
 	globMatch := GetScreensOutputGlob(dstFile)
-	return CreateWebpFromScreens(globMatch, dstFile)
+	return CreateWebpFromScreens(context.Background(), globMatch, dstFile)
 }
 
 func CreateSelectFilterScreens(srcFile string, dstFile string, maxScreens int, frameOffsetSeconds int) (string, error) {
@@ -348,11 +349,15 @@ func CreateSelectFilterScreens(srcFile string, dstFile string, maxScreens int, f
 	screensDst := GetScreensOutputPattern(dstFile)
 	filter := fmt.Sprintf("select='not(mod(n,%d))',setpts='N/(30*TB)'", frameNum)
 	screenErr := ffmpeg.Input(srcFile, ffmpeg.KwArgs{}).
-		Output(screensDst, ffmpeg.KwArgs{"format": "image2", "vf": filter}).
+		Output(TempOutputName(screensDst), ffmpeg.KwArgs{"format": "image2", "vf": filter}).
 		OverWriteOutput().Run()
 	if screenErr != nil {
 		log.Printf("Failed to write multiple screens out %s", screenErr)
 	}
+	// Even a failed run can leave temp screens, only the ones that probe are kept
+	if _, renameErr := RenameTempSequence(context.Background(), screensDst); renameErr != nil {
+		log.Printf("Failed to move screens into place %s", renameErr)
+	}
 	// Rename the dstFile with Indexing information (replace.png with info)
 	return screensDst, err
 }
@@ -367,10 +372,12 @@ func GetScreenNumber(totalTime float64, maxScreens int, frameOffsetSeconds int)
 
 // Need to do timing test with this then a timing test with a much bigger file.
 // IMPORTANT if this is > 4 it will break ffmpeg finding the screens.
-func CreateSeekScreens(srcFile string, dstFile string, maxScreens int, frameOffsetSeconds int) ([]string, string, error) {
+// The onProgress (optional) is called after each screen is created.
+func CreateSeekScreens(ctx context.Context, srcFile string, dstFile string, maxScreens int, frameOffsetSeconds int, onProgress ProgressCallback) ([]string, string, error) {
 	totalTime, fps, err := GetTotalVideoLength(srcFile)
 	if err != nil {
 		log.Printf("Error creating screens for %s err: %s", srcFile, err)
+		TaskLogf(ctx, "Error creating screens for %s err: %s", srcFile, err)
 	}
 	msg := fmt.Sprintf("%s Total time was %f with %d as the fps", srcFile, totalTime, fps)
 	log.Print(msg)
@@ -395,28 +402,34 @@ func CreateSeekScreens(srcFile string, dstFile string, maxScreens int, frameOffs
 		// screenFile := fmt.Sprintf(screenFmt, ss)
 		screenFile := fmt.Sprintf(screenFmt, idx+1, ss)
 		// screenFile := fmt.Sprintf(screenFmt, idx)
-		err := CreateSeekScreen(srcFile, screenFile, ss)
+		err := CreateSeekScreen(ctx, srcFile, screenFile, ss)
 		if err != nil {
 			log.Printf("Error creating a seek screen %s", err)
 			break
 		} else {
 			screenFiles = append(screenFiles, screenFile)
+			StepProgress(idx+1, totalScreens, onProgress)
 		}
 	}
+	if ctx.Err() != nil {
+		return screenFiles, screenFmt, ctx.Err()
+	}
 	return screenFiles, screenFmt, err
 }
 
 // This can be much faster to do multiple seek screens vs a filter over about a 50mb
 // video file.  Then creating a palette and using these screens that makes for smaller webp.
-func CreateSeekScreen(srcFile string, dstFile string, screenTime int) error {
-	screenErr := ffmpeg.Input(srcFile, ffmpeg.KwArgs{"ss": screenTime}).
-		Output(dstFile, ffmpeg.KwArgs{"format": "image2", "vframes": 1}).
-		OverWriteOutput().Run()
-	return screenErr
+func CreateSeekScreen(ctx context.Context, srcFile string, dstFile string, screenTime int) error {
+	input := ffmpeg.Input(srcFile, ffmpeg.KwArgs{"ss": screenTime})
+	return WriteOutputAtomic(ctx, dstFile, func(tmpFile string) error {
+		return ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{input}, tmpFile, ffmpeg.KwArgs{"format": "image2", "vframes": 1}).
+			GlobalArgs(FfmpegLogArgs()...).
+			OverWriteOutput().WithErrorOutput(TaskLog(ctx)).Run()
+	}, nil)
 }
 
 // Note a src can b either a set of images with a %d00 or a video link
-func PaletteGen(paletteSrc string, dstFile string) (string, error) {
+func PaletteGen(ctx context.Context, paletteSrc string, dstFile string) (string, error) {
 	// TODO: Make this into a palette method
 	paletteFile := fmt.Sprintf("%s.palette.png", dstFile)
 
@@ -432,10 +445,12 @@ func PaletteGen(paletteSrc string, dstFile string) (string, error) {
 		"frames:v": 1,
 		"vf":       "palettegen",
 	}
-	paletteErr := ffmpeg.Input(paletteSrc, paletteArgs).
-		Output(paletteFile, outputArgs).
-		OverWriteOutput().Run()
-	//   OverWriteOutput().ErrorToStdOut().Run()
+	input := ffmpeg.Input(paletteSrc, paletteArgs)
+	paletteErr := WriteOutputAtomic(ctx, paletteFile, func(tmpFile string) error {
+		return ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{input}, tmpFile, outputArgs).
+			GlobalArgs(FfmpegLogArgs()...).
+			OverWriteOutput().WithErrorOutput(TaskLog(ctx)).Run()
+	}, nil)
 
 	if paletteErr != nil {
 		log.Printf("Failed to create a palette %s", paletteErr)
@@ -445,14 +460,14 @@ func PaletteGen(paletteSrc string, dstFile string) (string, error) {
 }
 
 // This does not seem to be much faster, but the gif/Webp might be a better toggle.
-func CreateWebpFromScreens(screensSrc string, dstFile string) (string, error) {
+func CreateWebpFromScreens(ctx context.Context, screensSrc string, dstFile string) (string, error) {
 	stripExtension := regexp.MustCompile(".png$")
 	dstFile = stripExtension.ReplaceAllString(dstFile, "")
 
 	// Need a function that determines the preview output filename and takes in the config
 	// for the preview type name...
 	log.Printf("What is the screens %s vs dstFile %s", screensSrc, dstFile)
-	paletteFile, palErr := PaletteGen(screensSrc, dstFile)
+	paletteFile, palErr := PaletteGen(ctx, screensSrc, dstFile)
 	if palErr != nil {
 		return "", palErr
 	}
@@ -460,27 +475,18 @@ func CreateWebpFromScreens(screensSrc string, dstFile string) (string, error) {
 	// Should scale based on a probe of the size maybe?  No need to make something
 	// tiny even smaller. This seems to produce a "decent" output.
 	filter := "paletteuse,setpts=25*PTS,scale=iw*.5:ih*.5"
-	screenErr := ffmpeg.Input(screensSrc, ffmpeg.KwArgs{
+	input := ffmpeg.Input(screensSrc, ffmpeg.KwArgs{
 		"pattern_type": "glob",
-	}).Output(dstFile, ffmpeg.KwArgs{
-		"i":              paletteFile,
-		"filter_complex": filter,
-		"loop":           0,
-	}).OverWriteOutput().Run()
-
-	if screenErr != nil {
-		return dstFile, screenErr
-	}
-
-	// Probably want to strip the paths but for now this is ok
-	if f, err := os.Stat(dstFile); err == nil {
-		if f.Size() > 0 {
-			return dstFile, nil
-		}
-		return dstFile, fmt.Errorf("file %s exists on disk but was too small", dstFile)
-	} else {
-		return dstFile, fmt.Errorf("%s doesn't seem to exist err %s", dstFile, err)
-	}
+	})
+	// The output is probed (and has to be non empty) before it replaces the dstFile
+	screenErr := WriteOutputAtomic(ctx, dstFile, func(tmpFile string) error {
+		return ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{input}, tmpFile, ffmpeg.KwArgs{
+			"i":              paletteFile,
+			"filter_complex": filter,
+			"loop":           0,
+		}).GlobalArgs(FfmpegLogArgs()...).OverWriteOutput().WithErrorOutput(TaskLog(ctx)).Run()
+	}, nil)
+	return dstFile, screenErr
 }
 
 func CreatePngFromVideo(srcFile string, dstFile string) (string, error) {
@@ -493,7 +499,9 @@ func CreatePngFromVideo(srcFile string, dstFile string) (string, error) {
 
 	// TODO: Get a full resolution image based on the stream resolution?
 	resizedImg := imaging.Resize(img, 640, 0, imaging.Lanczos)
-	err = imaging.Save(resizedImg, dstFile)
+	err = WriteOutputAtomic(context.Background(), dstFile, func(tmpFile string) error {
+		return imaging.Save(resizedImg, tmpFile) // The temp name keeps the extension imaging uses for the format
+	}, nil)
 	if err != nil {
 		log.Printf("Could not save the image %s with error %s\n", dstFile, err)
 		return "", err
@@ -602,15 +610,17 @@ func CreateGifFromVideo(srcFile string, dstFile string) (string, error) {
 	log.Printf("Gif total time %s framerate %s speedup %s", time_to_encode, framerate, filter_v)
 
 	// Framerate vframes
-	gif_err := ffmpeg.Input(srcFile, ffmpeg.KwArgs{"ss": skipSeconds}).
-		Output(dstFile, ffmpeg.KwArgs{
-			"s":        "640x480",
-			"pix_fmt":  "yuvj422p",
-			"t":        time_to_encode,
-			"vframes":  vframes,
-			"r":        framerate,
-			"filter:v": filter_v,
-		}).OverWriteOutput().Run()
+	gif_err := WriteOutputAtomic(context.Background(), dstFile, func(tmpFile string) error {
+		return ffmpeg.Input(srcFile, ffmpeg.KwArgs{"ss": skipSeconds}).
+			Output(tmpFile, ffmpeg.KwArgs{
+				"s":        "640x480",
+				"pix_fmt":  "yuvj422p",
+				"t":        time_to_encode,
+				"vframes":  vframes,
+				"r":        framerate,
+				"filter:v": filter_v,
+			}).OverWriteOutput().Run()
+	}, nil)
 	if gif_err != nil {
 		log.Printf("Failed to create the gif output %s\n with err: %s\n", dstFile, gif_err)
 	}
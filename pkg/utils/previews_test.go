@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -386,7 +387,7 @@ func TestVideoSelectScreens(t *testing.T) {
 
 	// TODO: Really need to fix the dest file info
 	globMatch := GetScreensOutputGlob(destFile)
-	webpFile, err := CreateWebpFromScreens(globMatch, destFile)
+	webpFile, err := CreateWebpFromScreens(context.Background(), globMatch, destFile)
 	if err != nil {
 		t.Errorf("Failed to create preview %s", err)
 	}
@@ -442,7 +443,7 @@ func Test_VideoCreateSeekScreens(t *testing.T) {
 	previewName := filepath.Join(dstDir, testFile+".webp")
 	srcFile := filepath.Join(srcDir, testFile)
 
-	err := CreateSeekScreen(srcFile, previewName+".jpeg", 10)
+	err := CreateSeekScreen(context.Background(), srcFile, previewName+".jpeg", 10)
 	if err != nil {
 		t.Errorf("Screen seek failed %s", err)
 	}
@@ -450,7 +451,7 @@ func Test_VideoCreateSeekScreens(t *testing.T) {
 	count := cfg.PreviewNumberOfScreens
 	offset := cfg.PreviewFirstScreenOffset
 	startMulti := time.Now()
-	screens, screenPtrn, multiErr := CreateSeekScreens(srcFile, previewName, count, offset)
+	screens, screenPtrn, multiErr := CreateSeekScreens(context.Background(), srcFile, previewName, count, offset, nil)
 	if multiErr != nil {
 		t.Errorf("Failed creating multiple screens %s", multiErr)
 	}
@@ -460,7 +461,7 @@ func Test_VideoCreateSeekScreens(t *testing.T) {
 
 	// Check to ensure you can create a gif from the seek screens
 	globMatch := GetScreensOutputGlob(previewName)
-	webp, webpErr := CreateWebpFromScreens(globMatch, previewName)
+	webp, webpErr := CreateWebpFromScreens(context.Background(), globMatch, previewName)
 	if webpErr != nil {
 		t.Errorf("Failed to create a webp screen collection %s", webpErr)
 	}
@@ -486,7 +487,7 @@ func Test_VideoCreatePaletteFile(t *testing.T) {
 	previewName := filepath.Join(dstDir, testFile)
 	srcFile := filepath.Join(srcDir, testFile)
 
-	paletteFile, err := PaletteGen(srcFile, previewName)
+	paletteFile, err := PaletteGen(context.Background(), srcFile, previewName)
 	if err != nil {
 		t.Errorf("Couldn't create a palette for %s err %s", srcFile, err)
 	}
@@ -0,0 +1,141 @@
+package utils
+
+/**
+ * Parsing for the ffmpeg -progress output so a task can report how far along it is.
+ * ffmpeg writes blocks of key=value lines terminated by progress=continue or progress=end
+ */
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Snapshot of how far along an ffmpeg process is
+type TaskProgress struct {
+	Percent    float64 // 0-100 based on the probed duration
+	Frames     int64   // Frames processed so far
+	Speed      float64 // Multiple of realtime (1.5 = 1.5x)
+	EtaSeconds int64   // Estimated seconds remaining, -1 if unknown
+	Done       bool
+}
+
+// Called each time ffmpeg finishes a progress block (can be nil)
+type ProgressCallback func(TaskProgress)
+
+// Add to an ffmpeg command with .GlobalArgs(ProgressArgs()...) and .WithOutput(ProgressWriter)
+func ProgressArgs() []string {
+	return []string{"-progress", "pipe:1", "-nostats"}
+}
+
+// An io.Writer that ffmpeg stdout can be sent to which calls back on each progress block
+type ProgressWriter struct {
+	duration   float64
+	onProgress ProgressCallback
+
+	mutex     sync.Mutex
+	buf       []byte
+	outTimeUs int64
+	current   TaskProgress
+}
+
+// The duration is the total length of the source in seconds (from GetTotalVideoLength)
+func NewProgressWriter(durationSeconds float64, onProgress ProgressCallback) *ProgressWriter {
+	return &ProgressWriter{
+		duration:   durationSeconds,
+		onProgress: onProgress,
+		current:    TaskProgress{EtaSeconds: -1},
+	}
+}
+
+func (pw *ProgressWriter) Write(p []byte) (int, error) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	pw.buf = append(pw.buf, p...)
+	for {
+		idx := bytes.IndexByte(pw.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(pw.buf[:idx])
+		pw.buf = pw.buf[idx+1:]
+		pw.parseLine(strings.TrimSpace(line))
+	}
+	return len(p), nil
+}
+
+// The most recent progress block, useful after ffmpeg exits
+func (pw *ProgressWriter) Current() TaskProgress {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	return pw.current
+}
+
+func (pw *ProgressWriter) parseLine(line string) {
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "frame":
+		if frames, err := strconv.ParseInt(value, 10, 64); err == nil {
+			pw.current.Frames = frames
+		}
+	case "out_time_us", "out_time_ms": // out_time_ms is also in microseconds (ffmpeg bug)
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us > 0 {
+			pw.outTimeUs = us
+		}
+	case "speed":
+		speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		if err == nil {
+			pw.current.Speed = speed
+		}
+	case "progress":
+		pw.current.Done = value == "end"
+		pw.calculate()
+		if pw.onProgress != nil {
+			pw.onProgress(pw.current)
+		}
+	}
+}
+
+func (pw *ProgressWriter) calculate() {
+	if pw.current.Done {
+		pw.current.Percent = 100
+		pw.current.EtaSeconds = 0
+		return
+	}
+	if pw.duration <= 0 {
+		return
+	}
+	processed := float64(pw.outTimeUs) / 1000000
+	percent := (processed / pw.duration) * 100
+	if percent > 100 {
+		percent = 100
+	}
+	pw.current.Percent = percent
+	if pw.current.Speed > 0 {
+		pw.current.EtaSeconds = int64((pw.duration - processed) / pw.current.Speed)
+		if pw.current.EtaSeconds < 0 {
+			pw.current.EtaSeconds = 0
+		}
+	} else {
+		pw.current.EtaSeconds = -1
+	}
+}
+
+// Progress for work that is done in a known number of steps (screens)
+func StepProgress(done int, total int, onProgress ProgressCallback) {
+	if onProgress == nil || total <= 0 {
+		return
+	}
+	percent := (float64(done) / float64(total)) * 100
+	onProgress(TaskProgress{
+		Percent:    percent,
+		Frames:     int64(done),
+		EtaSeconds: -1,
+		Done:       done >= total,
+	})
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressWriterParsing(t *testing.T) {
+	reports := []TaskProgress{}
+	pw := NewProgressWriter(100, func(p TaskProgress) {
+		reports = append(reports, p)
+	})
+
+	// ffmpeg does not write whole blocks at a time so split a line across writes
+	pw.Write([]byte("frame=250\nfps=50.0\nout_time_us=25000000\nspeed=2.5x\nprog"))
+	assert.Equal(t, 0, len(reports), "It should not report until the block is finished")
+	pw.Write([]byte("ress=continue\n"))
+	assert.Equal(t, 1, len(reports), "It should report on the progress line")
+
+	p := reports[0]
+	assert.Equal(t, int64(250), p.Frames)
+	assert.Equal(t, 2.5, p.Speed)
+	assert.Equal(t, 25.0, p.Percent, "25 of 100 seconds done")
+	assert.Equal(t, int64(30), p.EtaSeconds, "75 seconds left at 2.5x")
+	assert.False(t, p.Done)
+
+	pw.Write([]byte("frame=1000\nout_time_us=N/A\nspeed=N/A\nprogress=end\n"))
+	assert.Equal(t, 2, len(reports))
+	done := pw.Current()
+	assert.True(t, done.Done, "It should be finished")
+	assert.Equal(t, 100.0, done.Percent)
+	assert.Equal(t, int64(0), done.EtaSeconds)
+	assert.Equal(t, int64(1000), done.Frames)
+}
+
+func TestProgressWriterUnknownDuration(t *testing.T) {
+	pw := NewProgressWriter(0, nil)
+	pw.Write([]byte("frame=10\nout_time_us=1000000\nspeed=1x\nprogress=continue\n"))
+	p := pw.Current()
+	assert.Equal(t, 0.0, p.Percent, "Without a duration there is no percentage")
+	assert.Equal(t, int64(-1), p.EtaSeconds, "Or an eta")
+	assert.Equal(t, int64(10), p.Frames, "But frames still count")
+}
+
+func TestStepProgress(t *testing.T) {
+	reports := []TaskProgress{}
+	cb := func(p TaskProgress) { reports = append(reports, p) }
+	StepProgress(1, 4, cb)
+	StepProgress(4, 4, cb)
+	StepProgress(1, 4, nil)
+	assert.Equal(t, 2, len(reports))
+	assert.Equal(t, 25.0, reports[0].Percent)
+	assert.True(t, reports[1].Done)
+}
@@ -0,0 +1,157 @@
+package utils
+
+/**
+ * Compare an encode against the source so a visibly worse encode never replaces the original.
+ * ffmpeg prints the score of the libvmaf / ssim / psnr filters on stderr when it finishes, the
+ * encode is scaled back up to the source size first as the metrics need matching frames.
+ */
+import (
+	"bytes"
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var ErrNoQualityScore = errors.New("ffmpeg did not report a quality score")
+
+var qualityScoreRE = map[string]*regexp.Regexp{
+	"vmaf": regexp.MustCompile(`VMAF score[:=]\s*([\d.]+)`),
+	"ssim": regexp.MustCompile(`SSIM .*All:([\d.]+)`),
+	"psnr": regexp.MustCompile(`PSNR .*average:([\d.]+|inf)`),
+}
+
+var qualityFilters = map[string]string{
+	"vmaf": "libvmaf",
+	"ssim": "ssim",
+	"psnr": "psnr",
+}
+
+// Identical frames have an infinite psnr, which does not fit in JSON
+const MaxPsnr = 100.0
+
+var ffmpegFilters sync.Map
+
+// Is the filter compiled into the local ffmpeg (libvmaf is often missing), cached after the first check
+func HasFfmpegFilter(name string) bool {
+	if found, ok := ffmpegFilters.Load(name); ok {
+		return found.(bool)
+	}
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+	found := false
+	if err != nil {
+		log.Printf("Could not list the ffmpeg filters %s", err)
+	} else {
+		filterRE := regexp.MustCompile(`(?m)^\s*\S+\s+` + regexp.QuoteMeta(name) + `\s`)
+		found = filterRE.Match(out)
+	}
+	ffmpegFilters.Store(name, found)
+	return found
+}
+
+// The metric that will actually be used, vmaf falls back to ssim without libvmaf
+func QualityMetricAvailable(metric string) string {
+	if metric == "vmaf" && !HasFfmpegFilter(qualityFilters["vmaf"]) {
+		log.Printf("ffmpeg does not have libvmaf, using ssim for the quality check")
+		return "ssim"
+	}
+	return metric
+}
+
+// The minimum score for the metric
+func QualityThreshold(cfg *config.DirConfigEntry, metric string) float64 {
+	switch metric {
+	case "vmaf":
+		return cfg.QualityMinVmaf
+	case "ssim":
+		return cfg.QualityMinSsim
+	case "psnr":
+		return cfg.QualityMinPsnr
+	}
+	return 0
+}
+
+// Pull the score for the metric out of the ffmpeg output, the last score wins
+func ParseQualityScore(metric string, output string) (float64, error) {
+	scoreRE, ok := qualityScoreRE[metric]
+	if !ok {
+		return 0, fmt.Errorf("unknown quality metric %s", metric)
+	}
+	matches := scoreRE.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("%w for %s", ErrNoQualityScore, metric)
+	}
+	scoreStr := matches[len(matches)-1][1]
+	if scoreStr == "inf" {
+		return MaxPsnr, nil
+	}
+	score, err := strconv.ParseFloat(strings.TrimRight(scoreStr, "."), 64)
+	if err != nil {
+		return 0, err
+	}
+	if metric == "psnr" && score > MaxPsnr {
+		score = MaxPsnr
+	}
+	return score, nil
+}
+
+// Score dstFile against srcFile with the configured metric, the ffmpeg output goes to the task log
+func CompareVideoQuality(ctx context.Context, cfg *config.DirConfigEntry, srcFile string, dstFile string) (*models.VideoQuality, error) {
+	metric := QualityMetricAvailable(cfg.QualityMetric)
+	filterName, ok := qualityFilters[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown quality metric %s", cfg.QualityMetric)
+	}
+	srcInfo, err := ProbeContext(ctx, srcFile)
+	if err != nil {
+		return nil, err
+	}
+	width, height := GetVideoResolution(srcInfo)
+
+	inputArgs := ffmpeg.KwArgs{}
+	if cfg.QualitySampleSeconds > 0 {
+		inputArgs["t"] = cfg.QualitySampleSeconds
+	}
+	distorted := ffmpeg.Input(dstFile, inputArgs).Video()
+	if width > 0 && height > 0 {
+		distorted = distorted.Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d", width, height)}, ffmpeg.KwArgs{"flags": "bicubic"})
+	}
+	distorted = distorted.Filter("setpts", ffmpeg.Args{"PTS-STARTPTS"})
+	reference := ffmpeg.Input(srcFile, inputArgs).Video().Filter("setpts", ffmpeg.Args{"PTS-STARTPTS"})
+	compared := ffmpeg.Filter([]*ffmpeg.Stream{distorted, reference}, filterName, ffmpeg.Args{})
+
+	TaskLogf(ctx, "Comparing %s to %s with %s", dstFile, srcFile, metric)
+	output := bytes.Buffer{}
+	runErr := ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{compared}, "-", ffmpeg.KwArgs{"f": "null"}).
+		GlobalArgs("-hide_banner", "-nostats", "-loglevel", "info"). // The scores are only printed at info
+		WithErrorOutput(io.MultiWriter(&output, TaskLog(ctx))).Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("quality check with %s failed %w", metric, runErr)
+	}
+	score, err := ParseQualityScore(metric, output.String())
+	if err != nil {
+		return nil, err
+	}
+	threshold := QualityThreshold(cfg, metric)
+	quality := models.VideoQuality{
+		Metric:    metric,
+		Score:     score,
+		Threshold: threshold,
+		Passed:    score >= threshold,
+	}
+	TaskLogf(ctx, "Quality %s score %f minimum %f", metric, score, threshold)
+	return &quality, nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"contented/pkg/config"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQualityScore(t *testing.T) {
+	vmaf := "[Parsed_libvmaf_2 @ 0x55] VMAF score: 93.412345\n"
+	score, err := ParseQualityScore("vmaf", vmaf)
+	assert.NoError(t, err)
+	assert.InDelta(t, 93.412345, score, 0.00001)
+
+	ssim := "[Parsed_ssim_2 @ 0x55] SSIM Y:0.991 (20.5) U:0.993 (21.6) V:0.994 (22.1) All:0.992078 (21.0)\n"
+	score, err = ParseQualityScore("ssim", ssim)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.992078, score, 0.000001)
+
+	psnr := "[Parsed_psnr_2 @ 0x55] PSNR y:41.2 u:44.9 v:45.3 average:42.115 min:39.1 max:48.0\n"
+	score, err = ParseQualityScore("psnr", psnr)
+	assert.NoError(t, err)
+	assert.InDelta(t, 42.115, score, 0.0001)
+
+	identical := "[Parsed_psnr_2 @ 0x55] PSNR y:inf u:inf v:inf average:inf min:inf max:inf\n"
+	score, err = ParseQualityScore("psnr", identical)
+	assert.NoError(t, err)
+	assert.Equal(t, MaxPsnr, score, "Identical frames are capped so they can be stored")
+
+	_, err = ParseQualityScore("vmaf", "Conversion failed!")
+	assert.True(t, errors.Is(err, ErrNoQualityScore))
+	_, err = ParseQualityScore("butteraugli", vmaf)
+	assert.Error(t, err)
+}
+
+func TestQualityThreshold(t *testing.T) {
+	cfg := config.GetCfgDefaults()
+	assert.Equal(t, config.DefaultQualityMinVmaf, QualityThreshold(&cfg, "vmaf"))
+	assert.Equal(t, config.DefaultQualityMinSsim, QualityThreshold(&cfg, "ssim"))
+	assert.Equal(t, config.DefaultQualityMinPsnr, QualityThreshold(&cfg, "psnr"))
+	assert.Equal(t, "ssim", QualityMetricAvailable("ssim"))
+}
@@ -0,0 +1,241 @@
+package utils
+
+/**
+ * Subtitles for video content.  Sidecar files (movie.srt, movie.en.srt, movie.en.forced.vtt) are
+ * attached to the video with the same name when a directory is scanned instead of being listed as
+ * content, text subtitle streams in the video can be extracted to WebVTT and an encode keeps the
+ * subtitle streams the output container can hold (ENCODING_SUBTITLES).
+ */
+import (
+	"bytes"
+	"contented/pkg/config"
+	"contented/pkg/models"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const SubtitleContentType = "text/vtt; charset=utf-8"
+
+var SubtitleExtensions = []string{".srt", ".vtt"}
+
+// Used when the system mime types do not know the video extension
+var sidecarVideoExtensions = []string{".mp4", ".m4v", ".mkv", ".avi", ".wmv", ".mov", ".webm", ".mpg", ".mpeg", ".flv"}
+
+// Subtitle codecs that are text and can be converted to WebVTT / mov_text, bitmap subtitles
+// (hdmv_pgs_subtitle, dvd_subtitle) can only be copied into an mkv.
+var TextSubtitleCodecs = []string{"subrip", "srt", "ass", "ssa", "mov_text", "webvtt", "text"}
+
+// srt uses a comma for the milliseconds, WebVTT a period
+var srtTimestampRE = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+var subtitleLangRE = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+type SubtitleStream struct {
+	Index  int // The stream index in the file (for -map 0:<index>)
+	Codec  string
+	Lang   string
+	Forced bool
+}
+
+func IsSubtitleFile(name string) bool {
+	return slices.Contains(SubtitleExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+func isVideoName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return strings.Contains(mime.TypeByExtension(ext), "video") || slices.Contains(sidecarVideoExtensions, ext)
+}
+
+func IsTextSubtitle(codec string) bool {
+	return slices.Contains(TextSubtitleCodecs, codec)
+}
+
+// The directory extracted subtitles for a container go in
+func GetSubtitleDst(cnt *models.Container) string {
+	return filepath.Join(cnt.GetFqPath(), config.SUBTITLE_DIRECTORY)
+}
+
+func GetContentSubtitleDst(cnt *models.Container, contentID int64) string {
+	return filepath.Join(GetSubtitleDst(cnt), strconv.FormatInt(contentID, 10))
+}
+
+// The full path to a subtitle track, the track src has to be a plain file name as the tracks can
+// be updated through the content API.
+func GetSubtitleFilePath(cnt *models.Container, contentID int64, track *models.SubtitleTrack) (string, error) {
+	if track.Src == "" || filepath.Base(track.Src) != track.Src || HasUpwardTraversal(track.Src) || !IsSubtitleFile(track.Src) {
+		return "", fmt.Errorf("invalid subtitle file name %s", track.Src)
+	}
+	if track.Extracted {
+		return GetFilePathInContainer(track.Src, GetContentSubtitleDst(cnt, contentID))
+	}
+	return GetFilePathInContainer(track.Src, cnt.GetFqPath())
+}
+
+// Lowercase language key safe to use in a url and as a file name, und if it is unknown
+func SubtitleLang(lang string) string {
+	lang = strings.Trim(subtitleLangRE.ReplaceAllString(strings.ToLower(lang), "_"), "._")
+	if lang == "" {
+		return "und"
+	}
+	return lang
+}
+
+// Split the subtitle files that go with a video out of the directory listing, the tracks are keyed
+// by the video file name.  A subtitle file without a matching video stays in the listing.
+func MatchSidecarSubtitles(files []os.FileInfo) ([]os.FileInfo, map[string]models.SubtitleTracks) {
+	videoStems := map[string]string{}
+	for _, file := range files {
+		if isVideoName(file.Name()) {
+			videoStems[strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))] = file.Name()
+		}
+	}
+	remaining := []os.FileInfo{}
+	sidecars := map[string]models.SubtitleTracks{}
+	for _, file := range files {
+		name := file.Name()
+		if !IsSubtitleFile(name) {
+			remaining = append(remaining, file)
+			continue
+		}
+		ext := filepath.Ext(name)
+		subStem := strings.TrimSuffix(name, ext)
+
+		// The longest video name wins so movie.part2.en.srt is not given to movie.mp4
+		videoStem := ""
+		for stem := range videoStems {
+			if (subStem == stem || strings.HasPrefix(subStem, stem+".")) && len(stem) > len(videoStem) {
+				videoStem = stem
+			}
+		}
+		if videoStem == "" {
+			remaining = append(remaining, file)
+			continue
+		}
+		video := videoStems[videoStem]
+		track := models.SubtitleTrack{
+			Lang:   SubtitleLang(strings.TrimPrefix(subStem, videoStem)),
+			Src:    name,
+			Format: strings.TrimPrefix(strings.ToLower(ext), "."),
+		}
+		// Both an .srt and .vtt for the same language, the vtt does not need converting
+		if existing := sidecars[video].Find(track.Lang); existing != nil {
+			if track.Format == "vtt" {
+				*existing = track
+			}
+			continue
+		}
+		sidecars[video] = append(sidecars[video], track)
+	}
+	for video := range sidecars {
+		slices.SortFunc(sidecars[video], func(a, b models.SubtitleTrack) int {
+			return strings.Compare(a.Lang, b.Lang)
+		})
+	}
+	return remaining, sidecars
+}
+
+// Browsers only support WebVTT in a <track>, an srt only needs a header and new timestamps
+func SrtToVtt(srt []byte) []byte {
+	text := strings.ReplaceAll(string(bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))), "\r\n", "\n")
+	text = srtTimestampRE.ReplaceAllString(text, "$1.$2")
+	return []byte("WEBVTT\n\n" + strings.TrimLeft(text, "\n"))
+}
+
+// The subtitle streams from ffprobe output
+func GetSubtitleStreams(vidInfo string) []SubtitleStream {
+	streams := []SubtitleStream{}
+	for _, stream := range gjson.Get(vidInfo, `streams.#(codec_type=="subtitle")#`).Array() {
+		streams = append(streams, SubtitleStream{
+			Index:  int(stream.Get("index").Int()),
+			Codec:  stream.Get("codec_name").String(),
+			Lang:   stream.Get("tags.language").String(),
+			Forced: stream.Get("disposition.forced").Int() == 1,
+		})
+	}
+	return streams
+}
+
+// The -map values and subtitle codec to keep the subtitle streams an encode to the container can
+// hold, no maps means there was nothing to keep.
+func SubtitleOutputArgs(container string, streams []SubtitleStream) ([]string, string) {
+	codec := "mov_text"
+	switch container {
+	case "mkv":
+		codec = "copy"
+	case "webm":
+		codec = "webvtt"
+	}
+	maps := []string{}
+	for _, stream := range streams {
+		if codec != "copy" && !IsTextSubtitle(stream.Codec) {
+			log.Printf("Dropping %s subtitle stream %d, %s cannot hold it", stream.Codec, stream.Index, container)
+			continue
+		}
+		maps = append(maps, fmt.Sprintf("0:%d", stream.Index))
+	}
+	if len(maps) == 0 {
+		return maps, ""
+	}
+	return maps, codec
+}
+
+// Write each text subtitle stream in srcFile to dstDir as <lang>.vtt (anything already there is
+// replaced).  Returns the tracks written and the streams that could not be converted.  Language
+// keys already used by the taken tracks (sidecars) get the stream index added.
+func ExtractSubtitles(ctx context.Context, srcFile string, dstDir string, taken models.SubtitleTracks) (models.SubtitleTracks, []SubtitleStream, error) {
+	vidInfo, err := ProbeContext(ctx, srcFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.RemoveAll(dstDir); err != nil {
+		return nil, nil, err
+	}
+	tracks := models.SubtitleTracks{}
+	skipped := []SubtitleStream{}
+	for _, stream := range GetSubtitleStreams(vidInfo) {
+		if !IsTextSubtitle(stream.Codec) {
+			skipped = append(skipped, stream)
+			continue
+		}
+		lang := SubtitleLang(stream.Lang)
+		if stream.Forced {
+			lang += ".forced"
+		}
+		if taken.Find(lang) != nil || tracks.Find(lang) != nil {
+			lang = fmt.Sprintf("%s.%d", lang, stream.Index)
+		}
+		if err := os.MkdirAll(dstDir, 0755); err != nil {
+			return nil, nil, err
+		}
+		track := models.SubtitleTrack{Lang: lang, Src: lang + ".vtt", Format: "vtt", Extracted: true}
+		dstFile := filepath.Join(dstDir, track.Src)
+		TaskLogf(ctx, "Extracting %s subtitle stream %d from %s to %s", stream.Codec, stream.Index, srcFile, dstFile)
+
+		kwArgs := ffmpeg.KwArgs{"map": fmt.Sprintf("0:%d", stream.Index), "c:s": "webvtt", "f": "webvtt"}
+		runErr := WriteOutputAtomic(ctx, dstFile, func(tmpFile string) error {
+			return ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(srcFile)}, tmpFile, kwArgs).
+				GlobalArgs(FfmpegLogArgs()...).
+				OverWriteOutput().WithErrorOutput(TaskLog(ctx)).Run()
+		}, nil)
+		if ctx.Err() != nil {
+			os.RemoveAll(dstDir)
+			return nil, nil, ctx.Err()
+		}
+		if runErr != nil {
+			os.RemoveAll(dstDir)
+			return nil, nil, fmt.Errorf("failed to extract subtitle stream %d %w", stream.Index, runErr)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, skipped, nil
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"contented/pkg/models"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchSidecarSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"movie.mp4", "movie.srt", "movie.EN.srt", "movie.en.vtt", "movie.en.forced.srt",
+		"movie.part2.mkv", "movie.part2.fr.srt", "orphan.srt", "notes.txt",
+	}
+	files := []os.FileInfo{}
+	for _, name := range names {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("1"), 0644))
+		info, _ := os.Stat(filepath.Join(dir, name))
+		files = append(files, info)
+	}
+
+	remaining, sidecars := MatchSidecarSubtitles(files)
+	remainingNames := []string{}
+	for _, file := range remaining {
+		remainingNames = append(remainingNames, file.Name())
+	}
+	slices.Sort(remainingNames)
+	assert.Equal(t, []string{"movie.mp4", "movie.part2.mkv", "notes.txt", "orphan.srt"}, remainingNames, "Only subtitles with a video are removed")
+
+	movie := sidecars["movie.mp4"]
+	assert.Equal(t, 3, len(movie), "One track per language")
+	assert.Equal(t, models.SubtitleTrack{Lang: "en", Src: "movie.en.vtt", Format: "vtt"}, *movie.Find("en"), "The vtt is preferred")
+	assert.Equal(t, "movie.en.forced.srt", movie.Find("en.forced").Src)
+	assert.Equal(t, "movie.srt", movie.Find("und").Src, "No language in the name is undetermined")
+
+	part2 := sidecars["movie.part2.mkv"]
+	assert.Equal(t, 1, len(part2), "The longest video name gets the subtitle")
+	assert.Equal(t, "fr", part2[0].Lang)
+}
+
+func TestFindContentSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	cnt := models.Container{ID: 1, Path: dir, Name: "subs"}
+	assert.NoError(t, os.MkdirAll(cnt.GetFqPath(), 0755))
+	for _, name := range []string{"a.mkv", "a.en.srt", "b.png"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), name), []byte("1"), 0644))
+	}
+	contents := FindContent(cnt, 10, 0)
+	assert.Equal(t, 2, len(contents), "The sidecar is not content")
+	for _, content := range contents {
+		if content.Src == "a.mkv" {
+			assert.Equal(t, 1, len(content.Subtitles))
+			assert.Equal(t, "en", content.Subtitles[0].Lang)
+		} else {
+			assert.Nil(t, content.Subtitles)
+		}
+	}
+}
+
+func TestSubtitleFiles(t *testing.T) {
+	cnt := &models.Container{Path: t.TempDir(), Name: "subtitle_test"}
+	assert.NoError(t, os.MkdirAll(GetContentSubtitleDst(cnt, 3), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(cnt.GetFqPath(), "a.en.srt"), []byte("1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(GetContentSubtitleDst(cnt, 3), "eng.vtt"), []byte("1"), 0644))
+
+	fqPath, err := GetSubtitleFilePath(cnt, 3, &models.SubtitleTrack{Lang: "en", Src: "a.en.srt"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(cnt.GetFqPath(), "a.en.srt"), fqPath)
+	fqPath, err = GetSubtitleFilePath(cnt, 3, &models.SubtitleTrack{Lang: "eng", Src: "eng.vtt", Extracted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(GetContentSubtitleDst(cnt, 3), "eng.vtt"), fqPath)
+
+	for _, src := range []string{"../a.en.srt", "sub/a.en.srt", "a.mp4", ""} {
+		_, err = GetSubtitleFilePath(cnt, 3, &models.SubtitleTrack{Lang: "en", Src: src})
+		assert.Error(t, err, "Invalid subtitle src %s", src)
+	}
+	assert.Equal(t, "und", SubtitleLang(""))
+	assert.Equal(t, "pt-br", SubtitleLang(".PT-BR"))
+	assert.Equal(t, "en_sdh", SubtitleLang("en sdh"))
+}
+
+func TestSrtToVtt(t *testing.T) {
+	srt := "\xef\xbb\xbf1\r\n00:00:01,500 --> 00:00:04,000\r\nHello, world\r\n\r\n2\r\n00:01:00,000 --> 00:01:02,250\r\nBye\r\n"
+	vtt := string(SrtToVtt([]byte(srt)))
+	expect := "WEBVTT\n\n1\n00:00:01.500 --> 00:00:04.000\nHello, world\n\n2\n00:01:00.000 --> 00:01:02.250\nBye\n"
+	assert.Equal(t, expect, vtt, "Commas in the text are left alone")
+}
+
+func TestSubtitleOutputArgs(t *testing.T) {
+	probe := `{"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac"},
+		{"index": 2, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}},
+		{"index": 3, "codec_type": "subtitle", "codec_name": "hdmv_pgs_subtitle", "tags": {"language": "fre"}, "disposition": {"forced": 1}}
+	]}`
+	streams := GetSubtitleStreams(probe)
+	assert.Equal(t, []SubtitleStream{
+		{Index: 2, Codec: "subrip", Lang: "eng"},
+		{Index: 3, Codec: "hdmv_pgs_subtitle", Lang: "fre", Forced: true},
+	}, streams)
+
+	maps, codec := SubtitleOutputArgs("mp4", streams)
+	assert.Equal(t, []string{"0:2"}, maps, "mp4 cannot hold bitmap subtitles")
+	assert.Equal(t, "mov_text", codec)
+
+	maps, codec = SubtitleOutputArgs("mkv", streams)
+	assert.Equal(t, []string{"0:2", "0:3"}, maps)
+	assert.Equal(t, "copy", codec)
+
+	_, codec = SubtitleOutputArgs("webm", streams)
+	assert.Equal(t, "webvtt", codec)
+
+	maps, codec = SubtitleOutputArgs("mp4", GetSubtitleStreams(`{"streams": []}`))
+	assert.Empty(t, maps, "No subtitles to keep")
+	assert.Equal(t, "", codec)
+}
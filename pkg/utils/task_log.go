@@ -0,0 +1,227 @@
+package utils
+
+/**
+ * Each task gets a log file the ffmpeg / ffprobe stderr is written to, otherwise a failed encode
+ * only leaves "exit status 1" to debug with.  The log is carried on the task context so the ffmpeg
+ * helpers do not need to know about tasks, without one the output is discarded.
+ */
+import (
+	"contented/pkg/config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+type taskLogKey struct{}
+
+// Matches task logs and their rotated copies, used when purging the log directory
+var taskLogRE = regexp.MustCompile(`^task_\d+\.log(\.\d+)?$`)
+
+// Attach the writer ffmpeg output for the task should go to
+func WithTaskLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, taskLogKey{}, w)
+}
+
+// The task log for the context, io.Discard if the work is not running as a task
+func TaskLog(ctx context.Context) io.Writer {
+	if ctx != nil {
+		if w, ok := ctx.Value(taskLogKey{}).(io.Writer); ok && w != nil {
+			return w
+		}
+	}
+	return io.Discard
+}
+
+// Write a line to the task log (a no-op without one)
+func TaskLogf(ctx context.Context, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprintf(TaskLog(ctx), "[%s] %s\n", time.Now().UTC().Format(time.RFC3339), line)
+}
+
+// Add to an ffmpeg command so the task log gets ffmpeg output at the configured level
+func FfmpegLogArgs() []string {
+	level := config.GetCfg().FfmpegLogLevel
+	if level == "" {
+		level = config.DefaultFfmpegLogLevel
+	}
+	return []string{"-hide_banner", "-loglevel", level}
+}
+
+// ffmpeg.Probe but a failure (which includes the ffprobe stderr) is written to the task log
+func ProbeContext(ctx context.Context, srcFile string) (string, error) {
+	info, err := ffmpeg.Probe(srcFile)
+	if err != nil {
+		TaskLogf(ctx, "ffprobe %s failed %s", srcFile, err)
+	}
+	return info, err
+}
+
+func TaskLogName(taskID int64) string {
+	return fmt.Sprintf("task_%d.log", taskID)
+}
+
+// The full path to a log name, the name is checked so a task cannot point outside of the log dir
+func TaskLogPath(logDir string, name string) (string, error) {
+	if !taskLogRE.MatchString(name) {
+		return "", fmt.Errorf("invalid task log name %s", name)
+	}
+	return filepath.Join(logDir, name), nil
+}
+
+// A size capped log file, past maxBytes it is moved to .1 (.1 to .2 etc) keeping maxFiles old copies
+type RotatingLog struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Open (appending to) the log file, a retried task keeps adding to the same log
+func OpenRotatingLog(path string, maxBytes int64, maxFiles int) (*RotatingLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rl := &RotatingLog{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := rl.open(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Open the log for a task using the config limits
+func OpenTaskLog(cfg *config.DirConfigEntry, taskID int64) (*RotatingLog, error) {
+	path, err := TaskLogPath(cfg.TaskLogDir, TaskLogName(taskID))
+	if err != nil {
+		return nil, err
+	}
+	return OpenRotatingLog(path, cfg.TaskLogMaxBytes, cfg.TaskLogMaxFiles)
+}
+
+func (rl *RotatingLog) open() error {
+	f, err := os.OpenFile(rl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rl.file = f
+	rl.size = info.Size()
+	return nil
+}
+
+func (rl *RotatingLog) Write(p []byte) (int, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rl.maxBytes > 0 && rl.size > 0 && rl.size+int64(len(p)) > rl.maxBytes {
+		if err := rl.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rl.file.Write(p)
+	rl.size += int64(n)
+	return n, err
+}
+
+func (rl *RotatingLog) rotate() error {
+	if err := rl.file.Close(); err != nil {
+		return err
+	}
+	rl.file = nil
+	if rl.maxFiles <= 0 {
+		if err := os.Remove(rl.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rl.open()
+	}
+	os.Remove(rotatedName(rl.path, rl.maxFiles))
+	for idx := rl.maxFiles - 1; idx > 0; idx-- {
+		os.Rename(rotatedName(rl.path, idx), rotatedName(rl.path, idx+1))
+	}
+	if err := os.Rename(rl.path, rotatedName(rl.path, 1)); err != nil {
+		return err
+	}
+	return rl.open()
+}
+
+func (rl *RotatingLog) Close() error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.file == nil {
+		return nil
+	}
+	err := rl.file.Close()
+	rl.file = nil
+	return err
+}
+
+func rotatedName(path string, idx int) string {
+	return path + "." + strconv.Itoa(idx)
+}
+
+// The log with any rotated copies, oldest output first
+func ReadTaskLog(path string) ([]byte, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	content := []byte{}
+	for idx := len(rotated); idx > 0; idx-- {
+		old, err := os.ReadFile(rotatedName(path, idx))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		content = append(content, old...)
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(content, current...), nil
+}
+
+// Remove task logs (and rotated copies) last written before olderThan, returns how many were removed
+func PurgeTaskLogs(logDir string, olderThan time.Time) (int, error) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !taskLogRE.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(olderThan) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(logDir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingLog(t *testing.T) {
+	dir := t.TempDir()
+	path, err := TaskLogPath(dir, TaskLogName(12))
+	assert.NoError(t, err)
+
+	rl, err := OpenRotatingLog(path, 10, 2)
+	assert.NoError(t, err)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := rl.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, rl.Close())
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "Only two old copies are kept")
+	content, err := ReadTaskLog(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "bbbbbbbb\ncccccccc\ndddddddd\n", string(content), "Oldest output first, the first line rotated away")
+
+	// A retry appends to the same log
+	again, err := OpenRotatingLog(path, 100, 2)
+	assert.NoError(t, err)
+	again.Write([]byte("retry\n"))
+	again.Close()
+	content, _ = ReadTaskLog(path)
+	assert.True(t, strings.HasSuffix(string(content), "dddddddd\nretry\n"))
+
+	_, err = TaskLogPath(dir, "../../etc/passwd")
+	assert.Error(t, err, "Log names cannot leave the log dir")
+	_, err = ReadTaskLog(filepath.Join(dir, TaskLogName(99)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTaskLogContext(t *testing.T) {
+	assert.Equal(t, io.Discard, TaskLog(context.Background()), "No task log discards the output")
+
+	sb := strings.Builder{}
+	ctx := WithTaskLog(context.Background(), &sb)
+	TaskLogf(ctx, "ffprobe %s failed", "missing.mp4")
+	assert.Contains(t, sb.String(), "ffprobe missing.mp4 failed")
+	assert.Contains(t, FfmpegLogArgs(), "-loglevel")
+}
+
+func TestPurgeTaskLogs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"task_1.log", "task_1.log.1", "task_2.log", "notes.txt"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("log"), 0644))
+	}
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for _, name := range []string{"task_1.log", "task_1.log.1", "notes.txt"} {
+		assert.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+	}
+
+	removed, err := PurgeTaskLogs(dir, time.Now().Add(-14*24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed, "Only the old task logs are removed")
+	_, err = os.Stat(filepath.Join(dir, "task_2.log"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	assert.NoError(t, err, "Other files are left alone")
+
+	removed, err = PurgeTaskLogs(filepath.Join(dir, "missing"), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
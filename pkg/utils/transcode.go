@@ -0,0 +1,61 @@
+package utils
+
+/**
+ * Stream a video the browser cannot play as fragmented mp4 straight from ffmpeg, nothing is written
+ * to disk so the response cannot be cached or range requested.  Seeking is done by starting a new
+ * stream from a later time.
+ */
+import (
+	"bytes"
+	"contented/pkg/config"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const TranscodeContentType = "video/mp4"
+
+// The fragments have to be written as they are encoded as the output is not seekable
+const transcodeMovFlags = "frag_keyframe+empty_moov+default_base_moof"
+
+// h264 only needs a new container, anything else is re-encoded with the TRANSCODE_CODEC
+func TranscodeOutputArgs(cfg *config.DirConfigEntry, videoCodec string) ffmpeg.KwArgs {
+	kwArgs := ffmpeg.KwArgs{
+		"c:a":      "aac",
+		"b:a":      "128k",
+		"ac":       2,
+		"f":        "mp4",
+		"movflags": transcodeMovFlags,
+	}
+	if videoCodec == "h264" {
+		kwArgs["c:v"] = "copy"
+	} else {
+		kwArgs["c:v"] = cfg.TranscodeCodec
+		kwArgs["preset"] = cfg.TranscodePreset
+		kwArgs["pix_fmt"] = "yuv420p"
+	}
+	return kwArgs
+}
+
+// Write srcFile from startSeconds to w until it finishes or ctx is canceled (killing ffmpeg)
+func TranscodeStream(ctx context.Context, cfg *config.DirConfigEntry, srcFile string, videoCodec string, startSeconds float64, w io.Writer) error {
+	inputArgs := ffmpeg.KwArgs{}
+	if startSeconds > 0 {
+		inputArgs["ss"] = fmt.Sprintf("%.3f", startSeconds)
+	}
+	stderr := bytes.Buffer{}
+	err := ffmpeg.OutputContext(ctx, []*ffmpeg.Stream{ffmpeg.Input(srcFile, inputArgs)}, "pipe:1", TranscodeOutputArgs(cfg, videoCodec)).
+		GlobalArgs("-hide_banner", "-nostats", "-loglevel", "error").
+		WithOutput(w).WithErrorOutput(&stderr).Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Printf("Transcode of %s failed %s", srcFile, stderr.String())
+		return fmt.Errorf("transcode of %s failed %w", srcFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"contented/pkg/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranscodeOutputArgs(t *testing.T) {
+	cfg := config.DirConfigEntry{TranscodeCodec: "libx264", TranscodePreset: "veryfast"}
+
+	args := TranscodeOutputArgs(&cfg, "hevc")
+	assert.Equal(t, "libx264", args["c:v"])
+	assert.Equal(t, "veryfast", args["preset"])
+	assert.Equal(t, "mp4", args["f"])
+	assert.Contains(t, args["movflags"], "frag_keyframe", "The output has to be fragmented to stream")
+	assert.Equal(t, "aac", args["c:a"])
+
+	args = TranscodeOutputArgs(&cfg, "h264")
+	assert.Equal(t, "copy", args["c:v"], "h264 only needs a new container")
+	_, hasPreset := args["preset"]
+	assert.False(t, hasPreset)
+}
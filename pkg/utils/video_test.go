@@ -2,6 +2,7 @@ package utils
 
 import (
 	"contented/pkg/config"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -55,7 +56,7 @@ func Test_VideoEncoding(t *testing.T) {
 	//cfg.CodecForConversionName = "libx265" for testing if you have a working nvida setup hevc_nvenc
 	config.SetCfg(*cfg)
 
-	msg, err, encoded := ConvertVideoToH265(srcFile, dstFile)
+	msg, err, encoded := ConvertVideoToH265(context.Background(), srcFile, dstFile, nil)
 	if err != nil {
 		t.Errorf("Failed to convert %s", err)
 	}
@@ -92,7 +93,7 @@ func Test_VideoEncoding(t *testing.T) {
 	}
 
 	shouldNotEncodeTwice := dstFile + "ShouldNotEncodeAlreadyDone.mp4"
-	checkMsg, err, encoded := ConvertVideoToH265(dstFile, shouldNotEncodeTwice)
+	checkMsg, err, encoded := ConvertVideoToH265(context.Background(), dstFile, shouldNotEncodeTwice, nil)
 	if !strings.Contains(checkMsg, "ignored because it matched") || err != nil {
 		t.Errorf("This should be encoded as hevc and shouldn't work %s err: %s", checkMsg, err)
 	}
@@ -113,7 +114,7 @@ func Test_VideoEncodingNotMatching(t *testing.T) {
 	cfg.CodecsToConvert = "windows_trash|quicktime" // Shouldn't match
 	config.SetCfg(*cfg)
 
-	checkMsg, checkErr, encoded := ConvertVideoToH265(srcFile, dstFile)
+	checkMsg, checkErr, encoded := ConvertVideoToH265(context.Background(), srcFile, dstFile, nil)
 	if _, err := os.Stat(dstFile); !os.IsNotExist(err) {
 		t.Errorf("We should NOT have a file called %s", dstFile)
 	}
@@ -164,3 +165,15 @@ func Test_VideosAreDifferent(t *testing.T) {
 		t.Errorf("There should not be an error %s", dupeErr)
 	}
 }
+
+func Test_EstimateVideoBitrate(t *testing.T) {
+	stream := `{"streams": [{"codec_type": "audio", "bit_rate": "128000"}, {"codec_type": "video", "bit_rate": "800000"}], "format": {"bit_rate": "950000"}}`
+	assert.Equal(t, int64(800000), EstimateVideoBitrate(stream), "The video stream rate is used first")
+
+	format := `{"streams": [{"codec_type": "video"}], "format": {"bit_rate": "950000"}}`
+	assert.Equal(t, int64(950000), EstimateVideoBitrate(format), "mkv often only has the overall rate")
+
+	sized := `{"streams": [{"codec_type": "video"}], "format": {"duration": "10.0", "size": "1000000"}}`
+	assert.Equal(t, int64(800000), EstimateVideoBitrate(sized))
+	assert.Equal(t, int64(0), EstimateVideoBitrate(`{"streams": []}`))
+}
@@ -5,73 +5,458 @@ package worker
  */
 import (
 	"contented/pkg/models"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"runtime/debug"
+	"sync"
+	"time"
 )
 
-// Task represents a unit of work to be processed
+// Task represents a unit of work to be processed, a higher priority is handled first
 type Task struct {
 	ID        int64                    `json:"id"`
 	Operation models.TaskOperationType `json:"operation" db:"operation"`
+	Priority  int                      `json:"priority" db:"priority"`
 }
 
 func (t Task) String() string {
 	return fmt.Sprintf("Task %d: %s", t.ID, t.Operation)
 }
 
-// TaskHandler is a function type for processing tasks
-type TaskHandler func(Task) error
+// TaskHandler is a function type for processing tasks, the context is canceled if the
+// task is canceled while it is running.
+type TaskHandler func(context.Context, Task) error
 type MaxConcurrentTasks int
 
-// TaskQueue manages the distribution of tasks to different channels
+var ErrQueueFull = errors.New("the task queue is full")
+var ErrQueueStopped = errors.New("the task queue is stopped")
+
+// ErrShutdown is the cause of the context cancel when running tasks outlast the shutdown grace
+// period, handlers can check context.Cause to put the task back instead of failing it.
+var ErrShutdown = errors.New("the task queue is shutting down")
+
+// How long Shutdown waits on the handlers to return after canceling them
+var ShutdownCancelWait = 10 * time.Second
+
+// PanicHandler is called with the recovered value and stack trace when a TaskHandler panics
+type PanicHandler func(Task, any, []byte)
+
+// HeartbeatHandler is called on an interval for as long as a task is being handled
+type HeartbeatHandler func(Task)
+
+// OperationLimit caps a single operation within the queue, zero values mean only the queue wide
+// limits apply.
+type OperationLimit struct {
+	MaxConcurrent int `json:"max_concurrent"`
+	QueueSize     int `json:"queue_size"`
+}
+
+// OperationStats is the limit and current usage of a single operation in the queue
+type OperationStats struct {
+	OperationLimit
+	Running int `json:"running"`
+	Pending int `json:"pending"`
+}
+
+// QueueStats is a snapshot of the queue limits and how busy it is
+type QueueStats struct {
+	MaxConcurrent int                       `json:"max_concurrent"`
+	QueueSize     int                       `json:"queue_size"`
+	Running       int                       `json:"running"`
+	Pending       int                       `json:"pending"`
+	Operations    map[string]OperationStats `json:"operations"`
+}
+
+// TaskQueue manages the distribution of tasks to the registered handlers.  Waiting tasks are
+// started highest priority first, as long as the queue and the operation are under their
+// concurrency limits.
 type TaskQueue struct {
-	inputQueue         chan Task
-	typeHandlers       map[string]TaskHandler
+	typeHandlers map[string]TaskHandler
+
+	// Everything below is guarded by the mutex, cond is signaled whenever a slot or task frees up
+	mutex              sync.Mutex
+	cond               *sync.Cond
+	pending            []Task // In the order they were added
+	queueSize          int
 	maxConcurrentTasks MaxConcurrentTasks
-	runningTasks       chan struct{}
+	running            int
+	runningByOperation map[string]int
+	operationLimits    map[string]OperationLimit
+	stopped            bool
+
+	// Cancel functions for the tasks currently being handled, keyed by task ID
+	cancelMutex sync.Mutex
+	cancelFuncs map[int64]context.CancelCauseFunc
+
+	panicHandler      PanicHandler
+	heartbeatHandler  HeartbeatHandler
+	heartbeatInterval time.Duration
+	releaseHandler    func(Task)
 }
 
-// NewTaskQueue creates a new TaskQueue
+// NewTaskQueue creates a new TaskQueue, bufferSize is how many tasks can wait to be started
 func NewTaskQueue(bufferSize int, maxConcurrent MaxConcurrentTasks) *TaskQueue {
-	return &TaskQueue{
-		inputQueue:         make(chan Task, bufferSize),
+	tq := &TaskQueue{
 		typeHandlers:       make(map[string]TaskHandler),
+		pending:            []Task{},
+		queueSize:          bufferSize,
 		maxConcurrentTasks: maxConcurrent,
-		runningTasks:       make(chan struct{}, maxConcurrent),
+		runningByOperation: make(map[string]int),
+		operationLimits:    make(map[string]OperationLimit),
+		cancelFuncs:        make(map[int64]context.CancelCauseFunc),
 	}
+	tq.cond = sync.NewCond(&tq.mutex)
+	return tq
 }
 
-// Start begins processing tasks from the input queue
+// Start begins processing tasks, once stopped it finishes starting whatever is still waiting
 func (tq *TaskQueue) Start() {
 	go func() {
-		for task := range tq.inputQueue {
-			tq.runningTasks <- struct{}{} // Acquire a slot
+		for {
+			task, ok := tq.nextTask()
+			if !ok {
+				return
+			}
 			if handler, exists := tq.typeHandlers[task.Operation.String()]; exists {
-				go func(t Task, h TaskHandler) {
-					defer func() { <-tq.runningTasks }() // Release the slot when done
-					h(t)
-				}(task, handler)
+				ctx, cancel := context.WithCancelCause(context.Background())
+				tq.trackTask(task.ID, cancel)
+				go func(ctx context.Context, t Task, h TaskHandler) {
+					defer func() {
+						tq.untrackTask(t.ID)
+						cancel(nil)
+						tq.release(t) // Release the slot when done
+					}()
+					tq.runTask(ctx, t, h)
+				}(ctx, task, handler)
 			} else {
-				<-tq.runningTasks // Release the slot immediately if no handler
+				tq.release(task) // Release the slot immediately if no handler
 				log.Printf("Warning: No handler for task type %s", task.Operation)
 			}
 		}
 	}()
 }
 
+// nextTask blocks until a task can be started and takes a slot for it, false once the queue
+// is stopped and empty.
+func (tq *TaskQueue) nextTask() (Task, bool) {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	for {
+		if idx := tq.nextRunnable(); idx >= 0 {
+			task := tq.pending[idx]
+			tq.pending = append(tq.pending[:idx], tq.pending[idx+1:]...)
+			tq.running++
+			tq.runningByOperation[task.Operation.String()]++
+			tq.cond.Broadcast() // There is room to enqueue again
+			return task, true
+		}
+		if tq.stopped && len(tq.pending) == 0 {
+			return Task{}, false
+		}
+		tq.cond.Wait()
+	}
+}
+
+// nextRunnable is the index of the highest priority task under its limits, or -1.  Equal
+// priorities are first in first out.  The queues are small (hundreds) so a scan is simpler
+// than keeping a heap per operation.
+func (tq *TaskQueue) nextRunnable() int {
+	if tq.maxConcurrentTasks > 0 && tq.running >= int(tq.maxConcurrentTasks) {
+		return -1
+	}
+	best := -1
+	for idx, task := range tq.pending {
+		op := task.Operation.String()
+		if limit := tq.operationLimits[op].MaxConcurrent; limit > 0 && tq.runningByOperation[op] >= limit {
+			continue
+		}
+		if best < 0 || task.Priority > tq.pending[best].Priority {
+			best = idx
+		}
+	}
+	return best
+}
+
+func (tq *TaskQueue) release(task Task) {
+	tq.mutex.Lock()
+	tq.running--
+	tq.runningByOperation[task.Operation.String()]--
+	tq.cond.Broadcast()
+	tq.mutex.Unlock()
+
+	if tq.releaseHandler != nil {
+		tq.releaseHandler(task)
+	}
+}
+
+// runTask calls the handler, a panic is recovered so it cannot take down the queue (or the process)
+func (tq *TaskQueue) runTask(ctx context.Context, task Task, handler TaskHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			log.Printf("Task %s panicked %v\n%s", task, r, stack)
+			err = fmt.Errorf("task %s panicked: %v", task, r)
+			if tq.panicHandler != nil {
+				tq.panicHandler(task, r, stack)
+			}
+		}
+	}()
+	stopHeartbeat := tq.startHeartbeat(task)
+	defer stopHeartbeat()
+	return handler(ctx, task)
+}
+
+// startHeartbeat calls the heartbeat handler on the interval until the returned func is called
+func (tq *TaskQueue) startHeartbeat(task Task) func() {
+	if tq.heartbeatHandler == nil || tq.heartbeatInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(tq.heartbeatInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				tq.heartbeatHandler(task)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// SetReleaseHandler is called each time a task finishes and frees up a slot
+func (tq *TaskQueue) SetReleaseHandler(handler func(Task)) {
+	tq.releaseHandler = handler
+}
+
+// SetPanicHandler is called when a task handler panics, the task is still removed from the queue
+func (tq *TaskQueue) SetPanicHandler(handler PanicHandler) {
+	tq.panicHandler = handler
+}
+
+// SetHeartbeat calls the handler every interval for each running task
+func (tq *TaskQueue) SetHeartbeat(interval time.Duration, handler HeartbeatHandler) {
+	tq.heartbeatInterval = interval
+	tq.heartbeatHandler = handler
+}
+
 // RegisterTaskHandler adds a new task type and its corresponding handler function
 func (tq *TaskQueue) RegisterTaskHandler(taskOperation string, handler TaskHandler) {
 	tq.typeHandlers[taskOperation] = handler
 }
 
-// EnqueueTask adds a task to the input queue
-func (tq *TaskQueue) EnqueueTask(task Task) {
-	tq.inputQueue <- task
+// EnqueueTask adds a task to the queue, it never blocks.  A full queue (or operation) returns
+// ErrQueueFull, the caller should keep the task somewhere else (the DB) and try again later.
+func (tq *TaskQueue) EnqueueTask(task Task) error {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	if tq.stopped {
+		return ErrQueueStopped
+	}
+	if tq.isFull(task.Operation.String()) {
+		return ErrQueueFull
+	}
+	tq.pending = append(tq.pending, task)
+	tq.cond.Broadcast()
+	return nil
 }
 
-// Stop closes the input queue and stops processing new tasks
+func (tq *TaskQueue) isFull(operation string) bool {
+	if tq.queueSize > 0 && len(tq.pending) >= tq.queueSize {
+		return true
+	}
+	if limit := tq.operationLimits[operation].QueueSize; limit > 0 {
+		return tq.pendingForOperation(operation) >= limit
+	}
+	return false
+}
+
+func (tq *TaskQueue) pendingForOperation(operation string) int {
+	count := 0
+	for _, task := range tq.pending {
+		if task.Operation.String() == operation {
+			count++
+		}
+	}
+	return count
+}
+
+// Stop stops accepting new tasks, anything already waiting is still started
 func (tq *TaskQueue) Stop() {
-	close(tq.inputQueue)
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	tq.stopped = true
+	tq.cond.Broadcast()
+}
+
+// Shutdown stops accepting tasks and drops anything still waiting (returned so the caller can put
+// it back), then waits for the running tasks to finish.  Once the context is done the running
+// tasks are canceled with ErrShutdown as the cause and it waits up to ShutdownCancelWait for the
+// handlers to return.  Returns the dropped tasks and false if tasks were still running.
+func (tq *TaskQueue) Shutdown(ctx context.Context) ([]Task, bool) {
+	tq.mutex.Lock()
+	tq.stopped = true
+	dropped := tq.pending
+	tq.pending = []Task{}
+	tq.cond.Broadcast()
+	tq.mutex.Unlock()
+
+	if tq.waitIdle(ctx) {
+		return dropped, true
+	}
+	tq.cancelAll(ErrShutdown)
+	cancelCtx, cancel := context.WithTimeout(context.Background(), ShutdownCancelWait)
+	defer cancel()
+	return dropped, tq.waitIdle(cancelCtx)
+}
+
+// waitIdle blocks until nothing is running, false if the context was done first
+func (tq *TaskQueue) waitIdle(ctx context.Context) bool {
+	stopWake := context.AfterFunc(ctx, func() {
+		tq.mutex.Lock()
+		tq.cond.Broadcast()
+		tq.mutex.Unlock()
+	})
+	defer stopWake()
+
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	for tq.running > 0 {
+		if ctx.Err() != nil {
+			return false
+		}
+		tq.cond.Wait()
+	}
+	return true
+}
+
+// Available is roughly how many more tasks can be queued before they would have to wait on
+// a free slot, used by workers claiming tasks so they do not hoard work other workers could run.
+func (tq *TaskQueue) Available() int {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	return int(tq.maxConcurrentTasks) - tq.running - len(tq.pending)
+}
+
+// AvailableFor is Available but also counting the queue size limit of the operation
+func (tq *TaskQueue) AvailableFor(operation string) int {
+	available := tq.Available()
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	if tq.queueSize > 0 && tq.queueSize-len(tq.pending) < available {
+		available = tq.queueSize - len(tq.pending)
+	}
+	if limit := tq.operationLimits[operation].QueueSize; limit > 0 {
+		if opAvailable := limit - tq.pendingForOperation(operation); opAvailable < available {
+			available = opAvailable
+		}
+	}
+	return available
+}
+
+// IsStopped is true once Stop has been called, nothing more can be enqueued
+func (tq *TaskQueue) IsStopped() bool {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	return tq.stopped
+}
+
+// SetMaxConcurrent changes how many tasks run at once, a lower value lets running tasks finish
+func (tq *TaskQueue) SetMaxConcurrent(maxConcurrent MaxConcurrentTasks) {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	tq.maxConcurrentTasks = maxConcurrent
+	tq.cond.Broadcast()
+}
+
+// SetQueueSize changes how many tasks can be waiting, tasks already waiting are kept
+func (tq *TaskQueue) SetQueueSize(queueSize int) {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	tq.queueSize = queueSize
+	tq.cond.Broadcast()
+}
+
+// SetOperationLimit caps the concurrency and waiting tasks of one operation
+func (tq *TaskQueue) SetOperationLimit(operation string, limit OperationLimit) {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	tq.operationLimits[operation] = limit
+	tq.cond.Broadcast()
+}
+
+// Stats for every operation with a handler or limit
+func (tq *TaskQueue) Stats() QueueStats {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	stats := QueueStats{
+		MaxConcurrent: int(tq.maxConcurrentTasks),
+		QueueSize:     tq.queueSize,
+		Running:       tq.running,
+		Pending:       len(tq.pending),
+		Operations:    map[string]OperationStats{},
+	}
+	for op := range tq.typeHandlers {
+		stats.Operations[op] = OperationStats{}
+	}
+	for op := range tq.operationLimits {
+		stats.Operations[op] = OperationStats{}
+	}
+	for op := range stats.Operations {
+		stats.Operations[op] = OperationStats{
+			OperationLimit: tq.operationLimits[op],
+			Running:        tq.runningByOperation[op],
+			Pending:        tq.pendingForOperation(op),
+		}
+	}
+	return stats
+}
+
+// CancelTask cancels the context of a running task, returns false if the task is not running
+func (tq *TaskQueue) CancelTask(taskID int64) bool {
+	tq.cancelMutex.Lock()
+	defer tq.cancelMutex.Unlock()
+	if cancel, exists := tq.cancelFuncs[taskID]; exists {
+		log.Printf("Canceling running task %d", taskID)
+		cancel(nil)
+		return true
+	}
+	return false
+}
+
+// cancelAll cancels every running task with the cause
+func (tq *TaskQueue) cancelAll(cause error) {
+	tq.cancelMutex.Lock()
+	defer tq.cancelMutex.Unlock()
+	for taskID, cancel := range tq.cancelFuncs {
+		log.Printf("Canceling running task %d %s", taskID, cause)
+		cancel(cause)
+	}
+}
+
+// IsRunning checks if a task is currently being handled by this queue
+func (tq *TaskQueue) IsRunning(taskID int64) bool {
+	tq.cancelMutex.Lock()
+	defer tq.cancelMutex.Unlock()
+	_, exists := tq.cancelFuncs[taskID]
+	return exists
+}
+
+func (tq *TaskQueue) trackTask(taskID int64, cancel context.CancelCauseFunc) {
+	tq.cancelMutex.Lock()
+	defer tq.cancelMutex.Unlock()
+	tq.cancelFuncs[taskID] = cancel
+}
+
+func (tq *TaskQueue) untrackTask(taskID int64) {
+	tq.cancelMutex.Lock()
+	defer tq.cancelMutex.Unlock()
+	delete(tq.cancelFuncs, taskID)
 }
 
 // GetTaskHandler returns the handler function for a specific task type
@@ -2,7 +2,10 @@ package worker
 
 import (
 	"contented/pkg/models"
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 // TestNewTaskQueueWithMaxConcurrent tests the creation of a new TaskQueue with max concurrent tasks
@@ -18,8 +21,8 @@ func TestNewTaskQueueWithMaxConcurrent(t *testing.T) {
 		return
 	}
 
-	if cap(tq.inputQueue) != bufferSize {
-		t.Errorf("Expected input queue capacity of %d, got %d", bufferSize, cap(tq.inputQueue))
+	if tq.queueSize != bufferSize {
+		t.Errorf("Expected queue size of %d, got %d", bufferSize, tq.queueSize)
 	}
 
 	if len(tq.typeHandlers) != 0 {
@@ -30,15 +33,15 @@ func TestNewTaskQueueWithMaxConcurrent(t *testing.T) {
 		t.Errorf("Expected maxConcurrentTasks to be %d, got %d", maxConcurrent, tq.maxConcurrentTasks)
 	}
 
-	if cap(tq.runningTasks) != int(maxConcurrent) {
-		t.Errorf("Expected runningTasks capacity to be %d, got %d", maxConcurrent, cap(tq.runningTasks))
+	if tq.running != 0 || len(tq.pending) != 0 {
+		t.Errorf("Expected nothing running or pending, got %d running %d pending", tq.running, len(tq.pending))
 	}
 }
 
 // TestRegisterTaskHandler tests registering a task handler
 func TestRegisterTaskHandler(t *testing.T) {
 	tq := NewTaskQueue(1, 5)
-	handler := func(Task) error { return nil }
+	handler := func(context.Context, Task) error { return nil }
 	tq.RegisterTaskHandler("test", handler)
 	if len(tq.typeHandlers) != 1 {
 		t.Errorf("Expected 1 handler, got %d", len(tq.typeHandlers))
@@ -53,12 +56,292 @@ func TestEnqueueTask(t *testing.T) {
 	tq := NewTaskQueue(1, 5)
 	task := Task{ID: int64(123), Operation: models.TaskOperation.ENCODING}
 	tq.EnqueueTask(task)
+	if len(tq.pending) != 1 {
+		t.Fatal("Task was not enqueued")
+	}
+	if receivedTask := tq.pending[0]; receivedTask != task {
+		t.Errorf("Expected task %v, got %v", task, receivedTask)
+	}
+}
+
+// TestCancelTask tests that a running task has its context canceled
+func TestCancelTask(t *testing.T) {
+	tq := NewTaskQueue(1, 1)
+	started := make(chan struct{})
+	finished := make(chan error)
+	tq.RegisterTaskHandler(models.TaskOperation.ENCODING.String(), func(ctx context.Context, task Task) error {
+		close(started)
+		<-ctx.Done()
+		finished <- ctx.Err()
+		return ctx.Err()
+	})
+	tq.Start()
+	defer tq.Stop()
+
+	if tq.CancelTask(42) {
+		t.Error("A task that is not running should not be canceled")
+	}
+	tq.EnqueueTask(Task{ID: int64(42), Operation: models.TaskOperation.ENCODING})
+	<-started
+	if !tq.IsRunning(42) {
+		t.Error("The task should be tracked as running")
+	}
+	if !tq.CancelTask(42) {
+		t.Error("The running task should have been canceled")
+	}
 	select {
-	case receivedTask := <-tq.inputQueue:
-		if receivedTask != task {
-			t.Errorf("Expected task %v, got %v", task, receivedTask)
+	case err := <-finished:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected a canceled context, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("The handler never saw the cancel")
+	}
+}
+
+// TestAvailable checks the queue reports how much room it has for claimed tasks
+func TestAvailable(t *testing.T) {
+	tq := NewTaskQueue(5, 2)
+	if tq.Available() != 2 {
+		t.Errorf("Expected 2 available slots, got %d", tq.Available())
+	}
+	tq.EnqueueTask(Task{ID: int64(1), Operation: models.TaskOperation.ENCODING})
+	if tq.Available() != 1 {
+		t.Errorf("A waiting task should take a slot, got %d", tq.Available())
+	}
+	tq.EnqueueTask(Task{ID: int64(2), Operation: models.TaskOperation.ENCODING})
+	if tq.Available() > 0 {
+		t.Errorf("The queue should be full, got %d", tq.Available())
+	}
+}
+
+// TestPanicRecovery checks a panicking handler is reported and does not stop the queue
+func TestPanicRecovery(t *testing.T) {
+	tq := NewTaskQueue(5, 1)
+	panicked := make(chan []byte, 1)
+	tq.SetPanicHandler(func(task Task, r any, stack []byte) {
+		panicked <- stack
+	})
+	ran := make(chan int64, 1)
+	tq.RegisterTaskHandler(models.TaskOperation.ENCODING.String(), func(ctx context.Context, task Task) error {
+		if task.ID == 1 {
+			panic("handler blew up")
 		}
-	default:
-		t.Error("Task was not enqueued")
+		ran <- task.ID
+		return nil
+	})
+	tq.Start()
+	defer tq.Stop()
+
+	tq.EnqueueTask(Task{ID: int64(1), Operation: models.TaskOperation.ENCODING})
+	select {
+	case stack := <-panicked:
+		if len(stack) == 0 {
+			t.Error("Expected a stack trace for the panic")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The panic handler was never called")
+	}
+
+	tq.EnqueueTask(Task{ID: int64(2), Operation: models.TaskOperation.ENCODING})
+	select {
+	case id := <-ran:
+		if id != 2 {
+			t.Errorf("Expected task 2 to run, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("The queue should keep running tasks after a panic")
+	}
+	if tq.IsRunning(1) {
+		t.Error("The panicked task should no longer be tracked")
+	}
+}
+
+// TestHeartbeat checks running tasks heartbeat until the handler returns
+func TestHeartbeat(t *testing.T) {
+	tq := NewTaskQueue(5, 1)
+	beats := make(chan int64, 10)
+	tq.SetHeartbeat(5*time.Millisecond, func(task Task) {
+		beats <- task.ID
+	})
+	release := make(chan struct{})
+	tq.RegisterTaskHandler(models.TaskOperation.ENCODING.String(), func(ctx context.Context, task Task) error {
+		<-release
+		return nil
+	})
+	tq.Start()
+	defer tq.Stop()
+
+	tq.EnqueueTask(Task{ID: int64(7), Operation: models.TaskOperation.ENCODING})
+	select {
+	case id := <-beats:
+		if id != 7 {
+			t.Errorf("Expected a heartbeat for task 7, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("The running task never heartbeat")
+	}
+	close(release)
+}
+
+// TestPriority checks higher priority tasks are started first and equal priorities stay in order
+func TestPriority(t *testing.T) {
+	tq := NewTaskQueue(10, 1)
+	order := make(chan int64, 4)
+	tq.RegisterTaskHandler(models.TaskOperation.TAGGING.String(), func(ctx context.Context, task Task) error {
+		order <- task.ID
+		return nil
+	})
+	// Queue everything before starting so the priority decides the order
+	tq.EnqueueTask(Task{ID: 1, Operation: models.TaskOperation.TAGGING, Priority: -10})
+	tq.EnqueueTask(Task{ID: 2, Operation: models.TaskOperation.TAGGING, Priority: -10})
+	tq.EnqueueTask(Task{ID: 3, Operation: models.TaskOperation.TAGGING, Priority: 10})
+	tq.EnqueueTask(Task{ID: 4, Operation: models.TaskOperation.TAGGING})
+	tq.Start()
+	defer tq.Stop()
+
+	expected := []int64{3, 4, 1, 2}
+	for _, id := range expected {
+		select {
+		case ran := <-order:
+			if ran != id {
+				t.Errorf("Expected task %d to run next, got %d", id, ran)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Task %d never ran", id)
+		}
+	}
+}
+
+// TestOperationLimit checks an operation at its limit does not block other operations
+func TestOperationLimit(t *testing.T) {
+	tq := NewTaskQueue(10, 5)
+	tq.SetOperationLimit(models.TaskOperation.TAGGING.String(), OperationLimit{MaxConcurrent: 1})
+	release := make(chan struct{})
+	started := make(chan int64, 5)
+	handler := func(ctx context.Context, task Task) error {
+		started <- task.ID
+		<-release
+		return nil
+	}
+	tq.RegisterTaskHandler(models.TaskOperation.TAGGING.String(), handler)
+	tq.RegisterTaskHandler(models.TaskOperation.SCREENS.String(), handler)
+	tq.Start()
+	defer tq.Stop()
+
+	tq.EnqueueTask(Task{ID: 1, Operation: models.TaskOperation.TAGGING})
+	tq.EnqueueTask(Task{ID: 2, Operation: models.TaskOperation.TAGGING})
+	tq.EnqueueTask(Task{ID: 3, Operation: models.TaskOperation.SCREENS})
+
+	running := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-started:
+			running[id] = true
+		case <-time.After(time.Second):
+			t.Fatal("Expected two tasks to start")
+		}
+	}
+	if !running[1] || !running[3] {
+		t.Errorf("Expected tasks 1 and 3 to be running, got %v", running)
+	}
+	stats := tq.Stats()
+	tagging := stats.Operations[models.TaskOperation.TAGGING.String()]
+	if tagging.Running != 1 || tagging.Pending != 1 {
+		t.Errorf("Expected one tagging task running and one pending, got %+v", tagging)
+	}
+
+	tq.SetOperationLimit(models.TaskOperation.TAGGING.String(), OperationLimit{MaxConcurrent: 2})
+	select {
+	case id := <-started:
+		if id != 2 {
+			t.Errorf("Expected task 2 to start once the limit was raised, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Raising the limit should start the waiting task")
+	}
+	close(release)
+}
+
+// TestEnqueueFull checks a full queue returns an error rather than blocking the caller
+func TestEnqueueFull(t *testing.T) {
+	tq := NewTaskQueue(2, 1)
+	tq.SetOperationLimit(models.TaskOperation.TAGGING.String(), OperationLimit{QueueSize: 1})
+	if err := tq.EnqueueTask(Task{ID: int64(1), Operation: models.TaskOperation.TAGGING}); err != nil {
+		t.Errorf("Expected the first task to be queued, got %v", err)
+	}
+	if tq.AvailableFor(models.TaskOperation.TAGGING.String()) > 0 {
+		t.Error("Tagging should be at its queue size")
+	}
+	if err := tq.EnqueueTask(Task{ID: int64(2), Operation: models.TaskOperation.TAGGING}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected the operation to be full, got %v", err)
+	}
+	if err := tq.EnqueueTask(Task{ID: int64(3), Operation: models.TaskOperation.SCREENS}); err != nil {
+		t.Errorf("Other operations can still be queued, got %v", err)
+	}
+	if err := tq.EnqueueTask(Task{ID: int64(4), Operation: models.TaskOperation.SCREENS}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+	tq.Stop()
+	if err := tq.EnqueueTask(Task{ID: int64(5), Operation: models.TaskOperation.SCREENS}); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Expected the queue to be stopped, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tq := NewTaskQueue(5, 1)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	tq.RegisterTaskHandler(models.TaskOperation.TAGGING.String(), func(ctx context.Context, task Task) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	tq.Start()
+	tq.EnqueueTask(Task{ID: int64(1), Operation: models.TaskOperation.TAGGING})
+	tq.EnqueueTask(Task{ID: int64(2), Operation: models.TaskOperation.TAGGING})
+	<-started
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	dropped, finished := tq.Shutdown(context.Background())
+	if !finished {
+		t.Error("The running task should have finished inside the grace period")
+	}
+	if len(dropped) != 1 || dropped[0].ID != 2 {
+		t.Errorf("The waiting task should be handed back, got %v", dropped)
+	}
+	if err := tq.EnqueueTask(Task{ID: int64(3), Operation: models.TaskOperation.TAGGING}); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Nothing can be queued after a shutdown, got %v", err)
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	tq := NewTaskQueue(5, 1)
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	tq.RegisterTaskHandler(models.TaskOperation.ENCODING.String(), func(ctx context.Context, task Task) error {
+		close(started)
+		<-ctx.Done()
+		cause <- context.Cause(ctx)
+		return ctx.Err()
+	})
+	tq.Start()
+	tq.EnqueueTask(Task{ID: int64(1), Operation: models.TaskOperation.ENCODING})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, finished := tq.Shutdown(ctx)
+	if !finished {
+		t.Error("The canceled task should still return")
+	}
+	if err := <-cause; !errors.Is(err, ErrShutdown) {
+		t.Errorf("The task should be canceled by the shutdown, got %v", err)
+	}
+	if tq.IsRunning(1) {
+		t.Error("Nothing should be running after the shutdown")
 	}
 }
@@ -6,12 +6,14 @@ export let ApiDef = {
   contented: {
     splash: base + 'splash/',
     view: base + 'view/',
+    transcode: base + 'transcode/',
     download: base + 'download/{mcID}',
     preview: base + 'preview/',
     containers: base + 'containers',
     containerContent: base + 'containers/{cId}/contents',
     content: '/api/contents/{id}',
     contentScreens: base + 'contents/{mcID}/screens',
+    contentSubtitles: base + 'contents/{mcID}/subtitles/{lang}',
     screens: base + 'screens/',
     contentAll: base + 'content/',
     searchContents: '/api/search/contents',
@@ -174,6 +174,15 @@ export class VideoCodecInfo implements VideoCodecInfoInterface {
   }
 }
 
+// Sidecar .srt/.vtt files and subtitle streams extracted from the video, always served as WebVTT
+export const SubtitleTrackSchema = z.object({
+  lang: z.string(),
+  src: z.string(),
+  format: z.string(),
+  extracted: z.boolean().default(false).optional(),
+});
+export type SubtitleTrack = z.infer<typeof SubtitleTrackSchema>;
+
 export const ContentSchema = z.object({
   id: z.number(),
   src: z.string(),
@@ -195,6 +204,11 @@ export const ContentSchema = z.object({
   created_at: z.coerce.date().optional(),
   updated_at: z.coerce.date().optional(),
   duplicate: z.boolean().default(false),
+  quality_metric: z.string().optional(),
+  quality_score: z.number().optional(),
+  quality_rejected: z.boolean().default(false).optional(),
+  browser_playable: z.boolean().default(true).optional(), // False should stream from the transcode url
+  subtitles: SubtitleTrackSchema.array().nullable().default([]).optional(),
 });
 
 export type ContentInterface = z.infer<typeof ContentSchema>;
@@ -216,6 +230,11 @@ export class Content implements ContentInterface {
   created_at: Date = new Date();
   updated_at: Date = new Date();
   duplicate: boolean = false;
+  quality_metric: string = '';
+  quality_score: number = 0;
+  quality_rejected: boolean = false;
+  browser_playable: boolean = true;
+  subtitles: SubtitleTrack[] = [];
   videoInfoParsed: VideoCodecInfo | undefined = undefined;
 
   constructor(data: any = {}) {
@@ -228,6 +247,7 @@ export class Content implements ContentInterface {
 
     this.screens = (this.screens || []).map(screen => new Screen(screen));
     this.tags = (this.tags || []).map(tag => new Tag(tag));
+    this.subtitles = this.subtitles || [];
 
     if (this.isVideo() && this.meta) {
       this.videoInfoParsed = this.getVideoInfo();
@@ -255,6 +275,22 @@ export class Content implements ContentInterface {
     return `${ApiDef.contented.view}${this.id}`;
   }
 
+  // Videos the browser cannot play are piped through ffmpeg as fragmented mp4
+  get videoUrl() {
+    if (this.isVideo() && !this.browser_playable) {
+      return `${ApiDef.contented.transcode}${this.id}`;
+    }
+    return this.fullUrl;
+  }
+
+  subtitleUrl(track: SubtitleTrack) {
+    return ApiDef.contented.contentSubtitles.replace('{mcID}', `${this.id}`).replace('{lang}', track.lang);
+  }
+
+  get videoType() {
+    return this.isVideo() && !this.browser_playable ? 'video/mp4' : this.content_type;
+  }
+
   get videoInfo(): VideoCodecInfo | undefined {
     return this.getVideoInfo();
   }
@@ -53,6 +53,8 @@ export const TaskTypes = {
   WEBP: 'webp_from_screens',
   TAGGING: 'tag_content',
   DUPES: 'detect_duplicates',
+  HLS: 'hls_package',
+  SUBTITLES: 'subtitle_extraction',
 } as const;
 
 // Odd but works because of a strange constant hackery found in the zod forums.
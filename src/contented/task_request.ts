@@ -6,6 +6,7 @@ import { z } from 'zod';
 
 export const TASK_STATES = {
   NEW: 'new',
+  WAITING: 'waiting',
   PENDING: 'pending',
   IN_PROGRESS: 'in_progress',
   CANCELED: 'canceled',
@@ -19,6 +20,8 @@ export enum TaskOperation {
   WEBP = 'webp_from_screens',
   TAGGING = 'tag_content',
   DUPES = 'detect_duplicates',
+  HLS = 'hls_package',
+  SUBTITLES = 'subtitle_extraction',
 }
 
 export const TaskOperationEnum = z.enum([TaskOperation.ENCODING, ...Object.values(TaskOperation)]);
@@ -39,10 +42,21 @@ export const TaskRequestSchema = z.object({
   number_of_screens: z.number().optional(),
   start_time_seconds: z.number().optional(),
   codec: z.string().optional(),
+  profile: z.string().nullish(),
   width: z.number().optional(),
   height: z.number().optional(),
   message: z.string().optional(),
   err_msg: z.string().optional(),
+  progress: z.number().optional(),
+  frames_processed: z.number().optional(),
+  speed: z.number().optional(),
+  eta_seconds: z.number().optional(),
+  pipeline_id: z.number().nullish(),
+  schedule: z.string().nullish(),
+  idempotency_key: z.string().nullish(),
+  log_file: z.string().nullish(),
+  parent_id: z.number().nullish(),
+  result: z.any().nullish(),
 });
 
 export type ITaskRequest = z.infer<typeof TaskRequestSchema>;
@@ -57,10 +71,23 @@ export class TaskRequest implements ITaskRequest {
   number_of_screens: number = 0;
   start_time_seconds: number = 0;
   codec: string = '';
+  profile?: string | null;
   width?: number;
   height?: number;
   message: string = '';
   err_msg: string = '';
+  progress: number = 0;
+  frames_processed: number = 0;
+  speed: number = 0;
+  eta_seconds: number = -1;
+  pipeline_id?: number | null;
+  schedule?: string | null;
+  idempotency_key?: string | null;
+  log_file?: string | null;
+  parent_id?: number | null;
+
+  // Structured output of the task, the shape depends on the operation
+  result?: any;
 
   uxLoading = false;
 
@@ -75,8 +102,8 @@ export class TaskRequest implements ITaskRequest {
     const tr = TaskRequestSchema.parse(obj);
     Object.assign(this, tr);
 
-    if (obj.operation === TaskOperation.DUPES && obj.message) {
-      this.complexMessage = JSON.parse(obj.message);
+    if (obj.operation === TaskOperation.DUPES && obj.result) {
+      this.complexMessage = obj.result.duplicates || [];
     }
   }
 
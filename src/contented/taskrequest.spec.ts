@@ -75,16 +75,18 @@ describe('TaskRequestCmp', () => {
 
     const tasks = MockData.taskRequests();
     const task = { ...tasks.results[0] };
-    task.message = JSON.stringify([
-      {
-        keep_id: 'db1c539f-e5e2-4e51-a675-85a2ab63cedf',
-        container_id: 'dce293d6-7abf-4d4c-9802-3e809e5877a6',
-        container_name: 'test_encoding',
-        duplicate_id: 'f0cfb1c3-6e7e-4dbf-acfc-7ab2bc9a3e80',
-        keep_src: 'SampleVideo_1280x720_1mb_h265.mp4',
-        duplicate_src: 'SampleVideo_1280x720_1mb.mp4',
-      },
-    ]);
+    task.result = {
+      duplicates: [
+        {
+          keep_id: 'db1c539f-e5e2-4e51-a675-85a2ab63cedf',
+          container_id: 'dce293d6-7abf-4d4c-9802-3e809e5877a6',
+          container_name: 'test_encoding',
+          duplicate_id: 'f0cfb1c3-6e7e-4dbf-acfc-7ab2bc9a3e80',
+          keep_src: 'SampleVideo_1280x720_1mb_h265.mp4',
+          duplicate_src: 'SampleVideo_1280x720_1mb.mp4',
+        },
+      ],
+    };
     task.operation = 'detect_duplicates';
 
     const taskCheck = new TaskRequest(task);